@@ -0,0 +1,591 @@
+package godb
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Users, roles and privileges. Sessions run as the superuser until
+// Catalog.SetUser names a user; the superuser may do anything and is the
+// only one who may run CREATE USER, CREATE ROLE, GRANT, REVOKE and other
+// DDL. A user may read a column with SELECT, add rows to a table with INSERT
+// and remove rows with DELETE only if the privilege was granted to the user
+// or to one of the user's roles:
+//
+//	CREATE USER alice
+//	CREATE ROLE clinician
+//	GRANT clinician TO alice
+//	GRANT SELECT (id, age), INSERT ON patients TO clinician
+//	REVOKE INSERT ON patients FROM clinician
+//
+// SELECT without a column list (and ALL) covers every column of the table.
+// A query needs SELECT on every column it reads anywhere, including WHERE
+// clauses of DELETE; a table it reads no column of (e.g. count(*)) needs
+// SELECT on at least one column. Users, memberships and grants are kept in
+// the system tables _users, _role_members and _grants, heap files next to
+// the catalog.
+
+type Privilege string
+
+const (
+	SelectPrivilege Privilege = "select"
+	InsertPrivilege Privilege = "insert"
+	DeletePrivilege Privilege = "delete"
+)
+
+// The column of grants of table-wide privileges.
+const allColumns = "*"
+
+var (
+	usersDesc       = TupleDesc{Fields: []FieldType{{Fname: "name", Ftype: StringType}, {Fname: "kind", Ftype: StringType}}}
+	roleMembersDesc = TupleDesc{Fields: []FieldType{{Fname: "member", Ftype: StringType}, {Fname: "role", Ftype: StringType}}}
+	grantsDesc      = TupleDesc{Fields: []FieldType{{Fname: "grantee", Ftype: StringType}, {Fname: "privilege", Ftype: StringType}, {Fname: "tbl", Ftype: StringType}, {Fname: "col", Ftype: StringType}}}
+	attributesDesc  = TupleDesc{Fields: []FieldType{{Fname: "user", Ftype: StringType}, {Fname: "name", Ftype: StringType}, {Fname: "value", Ftype: StringType}}}
+)
+
+type grantKey struct {
+	grantee   string
+	privilege Privilege
+	table     string
+	column    string
+}
+
+type accessControl struct {
+	mutex   sync.Mutex
+	bp      *BufferPool
+	users   map[string]string          // name -> "user" or "role"
+	members map[string]map[string]bool // user -> roles
+	grants  map[grantKey]bool
+
+	attributes map[string]map[string]string // user -> name -> value; see row_security.go
+	policies   rowPolicies
+
+	usersFile, membersFile, grantsFile, attributesFile *HeapFile
+}
+
+func openSystemTable(c *Catalog, name string, desc *TupleDesc, row func(t *Tuple)) (*HeapFile, error) {
+	hf, err := NewHeapFile(c.rootPath+"/"+name+".dat", desc, c.bp)
+	if err != nil {
+		return nil, err
+	}
+	tid := NewTID()
+	c.bp.BeginTransaction(tid)
+	defer c.bp.CommitTransaction(tid)
+	iter, err := hf.Iterator(tid)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t, err := iter()
+		if err != nil {
+			return nil, err
+		}
+		if t == nil {
+			return hf, nil
+		}
+		row(t)
+	}
+}
+
+// The catalog's users and grants, loaded from the system tables on first
+// use.
+func (c *Catalog) access() (*accessControl, error) {
+	if c.acl != nil {
+		return c.acl, nil
+	}
+	a := &accessControl{bp: c.bp, users: make(map[string]string), members: make(map[string]map[string]bool), grants: make(map[grantKey]bool), attributes: make(map[string]map[string]string)}
+	var err error
+	a.usersFile, err = openSystemTable(c, "_users", &usersDesc, func(t *Tuple) {
+		a.users[t.Fields[0].(StringField).Value] = t.Fields[1].(StringField).Value
+	})
+	if err != nil {
+		return nil, err
+	}
+	a.membersFile, err = openSystemTable(c, "_role_members", &roleMembersDesc, func(t *Tuple) {
+		a.addMember(t.Fields[0].(StringField).Value, t.Fields[1].(StringField).Value)
+	})
+	if err != nil {
+		return nil, err
+	}
+	a.grantsFile, err = openSystemTable(c, "_grants", &grantsDesc, func(t *Tuple) {
+		a.grants[grantKey{t.Fields[0].(StringField).Value, Privilege(t.Fields[1].(StringField).Value), t.Fields[2].(StringField).Value, t.Fields[3].(StringField).Value}] = true
+	})
+	if err != nil {
+		return nil, err
+	}
+	a.attributesFile, err = openSystemTable(c, "_user_attributes", &attributesDesc, func(t *Tuple) {
+		a.addAttribute(t.Fields[0].(StringField).Value, t.Fields[1].(StringField).Value, t.Fields[2].(StringField).Value)
+	})
+	if err != nil {
+		return nil, err
+	}
+	a.policies, err = openRowPolicies(c.rootPath + "/" + rowPoliciesFile)
+	if err != nil {
+		return nil, err
+	}
+	c.acl = a
+	return a, nil
+}
+
+func (a *accessControl) addMember(user string, role string) {
+	if a.members[user] == nil {
+		a.members[user] = make(map[string]bool)
+	}
+	a.members[user][role] = true
+}
+
+// Appends fields to a system table in a transaction of its own.
+func (a *accessControl) insertRow(hf *HeapFile, fields ...string) error {
+	values := make([]DBValue, len(fields))
+	for i, f := range fields {
+		if len(f) > StringLength {
+			return GoDBError{IllegalOperationError, fmt.Sprintf("%s is longer than %d bytes", f, StringLength)}
+		}
+		values[i] = StringField{f}
+	}
+	tid := NewTID()
+	a.bp.BeginTransaction(tid)
+	err := hf.insertTuple(&Tuple{*hf.Descriptor(), values, nil}, tid)
+	if err != nil {
+		a.bp.AbortTransaction(tid)
+		return err
+	}
+	a.bp.CommitTransaction(tid)
+	return nil
+}
+
+// Deletes the rows of a system table equal to fields.
+func (a *accessControl) deleteRows(hf *HeapFile, fields ...string) error {
+	tid := NewTID()
+	a.bp.BeginTransaction(tid)
+	iter, err := hf.Iterator(tid)
+	if err != nil {
+		a.bp.AbortTransaction(tid)
+		return err
+	}
+	var matches []*Tuple
+	for {
+		t, err := iter()
+		if err != nil {
+			a.bp.AbortTransaction(tid)
+			return err
+		}
+		if t == nil {
+			break
+		}
+		match := true
+		for i, f := range fields {
+			match = match && t.Fields[i].(StringField).Value == f
+		}
+		if match {
+			matches = append(matches, t)
+		}
+	}
+	for _, t := range matches {
+		err = hf.deleteTuple(t, tid)
+		if err != nil {
+			a.bp.AbortTransaction(tid)
+			return err
+		}
+	}
+	a.bp.CommitTransaction(tid)
+	return nil
+}
+
+func (a *accessControl) create(name string, kind string) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if _, exists := a.users[name]; exists {
+		return GoDBError{IllegalOperationError, fmt.Sprintf("user or role '%s' already exists", name)}
+	}
+	err := a.insertRow(a.usersFile, name, kind)
+	if err != nil {
+		return err
+	}
+	a.users[name] = kind
+	return nil
+}
+
+func (a *accessControl) grantRole(role string, user string, grant bool) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.users[role] != "role" {
+		return GoDBError{IllegalOperationError, fmt.Sprintf("no role '%s'", role)}
+	}
+	if a.users[user] != "user" {
+		return GoDBError{IllegalOperationError, fmt.Sprintf("no user '%s'", user)}
+	}
+	if !grant {
+		err := a.deleteRows(a.membersFile, user, role)
+		if err != nil {
+			return err
+		}
+		delete(a.members[user], role)
+		return nil
+	}
+	if a.members[user][role] {
+		return nil
+	}
+	err := a.insertRow(a.membersFile, user, role)
+	if err != nil {
+		return err
+	}
+	a.addMember(user, role)
+	return nil
+}
+
+func (a *accessControl) grant(key grantKey, grant bool) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if _, exists := a.users[key.grantee]; !exists {
+		return GoDBError{IllegalOperationError, fmt.Sprintf("no user or role '%s'", key.grantee)}
+	}
+	if !grant {
+		err := a.deleteRows(a.grantsFile, key.grantee, string(key.privilege), key.table, key.column)
+		if err != nil {
+			return err
+		}
+		delete(a.grants, key)
+		return nil
+	}
+	if a.grants[key] {
+		return nil
+	}
+	err := a.insertRow(a.grantsFile, key.grantee, string(key.privilege), key.table, key.column)
+	if err != nil {
+		return err
+	}
+	a.grants[key] = true
+	return nil
+}
+
+// whether user or one of its roles holds privilege on column of table
+// (allColumns: on the whole table)
+func (a *accessControl) allowed(user string, privilege Privilege, table string, column string) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	grantees := []string{user}
+	for role := range a.members[user] {
+		grantees = append(grantees, role)
+	}
+	for _, g := range grantees {
+		if a.grants[grantKey{g, privilege, table, allColumns}] || a.grants[grantKey{g, privilege, table, column}] {
+			return true
+		}
+	}
+	return false
+}
+
+// whether user or one of its roles holds privilege on some column of table
+func (a *accessControl) allowedAnyColumn(user string, privilege Privilege, table string) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	for key := range a.grants {
+		if key.privilege == privilege && key.table == table && (key.grantee == user || a.members[user][key.grantee]) {
+			return true
+		}
+	}
+	return false
+}
+
+// the roles user is a member of, sorted by name
+func (a *accessControl) roles(user string) []string {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	var roles []string
+	for role := range a.members[user] {
+		roles = append(roles, role)
+	}
+	sort.Strings(roles)
+	return roles
+}
+
+// Runs the session as user, who must exist. Only the superuser may switch
+// users, so a session that has become a user stays that user.
+func (c *Catalog) SetUser(user string) error {
+	err := c.checkSuperuser("switch users")
+	if err != nil {
+		return err
+	}
+	if user != "" {
+		a, err := c.access()
+		if err != nil {
+			return err
+		}
+		a.mutex.Lock()
+		kind := a.users[user]
+		a.mutex.Unlock()
+		if kind != "user" {
+			return GoDBError{IllegalOperationError, fmt.Sprintf("no user '%s'", user)}
+		}
+	}
+	c.user = user
+	c.role = ""
+	return nil
+}
+
+func (c *Catalog) User() string {
+	return c.user
+}
+
+// The roles whose masks, token vault rights and privacy policies apply to
+// the session. The superuser acts as the role chosen with SetRole ("" if
+// none); a user acts as the chosen role while it holds it, and otherwise as
+// every role it holds.
+func (c *Catalog) sessionRoles() []string {
+	if c.user == "" {
+		return []string{c.role}
+	}
+	a, err := c.access()
+	if err != nil {
+		return nil
+	}
+	roles := a.roles(c.user)
+	for _, role := range roles {
+		if role == c.role {
+			return []string{role}
+		}
+	}
+	return roles
+}
+
+// The role current_role() stands for: the session's only role (see
+// sessionRoles), or "" when a user holds several and has chosen none.
+func (c *Catalog) currentRole() string {
+	roles := c.sessionRoles()
+	if len(roles) != 1 {
+		return ""
+	}
+	return roles[0]
+}
+
+func (c *Catalog) checkSuperuser(what string) error {
+	if c.user != "" {
+		return GoDBError{PermissionError, fmt.Sprintf("permission denied: only the superuser may %s", what)}
+	}
+	return nil
+}
+
+// Checks that the session user may exercise privilege on all of table.
+func (c *Catalog) checkTablePrivilege(privilege Privilege, table string) error {
+	if c.user == "" {
+		return nil
+	}
+	a, err := c.access()
+	if err != nil {
+		return err
+	}
+	if !a.allowed(c.user, privilege, table, allColumns) {
+		return GoDBError{PermissionError, fmt.Sprintf("permission denied: %s on table %s", privilege, table)}
+	}
+	return nil
+}
+
+// Checks that the session user may read columns (table -> column -> true)
+// and, for tables with no columns listed, at least one column.
+func (c *Catalog) checkSelectPrivileges(columns map[string]map[string]bool) error {
+	if c.user == "" {
+		return nil
+	}
+	a, err := c.access()
+	if err != nil {
+		return err
+	}
+	for table, cols := range columns {
+		if len(cols) == 0 && !a.allowedAnyColumn(c.user, SelectPrivilege, table) {
+			return GoDBError{PermissionError, fmt.Sprintf("permission denied: select on table %s", table)}
+		}
+		for col := range cols {
+			if !a.allowed(c.user, SelectPrivilege, table, col) {
+				return GoDBError{PermissionError, fmt.Sprintf("permission denied: select on column %s of table %s", col, table)}
+			}
+		}
+	}
+	return nil
+}
+
+// Adds the table columns lsn reads to columns. Columns of subqueries are
+// checked when the subquery is planned.
+func (lsn *LogicalSelectNode) readColumns(c *Catalog, plan *LogicalPlan, columns map[string]map[string]bool) error {
+	switch lsn.exprType {
+	case ExprFunc, ExprAggr:
+		for _, arg := range lsn.args {
+			err := arg.readColumns(c, plan, columns)
+			if err != nil {
+				return err
+			}
+		}
+	case ExprField:
+		if lsn.field == "*" {
+			return nil // count(*) reads no column
+		}
+		table, err := checkNameInTablesOrSubqueries(lsn.table, lsn.field, c, plan.subqueries, plan.tables)
+		if err != nil {
+			return err
+		}
+		if t := planTable(plan, table); t != nil {
+			columns[t.tableName][lsn.field] = true
+		}
+	case ExprStar:
+		for _, t := range plan.tables {
+			if lsn.table != "" && lsn.table != t.tableName && lsn.table != t.alias {
+				continue
+			}
+			for _, f := range (*t.file).Descriptor().Fields {
+				columns[t.tableName][f.Fname] = true
+			}
+		}
+	}
+	return nil
+}
+
+// the table of plan called (or aliased) name, if any
+func planTable(plan *LogicalPlan, name string) *LogicalTableNode {
+	if name == "" {
+		return nil
+	}
+	for _, t := range plan.tables {
+		if t.alias == name || t.tableName == name {
+			return t
+		}
+	}
+	return nil
+}
+
+// The columns of each table of plan that it reads.
+func (plan *LogicalPlan) readColumns(c *Catalog) (map[string]map[string]bool, error) {
+	columns := make(map[string]map[string]bool)
+	for _, t := range plan.tables {
+		if columns[t.tableName] == nil {
+			columns[t.tableName] = make(map[string]bool)
+		}
+	}
+	var nodes []*LogicalSelectNode
+	for _, f := range plan.filters {
+		nodes = append(nodes, &f.fieldExpr, &f.constExpr)
+	}
+	for _, j := range plan.joins {
+		nodes = append(nodes, j.left, j.right)
+	}
+	nodes = append(nodes, plan.selects...)
+	nodes = append(nodes, plan.aggs...)
+	for _, g := range plan.groupByFields {
+		nodes = append(nodes, g.expr)
+	}
+	for _, o := range plan.orderByFields {
+		nodes = append(nodes, o.expr)
+	}
+	for _, n := range nodes {
+		err := n.readColumns(c, plan, columns)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return columns, nil
+}
+
+var (
+	createUserRegexp = regexp.MustCompile(`(?is)^\s*create\s+(user|role)\s+(\w+)\s*;?\s*$`)
+	grantRegexp      = regexp.MustCompile(`(?is)^\s*(grant|revoke)\s+(.+?)\s+on\s+(?:table\s+)?(\w+)\s+(?:to|from)\s+(\w+)\s*;?\s*$`)
+	grantRoleRegexp  = regexp.MustCompile(`(?is)^\s*(grant|revoke)\s+(\w+)\s+(?:to|from)\s+(\w+)\s*;?\s*$`)
+	privilegeRegexp  = regexp.MustCompile(`(?is)^\s*(\w+)\s*(?:\(([^)]*)\))?\s*(?:,|$)`)
+)
+
+// Runs query if it is an access control statement; returns false if it is
+// not one.
+func processAccessControl(c *Catalog, query string) (bool, error) {
+	if m := createUserRegexp.FindStringSubmatch(query); m != nil {
+		if err := c.checkSuperuser("create users and roles"); err != nil {
+			return true, err
+		}
+		a, err := c.access()
+		if err != nil {
+			return true, err
+		}
+		return true, a.create(strings.ToLower(m[2]), strings.ToLower(m[1]))
+	}
+	if m := grantRegexp.FindStringSubmatch(query); m != nil {
+		if err := c.checkSuperuser("grant and revoke privileges"); err != nil {
+			return true, err
+		}
+		grant := strings.EqualFold(m[1], "grant")
+		table, grantee := strings.ToLower(m[3]), strings.ToLower(m[4])
+		if c.tableMap[table] == nil {
+			return true, GoDBError{NoSuchTableError, fmt.Sprintf("no table '%s' found", table)}
+		}
+		keys, err := parsePrivileges(c, m[2], table, grantee)
+		if err != nil {
+			return true, err
+		}
+		a, err := c.access()
+		if err != nil {
+			return true, err
+		}
+		for _, key := range keys {
+			err = a.grant(key, grant)
+			if err != nil {
+				return true, err
+			}
+		}
+		return true, nil
+	}
+	if m := grantRoleRegexp.FindStringSubmatch(query); m != nil {
+		if err := c.checkSuperuser("grant and revoke roles"); err != nil {
+			return true, err
+		}
+		a, err := c.access()
+		if err != nil {
+			return true, err
+		}
+		return true, a.grantRole(strings.ToLower(m[2]), strings.ToLower(m[3]), strings.EqualFold(m[1], "grant"))
+	}
+	return processRowSecurity(c, query)
+}
+
+// Parses a privilege list such as "select (id, age), insert" into grants
+// on table.
+func parsePrivileges(c *Catalog, list string, table string, grantee string) ([]grantKey, error) {
+	desc := c.tableMap[table].desc
+	var keys []grantKey
+	for rest := strings.TrimSpace(list); rest != ""; rest = strings.TrimSpace(rest) {
+		m := privilegeRegexp.FindStringSubmatchIndex(rest)
+		if m == nil {
+			return nil, GoDBError{ParseError, fmt.Sprintf("invalid privilege list %s", list)}
+		}
+		name := strings.ToLower(rest[m[2]:m[3]])
+		var privileges []Privilege
+		switch name {
+		case "select", "insert", "delete":
+			privileges = []Privilege{Privilege(name)}
+		case "all":
+			privileges = []Privilege{SelectPrivilege, InsertPrivilege, DeletePrivilege}
+		default:
+			return nil, GoDBError{ParseError, fmt.Sprintf("unknown privilege %s", name)}
+		}
+		columns := []string{allColumns}
+		if m[4] >= 0 {
+			if name != "select" {
+				return nil, GoDBError{ParseError, fmt.Sprintf("column lists are only supported for select, not %s", name)}
+			}
+			columns = nil
+			for _, col := range strings.Split(rest[m[4]:m[5]], ",") {
+				col = strings.ToLower(strings.TrimSpace(col))
+				_, err := findFieldInTd(FieldType{col, "", UnknownType}, &desc)
+				if err != nil {
+					return nil, err
+				}
+				columns = append(columns, col)
+			}
+		}
+		for _, p := range privileges {
+			for _, col := range columns {
+				keys = append(keys, grantKey{grantee, p, table, col})
+			}
+		}
+		rest = rest[m[1]:]
+	}
+	return keys, nil
+}
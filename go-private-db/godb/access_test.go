@@ -0,0 +1,166 @@
+package godb
+
+import (
+	"os"
+	"testing"
+)
+
+func accessTestCatalog(t *testing.T) (*Catalog, TransactionID, string) {
+	dir := t.TempDir()
+	os.WriteFile(dir+"/catalog.txt", []byte("patients (id string, ssn string, age int)\nvisits (id string, ward string)\n"), 0600)
+	bp := NewBufferPool(10)
+	c, err := NewCatalogFromFile("catalog.txt", bp, dir)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	tid := NewTID()
+	bp.BeginTransaction(tid)
+	for _, sql := range []string{
+		"insert into patients values ('p1', '123-45-6789', 30), ('p2', '987-65-4321', 40)",
+		"insert into visits values ('p1', 'a')",
+	} {
+		_, op, err := Parse(c, sql)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		iter, _ := op.Iterator(tid)
+		if _, err = iter(); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	bp.CommitTransaction(tid)
+	tid = NewTID()
+	bp.BeginTransaction(tid)
+	return c, tid, dir
+}
+
+func mustParse(t *testing.T, c *Catalog, sql string) {
+	_, _, err := Parse(c, sql)
+	if err != nil {
+		t.Fatalf("%s: %s", sql, err.Error())
+	}
+}
+
+// ends the session's user, which SetUser leaves to the superuser
+func asSuperuser(c *Catalog) {
+	c.user = ""
+	c.role = ""
+}
+
+func expectPermissionError(t *testing.T, c *Catalog, sql string) {
+	_, _, err := Parse(c, sql)
+	if err == nil {
+		t.Errorf("%s: expected a permission error", sql)
+	} else if gerr, ok := err.(GoDBError); !ok || gerr.code != PermissionError {
+		t.Errorf("%s: expected a permission error, got %s", sql, err.Error())
+	}
+}
+
+func TestColumnPrivileges(t *testing.T) {
+	c, tid, _ := accessTestCatalog(t)
+	for _, sql := range []string{
+		"CREATE USER alice",
+		"create user bob",
+		"CREATE ROLE clinician",
+		"GRANT clinician TO alice",
+		"GRANT SELECT (id, age), INSERT ON patients TO clinician",
+		"grant select on visits to bob;",
+	} {
+		mustParse(t, c, sql)
+	}
+	if c.SetUser("carol") == nil {
+		t.Errorf("expected an error for an unknown user")
+	}
+
+	err := c.SetUser("alice")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if rows := queryRows(t, c, tid, "select id, age from patients where age > 35"); len(rows) != 1 {
+		t.Errorf("expected one row, got %d", len(rows))
+	}
+	mustParse(t, c, "select count(*) from patients")
+	mustParse(t, c, "insert into patients values ('p3', '111-11-1111', 50)")
+	expectPermissionError(t, c, "select ssn from patients")
+	expectPermissionError(t, c, "select * from patients")
+	expectPermissionError(t, c, "select id from patients where ssn = '123-45-6789'")
+	expectPermissionError(t, c, "select p.id from patients p, visits v where p.id = v.id")
+	expectPermissionError(t, c, "select count(*) from visits")
+	expectPermissionError(t, c, "delete from patients where id = 'p1'")
+	expectPermissionError(t, c, "grant select on patients to alice")
+	expectPermissionError(t, c, "create user mallory")
+	expectPermissionError(t, c, "create table t (x int)")
+
+	asSuperuser(c)
+	c.SetUser("bob")
+	mustParse(t, c, "select * from visits")
+	expectPermissionError(t, c, "select id from patients")
+
+	asSuperuser(c)
+	mustParse(t, c, "revoke select (age) on patients from clinician")
+	mustParse(t, c, "grant delete on patients to clinician")
+	c.SetUser("alice")
+	expectPermissionError(t, c, "select age from patients")
+	mustParse(t, c, "delete from patients where id = 'p1'")
+	expectPermissionError(t, c, "delete from patients where age > 10")
+}
+
+func TestAccessControlPersists(t *testing.T) {
+	c, _, dir := accessTestCatalog(t)
+	mustParse(t, c, "create user alice")
+	mustParse(t, c, "create role clinician")
+	mustParse(t, c, "grant clinician to alice")
+	mustParse(t, c, "grant all on visits to clinician")
+	c.bp.FlushAllPages()
+
+	c2, err := NewCatalogFromFile("catalog.txt", NewBufferPool(10), dir)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, _, err = Parse(c2, "create user alice"); err == nil {
+		t.Errorf("expected alice to exist after reopening the catalog")
+	}
+	err = c2.SetUser("alice")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	mustParse(t, c2, "select ward from visits")
+	mustParse(t, c2, "delete from visits where id = 'p1'")
+	expectPermissionError(t, c2, "select id from patients")
+
+	asSuperuser(c2)
+	mustParse(t, c2, "revoke clinician from alice")
+	c2.SetUser("alice")
+	expectPermissionError(t, c2, "select ward from visits")
+}
+
+func TestSessionSetupNeedsSuperuser(t *testing.T) {
+	c, _, _ := accessTestCatalog(t)
+	mustParse(t, c, "create user alice")
+	mustParse(t, c, "create user bob")
+	mustParse(t, c, "create role clinician")
+	mustParse(t, c, "create role auditor")
+	mustParse(t, c, "grant clinician to alice")
+	if err := c.SetUser("alice"); err != nil {
+		t.Fatalf(err.Error())
+	}
+	for name, err := range map[string]error{
+		"switching back to the superuser": c.SetUser(""),
+		"switching to another user":       c.SetUser("bob"),
+		"taking a role it does not hold":  c.SetRole("auditor"),
+		"declaring a mask":                c.SetColumnMask("clinician", "patients", "ssn", "maskssn(ssn)"),
+		"dropping a mask":                 c.DropColumnMask("clinician", "patients", "ssn"),
+		"opening a token vault":           c.SetTokenVault(nil),
+		"setting a privacy policy":        c.RequirePrivacy("clinician", PrivacyPolicy{Epsilon: 1}),
+	} {
+		if gerr, ok := err.(GoDBError); !ok || gerr.code != PermissionError {
+			t.Errorf("%s: expected a permission error, got %v", name, err)
+		}
+	}
+	if c.User() != "alice" {
+		t.Errorf("expected the session to stay alice's, got %q", c.User())
+	}
+	if err := c.SetRole("clinician"); err != nil {
+		t.Errorf("expected alice to take a role she holds, got %v", err)
+	}
+}
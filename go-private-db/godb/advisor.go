@@ -0,0 +1,394 @@
+package godb
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/xwb1989/sqlparser"
+)
+
+// Recommends the weakest encryption kind for every catalog column that
+// still lets the server run a workload of queries:
+//
+//   - columns that are only returned to the client can use RND
+//   - equality predicates, equi-joins, GROUP BY and DISTINCT need DET
+//   - range predicates, ORDER BY, MIN and MAX need ORE
+//   - SUM and AVG need HOM
+//
+// ORE also supports everything DET does. HOM cannot be combined with DET or
+// ORE on one column, so a column that needs both is left in plaintext.
+// Queries the server cannot run on any encrypted column (LIKE, functions
+// of columns, unsupported statements) are reported as unsupported instead
+// of influencing the recommendation.
+
+type ColumnAdvice struct {
+	Table    string
+	Column   string
+	Kind     EncryptionKind
+	ForcedBy []string // queries that require Kind
+	Reason   string   // why the column must stay in plaintext, if it must
+}
+
+type UnsupportedQuery struct {
+	Query  string
+	Reason string
+}
+
+type EncryptionAdvice struct {
+	Columns     []ColumnAdvice
+	Unsupported []UnsupportedQuery
+}
+
+// Splits a workload file into statements at semicolons, skipping blank
+// lines and "--" comments.
+func ParseWorkload(r io.Reader) ([]string, error) {
+	var queries []string
+	current := ""
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "--") {
+			continue
+		}
+		current += " " + line
+		for strings.Contains(current, ";") {
+			i := strings.Index(current, ";")
+			if q := strings.TrimSpace(current[:i]); q != "" {
+				queries = append(queries, q)
+			}
+			current = current[i+1:]
+		}
+	}
+	if q := strings.TrimSpace(current); q != "" {
+		queries = append(queries, q)
+	}
+	return queries, scanner.Err()
+}
+
+type columnRef struct {
+	table, column string
+}
+
+// requirements of one query
+type queryNeeds struct {
+	c     *Catalog
+	needs map[columnRef]map[EncryptionKind]bool
+}
+
+func (q *queryNeeds) require(col columnRef, kind EncryptionKind) {
+	if q.needs[col] == nil {
+		q.needs[col] = make(map[EncryptionKind]bool)
+	}
+	q.needs[col][kind] = true
+}
+
+func (q *queryNeeds) resolve(plan *LogicalPlan, node *LogicalSelectNode) (columnRef, error) {
+	table, field, err := node.getTableField(q.c, plan.subqueries, plan.tables)
+	if err != nil {
+		return columnRef{}, err
+	}
+	if node.exprType == ExprField {
+		field = node.field
+	}
+	for _, t := range plan.tables {
+		if t.alias == table {
+			table = t.tableName
+		}
+	}
+	return columnRef{table, field}, nil
+}
+
+func (q *queryNeeds) requireField(plan *LogicalPlan, node *LogicalSelectNode, kind EncryptionKind) error {
+	switch node.exprType {
+	case ExprConst, ExprStar:
+		return nil
+	case ExprField:
+		col, err := q.resolve(plan, node)
+		if err != nil {
+			return err
+		}
+		if _, exists := q.c.tableMap[col.table]; exists {
+			q.require(col, kind)
+			return nil
+		}
+		for _, sub := range plan.subqueries {
+			if sub.alias == col.table {
+				return q.requireOutput(sub, col.column, kind)
+			}
+		}
+		return GoDBError{IllegalOperationError, fmt.Sprintf("cannot trace column %s.%s to a table", col.table, col.column)}
+	}
+	return GoDBError{IllegalOperationError, fmt.Sprintf("expression %s cannot be evaluated on encrypted columns", sqlNodeName(node))}
+}
+
+// Carries a requirement on output column name of subquery sub through to
+// the columns it is computed from.
+func (q *queryNeeds) requireOutput(sub *LogicalPlan, name string, kind EncryptionKind) error {
+	for _, s := range sub.selects {
+		if s.exprType == ExprStar {
+			for _, t := range sub.tables {
+				if _, err := findFieldInTd(FieldType{name, "", UnknownType}, (*t.file).Descriptor()); err == nil {
+					q.require(columnRef{t.tableName, name}, kind)
+					return nil
+				}
+			}
+			for _, subsub := range sub.subqueries {
+				for _, f := range subsub.getSubplanFields(q.c) {
+					if f.Fname == name {
+						return q.requireOutput(subsub, name, kind)
+					}
+				}
+			}
+			continue
+		}
+		_, field, err := s.getTableField(q.c, sub.subqueries, sub.tables)
+		if err != nil {
+			return err
+		}
+		if s.alias != name && field != name {
+			continue
+		}
+		switch {
+		case s.exprType == ExprConst || kind == RndKind:
+			return nil // only returned
+		case s.exprType == ExprField:
+			return q.requireField(sub, s, kind)
+		case s.exprType == ExprAggr && *s.funcOp == "count":
+			return nil // counts are computed in plaintext
+		case s.exprType == ExprAggr && (*s.funcOp == "min" || *s.funcOp == "max"):
+			for _, arg := range s.args {
+				err := q.requireField(sub, arg, OreKind)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		return GoDBError{IllegalOperationError, fmt.Sprintf("column %s of subquery %s is computed by %s, which cannot be compared on encrypted columns", name, sub.alias, sqlNodeName(s))}
+	}
+	return GoDBError{IllegalOperationError, fmt.Sprintf("cannot trace column %s of subquery %s to a table", name, sub.alias)}
+}
+
+func sqlNodeName(node *LogicalSelectNode) string {
+	if node.funcOp != nil {
+		return *node.funcOp + "(...)"
+	}
+	return node.field
+}
+
+func (q *queryNeeds) addPlan(plan *LogicalPlan) error {
+	for _, sub := range plan.subqueries {
+		err := q.addPlan(sub)
+		if err != nil {
+			return err
+		}
+	}
+	selectKind := RndKind
+	if plan.distinct {
+		selectKind = DetKind
+	}
+	for _, s := range plan.selects {
+		if s.exprType == ExprAggr {
+			continue
+		}
+		err := q.requireField(plan, s, selectKind)
+		if err != nil {
+			return err
+		}
+	}
+	for _, a := range plan.aggs {
+		var kind EncryptionKind
+		switch *a.funcOp {
+		case "sum", "avg":
+			kind = HomKind
+		case "min", "max":
+			kind = OreKind
+		case "count":
+			kind = RndKind
+		default:
+			return GoDBError{IllegalOperationError, fmt.Sprintf("aggregate %s cannot be evaluated on encrypted columns", *a.funcOp)}
+		}
+		for _, arg := range a.args {
+			err := q.requireField(plan, arg, kind)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for _, f := range plan.filters {
+		var kind EncryptionKind
+		switch f.predOp {
+		case OpEq, OpNeq:
+			kind = DetKind
+		case OpLike:
+			return GoDBError{IllegalOperationError, "LIKE predicates cannot be evaluated on encrypted columns"}
+		default:
+			kind = OreKind
+		}
+		err := q.requireField(plan, &f.fieldExpr, kind)
+		if err != nil {
+			return err
+		}
+		err = q.requireField(plan, &f.constExpr, kind)
+		if err != nil {
+			return err
+		}
+	}
+	for _, j := range plan.joins {
+		kind := OreKind
+		if j.predOp == OpEq {
+			kind = DetKind
+		}
+		for _, side := range []*LogicalSelectNode{j.left, j.right} {
+			err := q.requireField(plan, side, kind)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for _, g := range plan.groupByFields {
+		err := q.requireField(plan, g.expr, DetKind)
+		if err != nil {
+			return err
+		}
+	}
+	for _, o := range plan.orderByFields {
+		err := q.requireField(plan, o.expr, OreKind)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func deletePlan(c *Catalog, stmt *sqlparser.Delete) (*LogicalPlan, error) {
+	if len(stmt.TableExprs) != 1 {
+		return nil, GoDBError{ParseError, "godb does not supporting deleting from multiple tables"}
+	}
+	tables, subplans, _, err := parseFrom(c, stmt.TableExprs[0])
+	if err != nil {
+		return nil, err
+	}
+	plan := &LogicalPlan{tables: tables, subqueries: subplans}
+	if stmt.Where != nil {
+		plan.filters, plan.joins, err = parseWhere(c, subplans, tables, stmt.Where.Expr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return plan, nil
+}
+
+// the per-column requirements of a single query
+func queryRequirements(c *Catalog, sql string) (map[columnRef]map[EncryptionKind]bool, error) {
+	stmt, err := sqlparser.Parse(sql)
+	if err != nil {
+		return nil, err
+	}
+	q := &queryNeeds{c, make(map[columnRef]map[EncryptionKind]bool)}
+	switch stmt := stmt.(type) {
+	case *sqlparser.Select:
+		plan, err := parseStatement(c, stmt)
+		if err != nil {
+			return nil, err
+		}
+		err = q.addPlan(plan)
+		if err != nil {
+			return nil, err
+		}
+	case *sqlparser.Delete:
+		plan, err := deletePlan(c, stmt)
+		if err != nil {
+			return nil, err
+		}
+		err = q.addPlan(plan)
+		if err != nil {
+			return nil, err
+		}
+	case *sqlparser.Insert:
+		// values are encrypted by the proxy; nothing is evaluated on the server
+	default:
+		return nil, GoDBError{IllegalOperationError, "only SELECT, INSERT and DELETE statements can run on encrypted tables"}
+	}
+	return q.needs, nil
+}
+
+// Recommends an encryption kind for every column of c given a workload of
+// queries (see ParseWorkload).
+func AdviseEncryption(c *Catalog, queries []string) *EncryptionAdvice {
+	advice := &EncryptionAdvice{}
+	byKind := make(map[columnRef]map[EncryptionKind][]string)
+	for _, sql := range queries {
+		needs, err := queryRequirements(c, sql)
+		if err != nil {
+			reason := err.Error()
+			if gerr, ok := err.(GoDBError); ok {
+				reason = gerr.errString
+			}
+			advice.Unsupported = append(advice.Unsupported, UnsupportedQuery{sql, reason})
+			continue
+		}
+		for col, kinds := range needs {
+			if byKind[col] == nil {
+				byKind[col] = make(map[EncryptionKind][]string)
+			}
+			for kind := range kinds {
+				byKind[col][kind] = append(byKind[col][kind], sql)
+			}
+		}
+	}
+
+	for _, t := range c.tables {
+		for _, f := range t.desc.Fields {
+			col := columnRef{t.name, f.Fname}
+			kinds := byKind[col]
+			a := ColumnAdvice{Table: t.name, Column: f.Fname, Kind: RndKind}
+			hom := kinds[HomKind]
+			compared := append(append([]string{}, kinds[DetKind]...), kinds[OreKind]...)
+			switch {
+			case len(hom) > 0 && len(compared) > 0:
+				a.Kind = PlaintextKind
+				a.ForcedBy = append(append([]string{}, hom...), compared...)
+				a.Reason = "needs both homomorphic aggregation and comparisons"
+			case len(hom) > 0:
+				a.Kind = HomKind
+				a.ForcedBy = hom
+			case len(kinds[OreKind]) > 0:
+				a.Kind = OreKind
+				a.ForcedBy = kinds[OreKind]
+			case len(kinds[DetKind]) > 0:
+				a.Kind = DetKind
+				a.ForcedBy = kinds[DetKind]
+			}
+			advice.Columns = append(advice.Columns, a)
+		}
+	}
+	return advice
+}
+
+func (a *EncryptionAdvice) String() string {
+	var sb strings.Builder
+	sb.WriteString("Column recommendations:\n")
+	for _, col := range a.Columns {
+		fmt.Fprintf(&sb, "  %s.%s: %s", col.Table, col.Column, strings.ToUpper(string(col.Kind)))
+		if col.Reason != "" {
+			fmt.Fprintf(&sb, " (%s)", col.Reason)
+		}
+		sb.WriteString("\n")
+		forcedBy := append([]string{}, col.ForcedBy...)
+		sort.Strings(forcedBy)
+		for _, q := range forcedBy {
+			fmt.Fprintf(&sb, "      required by: %s\n", q)
+		}
+	}
+	if len(a.Unsupported) > 0 {
+		sb.WriteString("Unsupported queries:\n")
+		for _, u := range a.Unsupported {
+			fmt.Fprintf(&sb, "  %s\n      %s\n", u.Query, u.Reason)
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,95 @@
+package godb
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestAdviseEncryption(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(dir+"/catalog.txt", []byte("t (id string, ssn string, age int, first_name string, diagnosis_code string, visits int)\nu (id string, zip string)\n"), 0600)
+	c, err := NewCatalogFromFile("catalog.txt", NewBufferPool(3), dir)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	workload := `-- reporting queries
+select sum(age) from t where diagnosis_code = 'S61519A';
+select first_name from t
+  where ssn = '123' order by id;
+select count(*) from t, u where t.id = u.id group by zip;
+select sum(visits) from t where visits > 3;
+select first_name from t where first_name like 'a%';
+delete from t where ssn = '456';
+update t set age = 3`
+	queries, err := ParseWorkload(strings.NewReader(workload))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(queries) != 7 {
+		t.Fatalf("expected 7 queries, got %d: %v", len(queries), queries)
+	}
+
+	advice := AdviseEncryption(c, queries)
+	expected := map[string]EncryptionKind{
+		"t.id":             OreKind,
+		"t.ssn":            DetKind,
+		"t.age":            HomKind,
+		"t.first_name":     RndKind,
+		"t.diagnosis_code": DetKind,
+		"t.visits":         PlaintextKind,
+		"u.id":             DetKind,
+		"u.zip":            DetKind,
+	}
+	for _, col := range advice.Columns {
+		name := col.Table + "." + col.Column
+		if col.Kind != expected[name] {
+			t.Errorf("expected %s for %s, got %s", expected[name], name, col.Kind)
+		}
+		if name == "t.ssn" && len(col.ForcedBy) != 2 {
+			t.Errorf("expected ssn to be forced by 2 queries, got %v", col.ForcedBy)
+		}
+	}
+	if len(advice.Unsupported) != 2 {
+		t.Errorf("expected 2 unsupported queries, got %v", advice.Unsupported)
+	}
+
+	report := advice.String()
+	if !strings.Contains(report, "t.visits: PLAINTEXT") || !strings.Contains(report, "LIKE") {
+		t.Errorf("unexpected report:\n%s", report)
+	}
+}
+
+func TestAdviseEncryptionThroughSubqueries(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(dir+"/catalog.txt", []byte("t (name string, age int, zip string, visits int)\n"), 0600)
+	c, err := NewCatalogFromFile("catalog.txt", NewBufferPool(3), dir)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	queries := []string{
+		"select s.a from (select age a from t) s where s.a > 3",
+		"select s.zip from (select * from t) s where s.zip = '02139'",
+		"select s.v from (select sum(visits) v from t) s where s.v > 3",
+	}
+	advice := AdviseEncryption(c, queries)
+	expected := map[string]EncryptionKind{
+		"t.name":   RndKind,
+		"t.age":    OreKind,
+		"t.zip":    DetKind,
+		"t.visits": RndKind,
+	}
+	for _, col := range advice.Columns {
+		name := col.Table + "." + col.Column
+		if col.Kind != expected[name] {
+			t.Errorf("expected %s for %s, got %s", expected[name], name, col.Kind)
+		}
+		if col.Kind == OreKind && (len(col.ForcedBy) != 1 || col.ForcedBy[0] != queries[0]) {
+			t.Errorf("expected %s to be forced by the subquery comparison, got %v", name, col.ForcedBy)
+		}
+	}
+	if len(advice.Unsupported) != 1 || advice.Unsupported[0].Query != queries[2] {
+		t.Errorf("expected the comparison on a subquery's sum to be unsupported, got %v", advice.Unsupported)
+	}
+}
@@ -1,5 +1,10 @@
 package godb
 
+import (
+	"runtime"
+	"sync"
+)
+
 type Aggregator struct {
 	// Expressions that when applied to tuples from the child operators,
 	// respectively, return the value of the group by key tuple
@@ -10,6 +15,10 @@ type Aggregator struct {
 	newAggState []AggState
 
 	child Operator // the child operator for the inputs to aggregate
+
+	noise *aggregateNoise // differential privacy noise, if any
+
+	suppression *SuppressionPolicy // small-cell suppression, if any
 }
 
 type EncryptedAggregator struct {
@@ -22,6 +31,12 @@ type EncryptedAggregator struct {
 	newAggState []EncryptedAggState
 
 	child Operator // the child operator for the inputs to aggregate
+
+	// If greater than 1, child tuples are aggregated by this many
+	// goroutines and the partial states merged (see aggregateParallel)
+	parallelism int
+
+	suppression *SuppressionPolicy // small-cell suppression, if any
 }
 
 type AggType int
@@ -35,16 +50,30 @@ const DefaultGroup int = 0 // for handling the case of no group-by
 
 // Constructor for an aggregator with a group-by
 func NewGroupedAggregator(emptyAggState []AggState, groupByFields []Expr, child Operator) *Aggregator {
-	return &Aggregator{groupByFields, emptyAggState, child}
+	return &Aggregator{groupByFields, emptyAggState, child, nil, nil}
 }
 
 // Constructor for an aggregator with no group-by
 func NewAggregator(emptyAggState []AggState, child Operator) *Aggregator {
-	return &Aggregator{nil, emptyAggState, child}
+	return &Aggregator{nil, emptyAggState, child, nil, nil}
 }
 
 func NewEncryptedAggregator(emptyAggState []EncryptedAggState, child Operator) *EncryptedAggregator {
-	return &EncryptedAggregator{nil, emptyAggState, child}
+	return &EncryptedAggregator{nil, emptyAggState, child, 1, nil}
+}
+
+// Constructor for an encrypted aggregator with a group-by
+func NewGroupedEncryptedAggregator(emptyAggState []EncryptedAggState, groupByFields []Expr, child Operator) *EncryptedAggregator {
+	return &EncryptedAggregator{groupByFields, emptyAggState, child, 1, nil}
+}
+
+// Constructor for an encrypted aggregator that spreads homomorphic additions
+// over parallelism goroutines. parallelism <= 0 means runtime.NumCPU().
+func NewParallelEncryptedAggregator(emptyAggState []EncryptedAggState, child Operator, parallelism int) *EncryptedAggregator {
+	if parallelism <= 0 {
+		parallelism = runtime.NumCPU()
+	}
+	return &EncryptedAggregator{nil, emptyAggState, child, parallelism, nil}
 }
 
 // Return a TupleDescriptor for this aggregation. If the aggregator has no group-by, the
@@ -97,6 +126,7 @@ func (a *EncryptedAggregator) Descriptor() *TupleDesc {
 // is no group-by, the iterator simply iterates through only one tuple, representing the
 // aggregation of all child tuples.
 func (a *Aggregator) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
+	bindVaultExprs(tid, a.groupByFields...)
 	// the child iterator
 	childIter, err := a.child.Iterator(tid)
 	if err != nil {
@@ -122,6 +152,8 @@ func (a *Aggregator) Iterator(tid TransactionID) (func() (*Tuple, error), error)
 	}
 	// the list of group key tuples
 	var groupByList []*Tuple
+	// the number of child tuples in each group, for small-cell suppression
+	counts := make(map[any]int)
 	// the iterator for iterating thru the finalized aggregation results for each group
 	var finalizedIter func() (*Tuple, error)
 	return func() (*Tuple, error) {
@@ -138,6 +170,7 @@ func (a *Aggregator) Iterator(tid TransactionID) (func() (*Tuple, error), error)
 				for i := 0; i < len(a.newAggState); i++ {
 					(*aggState[DefaultGroup])[i].AddTuple(t)
 				}
+				counts[DefaultGroup]++
 			} else { // adds tuple to the aggregation with grouping
 				keygenTup, err := extractGroupByKeyTuple(a, t)
 				if err != nil {
@@ -152,9 +185,21 @@ func (a *Aggregator) Iterator(tid TransactionID) (func() (*Tuple, error), error)
 				}
 
 				addTupleToGrpAggState(a, t, aggState[key])
+				counts[key]++
 			}
 		}
 
+		if finalizedIter == nil && a.suppression != nil {
+			keys := groupByList
+			if a.groupByFields == nil {
+				keys = []*Tuple{nil}
+			}
+			tuples, err := a.suppressedTuples(keys, aggState, counts)
+			if err != nil {
+				return nil, err
+			}
+			finalizedIter = tupleSliceIterator(tuples)
+		}
 		if finalizedIter == nil { // builds the iterator for iterating thru the finalized aggregation results for each group
 			if a.groupByFields == nil {
 				var tup *Tuple
@@ -166,6 +211,12 @@ func (a *Aggregator) Iterator(tid TransactionID) (func() (*Tuple, error), error)
 						tup = joinTuples(tup, newTup)
 					}
 				}
+				if a.noise != nil {
+					tup, err = a.noise.apply(*aggState[DefaultGroup], tup)
+					if err != nil {
+						return nil, err
+					}
+				}
 				finalizedIter = func() (*Tuple, error) { return nil, nil }
 				return tup, nil
 			} else {
@@ -202,39 +253,69 @@ func (a *EncryptedAggregator) Iterator(tid TransactionID) (func() (*Tuple, error
 	}
 	// the list of group key tuples
 	var groupByList []*Tuple
+	// the number of child tuples in each group, for small-cell suppression
+	counts := make(map[any]int)
 	// the iterator for iterating thru the finalized aggregation results for each group
 	var finalizedIter func() (*Tuple, error)
 	return func() (*Tuple, error) {
-		// iterates thru all child tuples
-		for t, err := childIter(); t != nil || err != nil; t, err = childIter() {
-			if err != nil {
-				return nil, err
-			}
-			if t == nil {
-				return nil, nil
-			}
-
-			if a.groupByFields == nil { // adds tuple to the aggregation in the case of no group-by
-				for i := 0; i < len(a.newAggState); i++ {
-					(*aggState[DefaultGroup])[i].AddTuple(t)
+		if a.parallelism > 1 {
+			if finalizedIter == nil {
+				partial, err := a.aggregateParallel(childIter)
+				if err != nil {
+					return nil, err
 				}
-			} else { // adds tuple to the aggregation with grouping
-				keygenTup, err := extractGroupByKeyTupleEncrypted(a, t)
+				aggState, groupByList, counts = partial.aggState, partial.groupByList, partial.counts
+			}
+		} else {
+			// iterates thru all child tuples
+			for t, err := childIter(); t != nil || err != nil; t, err = childIter() {
 				if err != nil {
 					return nil, err
 				}
-
-				key := keygenTup.tupleKey()
-				if aggState[key] == nil {
-					asNew := make([]EncryptedAggState, len(a.newAggState))
-					aggState[key] = &asNew
-					groupByList = append(groupByList, keygenTup)
+				if t == nil {
+					return nil, nil
 				}
 
-				addTupleToGrpAggStateEncrypted(a, t, aggState[key])
+				if a.groupByFields == nil { // adds tuple to the aggregation in the case of no group-by
+					for i := 0; i < len(a.newAggState); i++ {
+						(*aggState[DefaultGroup])[i].AddTuple(t)
+					}
+					counts[DefaultGroup]++
+				} else { // adds tuple to the aggregation with grouping
+					keygenTup, err := extractGroupByKeyTupleEncrypted(a, t)
+					if err != nil {
+						return nil, err
+					}
+
+					key := keygenTup.tupleKey()
+					if aggState[key] == nil {
+						asNew := make([]EncryptedAggState, len(a.newAggState))
+						aggState[key] = &asNew
+						groupByList = append(groupByList, keygenTup)
+					}
+
+					addTupleToGrpAggStateEncrypted(a, t, aggState[key])
+					counts[key]++
+				}
 			}
 		}
 
+		if finalizedIter == nil {
+			for _, states := range aggState {
+				for _, as := range *states {
+					if f, ok := as.(failingEncryptedAggState); ok && f.err() != nil {
+						return nil, f.err()
+					}
+				}
+			}
+		}
+		if finalizedIter == nil && a.suppression != nil {
+			keys := groupByList
+			if a.groupByFields == nil {
+				keys = []*Tuple{nil}
+			}
+			finalizedIter = tupleSliceIterator(a.suppressedTuples(keys, aggState, counts))
+		}
 		if finalizedIter == nil { // builds the iterator for iterating thru the finalized aggregation results for each group
 			if a.groupByFields == nil {
 				var tup *Tuple
@@ -256,6 +337,154 @@ func (a *EncryptedAggregator) Iterator(tid TransactionID) (func() (*Tuple, error
 	}, nil
 }
 
+const encryptedAggBatchSize = 64
+
+// Encrypted aggregation states that can fail (e.g. packed sums that would
+// overflow their slots) report it through err, which the
+// EncryptedAggregator checks before finalizing them.
+type failingEncryptedAggState interface {
+	err() error
+}
+
+// The aggregation states one worker of a parallel EncryptedAggregator has
+// built over its share of the child tuples.
+type encryptedPartialAgg struct {
+	aggState    map[any]*[]EncryptedAggState
+	groupByList []*Tuple
+	counts      map[any]int // child tuples per group
+}
+
+func (a *EncryptedAggregator) newPartialAgg() *encryptedPartialAgg {
+	p := &encryptedPartialAgg{aggState: make(map[any]*[]EncryptedAggState), counts: make(map[any]int)}
+	if a.groupByFields == nil {
+		states := make([]EncryptedAggState, len(a.newAggState))
+		for i, as := range a.newAggState {
+			states[i] = as.Copy()
+		}
+		p.aggState[DefaultGroup] = &states
+	}
+	return p
+}
+
+func (a *EncryptedAggregator) addToPartialAgg(p *encryptedPartialAgg, t *Tuple) error {
+	if a.groupByFields == nil {
+		for _, as := range *p.aggState[DefaultGroup] {
+			as.AddTuple(t)
+		}
+		p.counts[DefaultGroup]++
+		return nil
+	}
+	keygenTup, err := extractGroupByKeyTupleEncrypted(a, t)
+	if err != nil {
+		return err
+	}
+	key := keygenTup.tupleKey()
+	if p.aggState[key] == nil {
+		asNew := make([]EncryptedAggState, len(a.newAggState))
+		p.aggState[key] = &asNew
+		p.groupByList = append(p.groupByList, keygenTup)
+	}
+	addTupleToGrpAggStateEncrypted(a, t, p.aggState[key])
+	p.counts[key]++
+	return nil
+}
+
+// Merges other into p, group by group.
+func (p *encryptedPartialAgg) merge(other *encryptedPartialAgg) {
+	keys := []any{DefaultGroup}
+	if len(other.groupByList) > 0 {
+		keys = nil
+		for _, gby := range other.groupByList {
+			keys = append(keys, gby.tupleKey())
+		}
+	}
+	for i, key := range keys {
+		src, exists := other.aggState[key]
+		if !exists {
+			continue
+		}
+		p.counts[key] += other.counts[key]
+		dst, exists := p.aggState[key]
+		if !exists {
+			p.aggState[key] = src
+			p.groupByList = append(p.groupByList, other.groupByList[i])
+			continue
+		}
+		for j := range *dst {
+			(*dst)[j].Merge((*src)[j])
+		}
+	}
+}
+
+// Drains childIter, handing batches of tuples to a.parallelism workers that
+// each aggregate into their own partial states. The partial states are then
+// combined by a parallel tree reduction: in each round, every other
+// remaining partial merges its neighbour, halving the number left.
+func (a *EncryptedAggregator) aggregateParallel(childIter func() (*Tuple, error)) (*encryptedPartialAgg, error) {
+	partials := make([]*encryptedPartialAgg, a.parallelism)
+	errs := make([]error, a.parallelism)
+	batches := make(chan []*Tuple, a.parallelism)
+	var wg sync.WaitGroup
+	for w := 0; w < a.parallelism; w++ {
+		partials[w] = a.newPartialAgg()
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for batch := range batches {
+				for _, t := range batch {
+					if errs[w] == nil {
+						errs[w] = a.addToPartialAgg(partials[w], t)
+					}
+				}
+			}
+		}(w)
+	}
+
+	var readErr error
+	batch := make([]*Tuple, 0, encryptedAggBatchSize)
+	for {
+		t, err := childIter()
+		if err != nil {
+			readErr = err
+			break
+		}
+		if t == nil {
+			break
+		}
+		batch = append(batch, t)
+		if len(batch) == encryptedAggBatchSize {
+			batches <- batch
+			batch = make([]*Tuple, 0, encryptedAggBatchSize)
+		}
+	}
+	if len(batch) > 0 {
+		batches <- batch
+	}
+	close(batches)
+	wg.Wait()
+	if readErr != nil {
+		return nil, readErr
+	}
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for stride := 1; stride < len(partials); stride *= 2 {
+		var round sync.WaitGroup
+		for i := 0; i+stride < len(partials); i += 2 * stride {
+			round.Add(1)
+			go func(dst *encryptedPartialAgg, src *encryptedPartialAgg) {
+				defer round.Done()
+				dst.merge(src)
+			}(partials[i], partials[i+stride])
+		}
+		round.Wait()
+	}
+	return partials[0], nil
+}
+
 // Given a tuple t from a child iteror, return a tuple that identifies t's group.
 // The returned tuple should contain the fields from the groupByFields list
 // passed into the aggregator constructor.  The ith field can be extracted
@@ -335,6 +564,13 @@ func getFinalizedTuplesIterator(a *Aggregator, groupByList []*Tuple, aggState ma
 		for _, as := range *(aggState[key]) {
 			t = joinTuples(t, as.Finalize())
 		}
+		if a.noise != nil {
+			var err error
+			t, err = a.noise.apply(*aggState[key], t)
+			if err != nil {
+				return nil, err
+			}
+		}
 		curGbyTuple++
 		return t, nil
 	}
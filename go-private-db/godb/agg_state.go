@@ -5,7 +5,6 @@ import (
 	"encoding/binary"
 	"fmt"
 
-	"github.com/getamis/alice/crypto/homo"
 	"golang.org/x/exp/constraints"
 )
 
@@ -27,6 +26,10 @@ type AggState interface {
 	// Adds an tuple to the aggregation state.
 	AddTuple(*Tuple)
 
+	// Folds another aggregation state of the same type (e.g. that of
+	// another group) into this one.
+	Merge(other AggState)
+
 	// Returns the final result of the aggregation as a tuple.
 	Finalize() *Tuple
 
@@ -39,7 +42,7 @@ type EncryptedAggState interface {
 	// Initializes an aggregation state. Is supplied with an alias,
 	// an expr to evaluate an input tuple into a DBValue, and a getter
 	// to extract from the DBValue its int or string field's value.
-	Init(alias string, expr Expr, getter func(DBValue) any, publicKey homo.Pubkey) error
+	Init(alias string, expr Expr, getter func(DBValue) any, publicKey HomomorphicPubKey) error
 
 	// Makes an copy of the aggregation state.
 	Copy() EncryptedAggState
@@ -47,6 +50,10 @@ type EncryptedAggState interface {
 	// Adds an tuple to the aggregation state.
 	AddTuple(*Tuple)
 
+	// Folds another partial aggregation state of the same type (e.g. one
+	// computed over a different partition of the input) into this one.
+	Merge(other EncryptedAggState)
+
 	// Returns the final result of the aggregation as a tuple.
 	Finalize() *Tuple
 
@@ -65,7 +72,7 @@ type EncryptedCountAggState struct {
 	alias     string
 	expr      Expr
 	count     int64
-	publicKey homo.Pubkey
+	publicKey HomomorphicPubKey
 }
 
 func (a *CountAggState) Copy() AggState {
@@ -83,7 +90,7 @@ func (a *CountAggState) Init(alias string, expr Expr, getter func(DBValue) any)
 	return nil
 }
 
-func (a *EncryptedCountAggState) Init(alias string, expr Expr, getter func(DBValue) any, publicKey homo.Pubkey) error {
+func (a *EncryptedCountAggState) Init(alias string, expr Expr, getter func(DBValue) any, publicKey HomomorphicPubKey) error {
 	a.count = 0
 	a.expr = expr
 	a.alias = alias
@@ -99,6 +106,14 @@ func (a *EncryptedCountAggState) AddTuple(t *Tuple) {
 	a.count++
 }
 
+func (a *CountAggState) Merge(other AggState) {
+	a.count += other.(*CountAggState).count
+}
+
+func (a *EncryptedCountAggState) Merge(other EncryptedAggState) {
+	a.count += other.(*EncryptedCountAggState).count
+}
+
 func (a *CountAggState) Finalize() *Tuple {
 	td := a.GetTupleDesc()
 	f := IntField{int64(a.count)}
@@ -144,7 +159,28 @@ type EncryptedSumAggState[T string] struct {
 	expr      Expr
 	getter    func(DBValue) any
 	sum       string
-	publicKey homo.Pubkey
+	publicKey HomomorphicPubKey
+	additions packedAdditions
+}
+
+// Counts the ciphertexts added into a sum of packed ciphertexts (see
+// packColumn). Each slot of a sum of k packed values is below
+// k*2^ValueBits, so the guard bits absorb the carries of up to 2^GuardBits
+// values; one more could overflow into the neighbouring slot.
+type packedAdditions struct {
+	count int64
+	limit int64 // 0 for no limit
+}
+
+func (p *packedAdditions) add(n int64) {
+	p.count += n
+}
+
+func (p *packedAdditions) err() error {
+	if p.limit > 0 && p.count > p.limit {
+		return GoDBError{IllegalOperationError, fmt.Sprintf("sum of %d packed ciphertexts would overflow its slots, whose guard bits allow %d", p.count, p.limit)}
+	}
+	return nil
 }
 
 func (a *SumAggState[T]) Copy() AggState {
@@ -152,7 +188,7 @@ func (a *SumAggState[T]) Copy() AggState {
 }
 
 func (a *EncryptedSumAggState[T]) Copy() EncryptedAggState {
-	return &EncryptedSumAggState[T]{a.alias, a.expr, a.getter, a.sum, a.publicKey}
+	return &EncryptedSumAggState[T]{a.alias, a.expr, a.getter, a.sum, a.publicKey, a.additions}
 }
 
 func intAggGetter(v DBValue) any {
@@ -173,7 +209,7 @@ func (a *SumAggState[T]) Init(alias string, expr Expr, getter func(DBValue) any)
 	return nil
 }
 
-func (a *EncryptedSumAggState[T]) Init(alias string, expr Expr, getter func(DBValue) any, publicKey homo.Pubkey) error {
+func (a *EncryptedSumAggState[T]) Init(alias string, expr Expr, getter func(DBValue) any, publicKey HomomorphicPubKey) error {
 	z, _ := publicKey.Encrypt(make([]byte, 0))
 	a.sum = string(z)
 	a.expr = expr
@@ -189,6 +225,10 @@ func (a *SumAggState[T]) AddTuple(t *Tuple) {
 }
 
 func (a *EncryptedSumAggState[T]) AddTuple(t *Tuple) {
+	a.additions.add(1)
+	if a.additions.err() != nil {
+		return
+	}
 	v, _ := a.expr.EvalExpr(t)
 	b1 := []byte(a.sum)
 	b2 := []byte(a.getter(v).(string))
@@ -196,6 +236,27 @@ func (a *EncryptedSumAggState[T]) AddTuple(t *Tuple) {
 	a.sum = string(result)
 }
 
+func (a *SumAggState[T]) Merge(other AggState) {
+	a.sum += other.(*SumAggState[T]).sum
+}
+
+func (a *EncryptedSumAggState[T]) Merge(other EncryptedAggState) {
+	o := other.(*EncryptedSumAggState[T])
+	a.additions.add(o.additions.count)
+	result, _ := a.publicKey.Add([]byte(a.sum), []byte(o.sum))
+	a.sum = string(result)
+}
+
+// Makes the sum fail once it has added more packed ciphertexts than the
+// guard bits of packing allow.
+func (a *EncryptedSumAggState[T]) LimitPackedAdditions(packing SlotPacking) {
+	a.additions.limit = packing.maxAdditions()
+}
+
+func (a *EncryptedSumAggState[T]) err() error {
+	return a.additions.err()
+}
+
 func (a *SumAggState[T]) GetTupleDesc() *TupleDesc {
 	ft := FieldType{a.alias, "", IntType}
 	fts := []FieldType{ft}
@@ -245,7 +306,9 @@ type EncryptedAvgAggState[T string] struct {
 	getter    func(DBValue) any
 	count     int64
 	sum       string
-	publicKey homo.Pubkey
+	publicKey HomomorphicPubKey
+	slotsExpr Expr // if set, each tuple counts as this many values (see packColumn)
+	additions packedAdditions
 }
 
 func (a *AvgAggState[T]) Copy() AggState {
@@ -253,7 +316,7 @@ func (a *AvgAggState[T]) Copy() AggState {
 }
 
 func (a *EncryptedAvgAggState[T]) Copy() EncryptedAggState {
-	return &EncryptedAvgAggState[T]{a.alias, a.expr, a.getter, a.count, a.sum, a.publicKey}
+	return &EncryptedAvgAggState[T]{a.alias, a.expr, a.getter, a.count, a.sum, a.publicKey, a.slotsExpr, a.additions}
 }
 
 func (a *AvgAggState[T]) Init(alias string, expr Expr, getter func(DBValue) any) error {
@@ -265,7 +328,7 @@ func (a *AvgAggState[T]) Init(alias string, expr Expr, getter func(DBValue) any)
 	return nil
 }
 
-func (a *EncryptedAvgAggState[T]) Init(alias string, expr Expr, getter func(DBValue) any, publicKey homo.Pubkey) error {
+func (a *EncryptedAvgAggState[T]) Init(alias string, expr Expr, getter func(DBValue) any, publicKey HomomorphicPubKey) error {
 	a.alias = alias
 	a.expr = expr
 	a.getter = getter
@@ -292,12 +355,51 @@ func (a *AvgAggState[T]) AddTuple(t *Tuple) {
 }
 
 func (a *EncryptedAvgAggState[T]) AddTuple(t *Tuple) {
+	a.additions.add(1)
+	if a.additions.err() != nil {
+		return
+	}
 	v, _ := a.expr.EvalExpr(t)
 	b1 := []byte(a.sum)
 	b2 := []byte(a.getter(v).(string))
 	result, _ := a.publicKey.Add(b1, b2)
 	a.sum = string(result)
-	a.count++
+	if a.slotsExpr != nil {
+		slots, _ := a.slotsExpr.EvalExpr(t)
+		a.count += slots.(IntField).Value
+	} else {
+		a.count++
+	}
+}
+
+func (a *AvgAggState[T]) Merge(other AggState) {
+	o := other.(*AvgAggState[T])
+	a.sum += o.sum
+	a.count += o.count
+}
+
+func (a *EncryptedAvgAggState[T]) Merge(other EncryptedAggState) {
+	o := other.(*EncryptedAvgAggState[T])
+	a.additions.add(o.additions.count)
+	result, _ := a.publicKey.Add([]byte(a.sum), []byte(o.sum))
+	a.sum = string(result)
+	a.count += o.count
+}
+
+// Makes the average fail once its sum has added more packed ciphertexts
+// than the guard bits of packing allow.
+func (a *EncryptedAvgAggState[T]) LimitPackedAdditions(packing SlotPacking) {
+	a.additions.limit = packing.maxAdditions()
+}
+
+func (a *EncryptedAvgAggState[T]) err() error {
+	return a.additions.err()
+}
+
+// Counts each tuple as the number of packed values given by slotsExpr,
+// typically the PackedSlotsField column of a file written by packColumn.
+func (a *EncryptedAvgAggState[T]) CountSlotsFrom(slotsExpr Expr) {
+	a.slotsExpr = slotsExpr
 }
 
 func (a *AvgAggState[T]) GetTupleDesc() *TupleDesc {
@@ -370,6 +472,14 @@ func (a *MaxAggState[T]) AddTuple(t *Tuple) {
 	}
 }
 
+func (a *MaxAggState[T]) Merge(other AggState) {
+	o := other.(*MaxAggState[T])
+	if !o.null && (a.null || o.max > a.max) {
+		a.max = o.max
+		a.null = false
+	}
+}
+
 func (a *MaxAggState[T]) GetTupleDesc() *TupleDesc {
 	var ft FieldType
 	switch any(a.max).(type) {
@@ -434,6 +544,14 @@ func (a *MinAggState[T]) AddTuple(t *Tuple) {
 	}
 }
 
+func (a *MinAggState[T]) Merge(other AggState) {
+	o := other.(*MinAggState[T])
+	if !o.null && (a.null || o.min < a.min) {
+		a.min = o.min
+		a.null = false
+	}
+}
+
 func (a *MinAggState[T]) GetTupleDesc() *TupleDesc {
 	var ft FieldType
 	switch any(a.min).(type) {
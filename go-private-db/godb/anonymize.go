@@ -0,0 +1,336 @@
+package godb
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// De-identified export. AnonymizeOp generalizes the quasi-identifiers of
+// its child's rows (age, zip code, gender, ...) until every equivalence
+// class -- the rows sharing all generalized quasi-identifiers -- has at
+// least K rows and, optionally, L distinct values of a sensitive column.
+// Each quasi-identifier has a hierarchy of generalizations, expressions
+// over the column from the function library such as "agebucket(age, 10)"
+// or "keepprefix(zip, 3)". Following Datafly, the column with the most
+// distinct values is generalized one more level at a time, until the rows
+// in classes that are still too small are few enough to suppress.
+
+type Generalization struct {
+	Column string
+	Levels []string // least to most general; the raw column is level 0
+}
+
+type AnonymizationConfig struct {
+	K                int
+	L                int    // distinct sensitive values per class; 0 to skip l-diversity
+	Sensitive        string // the sensitive column, for l-diversity
+	QuasiIdentifiers []Generalization
+	MaxSuppression   float64 // fraction of the rows that may be suppressed
+}
+
+type AnonymizeOp struct {
+	config    AnonymizationConfig
+	child     Operator
+	quasi     []int    // field numbers of the quasi-identifiers
+	levels    [][]Expr // generalizations of each quasi-identifier
+	sensitive Expr
+
+	// results of the last run of the iterator
+	chosen     []int
+	suppressed int
+}
+
+func NewAnonymizeOp(config AnonymizationConfig, child Operator) (*AnonymizeOp, error) {
+	if config.K < 1 {
+		return nil, GoDBError{IllegalOperationError, "k must be at least 1"}
+	}
+	desc := child.Descriptor()
+	op := &AnonymizeOp{config: config, child: child}
+	for _, g := range config.QuasiIdentifiers {
+		fieldNo, err := findFieldInTd(FieldType{g.Column, "", UnknownType}, desc)
+		if err != nil {
+			return nil, err
+		}
+		levels := []Expr{&FieldExpr{desc.Fields[fieldNo]}}
+		for _, l := range g.Levels {
+			e, err := parseColumnExpr(nil, l, desc)
+			if err != nil {
+				return nil, err
+			}
+			err = checkColumnExpr(e, g.Column)
+			if err != nil {
+				return nil, err
+			}
+			levels = append(levels, e)
+		}
+		op.quasi = append(op.quasi, fieldNo)
+		op.levels = append(op.levels, levels)
+	}
+	if config.L > 0 {
+		fieldNo, err := findFieldInTd(FieldType{config.Sensitive, "", UnknownType}, desc)
+		if err != nil {
+			return nil, err
+		}
+		op.sensitive = &FieldExpr{desc.Fields[fieldNo]}
+	}
+	return op, nil
+}
+
+// The child's descriptor, with quasi-identifiers turned into strings.
+func (op *AnonymizeOp) Descriptor() *TupleDesc {
+	desc := op.child.Descriptor().copy()
+	for _, i := range op.quasi {
+		desc.Fields[i].Ftype = StringType
+	}
+	return desc
+}
+
+// The generalization level chosen for each quasi-identifier and the number
+// of suppressed rows, as of the last run of the iterator.
+func (op *AnonymizeOp) Levels() ([]int, int) {
+	return op.chosen, op.suppressed
+}
+
+func (op *AnonymizeOp) generalizers(levels []int) []Expr {
+	exprs := make([]Expr, len(levels))
+	for i, l := range levels {
+		exprs[i] = op.levels[i][l]
+	}
+	return exprs
+}
+
+// Counts the rows of each equivalence class by grouped aggregation. With
+// the sensitive column appended to exprs, counts the distinct sensitive
+// values of each class instead.
+func (op *AnonymizeOp) classSizes(rows Operator, exprs []Expr, distinct bool, tid TransactionID) (map[string]int, error) {
+	count := &CountAggState{}
+	count.Init("count", nil, nil)
+	iter, err := NewGroupedAggregator([]AggState{count}, exprs, rows).Iterator(tid)
+	if err != nil {
+		return nil, err
+	}
+	sizes := make(map[string]int)
+	for {
+		t, err := iter()
+		if err != nil {
+			return nil, err
+		}
+		if t == nil {
+			return sizes, nil
+		}
+		n := len(t.Fields) - 1
+		if distinct {
+			n-- // one group per (class, sensitive value)
+			sizes[fmt.Sprint(t.Fields[:n])]++
+		} else {
+			sizes[fmt.Sprint(t.Fields[:n])] = int(t.Fields[n].(IntField).Value)
+		}
+	}
+}
+
+func classKey(t *Tuple, exprs []Expr) (string, []DBValue, error) {
+	values := make([]DBValue, len(exprs))
+	for i, e := range exprs {
+		v, err := e.EvalExpr(t)
+		if err != nil {
+			return "", nil, err
+		}
+		values[i] = v
+	}
+	return fmt.Sprint(values), values, nil
+}
+
+// Chooses generalization levels for rows and returns them with the class
+// key of every row that must be suppressed.
+func (op *AnonymizeOp) generalize(rows *tupleListOp, tid TransactionID) ([]int, map[string]bool, error) {
+	levels := make([]int, len(op.quasi))
+	for {
+		exprs := op.generalizers(levels)
+		sizes, err := op.classSizes(rows, exprs, false, tid)
+		if err != nil {
+			return nil, nil, err
+		}
+		var diversity map[string]int
+		if op.sensitive != nil {
+			diversity, err = op.classSizes(rows, append(exprs, op.sensitive), true, tid)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		small := make(map[string]bool)
+		outliers := 0
+		for key, size := range sizes {
+			if size < op.config.K || (op.sensitive != nil && diversity[key] < op.config.L) {
+				small[key] = true
+				outliers += size
+			}
+		}
+		if float64(outliers) <= op.config.MaxSuppression*float64(len(rows.tuples)) {
+			return levels, small, nil
+		}
+
+		// generalize the column with the most distinct values
+		best, bestDistinct := -1, 0
+		for i := range op.quasi {
+			if levels[i]+1 >= len(op.levels[i]) {
+				continue
+			}
+			distinct := make(map[string]bool)
+			for _, t := range rows.tuples {
+				key, _, err := classKey(t, exprs[i:i+1])
+				if err != nil {
+					return nil, nil, err
+				}
+				distinct[key] = true
+			}
+			if len(distinct) > bestDistinct {
+				best, bestDistinct = i, len(distinct)
+			}
+		}
+		if best == -1 {
+			goal := fmt.Sprintf("%d-anonymity", op.config.K)
+			if op.sensitive != nil {
+				goal += fmt.Sprintf(" and %d-diversity", op.config.L)
+			}
+			return nil, nil, GoDBError{IllegalOperationError, fmt.Sprintf("cannot reach %s without suppressing %d of %d rows", goal, outliers, len(rows.tuples))}
+		}
+		levels[best]++
+	}
+}
+
+// Reads all of the child's rows, generalizes them and returns the rows of
+// every equivalence class that is large (and diverse) enough.
+func (op *AnonymizeOp) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
+	childIter, err := op.child.Iterator(tid)
+	if err != nil {
+		return nil, err
+	}
+	rows := &tupleListOp{op.child.Descriptor(), nil}
+	for {
+		t, err := childIter()
+		if err != nil {
+			return nil, err
+		}
+		if t == nil {
+			break
+		}
+		rows.tuples = append(rows.tuples, t)
+	}
+	levels, small, err := op.generalize(rows, tid)
+	if err != nil {
+		return nil, err
+	}
+	op.chosen = levels
+	op.suppressed = 0
+	exprs := op.generalizers(levels)
+	desc := op.Descriptor()
+
+	i := 0
+	return func() (*Tuple, error) {
+		for i < len(rows.tuples) {
+			t := rows.tuples[i]
+			i++
+			key, values, err := classKey(t, exprs)
+			if err != nil {
+				return nil, err
+			}
+			if small[key] {
+				op.suppressed++
+				continue
+			}
+			fields := append([]DBValue{}, t.Fields...)
+			for j, fieldNo := range op.quasi {
+				fields[fieldNo] = StringField{dbValueString(values[j])}
+			}
+			return &Tuple{*desc, fields, nil}, nil
+		}
+		return nil, nil
+	}, nil
+}
+
+func dbValueString(v DBValue) string {
+	switch v := v.(type) {
+	case IntField:
+		return fmt.Sprint(v.Value)
+	case StringField:
+		return v.Value
+	}
+	return ""
+}
+
+// Writes the rows of op to w as CSV, with a header of field names.
+func ExportCSV(op Operator, tid TransactionID, w io.Writer, sep string) error {
+	var names []string
+	for _, f := range op.Descriptor().Fields {
+		names = append(names, f.Fname)
+	}
+	_, err := fmt.Fprintln(w, strings.Join(names, sep))
+	if err != nil {
+		return err
+	}
+	iter, err := op.Iterator(tid)
+	if err != nil {
+		return err
+	}
+	for {
+		t, err := iter()
+		if err != nil {
+			return err
+		}
+		if t == nil {
+			return nil
+		}
+		values := make([]string, len(t.Fields))
+		for i, f := range t.Fields {
+			values[i] = dbValueString(f)
+		}
+		_, err = fmt.Fprintln(w, strings.Join(values, sep))
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Tuples inserted per transaction by ExportHeapFile.
+const exportHeapFileCommitEvery = 64
+
+// Appends the rows of op, read in transaction tid, to the heap file toFile
+// (created if it does not exist). Commits the rows in batches and returns
+// the number committed. On an error the failed batch is rolled back and the
+// count is the number of leading rows of op that toFile holds.
+func ExportHeapFile(op Operator, tid TransactionID, toFile string, bp *BufferPool) (*HeapFile, int, error) {
+	hf, err := NewHeapFile(toFile, op.Descriptor(), bp)
+	if err != nil {
+		return nil, 0, err
+	}
+	iter, err := op.Iterator(tid)
+	if err != nil {
+		return nil, 0, err
+	}
+	writeTid := NewTID()
+	bp.BeginTransaction(writeTid)
+	inserted, committed := 0, 0
+	for {
+		t, err := iter()
+		if err == nil && t == nil {
+			break
+		}
+		if err == nil {
+			err = hf.insertTuple(t, writeTid)
+		}
+		if err != nil {
+			bp.AbortTransaction(writeTid)
+			return hf, committed, partialWriteError(err, committed, toFile)
+		}
+		inserted++
+		if inserted%exportHeapFileCommitEvery == 0 {
+			bp.CommitTransaction(writeTid)
+			committed = inserted
+			writeTid = NewTID()
+			bp.BeginTransaction(writeTid)
+		}
+	}
+	bp.CommitTransaction(writeTid)
+	return hf, inserted, nil
+}
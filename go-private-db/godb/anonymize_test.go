@@ -0,0 +1,138 @@
+package godb
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func anonymizeTestRows() *tupleListOp {
+	desc := &TupleDesc{Fields: []FieldType{
+		{Fname: "age", Ftype: IntType}, {Fname: "zip", Ftype: StringType},
+		{Fname: "gender", Ftype: StringType}, {Fname: "diagnosis", Ftype: StringType},
+	}}
+	rows := []struct {
+		age               int64
+		zip, gender, diag string
+	}{
+		{31, "02138", "m", "flu"}, {33, "02139", "f", "asthma"}, {37, "02141", "f", "flu"},
+		{38, "02142", "m", "diabetes"}, {52, "94110", "f", "flu"}, {55, "94112", "m", "asthma"},
+		{58, "94115", "m", "asthma"}, {90, "10001", "f", "cancer"},
+	}
+	op := &tupleListOp{desc, nil}
+	for _, r := range rows {
+		op.tuples = append(op.tuples, &Tuple{*desc, []DBValue{IntField{r.age}, StringField{r.zip}, StringField{r.gender}, StringField{r.diag}}, nil})
+	}
+	return op
+}
+
+var anonymizeTestHierarchy = []Generalization{
+	{"age", []string{"agebucket(age, 10)", "agebucket(age, 100)"}},
+	{"zip", []string{"keepprefix(zip, 3)", "keepprefix(zip, 1)", "keepprefix(zip, 0)"}},
+	{"gender", []string{"'*'"}},
+}
+
+func collectAnonymized(t *testing.T, op *AnonymizeOp) []*Tuple {
+	iter, err := op.Iterator(NewTID())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	var rows []*Tuple
+	for {
+		tup, err := iter()
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if tup == nil {
+			return rows
+		}
+		rows = append(rows, tup)
+	}
+}
+
+func TestAnonymizeKAnonymity(t *testing.T) {
+	op, err := NewAnonymizeOp(AnonymizationConfig{K: 2, QuasiIdentifiers: anonymizeTestHierarchy, MaxSuppression: 0.2}, anonymizeTestRows())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	rows := collectAnonymized(t, op)
+	levels, suppressed := op.Levels()
+	if len(rows)+suppressed != 8 || suppressed > 1 {
+		t.Errorf("expected at most one of 8 rows suppressed, got %d rows and %d suppressed", len(rows), suppressed)
+	}
+	classes := make(map[string]int)
+	for _, r := range rows {
+		classes[fmt.Sprint(r.Fields[:3])]++
+	}
+	for class, n := range classes {
+		if n < 2 {
+			t.Errorf("class %s has %d rows (levels %v)", class, n, levels)
+		}
+	}
+	if op.Descriptor().Fields[0].Ftype != StringType || rows[0].Fields[3] != (StringField{"flu"}) {
+		t.Errorf("expected generalized strings for quasi-identifiers and the sensitive column unchanged")
+	}
+
+	var csv bytes.Buffer
+	err = ExportCSV(op, NewTID(), &csv, ",")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	lines := strings.Split(strings.TrimSpace(csv.String()), "\n")
+	if lines[0] != "age,zip,gender,diagnosis" || len(lines) != len(rows)+1 {
+		t.Errorf("unexpected CSV export:\n%s", csv.String())
+	}
+
+	bp := NewBufferPool(3)
+	tid := NewTID()
+	hf, exported, err := ExportHeapFile(op, tid, t.TempDir()+"/anonymized.dat", bp)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	bp.BeginTransaction(tid)
+	iter, _ := hf.Iterator(tid)
+	n := 0
+	for tup, _ := iter(); tup != nil; tup, _ = iter() {
+		n++
+	}
+	if n != len(rows) || exported != n {
+		t.Errorf("expected %d rows in exported heap file, got %d (reported %d)", len(rows), n, exported)
+	}
+}
+
+func TestAnonymizeLDiversity(t *testing.T) {
+	config := AnonymizationConfig{K: 2, L: 2, Sensitive: "diagnosis", QuasiIdentifiers: anonymizeTestHierarchy}
+	op, err := NewAnonymizeOp(config, anonymizeTestRows())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	rows := collectAnonymized(t, op)
+	if len(rows) != 8 {
+		t.Fatalf("expected no suppression, got %d rows", len(rows))
+	}
+	diagnoses := make(map[string]map[string]bool)
+	for _, r := range rows {
+		class := fmt.Sprint(r.Fields[:3])
+		if diagnoses[class] == nil {
+			diagnoses[class] = make(map[string]bool)
+		}
+		diagnoses[class][r.Fields[3].(StringField).Value] = true
+	}
+	for class, d := range diagnoses {
+		if len(d) < 2 {
+			t.Errorf("class %s has only diagnoses %v", class, d)
+		}
+	}
+
+	config.K = 100
+	op, _ = NewAnonymizeOp(config, anonymizeTestRows())
+	_, err = op.Iterator(NewTID())
+	if err == nil {
+		t.Errorf("expected k larger than the table to fail without suppression")
+	}
+	_, err = NewAnonymizeOp(AnonymizationConfig{K: 2, QuasiIdentifiers: []Generalization{{"age", []string{"keepprefix(zip, 1)"}}}}, anonymizeTestRows())
+	if err == nil {
+		t.Errorf("expected a generalization reading another column to be rejected")
+	}
+}
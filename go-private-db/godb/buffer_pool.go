@@ -30,6 +30,7 @@ type BufferPool struct {
 	ExclusiveLocks     map[any]TransactionID
 	ActiveTransactions map[TransactionID]bool
 	WaitsFor           map[TransactionID]([]TransactionID)
+	endHooks           map[TransactionID]([]func(committed bool))
 }
 
 // Create a new BufferPool with the specified number of pages
@@ -82,7 +83,12 @@ func (bp *BufferPool) AbortTransaction(tid TransactionID) {
 			}
 		}
 	}
+	hooks := bp.endHooks[tid]
+	delete(bp.endHooks, tid)
 	bp.Mutex.Unlock()
+	for _, hook := range hooks {
+		hook(false)
+	}
 }
 
 // Commit the transaction, releasing locks. Because GoDB is FORCE/NO STEAL, none
@@ -116,7 +122,22 @@ func (bp *BufferPool) CommitTransaction(tid TransactionID) {
 			}
 		}
 	}
+	hooks := bp.endHooks[tid]
+	delete(bp.endHooks, tid)
 	bp.Mutex.Unlock()
+	for _, hook := range hooks {
+		hook(true)
+	}
+}
+
+// Calls hook with whether tid committed when tid commits or aborts.
+func (bp *BufferPool) onTransactionEnd(tid TransactionID, hook func(committed bool)) {
+	bp.Mutex.Lock()
+	defer bp.Mutex.Unlock()
+	if bp.endHooks == nil {
+		bp.endHooks = make(map[TransactionID]([]func(committed bool)))
+	}
+	bp.endHooks[tid] = append(bp.endHooks[tid], hook)
 }
 
 func (bp *BufferPool) BeginTransaction(tid TransactionID) error {
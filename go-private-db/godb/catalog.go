@@ -8,8 +8,30 @@ import (
 )
 
 type Table struct {
-	name string
-	desc TupleDesc
+	name        string
+	desc        TupleDesc
+	options     map[string]ColumnOptions
+	encryption  *EncryptionScheme  // nil for plaintext tables
+	keys        *EncryptionRef     // where the keys of encryption live, nil if it is not saved
+	suppression *SuppressionPolicy // small-cell suppression of aggregates over the table
+}
+
+// Per-table settings given after the column list in the catalog file,
+// e.g. "keys patients.keys subject id subject_keys subjects.keys" (see
+// EncryptTable) or "suppress 10:merge".
+type tableOptions struct {
+	keys        *EncryptionRef
+	suppression *SuppressionPolicy
+}
+
+// Per-column settings given after the column type in the catalog file,
+// e.g. "name string pad pow2 pii name", "age int clamp 0:120" or
+// "id string enc det".
+type ColumnOptions struct {
+	Padding    PaddingPolicy
+	PII        PIIClass         // detected class of personal data
+	Clamp      *ClampBounds     // bounds for differentially private sums
+	Encryption ColumnEncryption // see EncryptTable
 }
 
 type Catalog struct {
@@ -18,6 +40,17 @@ type Catalog struct {
 	columnMap map[string][]*Table
 	bp        *BufferPool
 	rootPath  string
+	role      string // role queries run as, see SetRole
+	masks     map[columnMaskKey]columnMask
+	vault     *TokenVault
+	privacy   *privacySettings // nil until a privacy policy or the ledger is used
+
+	suppression *SuppressionPolicy // session-wide small-cell suppression
+
+	user string         // user queries run as, "" for the superuser; see SetUser
+	acl  *accessControl // nil until users or grants are used
+
+	keyStores map[string]*KeyStore // key stores of encrypted tables by path
 }
 
 func (c *Catalog) SaveToFile(catalogFile string, rootPath string) error {
@@ -69,31 +102,147 @@ func ImportCatalogFromCSVs(catalogFile string, bp *BufferPool, rootPath string,
 	return nil
 }
 
-func parseCatalogFile(catalogFile string, rootPath string) ([]TupleDesc, []string, error) {
+func parseColumnOptions(opts []string, line string) (ColumnOptions, error) {
+	var options ColumnOptions
+	for i := 0; i < len(opts); i += 2 {
+		if i+1 >= len(opts) {
+			return options, GoDBError{ParseError, fmt.Sprintf("missing value for column option %s (line %s)", opts[i], line)}
+		}
+		switch opts[i] {
+		case "pad":
+			padding, err := ParsePaddingPolicy(opts[i+1])
+			if err != nil {
+				return options, err
+			}
+			options.Padding = padding
+		case "pii":
+			class, err := parsePIIClass(opts[i+1])
+			if err != nil {
+				return options, err
+			}
+			options.PII = class
+		case "clamp":
+			bounds, err := parseClampBounds(opts[i+1])
+			if err != nil {
+				return options, err
+			}
+			options.Clamp = bounds
+		case "enc":
+			enc, err := parseColumnEncryption(opts[i+1])
+			if err != nil {
+				return options, err
+			}
+			options.Encryption = enc
+		default:
+			return options, GoDBError{ParseError, fmt.Sprintf("unknown column option %s (line %s)", opts[i], line)}
+		}
+	}
+	return options, nil
+}
+
+func parseTableOptions(opts []string, line string) (tableOptions, error) {
+	var options tableOptions
+	for i := 0; i < len(opts); i += 2 {
+		if i+1 >= len(opts) {
+			return options, GoDBError{ParseError, fmt.Sprintf("missing value for table option %s (line %s)", opts[i], line)}
+		}
+		name := strings.ToLower(opts[i])
+		if name == "keys" || name == "subject" || name == "subject_keys" {
+			if options.keys == nil {
+				options.keys = &EncryptionRef{}
+			}
+		}
+		switch name {
+		case "keys":
+			options.keys.Keys = opts[i+1]
+		case "subject":
+			options.keys.Subject = strings.ToLower(opts[i+1])
+		case "subject_keys":
+			options.keys.SubjectKeys = opts[i+1]
+		case "suppress":
+			policy, err := ParseSuppressionPolicy(opts[i+1])
+			if err != nil {
+				return options, err
+			}
+			options.suppression = policy
+		default:
+			return options, GoDBError{ParseError, fmt.Sprintf("unknown table option %s (line %s)", opts[i], line)}
+		}
+	}
+	return options, nil
+}
+
+func (t *Table) optionsString() string {
+	str := t.keys.String()
+	if t.suppression != nil {
+		str += " suppress " + t.suppression.String()
+	}
+	return str
+}
+
+func (o ColumnOptions) String() string {
+	str := ""
+	if o.Padding.Kind != NoPadding {
+		str += " pad " + o.Padding.String()
+	}
+	if o.PII != PIINone {
+		str += " pii " + string(o.PII)
+	}
+	if o.Clamp != nil {
+		str += " clamp " + o.Clamp.String()
+	}
+	if o.Encryption.Kind != "" {
+		str += " enc " + o.Encryption.String()
+	}
+	return str
+}
+
+func parseCatalogFile(catalogFile string, rootPath string) ([]TupleDesc, []string, []map[string]ColumnOptions, []tableOptions, error) {
 	var tables []TupleDesc
 	var names []string
+	var options []map[string]ColumnOptions
+	var tablesOptions []tableOptions
 	f, err := os.Open(rootPath + "/" + catalogFile)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, nil, err
 	}
+	defer f.Close()
 	scanner := bufio.NewScanner(f)
 
 	for scanner.Scan() {
 		// code to read each line
-		line := strings.ToLower(scanner.Text())
+		line := scanner.Text()
 		sep := strings.Split(line, "(")
 		if len(sep) != 2 {
-			return nil, nil, GoDBError{ParseError, fmt.Sprintf("expected one paren in catalog entry, got %d (%s)", len(sep), line)}
+			return nil, nil, nil, nil, GoDBError{ParseError, fmt.Sprintf("expected one paren in catalog entry, got %d (%s)", len(sep), line)}
+		}
+		tableName := strings.ToLower(strings.TrimSpace(sep[0]))
+		// table options follow the closing paren and keep their case, which
+		// matters for key store paths
+		rest, trailer, _ := strings.Cut(sep[1], ")")
+		rest = strings.ToLower(rest)
+		tableOpts, err := parseTableOptions(strings.Fields(trailer), line)
+		if err != nil {
+			return nil, nil, nil, nil, err
 		}
-		tableName := strings.TrimSpace(sep[0])
-		rest := strings.Trim(sep[1], "()")
 		fields := strings.Split(rest, ",")
 		var fieldArray []FieldType
+		tableOptions := make(map[string]ColumnOptions)
 		for _, f := range fields {
 			f := strings.TrimSpace(f)
 			nameType := strings.Split(f, " ")
-			if len(nameType) != 2 {
-				return nil, nil, GoDBError{ParseError, fmt.Sprintf("malformed catalog entry %s (line %s)", nameType, line)}
+			if len(nameType) < 2 {
+				return nil, nil, nil, nil, GoDBError{ParseError, fmt.Sprintf("malformed catalog entry %s (line %s)", nameType, line)}
+			}
+			if len(nameType) > 2 {
+				opts, err := parseColumnOptions(nameType[2:], line)
+				if err != nil {
+					return nil, nil, nil, nil, err
+				}
+				if opts.Encryption.Kind != "" && tableOpts.keys == nil {
+					return nil, nil, nil, nil, GoDBError{ParseError, fmt.Sprintf("encrypted column %s without a key store (line %s)", nameType[0], line)}
+				}
+				tableOptions[nameType[0]] = opts
 			}
 			switch nameType[1] {
 			case "int":
@@ -107,24 +256,41 @@ func parseCatalogFile(catalogFile string, rootPath string) ([]TupleDesc, []strin
 			case "text":
 				fieldArray = append(fieldArray, FieldType{nameType[0], "", StringType})
 			default:
-				return nil, nil, GoDBError{ParseError, fmt.Sprintf("unknown type %s (line %s)", nameType[1], line)}
+				return nil, nil, nil, nil, GoDBError{ParseError, fmt.Sprintf("unknown type %s (line %s)", nameType[1], line)}
 			}
 		}
 		tables = append(tables, TupleDesc{fieldArray})
 		names = append(names, tableName)
+		options = append(options, tableOptions)
+		tablesOptions = append(tablesOptions, tableOpts)
 	}
-	return tables, names, nil
+	return tables, names, options, tablesOptions, nil
 
 }
 
 func NewCatalogFromFile(catalogFile string, bp *BufferPool, rootPath string) (*Catalog, error) {
-	tabs, names, err := parseCatalogFile(catalogFile, rootPath)
+	tabs, names, options, tablesOptions, err := parseCatalogFile(catalogFile, rootPath)
 	if err != nil {
 		return nil, err
 	}
-	c := &Catalog{make([]*Table, 0), make(map[string]*Table), make(map[string][]*Table), bp, rootPath}
+	c := &Catalog{make([]*Table, 0), make(map[string]*Table), make(map[string][]*Table), bp, rootPath, "", make(map[columnMaskKey]columnMask), nil, nil, nil, "", nil, nil}
 	for i, t := range tabs {
 		c.addTable(names[i], t)
+		table := c.tableMap[names[i]]
+		table.options = options[i]
+		table.suppression = tablesOptions[i].suppression
+		if ref := tablesOptions[i].keys; ref != nil {
+			// fail rather than write plaintext into an encrypted table
+			table.encryption, err = c.loadTableEncryption(names[i], &table.desc, options[i], ref, false)
+			if err != nil {
+				return nil, GoDBError{MalformedDataError, fmt.Sprintf("cannot restore the encryption of table %s: %s", names[i], err.Error())}
+			}
+			table.keys = ref
+		}
+	}
+	err = c.loadColumnMasks()
+	if err != nil {
+		return nil, err
 	}
 
 	return c, nil
@@ -134,7 +300,7 @@ func NewCatalogFromFile(catalogFile string, bp *BufferPool, rootPath string) (*C
 func (c *Catalog) addTable(named string, desc TupleDesc) error {
 	_, err := c.GetTable(named)
 	if err != nil {
-		t := &Table{named, desc}
+		t := &Table{named, desc, make(map[string]ColumnOptions), nil, nil, nil}
 		c.tables = append(c.tables, t)
 		c.tableMap[named] = t
 		for _, f := range desc.Fields {
@@ -164,6 +330,39 @@ func (c *Catalog) GetTable(named string) (DBFile, error) {
 
 }
 
+// Marks table as encrypted under e. The table's descriptor in the catalog is
+// that of the encrypted file; statements that write to the table encrypt
+// their tuples under e first. e only lives in memory: the catalog does not
+// record it, and drops what EncryptTable recorded for the table. Use
+// EncryptTable for schemes that must survive reopening the catalog.
+func (c *Catalog) SetTableEncryption(table string, e *EncryptionScheme) error {
+	t := c.tableMap[table]
+	if t == nil {
+		return GoDBError{NoSuchTableError, fmt.Sprintf("no table '%s' found", table)}
+	}
+	if e != nil {
+		if _, err := e.Subjects.keyedFields(e, &t.desc); err != nil {
+			return err
+		}
+	}
+	t.encryption = e
+	t.keys = nil
+	for fname, opts := range t.options {
+		opts.Encryption = ColumnEncryption{}
+		t.options[fname] = opts
+	}
+	return nil
+}
+
+// The encryption scheme of table, or nil if it is stored in plaintext.
+func (c *Catalog) tableEncryption(table string) *EncryptionScheme {
+	t := c.tableMap[table]
+	if t == nil {
+		return nil
+	}
+	return t.encryption
+}
+
 func (c *Catalog) findTablesWithColumn(named string) []*Table {
 	t := c.columnMap[named]
 	return t
@@ -187,9 +386,33 @@ func (c *Catalog) CatalogString() string {
 			if i != 0 {
 				fieldStr = fieldStr + ", "
 			}
-			fieldStr = fieldStr + f.Fname + " " + typeNames[f.Ftype]
+			fieldStr = fieldStr + f.Fname + " " + typeNames[f.Ftype] + t.options[f.Fname].String()
 		}
-		outStr = outStr + t.name + " " + fieldStr + ")\n"
+		outStr = outStr + t.name + " " + fieldStr + ")" + t.optionsString() + "\n"
 	}
 	return outStr
 }
+
+// Copies the padding policies of the columns of tables into e. Policies are
+// looked up by (table, column), but e pads columns by name, so a column name
+// padded differently in two of the tables is an error.
+func (c *Catalog) applyColumnPadding(e *EncryptionScheme, tables []string) error {
+	from := make(map[string]string) // column -> table its policy came from
+	for _, table := range tables {
+		t := c.tableMap[table]
+		if t == nil {
+			return GoDBError{NoSuchTableError, fmt.Sprintf("no table '%s' found", table)}
+		}
+		for _, f := range t.desc.Fields {
+			padding := t.options[f.Fname].Padding
+			if other, exists := from[f.Fname]; exists && other != table && e.Padding[f.Fname] != padding {
+				return GoDBError{IllegalOperationError, fmt.Sprintf("column %s is padded differently in tables %s and %s", f.Fname, other, table)}
+			}
+			from[f.Fname] = table
+			if padding.Kind != NoPadding {
+				e.Padding[f.Fname] = padding
+			}
+		}
+	}
+	return nil
+}
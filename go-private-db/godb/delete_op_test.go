@@ -1,6 +1,8 @@
 package godb
 
 import (
+	"os"
+	"strings"
 	"testing"
 )
 
@@ -58,3 +60,61 @@ func TestDelete(t *testing.T) {
 	}
 
 }
+
+func TestEncryptedDelete(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(dir+"/catalog.txt", []byte("t (name string, age int)\n"), 0600)
+	bp := NewBufferPool(3)
+	c, err := NewCatalogFromFile("catalog.txt", bp, dir)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	e := getDummyEncryptionScheme()
+	e.Kinds = map[string]EncryptionKind{"name": DetKind, "age": HomKind}
+	c.SetTableEncryption("t", &e)
+
+	tid := NewTID()
+	bp.BeginTransaction(tid)
+	run := func(sql string) (int64, error) {
+		_, op, err := Parse(c, sql)
+		if err != nil {
+			return 0, err
+		}
+		iter, _ := op.Iterator(tid)
+		tup, err := iter()
+		if err != nil {
+			return 0, err
+		}
+		return tup.Fields[0].(IntField).Value, nil
+	}
+	_, err = run("insert into t values ('sam', 25), ('george jones', 999), ('sam', 30)")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	deleted, err := run("delete from t where name = 'sam'")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if deleted != 2 {
+		t.Errorf("expected 2 deleted tuples, got %d", deleted)
+	}
+
+	_, err = run("delete from t where name > 'a'")
+	if err == nil || !strings.Contains(err.Error(), "order-preserving") {
+		t.Errorf("expected error for a range predicate on a deterministic column, got %v", err)
+	}
+	_, err = run("delete from t where age = 999")
+	if err == nil || !strings.Contains(err.Error(), "column age uses hom encryption") {
+		t.Errorf("expected error for a predicate on a homomorphic column, got %v", err)
+	}
+
+	e.Kinds["age"] = DetKind
+	deleted, err = run("delete from t where age = 999")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if deleted != 1 {
+		t.Errorf("expected 1 deleted tuple, got %d", deleted)
+	}
+}
@@ -0,0 +1,436 @@
+package godb
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sync"
+)
+
+// Differential privacy for aggregate queries. Roles with a PrivacyPolicy
+// only get noisy COUNT, SUM and AVG results over a single table, without
+// GROUP BY (whose group keys would be released exactly): the planner
+// clamps summed columns to the bounds declared in the catalog
+// ("age int clamp 0:120"), the Aggregator adds Laplace or Gaussian noise
+// calibrated to the clamped range, and every query is charged against the
+// session user's epsilon budget in a ledger kept next to the catalog, with
+// the policies. Results of an EncryptedAggregator get the same treatment on
+// the client, when they are decrypted with DecryptPrivateAggregate.
+
+type NoiseMechanism int
+
+const (
+	LaplaceMechanism NoiseMechanism = iota
+	GaussianMechanism
+)
+
+type PrivacyPolicy struct {
+	Epsilon   float64 // charged per query, split evenly over its aggregates
+	Delta     float64 // for the Gaussian mechanism
+	Mechanism NoiseMechanism
+}
+
+// Bounds values of a column are clamped to before they are summed.
+type ClampBounds struct {
+	Lower, Upper int64
+}
+
+func parseClampBounds(s string) (*ClampBounds, error) {
+	var b ClampBounds
+	_, err := fmt.Sscanf(s, "%d:%d", &b.Lower, &b.Upper)
+	if err != nil || b.Lower > b.Upper {
+		return nil, GoDBError{ParseError, fmt.Sprintf("invalid clamp bounds %s, expected lower:upper", s)}
+	}
+	return &b, nil
+}
+
+func (b *ClampBounds) String() string {
+	return fmt.Sprintf("%d:%d", b.Lower, b.Upper)
+}
+
+// the most one row can change a sum of clamped values
+func (b *ClampBounds) sensitivity() float64 {
+	return math.Max(math.Abs(float64(b.Lower)), math.Abs(float64(b.Upper)))
+}
+
+const (
+	privacyLedgerFile   = "privacy_ledger.json"
+	privacyPoliciesFile = "privacy_policies.json"
+)
+
+// Per-user epsilon budgets and what has been spent of them, saved (mode
+// 0600) every time they change.
+type PrivacyLedger struct {
+	path    string
+	mutex   sync.Mutex
+	Budgets map[string]float64 `json:"budgets"`
+	Spent   map[string]float64 `json:"spent"`
+}
+
+// Opens the ledger saved at path, or an empty one if path does not exist.
+func OpenPrivacyLedger(path string) (*PrivacyLedger, error) {
+	l := &PrivacyLedger{path: path, Budgets: make(map[string]float64), Spent: make(map[string]float64)}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, l)
+	if err != nil {
+		return nil, GoDBError{MalformedDataError, fmt.Sprintf("malformed privacy ledger %s: %s", path, err.Error())}
+	}
+	return l, nil
+}
+
+func (l *PrivacyLedger) save() error {
+	data, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(l.path, data, 0600)
+}
+
+// Sets the total epsilon user may spend. Users without a budget can spend
+// nothing.
+func (l *PrivacyLedger) SetBudget(user string, epsilon float64) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.Budgets[user] = epsilon
+	return l.save()
+}
+
+func (l *PrivacyLedger) Remaining(user string) float64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.Budgets[user] - l.Spent[user]
+}
+
+func (l *PrivacyLedger) spend(user string, epsilon float64) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.Spent[user]+epsilon > l.Budgets[user]+1e-9 {
+		return GoDBError{IllegalOperationError, fmt.Sprintf("privacy budget of '%s' exhausted (%.3g of %.3g spent)", user, l.Spent[user], l.Budgets[user])}
+	}
+	l.Spent[user] += epsilon
+	return l.save()
+}
+
+// The policies of roles, saved (mode 0600) every time they change, and the
+// ledger.
+type privacySettings struct {
+	path     string
+	Policies map[string]PrivacyPolicy `json:"policies"`
+	ledger   *PrivacyLedger
+}
+
+func (s *privacySettings) save() error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.path, data, 0600)
+}
+
+// Loads the policies and the ledger saved in the catalog's directory on
+// first use.
+func (c *Catalog) privacySettings() (*privacySettings, error) {
+	if c.privacy != nil {
+		return c.privacy, nil
+	}
+	ledger, err := OpenPrivacyLedger(c.rootPath + "/" + privacyLedgerFile)
+	if err != nil {
+		return nil, err
+	}
+	s := &privacySettings{path: c.rootPath + "/" + privacyPoliciesFile, Policies: make(map[string]PrivacyPolicy), ledger: ledger}
+	data, err := os.ReadFile(s.path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		err = json.Unmarshal(data, s)
+		if err != nil {
+			return nil, GoDBError{MalformedDataError, fmt.Sprintf("malformed privacy policies %s: %s", s.path, err.Error())}
+		}
+	}
+	c.privacy = s
+	return s, nil
+}
+
+// Restricts role to differentially private aggregates under policy. The
+// budgets of its users are set in the ledger (see Catalog.PrivacyLedger).
+// Only the superuser may set policies.
+func (c *Catalog) RequirePrivacy(role string, policy PrivacyPolicy) error {
+	err := c.checkSuperuser("set privacy policies")
+	if err != nil {
+		return err
+	}
+	if policy.Epsilon <= 0 {
+		return GoDBError{IllegalOperationError, "epsilon must be positive"}
+	}
+	if policy.Mechanism == GaussianMechanism && (policy.Delta <= 0 || policy.Delta >= 1) {
+		return GoDBError{IllegalOperationError, "the Gaussian mechanism needs 0 < delta < 1"}
+	}
+	s, err := c.privacySettings()
+	if err != nil {
+		return err
+	}
+	old, exists := s.Policies[role]
+	s.Policies[role] = policy
+	err = s.save()
+	if err != nil {
+		if exists {
+			s.Policies[role] = old
+		} else {
+			delete(s.Policies, role)
+		}
+	}
+	return err
+}
+
+// The privacy ledger stored in the catalog's directory.
+func (c *Catalog) PrivacyLedger() (*PrivacyLedger, error) {
+	s, err := c.privacySettings()
+	if err != nil {
+		return nil, err
+	}
+	return s.ledger, nil
+}
+
+// the strictest (smallest epsilon) policy of the session's roles, if any
+// has one
+func (c *Catalog) privacyPolicy() (*PrivacyPolicy, error) {
+	s, err := c.privacySettings()
+	if err != nil {
+		return nil, err
+	}
+	var strictest *PrivacyPolicy
+	for _, role := range c.sessionRoles() {
+		policy, exists := s.Policies[role]
+		if exists && (strictest == nil || policy.Epsilon < strictest.Epsilon) {
+			strictest = &policy
+		}
+	}
+	return strictest, nil
+}
+
+func (c *Catalog) columnClamp(table string, column string) *ClampBounds {
+	t := c.tableMap[table]
+	if t == nil {
+		return nil
+	}
+	return t.options[column].Clamp
+}
+
+// Noise added to the results of an Aggregator, one entry per aggregate state.
+type aggregateNoise struct {
+	policy        PrivacyPolicy
+	epsilon       float64   // per aggregate
+	sensitivities []float64 // of the sum of each aggregate; counts have sensitivity 1
+}
+
+// A uniform float in [0, 1) from crypto/rand.
+func secureFloat64() (float64, error) {
+	var b [8]byte
+	_, err := rand.Read(b[:])
+	if err != nil {
+		return 0, err
+	}
+	return float64(binary.BigEndian.Uint64(b[:])>>11) / (1 << 53), nil
+}
+
+// Noise for a statistic with the given sensitivity under epsilon.
+func (p PrivacyPolicy) noise(sensitivity float64, epsilon float64) (float64, error) {
+	u1, err := secureFloat64()
+	if err != nil {
+		return 0, err
+	}
+	if p.Mechanism == GaussianMechanism {
+		u2, err := secureFloat64()
+		if err != nil {
+			return 0, err
+		}
+		sigma := sensitivity * math.Sqrt(2*math.Log(1.25/p.Delta)) / epsilon
+		return sigma * math.Sqrt(-2*math.Log(1-u1)) * math.Cos(2*math.Pi*u2), nil
+	}
+	b := sensitivity / epsilon
+	u := u1 - 0.5
+	if u < 0 {
+		return b * math.Log(1+2*u), nil
+	}
+	return -b * math.Log(1-2*u), nil
+}
+
+func (p PrivacyPolicy) noisyInt(v int64, sensitivity float64, epsilon float64) (int64, error) {
+	noise, err := p.noise(sensitivity, epsilon)
+	if err != nil {
+		return 0, err
+	}
+	return int64(math.Round(float64(v) + noise)), nil
+}
+
+// noisy average from a sum and count, spending epsilon on both halves
+func (p PrivacyPolicy) noisyAvg(sum int64, count int64, sensitivity float64, epsilon float64) (int64, error) {
+	sumNoise, err := p.noise(sensitivity, epsilon/2)
+	if err != nil {
+		return 0, err
+	}
+	countNoise, err := p.noise(1, epsilon/2)
+	if err != nil {
+		return 0, err
+	}
+	noisyCount := math.Max(1, float64(count)+countNoise)
+	return int64(math.Round((float64(sum) + sumNoise) / noisyCount)), nil
+}
+
+// Replaces the aggregate fields at the end of t with noisy values.
+func (n *aggregateNoise) apply(states []AggState, t *Tuple) (*Tuple, error) {
+	fields := append([]DBValue{}, t.Fields...)
+	first := len(fields) - len(states)
+	for i, as := range states {
+		var v int64
+		var err error
+		switch as := as.(type) {
+		case *CountAggState:
+			v, err = n.policy.noisyInt(int64(as.count), 1, n.epsilon)
+		case *SumAggState[int64]:
+			v, err = n.policy.noisyInt(as.sum, n.sensitivities[i], n.epsilon)
+		case *AvgAggState[int64]:
+			v, err = n.policy.noisyAvg(as.sum, as.count, n.sensitivities[i], n.epsilon)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		fields[first+i] = IntField{v}
+	}
+	return &Tuple{t.Desc, fields, t.Rid}, nil
+}
+
+// Clamps e to b with the imin and imax functions.
+func clampExpr(e Expr, b *ClampBounds) Expr {
+	upper := Expr(&ConstExpr{IntField{b.Upper}, IntType})
+	lower := Expr(&ConstExpr{IntField{b.Lower}, IntType})
+	min := Expr(&FuncExpr{"imin", []*Expr{&e, &upper}})
+	return &FuncExpr{"imax", []*Expr{&min, &lower}}
+}
+
+// Checks that plan is a query a role under a privacy policy may run.
+func checkPrivatePlan(plan *LogicalPlan) error {
+	if len(plan.subqueries) > 0 || len(plan.tables) != 1 || len(plan.joins) > 0 {
+		return GoDBError{IllegalOperationError, "differentially private queries must aggregate a single table"}
+	}
+	if len(plan.aggs) == 0 {
+		return GoDBError{IllegalOperationError, "only aggregate results may be returned under differential privacy"}
+	}
+	if len(plan.groupByFields) > 0 {
+		return GoDBError{IllegalOperationError, "GROUP BY is not supported under differential privacy, since it releases the group keys exactly"}
+	}
+	for _, s := range plan.selects {
+		if s.exprType != ExprAggr {
+			return GoDBError{IllegalOperationError, "only aggregates may be selected under differential privacy"}
+		}
+	}
+	for _, a := range plan.aggs {
+		switch *a.funcOp {
+		case "count", "sum", "avg":
+		default:
+			return GoDBError{IllegalOperationError, fmt.Sprintf("%s is not supported under differential privacy", *a.funcOp)}
+		}
+	}
+	if plan.limit != nil {
+		return GoDBError{IllegalOperationError, "LIMIT is not supported under differential privacy"}
+	}
+	return nil
+}
+
+// Describes one aggregate of an encrypted result for DecryptPrivateAggregate.
+type DPAggregate struct {
+	Kind   string // count, sum or avg; avg results have a sum and a count field
+	Table  string // table and column summed by sum and avg
+	Column string
+}
+
+// Decrypts the result of an EncryptedAggregator with e and, if a role of
+// the session has a privacy policy, charges the user's budget and adds
+// noise to each aggregate. aggs must describe every field of the result.
+// Sums are noised for the clamping bounds the catalog declares for their
+// column, which the client must have clamped values to before encrypting
+// them.
+func (c *Catalog) DecryptPrivateAggregate(e *EncryptionScheme, t *Tuple, aggs []DPAggregate) (*Tuple, error) {
+	result, err := e.encryptOrDecryptTuple(t, false)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := c.privacyPolicy()
+	if err != nil {
+		return nil, err
+	}
+	if policy == nil {
+		return result, nil
+	}
+	width := 0
+	sensitivities := make([]float64, len(aggs))
+	for i, a := range aggs {
+		switch a.Kind {
+		case "count":
+			width++
+			continue
+		case "sum":
+			width++
+		case "avg":
+			width += 2
+		default:
+			return nil, GoDBError{IllegalOperationError, fmt.Sprintf("%s is not supported under differential privacy", a.Kind)}
+		}
+		bounds := c.columnClamp(a.Table, a.Column)
+		if bounds == nil {
+			return nil, GoDBError{IllegalOperationError, fmt.Sprintf("column %s.%s needs clamping bounds for differentially private %s", a.Table, a.Column, a.Kind)}
+		}
+		sensitivities[i] = bounds.sensitivity()
+	}
+	if len(aggs) == 0 || width != len(result.Fields) {
+		return nil, GoDBError{IllegalOperationError, fmt.Sprintf("aggregates describe %d of the result's %d fields; every field must be noised", width, len(result.Fields))}
+	}
+	for _, f := range result.Fields {
+		if _, ok := f.(IntField); !ok {
+			return nil, GoDBError{MalformedDataError, "aggregate results must be ints"}
+		}
+	}
+	err = c.privacy.ledger.spend(c.user, policy.Epsilon)
+	if err != nil {
+		return nil, err
+	}
+	epsilon := policy.Epsilon / float64(len(aggs))
+	fields := append([]DBValue{}, result.Fields...)
+	noise := func(i int, sensitivity float64, epsilon float64) error {
+		v, err := policy.noisyInt(fields[i].(IntField).Value, sensitivity, epsilon)
+		fields[i] = IntField{v}
+		return err
+	}
+	i := 0
+	for j, a := range aggs {
+		switch a.Kind {
+		case "count":
+			err = noise(i, 1, epsilon)
+		case "sum":
+			err = noise(i, sensitivities[j], epsilon)
+		case "avg":
+			err = noise(i, sensitivities[j], epsilon/2)
+			if err == nil {
+				i++
+				err = noise(i, 1, epsilon/2)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		i++
+	}
+	return &Tuple{result.Desc, fields, nil}, nil
+}
@@ -0,0 +1,183 @@
+package godb
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"testing"
+)
+
+func dpTestCatalog(t *testing.T) (*Catalog, TransactionID, string) {
+	dir := t.TempDir()
+	os.WriteFile(dir+"/catalog.txt", []byte("t (name string, age int clamp 0:100, visits int)\n"), 0600)
+	bp := NewBufferPool(3)
+	c, err := NewCatalogFromFile("catalog.txt", bp, dir)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	var values []string
+	for i := 0; i < 50; i++ {
+		age := 20 + i
+		if i == 0 {
+			age = 1000 // clamped to 100
+		}
+		values = append(values, fmt.Sprintf("('p%d', %d, %d)", i, age, i%3))
+	}
+	tid := NewTID()
+	bp.BeginTransaction(tid)
+	_, op, err := Parse(c, "insert into t values "+strings.Join(values, ", "))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	iter, _ := op.Iterator(tid)
+	_, err = iter()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	return c, tid, dir
+}
+
+func TestPrivateAggregates(t *testing.T) {
+	c, tid, dir := dpTestCatalog(t)
+	if !strings.Contains(c.CatalogString(), "age int clamp 0:100") {
+		t.Errorf("expected clamp bounds in catalog, got %s", c.CatalogString())
+	}
+	if c.RequirePrivacy("researcher", PrivacyPolicy{Epsilon: 1, Mechanism: GaussianMechanism}) == nil {
+		t.Errorf("expected the Gaussian mechanism to need a delta")
+	}
+	err := c.RequirePrivacy("researcher", PrivacyPolicy{Epsilon: 1})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	c.RequirePrivacy("analyst", PrivacyPolicy{Epsilon: 1e9, Delta: 1e-6, Mechanism: GaussianMechanism})
+	for _, sql := range []string{
+		"create user rita",
+		"create user ann",
+		"create role researcher",
+		"create role analyst",
+		"grant researcher to rita",
+		"grant analyst to ann",
+		"grant select on t to researcher",
+		"grant select on t to analyst",
+	} {
+		mustParse(t, c, sql)
+	}
+	ledger, _ := c.PrivacyLedger()
+	ledger.SetBudget("rita", 2.5)
+	ledger.SetBudget("ann", 1e10)
+	c.SetUser("rita")
+
+	for _, sql := range []string{
+		"select name from t",
+		"select sum(visits) from t",
+		"select max(age) from t",
+		"select name, count(*) from t group by visits",
+		"select visits, sum(age) from t group by visits",
+		"select count(*) from t group by visits",
+	} {
+		_, _, err := Parse(c, sql)
+		if err == nil {
+			t.Errorf("expected %s to be rejected under differential privacy", sql)
+		}
+	}
+
+	rows := queryRows(t, c, tid, "select count(*) from t")
+	if n := rows[0].Fields[0].(IntField).Value; n < 30 || n > 70 {
+		t.Errorf("noisy count %d too far from 50", n)
+	}
+	rows = queryRows(t, c, tid, "select sum(age) from t")
+	if n := rows[0].Fields[0].(IntField).Value; n < 1300 || n > 3300 {
+		t.Errorf("noisy sum %d too far from the clamped sum", n)
+	}
+	_, _, err = Parse(c, "select count(*) from t")
+	if err == nil || !strings.Contains(err.Error(), "budget") {
+		t.Errorf("expected the exhausted budget to reject the query, got %v", err)
+	}
+	reloaded, err := OpenPrivacyLedger(dir + "/" + privacyLedgerFile)
+	if err != nil || reloaded.Spent["rita"] != 2 || reloaded.Budgets["rita"] != 2.5 {
+		t.Errorf("expected the ledger to be persisted, got %+v (%v)", reloaded, err)
+	}
+
+	// policies survive reopening the catalog
+	c2, err := NewCatalogFromFile("catalog.txt", NewBufferPool(3), dir)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	c2.SetUser("rita")
+	if _, _, err = Parse(c2, "select name from t"); err == nil {
+		t.Errorf("expected the privacy policy to persist")
+	}
+
+	// with a huge epsilon the noise vanishes and only clamping shows
+	asSuperuser(c)
+	c.SetUser("ann")
+	rows = queryRows(t, c, tid, "select sum(age), avg(age) from t")
+	exact := int64(100)
+	for i := 1; i < 50; i++ {
+		exact += int64(20 + i)
+	}
+	if rows[0].Fields[0] != (IntField{exact}) || rows[0].Fields[1] != (IntField{int64(math.Round(float64(exact) / 50))}) {
+		t.Errorf("expected clamped sum %d, got %v", exact, rows[0].Fields)
+	}
+
+	asSuperuser(c)
+	rows = queryRows(t, c, tid, "select max(age) from t")
+	if rows[0].Fields[0] != (IntField{1000}) {
+		t.Errorf("expected roles without a policy to see exact results, got %v", rows[0].Fields[0])
+	}
+}
+
+func TestDecryptPrivateAggregate(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(dir+"/catalog.txt", []byte("t (age int clamp 0:100, visits int)\n"), 0600)
+	c, err := NewCatalogFromFile("catalog.txt", NewBufferPool(3), dir)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	e := getDummyEncryptionScheme()
+	desc := TupleDesc{Fields: []FieldType{{Fname: "age", Ftype: IntType}}}
+	encrypted := &Tuple{desc, []DBValue{IntField{101}}, nil}
+	aggs := []DPAggregate{{Kind: "sum", Table: "t", Column: "age"}}
+
+	result, err := c.DecryptPrivateAggregate(&e, encrypted, aggs)
+	if err != nil || result.Fields[0] != (IntField{100}) {
+		t.Errorf("expected exact decryption without a policy, got %v (%v)", result, err)
+	}
+
+	c.RequirePrivacy("researcher", PrivacyPolicy{Epsilon: 1e9})
+	mustParse(t, c, "create user rita")
+	mustParse(t, c, "create role researcher")
+	mustParse(t, c, "grant researcher to rita")
+	ledger, _ := c.PrivacyLedger()
+	ledger.SetBudget("rita", 2e9)
+	c.SetUser("rita")
+
+	// rejected before anything is charged
+	two := &Tuple{TupleDesc{Fields: []FieldType{{Fname: "age", Ftype: IntType}, {Fname: "count", Ftype: IntType}}}, []DBValue{IntField{101}, IntField{1}}, nil}
+	for name, rejected := range map[string][]DPAggregate{
+		"no aggregates":         nil,
+		"a field left exact":    aggs,
+		"column without bounds": {{Kind: "sum", Table: "t", Column: "visits"}, {Kind: "count"}},
+	} {
+		if _, err = c.DecryptPrivateAggregate(&e, two, rejected); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	if ledger.Remaining("rita") != 2e9 {
+		t.Errorf("expected rejected decryptions not to be charged")
+	}
+
+	result, err = c.DecryptPrivateAggregate(&e, encrypted, aggs)
+	if err != nil || result.Fields[0] != (IntField{100}) {
+		t.Errorf("expected negligible noise, got %v (%v)", result, err)
+	}
+	result, err = c.DecryptPrivateAggregate(&e, two, []DPAggregate{{Kind: "avg", Table: "t", Column: "age"}})
+	if err != nil || result.Fields[1] != (IntField{1}) {
+		t.Errorf("expected negligible noise on an average's count, got %v (%v)", result, err)
+	}
+	_, err = c.DecryptPrivateAggregate(&e, encrypted, aggs)
+	if err == nil {
+		t.Errorf("expected the third decryption to exceed the budget")
+	}
+}
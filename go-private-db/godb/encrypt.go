@@ -2,23 +2,54 @@ package godb
 
 import (
 	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
 	"encoding/binary"
-	"fmt"
 	"strconv"
 
-	"github.com/getamis/alice/crypto/homo"
-	"github.com/getamis/alice/crypto/homo/paillier"
 	"github.com/tink-crypto/tink-go/daead/subtle"
 )
 
+// What kind of encryption a column uses, which determines the operations
+// the server can evaluate on it.
+type EncryptionKind string
+
+const (
+	PlaintextKind EncryptionKind = "plaintext"
+	RndKind       EncryptionKind = "rnd" // randomized; no server-side operations
+	DetKind       EncryptionKind = "det" // deterministic; equality
+	OreKind       EncryptionKind = "ore" // order-revealing; equality and order
+	HomKind       EncryptionKind = "hom" // additively homomorphic; sums
+)
+
 type EncryptionScheme struct {
 	EncryptMethods                 map[string](func(v any) (any, error))
 	DefaultEncrypt                 func(v any) (any, error)
 	DecryptMethods                 map[string](func(v any) (any, error))
 	DefaultDecrypt                 func(v any) (any, error)
 	IntFieldEncryptedAsStringField map[string]bool
-	PaillierMap                    map[string](*(paillier.Paillier))
-	PublicKeys                     map[string](*homo.Pubkey)
+	HomKeys                        *HomomorphicKeyRing // keys of homomorphically encrypted columns
+	PublicKeys                     map[string](*HomomorphicPubKey)
+	Pipeline                       EncryptionPipelineConfig
+	MAC                            *RowMAC                  // if set, encrypted rows carry authentication tags
+	Padding                        map[string]PaddingPolicy // string columns padded before encryption
+	Kinds                          map[string]EncryptionKind
+	DefaultKind                    EncryptionKind // kind of columns using DefaultEncrypt
+	Subjects                       *SubjectKeys   // if set, randomized columns are also encrypted under per-subject keys
+}
+
+// The kind of encryption used for column fname. Columns of unknown kind
+// are treated as randomized.
+func (e *EncryptionScheme) kind(fname string) EncryptionKind {
+	kind, exists := e.Kinds[fname]
+	if !exists {
+		kind = e.DefaultKind
+	}
+	if kind == "" {
+		return RndKind
+	}
+	return kind
 }
 
 func (e *EncryptionScheme) getMethod(fname string, encrypt bool) func(v any) (any, error) {
@@ -39,51 +70,110 @@ func (e *EncryptionScheme) getMethod(fname string, encrypt bool) func(v any) (an
 	}
 }
 
+// Encrypts a constant compared against column fname, padding it like the
+// column's values so deterministic ciphertexts still match.
 func (e *EncryptionScheme) encryptVal(value string, fname string) (string, error) {
 	method := e.getMethod(fname, true)
+	value, err := e.Padding[fname].pad(value)
+	if err != nil {
+		return "", err
+	}
 	res, err := method(value)
-	return res.(string), err
+	if err != nil {
+		return "", err
+	}
+	return res.(string), nil
 }
 
 func (e *EncryptionScheme) encryptOrDecryptTuple(t *Tuple, encrypt bool) (*Tuple, error) {
+	if !encrypt && e.MAC != nil && e.MAC.hasColumns(&t.Desc) {
+		verified, err := e.MAC.verify(t)
+		if err != nil {
+			return nil, err
+		}
+		t = verified
+	}
+
 	fields := make([]DBValue, len(t.Fields))
+	subjectKeyed, err := e.Subjects.keyedFields(e, &t.Desc)
+	if err != nil {
+		return nil, err
+	}
 	for i := 0; i < len(t.Desc.Fields); i++ {
-		fname := t.Desc.Fields[i].Fname
-		method := e.getMethod(fname, encrypt)
-		_, swappedTypes := e.IntFieldEncryptedAsStringField[fname]
-		if swappedTypes && encrypt {
-			encryptedField, err := method(t.Fields[i].(IntField).Value)
-			if err != nil {
-				return nil, err
-			}
-			fields[i] = StringField{Value: encryptedField.(string)}
-		} else if swappedTypes && !encrypt {
-			encryptedField, err := method(t.Fields[i].(StringField).Value)
-			if err != nil {
-				return nil, err
-			}
-			fields[i] = IntField{Value: encryptedField.(int64)}
-		} else if t.Desc.Fields[i].Ftype == StringType {
-			encryptedField, err := method(t.Fields[i].(StringField).Value)
+		if subjectKeyed != nil && subjectKeyed[i] {
+			continue
+		}
+		field, err := e.encryptOrDecryptField(t.Desc.Fields[i], t.Fields[i], encrypt)
+		if err != nil {
+			return nil, err
+		}
+		fields[i] = field
+	}
+	if subjectKeyed != nil {
+		err := e.Subjects.encryptOrDecryptFields(e, t, fields, subjectKeyed, encrypt)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if encrypt && e.MAC != nil {
+		return e.MAC.sign(&Tuple{Desc: t.Desc, Fields: fields})
+	}
+	return &Tuple{Desc: t.Desc, Fields: fields}, nil
+}
+
+// Encrypts (or decrypts) value v of field ft with the column's method.
+func (e *EncryptionScheme) encryptOrDecryptField(ft FieldType, v DBValue, encrypt bool) (DBValue, error) {
+	fname := ft.Fname
+	method := e.getMethod(fname, encrypt)
+	_, swappedTypes := e.IntFieldEncryptedAsStringField[fname]
+	if swappedTypes && encrypt {
+		encryptedField, err := method(v.(IntField).Value)
+		if err != nil {
+			return nil, err
+		}
+		return StringField{Value: encryptedField.(string)}, nil
+	} else if swappedTypes && !encrypt {
+		encryptedField, err := method(v.(StringField).Value)
+		if err != nil {
+			return nil, err
+		}
+		return IntField{Value: encryptedField.(int64)}, nil
+	} else if ft.Ftype == StringType {
+		padding := e.Padding[fname]
+		value := v.(StringField).Value
+		if encrypt {
+			padded, err := padding.pad(value)
 			if err != nil {
 				return nil, err
 			}
-			fields[i] = StringField{Value: encryptedField.(string)}
-		} else if t.Desc.Fields[i].Ftype == IntType {
-			encryptedField, err := method(t.Fields[i].(IntField).Value)
+			value = padded
+		}
+		encryptedField, err := method(value)
+		if err != nil {
+			return nil, err
+		}
+		value = encryptedField.(string)
+		if !encrypt {
+			value, err = padding.unpad(value)
 			if err != nil {
 				return nil, err
 			}
-			fields[i] = IntField{Value: encryptedField.(int64)}
 		}
+		return StringField{Value: value}, nil
+	} else if ft.Ftype == IntType {
+		encryptedField, err := method(v.(IntField).Value)
+		if err != nil {
+			return nil, err
+		}
+		return IntField{Value: encryptedField.(int64)}, nil
 	}
-	return &Tuple{Desc: t.Desc, Fields: fields}, nil
+	return nil, nil
 }
 
-func (e *EncryptionScheme) encryptOrDecrypt(hf *HeapFile, toFile string, encrypt bool, tid TransactionID) (*HeapFile, error) {
-	bp := NewBufferPool(3)
-
-	newDesc := hf.desc.copy()
+// Returns the descriptor of tuples with descriptor desc after encryption
+// (or decryption) under e.
+func (e *EncryptionScheme) encryptedDesc(desc *TupleDesc, encrypt bool) *TupleDesc {
+	newDesc := desc.copy()
 	for i := 0; i < len(newDesc.Fields); i++ {
 		_, swappedTypes := e.IntFieldEncryptedAsStringField[newDesc.Fields[i].Fname]
 		if swappedTypes && encrypt {
@@ -92,23 +182,34 @@ func (e *EncryptionScheme) encryptOrDecrypt(hf *HeapFile, toFile string, encrypt
 			newDesc.Fields[i].Ftype = IntType
 		}
 	}
+	if e.MAC != nil && encrypt {
+		newDesc.Fields = append(newDesc.Fields, e.MAC.fields()...)
+	} else if e.MAC != nil && e.MAC.hasColumns(newDesc) {
+		newDesc.Fields = newDesc.Fields[:len(newDesc.Fields)-2]
+	}
+	return newDesc
+}
+
+func (e *EncryptionScheme) encryptOrDecrypt(hf *HeapFile, toFile string, encrypt bool, tid TransactionID) (*HeapFile, error) {
+	bp := NewBufferPool(3)
 
-	_hf, err := NewHeapFile(toFile, newDesc, bp)
+	_hf, err := NewHeapFile(toFile, e.encryptedDesc(hf.desc, encrypt), bp)
 	if err != nil {
 		return nil, err
 	}
 
-	iter, _ := hf.Iterator(tid)
-	for {
-		t, _ := iter()
-		if t == nil {
-			break
-		}
-		encryptedTuple, err := e.encryptOrDecryptTuple(t, encrypt)
-		if err != nil {
-			return nil, err
-		}
-		_hf.insertTuple(encryptedTuple, tid)
+	iter, err := hf.Iterator(tid)
+	if err != nil {
+		return nil, err
+	}
+	if !encrypt && e.MAC != nil {
+		iter = e.MAC.uniqueRowIDs(iter)
+	}
+	err = e.pipelineTuples(iter, encrypt, func(t *Tuple) error {
+		return _hf.insertTuple(t, tid)
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	return _hf, nil
@@ -172,120 +273,124 @@ func newDetDecryptionFunc(key []byte) func(v any) (any, error) {
 	}
 }
 
-func newHomEncryptionFunc(keysize int) (func(v any) (any, error), func(v any) (any, error), homo.Pubkey) {
-	pall, err := paillier.NewPaillier(keysize)
+// Randomized encryption with AES-256-GCM under key: a fresh nonce is drawn
+// for every value and prepended to its ciphertext. Ints are encrypted as
+// their decimal strings.
+func newRndEncryptionFunc(key []byte) (func(v any) (any, error), error) {
+	aead, err := newGCM(key)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-
-	encrypt := func(v any) (any, error) {
+	return func(v any) (any, error) {
+		var buf []byte
 		if intValue, ok := v.(int64); ok {
-
-			buf := new(bytes.Buffer)
-			err := binary.Write(buf, binary.BigEndian, intValue)
-			if err != nil {
-				fmt.Println("binary.Write failed:", err)
-			}
-			byts := buf.Bytes()
-
-			result, err := pall.Encrypt(byts)
-			if err != nil {
-				return nil, err
-			} else {
-				return string(result), nil
-			}
+			buf = []byte(strconv.FormatInt(intValue, 10))
+		} else if stringValue, ok := v.(string); ok {
+			buf = []byte(stringValue)
 		} else {
-			panic("cannot encrypt unsupported type!")
+			return nil, GoDBError{TypeMismatchError, "randomized encryption only supports ints and strings"}
 		}
-	}
-
-	decrypt := func(v any) (any, error) {
-		b := []byte(v.(string))
+		nonce := make([]byte, aead.NonceSize())
+		_, err := rand.Read(nonce)
 		if err != nil {
 			return nil, err
 		}
+		return string(aead.Seal(nonce, nonce, buf, nil)), nil
+	}, nil
+}
 
-		d, err := pall.Decrypt(b)
-
+func newRndDecryptionFunc(key []byte) (func(v any) (any, error), error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return func(v any) (any, error) {
+		stringValue, ok := v.(string)
+		if !ok {
+			return nil, GoDBError{TypeMismatchError, "randomized ciphertexts must be strings"}
+		}
+		n := aead.NonceSize()
+		if len(stringValue) < n {
+			return nil, GoDBError{MalformedDataError, "randomized ciphertext is too short"}
+		}
+		result, err := aead.Open(nil, []byte(stringValue[:n]), []byte(stringValue[n:]), nil)
 		if err != nil {
-			return nil, err
+			return nil, GoDBError{IntegrityError, "randomized ciphertext failed to decrypt: wrong key or corrupted value"}
 		}
+		return string(result), nil
+	}, nil
+}
 
-		dByte := make([]byte, 8)
-		copy(dByte[8-len(d):], d)
-		dInt := binary.BigEndian.Uint64(dByte)
-		return int64(dInt), nil
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
 	}
+	return cipher.NewGCM(block)
+}
 
-	return encrypt, decrypt, pall.GetPubKey()
+// Paillier encrypt and decrypt functions under a fresh key. If poolConfig
+// has a positive Size, randomizers are precomputed in the background until
+// the returned stop function is called.
+func newHomEncryptionFunc(keysize int, poolConfig RandomizerPoolConfig) (func(v any) (any, error), func(v any) (any, error), HomomorphicPubKey, func()) {
+	scheme, err := NewHomomorphicScheme(PaillierSchemeKind, keysize)
+	if err != nil {
+		panic(err)
+	}
+	pooled := scheme.(RandomizerPooledScheme)
+	err = pooled.StartRandomizerPool(poolConfig)
+	if err != nil {
+		panic(err)
+	}
+	encrypt, decrypt, pk := newHomEncryptionFuncFromScheme(NewHomomorphicKeyRing(scheme))
+	return encrypt, decrypt, pk, pooled.StopRandomizerPool
 }
 
+// Returns a function encrypting int64s under a fresh Paillier key, which is
+// added to e.HomKeys as its current key. Ciphertexts are enveloped []bytes.
 func (e *EncryptionScheme) newHomEncryptionFunc(keysize int) func(v any) (any, error) {
-	pall, err := paillier.NewPaillier(keysize)
+	scheme, err := NewHomomorphicScheme(PaillierSchemeKind, keysize)
 	if err != nil {
 		panic(err)
 	}
+	if e.HomKeys == nil {
+		e.HomKeys = NewHomomorphicKeyRing()
+	}
+	e.HomKeys.Rotate(scheme)
+	keys := e.HomKeys
 
 	return func(v any) (any, error) {
 		if intValue, ok := v.(int64); ok {
-
 			buf := new(bytes.Buffer)
 			err := binary.Write(buf, binary.BigEndian, intValue)
-			if err != nil {
-				fmt.Println("binary.Write failed:", err)
-			}
-			byts := buf.Bytes()
-
-			result, err := pall.Encrypt(byts)
-			e.PaillierMap[string(result)] = pall
-
 			if err != nil {
 				return nil, err
-			} else {
-				return result, nil
 			}
+			return keys.Encrypt(buf.Bytes())
 		} else {
-			panic("cannot encrypt unsupported type!")
+			return nil, GoDBError{TypeMismatchError, "homomorphic encryption only supports ints"}
 		}
 	}
 }
 
+// Returns a function decrypting enveloped ciphertexts under any key in
+// e.HomKeys into big-endian plaintext bytes.
 func (e *EncryptionScheme) newHomDecryptionFunc() func(v any) (any, error) {
-
 	return func(v any) (any, error) {
-		pall, exists := e.PaillierMap[string(v.([]byte))]
-
-		if !exists {
-			panic("cannot decrypt unencrypted type!")
+		c, ok := v.([]byte)
+		if !ok {
+			return nil, GoDBError{TypeMismatchError, "homomorphic ciphertexts must be []byte"}
 		}
-
-		result, err := pall.Decrypt(v.([]byte))
-
-		if err != nil {
-			return nil, err
-		} else {
-			return result, nil
+		if e.HomKeys == nil {
+			return nil, GoDBError{IllegalOperationError, "encryption scheme has no homomorphic keys"}
 		}
+		return e.HomKeys.Decrypt(c)
 	}
 }
 
 func (e *EncryptionScheme) homAdd(v1 []byte, v2 []byte) ([]byte, error) {
-	pall1, exists := e.PaillierMap[string(v1)]
-	if !exists {
-		panic("cannot add unencrypted type!")
-	}
-
-	pall2, exists := e.PaillierMap[string(v2)]
-	if !exists {
-		panic("cannot add unencrypted type!")
+	if e.HomKeys == nil {
+		return nil, GoDBError{IllegalOperationError, "encryption scheme has no homomorphic keys"}
 	}
-
-	if pall1 != pall2 {
-		panic("cannot add encrypted types with different schemes!")
-	}
-
-	sum, _ := pall1.Add(v1, v2)
-	e.PaillierMap[string(sum)] = pall1
-
-	return sum, nil
+	return e.HomKeys.Add(v1, v2)
 }
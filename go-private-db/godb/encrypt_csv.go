@@ -0,0 +1,78 @@
+package godb
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// Tuples inserted per transaction by EncryptCSV. Each commit flushes the
+// transaction's dirty pages, so this bounds how many pages an import holds
+// in the buffer pool.
+const encryptCSVCommitEvery = 64
+
+// Parses CSV rows with descriptor desc from in, encrypts them under e and
+// appends them to the heap file toFile (created if it does not exist) using
+// buffer pool bp. Plaintext rows only ever exist in memory; nothing but
+// ciphertext is written to disk. Encryption runs on the pipeline configured
+// by e.Pipeline. Commits the rows in batches and returns the number
+// committed. On an error the failed batch is rolled back and the count is
+// the number of leading data rows of in that toFile holds, so an import can
+// resume after them.
+func EncryptCSV(e *EncryptionScheme, desc *TupleDesc, in io.Reader, hasHeader bool, sep string, toFile string, bp *BufferPool) (*HeapFile, int, error) {
+	hf, err := NewHeapFile(toFile, e.encryptedDesc(desc, true), bp)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	scanner := bufio.NewScanner(in)
+	lineNo := 0
+	next := func() (*Tuple, error) {
+		for scanner.Scan() {
+			lineNo++
+			fields, err := splitCSVLine(desc, scanner.Text(), sep, lineNo, false)
+			if err != nil {
+				return nil, err
+			}
+			if lineNo == 1 && hasHeader {
+				continue
+			}
+			return csvFieldsToTuple(desc, fields, lineNo)
+		}
+		return nil, scanner.Err()
+	}
+
+	tid := NewTID()
+	bp.BeginTransaction(tid)
+	inserted, committed := 0, 0
+	err = e.pipelineTuples(next, true, func(t *Tuple) error {
+		err := hf.insertTuple(t, tid)
+		if err != nil {
+			return err
+		}
+		inserted++
+		if inserted%encryptCSVCommitEvery == 0 {
+			bp.CommitTransaction(tid)
+			committed = inserted
+			tid = NewTID()
+			bp.BeginTransaction(tid)
+		}
+		return nil
+	})
+	if err != nil {
+		bp.AbortTransaction(tid)
+		return hf, committed, partialWriteError(err, committed, toFile)
+	}
+	bp.CommitTransaction(tid)
+	return hf, inserted, nil
+}
+
+// Reports that a batched write to toFile failed after committing committed
+// rows, keeping the code of err if it has one.
+func partialWriteError(err error, committed int, toFile string) error {
+	code := MalformedDataError
+	if gerr, ok := err.(GoDBError); ok {
+		code = gerr.code
+	}
+	return GoDBError{code, fmt.Sprintf("%s (%d rows were committed to %s before the error)", err.Error(), committed, toFile)}
+}
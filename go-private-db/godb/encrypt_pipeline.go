@@ -0,0 +1,166 @@
+package godb
+
+import (
+	"runtime"
+)
+
+const defaultPipelineBatchSize = 64
+
+// Controls how encryptOrDecrypt spreads work over goroutines. The zero value
+// uses one worker per CPU, batches of defaultPipelineBatchSize tuples, and
+// preserves the order of the input file.
+type EncryptionPipelineConfig struct {
+	// number of worker goroutines; <= 0 means runtime.NumCPU()
+	Parallelism int
+
+	// tuples handed to a worker at a time; <= 0 means defaultPipelineBatchSize
+	BatchSize int
+
+	// if set, batches are written as soon as they finish rather than in
+	// input order
+	Unordered bool
+
+	// if non-nil, called on the calling goroutine after each batch is
+	// written with the total number of tuples written so far
+	Progress func(done int)
+}
+
+func (c EncryptionPipelineConfig) parallelism() int {
+	if c.Parallelism <= 0 {
+		return runtime.NumCPU()
+	}
+	return c.Parallelism
+}
+
+func (c EncryptionPipelineConfig) batchSize() int {
+	if c.BatchSize <= 0 {
+		return defaultPipelineBatchSize
+	}
+	return c.BatchSize
+}
+
+type pipelineBatch struct {
+	seq    int
+	tuples []*Tuple
+	err    error
+}
+
+// Reads every tuple from iter, encrypts (or decrypts) batches of them on a
+// pool of workers and passes the results to emit on the calling goroutine.
+// Only the reader goroutine calls iter and only the calling goroutine calls
+// emit, so neither needs to be safe for concurrent use; the scheme's encrypt
+// and decrypt methods must be.
+func (e *EncryptionScheme) pipelineTuples(iter func() (*Tuple, error), encrypt bool, emit func(t *Tuple) error) error {
+	config := e.Pipeline
+	numWorkers := config.parallelism()
+	batchSize := config.batchSize()
+
+	// closed when we return early so the reader and workers stop
+	done := make(chan struct{})
+	defer close(done)
+
+	jobs := make(chan pipelineBatch, numWorkers)
+	results := make(chan pipelineBatch, numWorkers)
+
+	go func() {
+		defer close(jobs)
+		seq := 0
+		batch := make([]*Tuple, 0, batchSize)
+		for {
+			t, err := iter()
+			if err != nil {
+				select {
+				case jobs <- pipelineBatch{seq: seq, err: err}:
+				case <-done:
+				}
+				return
+			}
+			if t != nil {
+				batch = append(batch, t)
+			}
+			if len(batch) == batchSize || (t == nil && len(batch) > 0) {
+				select {
+				case jobs <- pipelineBatch{seq: seq, tuples: batch}:
+				case <-done:
+					return
+				}
+				seq++
+				batch = make([]*Tuple, 0, batchSize)
+			}
+			if t == nil {
+				return
+			}
+		}
+	}()
+
+	workersDone := make(chan struct{})
+	for i := 0; i < numWorkers; i++ {
+		go func() {
+			defer func() { workersDone <- struct{}{} }()
+			for job := range jobs {
+				if job.err == nil {
+					out := make([]*Tuple, len(job.tuples))
+					for j, t := range job.tuples {
+						out[j], job.err = e.encryptOrDecryptTuple(t, encrypt)
+						if job.err != nil {
+							break
+						}
+					}
+					job.tuples = out
+				}
+				select {
+				case results <- job:
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		for i := 0; i < numWorkers; i++ {
+			<-workersDone
+		}
+		close(results)
+	}()
+
+	written := 0
+	next := 0
+	pending := make(map[int]pipelineBatch)
+	write := func(b pipelineBatch) error {
+		for _, t := range b.tuples {
+			if err := emit(t); err != nil {
+				return err
+			}
+		}
+		written += len(b.tuples)
+		if config.Progress != nil {
+			config.Progress(written)
+		}
+		return nil
+	}
+
+	for b := range results {
+		if b.err != nil {
+			return b.err
+		}
+		if config.Unordered {
+			if err := write(b); err != nil {
+				return err
+			}
+			continue
+		}
+		pending[b.seq] = b
+		for {
+			ready, exists := pending[next]
+			if !exists {
+				break
+			}
+			delete(pending, next)
+			next++
+			if err := write(ready); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
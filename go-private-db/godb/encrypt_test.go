@@ -5,9 +5,8 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"strings"
 	"testing"
-
-	"github.com/getamis/alice/crypto/homo/paillier"
 )
 
 func getDummyEncryptionScheme() EncryptionScheme {
@@ -55,100 +54,125 @@ func getDummyEncryptionScheme() EncryptionScheme {
 		return v, nil
 	}
 
-	paillierMap := make(map[string](*(paillier.Paillier)))
-
 	return EncryptionScheme{
 		EncryptMethods: encryptMethods,
 		DefaultEncrypt: defaultEncrypt,
 		DecryptMethods: decryptMethods,
 		DefaultDecrypt: defaultEncrypt,
-		PaillierMap:    paillierMap,
 	}
 }
 
 func CSVToEncryptedDat(desc TupleDesc, inputFilename string, resultFileName string, sql string) (*HeapFile, EncryptionScheme) {
-	// assumes there are no .dat files with the below name
-	tempFileName := inputFilename + ".dat"
-	os.Remove(tempFileName)
-	os.Remove(resultFileName)
-	defer os.Remove(tempFileName)
-
-	// Make heapfile for csv file
-	bp := NewBufferPool(10)
-	hf, err := NewHeapFile(tempFileName, &desc, bp)
+	err, e := translateQuery(sql)
 	if err != nil {
-		print("ERROR MAKING TEST VARS, BLARGH")
 		panic(err.Error())
 	}
+	return CSVToEncryptedDatGivenE(desc, inputFilename, resultFileName, e), e
+}
 
-	//bp.BeginTransaction(nil)
+func CSVToEncryptedDatGivenE(desc TupleDesc, inputFilename string, resultFileName string, e EncryptionScheme) *HeapFile {
+	os.Remove(resultFileName)
 
-	// Reading from CSV
 	f, err := os.Open(inputFilename)
-	defer f.Close()
 	if err != nil {
 		panic("GenerateCSVToEncryptedDat: couldn't open csv file")
 	}
-	err = hf.LoadFromCSV(f, true, ",", false)
-	if err != nil {
-		panic(err.Error())
-	}
-
-	// Generating encrypted file
-	os.Remove(resultFileName)
-	err, e := translateQuery(sql)
-	if err != nil {
-		panic(err.Error())
-	}
+	defer f.Close()
 
-	encryptedHf, err := e.encryptOrDecrypt(hf, resultFileName, true, nil)
+	bp := NewBufferPool(10)
+	encryptedHf, _, err := EncryptCSV(&e, &desc, f, true, ",", resultFileName, bp)
 	if err != nil {
 		panic(err.Error())
 	}
-
-	// Emptying bufferpool
-	encryptedHf.bufPool.FlushAllPages()
-	return encryptedHf, e
+	return encryptedHf
 }
 
-func CSVToEncryptedDatGivenE(desc TupleDesc, inputFilename string, resultFileName string, e EncryptionScheme) *HeapFile {
-	// assumes there are no .dat files with the below name
-	tempFileName := inputFilename + ".dat"
-	os.Remove(tempFileName)
-	os.Remove(resultFileName)
-	defer os.Remove(tempFileName)
-
-	// Make heapfile for csv file
-	bp := NewBufferPool(10)
-	hf, err := NewHeapFile(tempFileName, &desc, bp)
+func TestEncryptCSV(t *testing.T) {
+	dir := t.TempDir()
+	csvFile := dir + "/people.csv"
+	err := os.WriteFile(csvFile, []byte("name,age\nsam,25\ngeorge jones,999\n"), 0600)
 	if err != nil {
-		print("ERROR MAKING TEST VARS, BLARGH")
-		panic(err.Error())
+		t.Fatalf(err.Error())
 	}
+	td, t1, t2, _, _, tid := makeTestVars()
 
-	//bp.BeginTransaction(nil)
-
-	// Reading from CSV
-	f, err := os.Open(inputFilename)
+	f, _ := os.Open(csvFile)
+	defer f.Close()
+	e := getDummyEncryptionScheme()
+	bp := NewBufferPool(3)
+	hf, n, err := EncryptCSV(&e, &td, f, true, ",", dir+"/people.dat", bp)
 	if err != nil {
-		panic("GenerateCSVToEncryptedDat: couldn't open csv file")
+		t.Fatalf(err.Error())
 	}
-	err = hf.LoadFromCSV(f, true, ",", false)
-	if err != nil {
-		panic(err.Error())
+	if n != 2 {
+		t.Errorf("expected 2 rows committed, got %d", n)
 	}
 
-	// Generating encrypted file
-	os.Remove(resultFileName)
-
-	encryptedHf, err := e.encryptOrDecrypt(hf, resultFileName, true, nil)
-	if err != nil {
-		panic(err.Error())
+	// only the csv and the encrypted file should exist
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 2 {
+		t.Errorf("expected only the csv and encrypted file in %s, got %d entries", dir, len(entries))
 	}
 
-	// Emptying bufferpool
-	encryptedHf.bufPool.FlushAllPages()
-	return encryptedHf
+	iter, _ := hf.Iterator(tid)
+	i := 0
+	for {
+		tp, _ := iter()
+		if tp == nil {
+			break
+		}
+		decrypted, err := e.encryptOrDecryptTuple(tp, false)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if !decrypted.equals(&t1) && !decrypted.equals(&t2) {
+			t.Errorf("tuple encrypted incorrectly: %v", tp.Fields)
+		}
+		i++
+	}
+	if i != 2 {
+		t.Errorf("expected 2 tuples, got %d", i)
+	}
+
+	// malformed rows are reported, not panicked on
+	bad := dir + "/bad.csv"
+	os.WriteFile(bad, []byte("name,age\nsam,notanumber\n"), 0600)
+	f2, _ := os.Open(bad)
+	defer f2.Close()
+	_, _, err = EncryptCSV(&e, &td, f2, true, ",", dir+"/bad.dat", bp)
+	if err == nil {
+		t.Errorf("expected error for malformed csv row")
+	}
+
+	// a failure after the first batch reports the rows that were committed
+	var rows strings.Builder
+	rows.WriteString("name,age\n")
+	for i := 0; i < encryptCSVCommitEvery+10; i++ {
+		rows.WriteString("sam,25\n")
+	}
+	rows.WriteString("sam,notanumber\n")
+	partial := dir + "/partial.csv"
+	os.WriteFile(partial, []byte(rows.String()), 0600)
+	f3, _ := os.Open(partial)
+	defer f3.Close()
+	hf, n, err = EncryptCSV(&e, &td, f3, true, ",", dir+"/partial.dat", bp)
+	if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("%d rows were committed", encryptCSVCommitEvery)) {
+		t.Errorf("expected the error to report the committed rows, got %v", err)
+	}
+	if n != encryptCSVCommitEvery {
+		t.Errorf("expected %d rows committed, got %d", encryptCSVCommitEvery, n)
+	}
+	tid = NewTID()
+	bp.BeginTransaction(tid)
+	iter, _ = hf.Iterator(tid)
+	i = 0
+	for tp, _ := iter(); tp != nil; tp, _ = iter() {
+		i++
+	}
+	bp.CommitTransaction(tid)
+	if i != n {
+		t.Errorf("expected the file to hold the %d committed rows, got %d", n, i)
+	}
 }
 
 // to encrypt a csv file: modify the file name variables, then run this test
@@ -277,6 +301,71 @@ func TestHeapFileDecryption(t *testing.T) {
 	}
 }
 
+func TestParallelEncryptionPreservesOrder(t *testing.T) {
+	td, _, _, hf, _, tid := makeTestVars()
+	n := 150
+	for i := 0; i < n; i++ {
+		tup := Tuple{Desc: td, Fields: []DBValue{StringField{fmt.Sprintf("p%d", i)}, IntField{int64(i)}}}
+		hf.insertTuple(&tup, tid)
+	}
+
+	e := getDummyEncryptionScheme()
+	lastProgress := 0
+	e.Pipeline = EncryptionPipelineConfig{
+		Parallelism: 4,
+		BatchSize:   7,
+		Progress: func(done int) {
+			if done <= lastProgress {
+				t.Errorf("progress went from %d to %d", lastProgress, done)
+			}
+			lastProgress = done
+		},
+	}
+	os.Remove("parallel_encrypted_test.dat")
+	defer os.Remove("parallel_encrypted_test.dat")
+	encryptedHf, err := e.encryptOrDecrypt(hf, "parallel_encrypted_test.dat", true, tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if lastProgress != n {
+		t.Errorf("expected final progress %d, got %d", n, lastProgress)
+	}
+
+	iter, _ := encryptedHf.Iterator(tid)
+	i := 0
+	for {
+		tp, _ := iter()
+		if tp == nil {
+			break
+		}
+		if tp.Fields[1].(IntField).Value != int64(i)+1 || tp.Fields[0].(StringField).Value != fmt.Sprintf("p%dabc", i) {
+			t.Errorf("tuple %d out of order or encrypted incorrectly: %v", i, tp.Fields)
+		}
+		i++
+	}
+	if i != n {
+		t.Errorf("expected %d tuples, got %d", n, i)
+	}
+}
+
+func TestParallelEncryptionError(t *testing.T) {
+	_, t1, t2, hf, _, tid := makeTestVars()
+	hf.insertTuple(&t1, tid)
+	hf.insertTuple(&t2, tid)
+
+	e := getDummyEncryptionScheme()
+	e.EncryptMethods["age"] = func(v any) (any, error) {
+		return nil, GoDBError{MalformedDataError, "cannot encrypt"}
+	}
+	e.Pipeline = EncryptionPipelineConfig{Parallelism: 2, BatchSize: 1, Unordered: true}
+	os.Remove("parallel_encrypted_test.dat")
+	defer os.Remove("parallel_encrypted_test.dat")
+	_, err := e.encryptOrDecrypt(hf, "parallel_encrypted_test.dat", true, tid)
+	if err == nil {
+		t.Errorf("expected encryption error to be returned")
+	}
+}
+
 func TestDetEncryptionInt64(t *testing.T) {
 	key := []byte("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
 	encryptFunc := newDetEncryptionFunc(key)
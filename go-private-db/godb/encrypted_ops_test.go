@@ -722,3 +722,94 @@ func TestEncryptedCountAggVertiJoinDistinct(t *testing.T) {
 		t.Errorf("unexpected sum or count")
 	}
 }
+
+// / Parallel Encrypted Aggregation Test ///
+func TestParallelEncryptedAgg(t *testing.T) {
+	scheme, err := NewHomomorphicScheme(PaillierSchemeKind, testHomKeySize)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	encrypt, decrypt, pk := newHomEncryptionFuncFromScheme(scheme)
+
+	td := TupleDesc{Fields: []FieldType{
+		{Fname: "name", Ftype: StringType},
+		{Fname: "age", Ftype: StringType},
+	}}
+	os.Remove("parallel_agg_test.dat")
+	defer os.Remove("parallel_agg_test.dat")
+	bp := NewBufferPool(3)
+	hf, err := NewHeapFile("parallel_agg_test.dat", &td, bp)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	tid := NewTID()
+	bp.BeginTransaction(tid)
+
+	n := 150
+	var sum int64
+	groupSums := make(map[string]int64)
+	for i := 0; i < n; i++ {
+		c, _ := encrypt(int64(i))
+		group := fmt.Sprintf("g%d", i%3)
+		tup := Tuple{Desc: td, Fields: []DBValue{StringField{group}, StringField{c.(string)}}}
+		hf.insertTuple(&tup, tid)
+		sum += int64(i)
+		groupSums[group] += int64(i)
+	}
+
+	expr := FieldExpr{FieldType{Fname: "age", Ftype: StringType}}
+	sa := EncryptedSumAggState[string]{}
+	sa.Init("sum", &expr, stringAggGetter, pk)
+	aa := EncryptedAvgAggState[string]{}
+	aa.Init("avg", &expr, stringAggGetter, pk)
+	ca := EncryptedCountAggState{}
+	ca.Init("count", &expr, stringAggGetter, pk)
+
+	agg := NewParallelEncryptedAggregator([]EncryptedAggState{&sa, &aa, &ca}, hf, 4)
+	iter, err := agg.Iterator(tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	tup, err := iter()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	gotSum, _ := decrypt(tup.Fields[0].(StringField).Value)
+	gotAvgSum, _ := decrypt(tup.Fields[1].(StringField).Value)
+	if gotSum.(int64) != sum || gotAvgSum.(int64) != sum {
+		t.Errorf("expected sums of %d, got %v and %v", sum, gotSum, gotAvgSum)
+	}
+	if tup.Fields[2].(IntField).Value != int64(n) || tup.Fields[3].(IntField).Value != int64(n) {
+		t.Errorf("expected counts of %d, got %v", n, tup.Fields[2:])
+	}
+	if tup, _ = iter(); tup != nil {
+		t.Errorf("expected a single result tuple")
+	}
+
+	// grouped
+	gby := FieldExpr{FieldType{Fname: "name", Ftype: StringType}}
+	grouped := &EncryptedAggregator{[]Expr{&gby}, []EncryptedAggState{&sa}, hf, 4, nil}
+	iter, err = grouped.Iterator(tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	groups := 0
+	for {
+		tup, err := iter()
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if tup == nil {
+			break
+		}
+		groups++
+		group := tup.Fields[0].(StringField).Value
+		got, _ := decrypt(tup.Fields[1].(StringField).Value)
+		if got.(int64) != groupSums[group] {
+			t.Errorf("group %s: expected sum %d, got %v", group, groupSums[group], got)
+		}
+	}
+	if groups != len(groupSums) {
+		t.Errorf("expected %d groups, got %d", len(groupSums), groups)
+	}
+}
@@ -0,0 +1,282 @@
+package godb
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"sync"
+)
+
+// Homomorphic ciphertexts are wrapped in an envelope naming the format
+// version, the scheme kind and the id of the key they were encrypted under:
+//
+//	version | len(kind) | kind | len(key id) | key id | ciphertext
+//
+// so ciphertexts under different keys (e.g. before and after a rotation)
+// can live side by side and every operation finds its key by id.
+const envelopeVersion byte = 1
+
+type CiphertextEnvelope struct {
+	Version byte
+	Kind    string
+	KeyID   string
+	Body    []byte
+}
+
+func (env CiphertextEnvelope) bytes() []byte {
+	b := []byte{env.Version, byte(len(env.Kind))}
+	b = append(b, env.Kind...)
+	b = append(b, byte(len(env.KeyID)))
+	b = append(b, env.KeyID...)
+	return append(b, env.Body...)
+}
+
+func parseEnvelope(b []byte) (CiphertextEnvelope, error) {
+	var env CiphertextEnvelope
+	if len(b) < 2 {
+		return env, GoDBError{MalformedDataError, "ciphertext is too short to have an envelope"}
+	}
+	env.Version = b[0]
+	if env.Version != envelopeVersion {
+		return env, GoDBError{MalformedDataError, fmt.Sprintf("unsupported ciphertext envelope version %d", env.Version)}
+	}
+	b = b[1:]
+	readString := func() (string, bool) {
+		if len(b) < 1 || len(b) < 1+int(b[0]) {
+			return "", false
+		}
+		s := string(b[1 : 1+int(b[0])])
+		b = b[1+int(b[0]):]
+		return s, true
+	}
+	var ok1, ok2 bool
+	env.Kind, ok1 = readString()
+	env.KeyID, ok2 = readString()
+	if !ok1 || !ok2 {
+		return env, GoDBError{MalformedDataError, "malformed ciphertext envelope"}
+	}
+	env.Body = b
+	return env, nil
+}
+
+// Identifies a homomorphic key by a hash of its kind and public key.
+func homomorphicKeyID(scheme HomomorphicPubKey, kind string) string {
+	h := sha256.New()
+	h.Write([]byte(kind))
+	h.Write(scheme.ToPubKeyBytes())
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// A HomomorphicKeyRing holds every generation of homomorphic key of a
+// database. It is itself a HomomorphicScheme: it encrypts under the current
+// key and wraps ciphertexts in envelopes, and decrypts and aggregates
+// ciphertexts under any of its keys. Ciphertexts under different keys
+// cannot be added.
+type HomomorphicKeyRing struct {
+	mutex   sync.RWMutex
+	keys    map[string]HomomorphicScheme
+	current string
+}
+
+// Creates a key ring with the given keys; the last one is current.
+func NewHomomorphicKeyRing(schemes ...HomomorphicScheme) *HomomorphicKeyRing {
+	r := &HomomorphicKeyRing{keys: make(map[string]HomomorphicScheme)}
+	for _, s := range schemes {
+		r.Rotate(s)
+	}
+	return r
+}
+
+// Adds scheme to the ring and makes it the key new values are encrypted
+// under. Returns its key id.
+func (r *HomomorphicKeyRing) Rotate(scheme HomomorphicScheme) string {
+	id := homomorphicKeyID(scheme, scheme.Kind())
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.keys[id] = scheme
+	r.current = id
+	return id
+}
+
+func (r *HomomorphicKeyRing) CurrentKeyID() string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.current
+}
+
+func (r *HomomorphicKeyRing) currentKey() (string, HomomorphicScheme, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if r.current == "" {
+		return "", nil, GoDBError{IllegalOperationError, "homomorphic key ring has no keys"}
+	}
+	return r.current, r.keys[r.current], nil
+}
+
+// Opens an envelope and finds the key it names.
+func (r *HomomorphicKeyRing) open(c []byte) (CiphertextEnvelope, HomomorphicScheme, error) {
+	env, err := parseEnvelope(c)
+	if err != nil {
+		return env, nil, err
+	}
+	r.mutex.RLock()
+	scheme, exists := r.keys[env.KeyID]
+	r.mutex.RUnlock()
+	if !exists {
+		return env, nil, GoDBError{IllegalOperationError, fmt.Sprintf("no homomorphic key with id %s", env.KeyID)}
+	}
+	if scheme.Kind() != env.Kind {
+		return env, nil, GoDBError{MalformedDataError, fmt.Sprintf("ciphertext claims scheme %s, but key %s is %s", env.Kind, env.KeyID, scheme.Kind())}
+	}
+	return env, scheme, nil
+}
+
+func (r *HomomorphicKeyRing) Encrypt(m []byte) ([]byte, error) {
+	id, scheme, err := r.currentKey()
+	if err != nil {
+		return nil, err
+	}
+	c, err := scheme.Encrypt(m)
+	if err != nil {
+		return nil, err
+	}
+	return CiphertextEnvelope{envelopeVersion, scheme.Kind(), id, c}.bytes(), nil
+}
+
+func (r *HomomorphicKeyRing) Add(c1 []byte, c2 []byte) ([]byte, error) {
+	env1, scheme, err := r.open(c1)
+	if err != nil {
+		return nil, err
+	}
+	env2, _, err := r.open(c2)
+	if err != nil {
+		return nil, err
+	}
+	if env1.KeyID != env2.KeyID {
+		return nil, GoDBError{IllegalOperationError, fmt.Sprintf("cannot add ciphertexts under different keys %s and %s", env1.KeyID, env2.KeyID)}
+	}
+	sum, err := scheme.Add(env1.Body, env2.Body)
+	if err != nil {
+		return nil, err
+	}
+	env1.Body = sum
+	return env1.bytes(), nil
+}
+
+func (r *HomomorphicKeyRing) MulConst(c []byte, scalar *big.Int) ([]byte, error) {
+	env, scheme, err := r.open(c)
+	if err != nil {
+		return nil, err
+	}
+	product, err := scheme.MulConst(env.Body, scalar)
+	if err != nil {
+		return nil, err
+	}
+	env.Body = product
+	return env.bytes(), nil
+}
+
+func (r *HomomorphicKeyRing) Decrypt(c []byte) ([]byte, error) {
+	env, scheme, err := r.open(c)
+	if err != nil {
+		return nil, err
+	}
+	return scheme.Decrypt(env.Body)
+}
+
+// The public key of the current key.
+func (r *HomomorphicKeyRing) ToPubKeyBytes() []byte {
+	_, scheme, err := r.currentKey()
+	if err != nil {
+		return nil
+	}
+	return scheme.ToPubKeyBytes()
+}
+
+// Returns the ring's public keys, which aggregate enveloped ciphertexts
+// under any of the ring's keys.
+func (r *HomomorphicKeyRing) GetPubKey() HomomorphicPubKey {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	pub := &HomomorphicKeyRing{keys: make(map[string]HomomorphicScheme), current: r.current}
+	for id, s := range r.keys {
+		pub.keys[id] = publicOnlyScheme{s.GetPubKey(), s.Kind()}
+	}
+	return pub
+}
+
+const HomomorphicKeyRingKind string = "keyring"
+
+func (r *HomomorphicKeyRing) Kind() string {
+	return HomomorphicKeyRingKind
+}
+
+type keyRingEntry struct {
+	ID   string
+	Kind string
+	Priv []byte
+}
+
+type keyRingFile struct {
+	Current string
+	Keys    []keyRingEntry
+}
+
+// Serializes every key in the ring with its id; LoadHomomorphicKeyRing
+// reverses it. Ids are stored rather than recomputed, since a reloaded key
+// need not serialize its public key identically.
+func (r *HomomorphicKeyRing) ToPrivKeyBytes() []byte {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	f := keyRingFile{Current: r.current}
+	for id, s := range r.keys {
+		f.Keys = append(f.Keys, keyRingEntry{id, s.Kind(), s.ToPrivKeyBytes()})
+	}
+	b, _ := json.Marshal(f)
+	return b
+}
+
+func LoadHomomorphicKeyRing(bs []byte) (*HomomorphicKeyRing, error) {
+	var f keyRingFile
+	err := json.Unmarshal(bs, &f)
+	if err != nil {
+		return nil, GoDBError{MalformedDataError, "malformed homomorphic key ring: " + err.Error()}
+	}
+	r := NewHomomorphicKeyRing()
+	for _, k := range f.Keys {
+		s, err := LoadHomomorphicScheme(k.Kind, k.Priv)
+		if err != nil {
+			return nil, err
+		}
+		r.keys[k.ID] = s
+	}
+	if _, exists := r.keys[f.Current]; !exists {
+		return nil, GoDBError{MalformedDataError, "homomorphic key ring's current key is missing"}
+	}
+	r.current = f.Current
+	return r, nil
+}
+
+// A public key standing in for a scheme in the public copy of a key ring.
+type publicOnlyScheme struct {
+	HomomorphicPubKey
+	kind string
+}
+
+func (s publicOnlyScheme) Decrypt(c []byte) ([]byte, error) {
+	return nil, GoDBError{IllegalOperationError, "cannot decrypt with a public key"}
+}
+
+func (s publicOnlyScheme) GetPubKey() HomomorphicPubKey {
+	return s.HomomorphicPubKey
+}
+
+func (s publicOnlyScheme) ToPrivKeyBytes() []byte {
+	return nil
+}
+
+func (s publicOnlyScheme) Kind() string {
+	return s.kind
+}
@@ -0,0 +1,87 @@
+package godb
+
+import (
+	"testing"
+)
+
+func TestHomomorphicKeyRingRotation(t *testing.T) {
+	old, err := NewHomomorphicScheme(PaillierSchemeKind, testHomKeySize)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	keys := NewHomomorphicKeyRing(old)
+	encrypt, decrypt, pk := newHomEncryptionFuncFromScheme(keys)
+
+	c1, _ := encrypt(int64(20))
+	c2, _ := encrypt(int64(22))
+	oldID := keys.CurrentKeyID()
+
+	next, err := NewHomomorphicScheme(ECElGamalSchemeKind, 0)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	newID := keys.Rotate(next)
+	if newID == oldID {
+		t.Fatalf("expected a new key id after rotation")
+	}
+	c3, _ := encrypt(int64(5))
+
+	env, err := parseEnvelope([]byte(c3.(string)))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if env.Version != envelopeVersion || env.Kind != ECElGamalSchemeKind || env.KeyID != newID {
+		t.Errorf("unexpected envelope %d %s %s", env.Version, env.Kind, env.KeyID)
+	}
+
+	// old and new generations decrypt side by side
+	for c, expected := range map[string]int64{c1.(string): 20, c2.(string): 22, c3.(string): 5} {
+		v, err := decrypt(c)
+		if err != nil || v.(int64) != expected {
+			t.Errorf("expected %d, got %v (%v)", expected, v, err)
+		}
+	}
+
+	// sums are computed with the public key of the ciphertexts' generation
+	sum, err := pk.Add([]byte(c1.(string)), []byte(c2.(string)))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	v, _ := decrypt(string(sum))
+	if v.(int64) != 42 {
+		t.Errorf("expected sum 42, got %v", v)
+	}
+	_, err = pk.Add(sum, []byte(c3.(string)))
+	if err == nil {
+		t.Errorf("expected error adding ciphertexts under different keys")
+	}
+
+	// the key ring survives serialization
+	loaded, err := LoadHomomorphicKeyRing(keys.ToPrivKeyBytes())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if loaded.CurrentKeyID() != newID {
+		t.Errorf("expected current key %s after loading, got %s", newID, loaded.CurrentKeyID())
+	}
+	p, err := loaded.Decrypt(sum)
+	if err != nil || p[len(p)-1] != 42 {
+		t.Errorf("expected loaded key ring to decrypt the old generation, got %v (%v)", p, err)
+	}
+
+	// unknown versions and keys are rejected
+	bad := append([]byte{}, sum...)
+	bad[0] = envelopeVersion + 1
+	_, err = keys.Decrypt(bad)
+	if err == nil {
+		t.Errorf("expected error for an unknown envelope version")
+	}
+	_, err = NewHomomorphicKeyRing(next).Decrypt(sum)
+	if err == nil {
+		t.Errorf("expected error decrypting without the ciphertext's key")
+	}
+	_, err = pk.(HomomorphicScheme).Decrypt(sum)
+	if err == nil {
+		t.Errorf("expected the public key ring to refuse decryption")
+	}
+}
@@ -1,8 +1,12 @@
 package godb
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"math/rand"
+	"strings"
 	"time"
 )
 
@@ -92,6 +96,11 @@ var funcs = map[string]FuncType{
 	"epochtodatetimestring": {[]DBType{IntType}, StringType, dateString},
 	"imin":                  {[]DBType{IntType, IntType}, IntType, minFunc},
 	"imax":                  {[]DBType{IntType, IntType}, IntType, maxFunc},
+	"maskssn":               {[]DBType{StringType}, StringType, maskSSNFunc},
+	"pseudonym":             {[]DBType{StringType}, StringType, pseudonymFunc},
+	"truncyear":             {[]DBType{StringType}, StringType, truncYearFunc},
+	"agebucket":             {[]DBType{IntType, IntType}, StringType, ageBucketFunc},
+	"keepprefix":            {[]DBType{StringType, IntType}, StringType, keepPrefixFunc},
 }
 
 func ListOfFunctions() string {
@@ -115,6 +124,8 @@ func ListOfFunctions() string {
 		args = args + ")"
 		fList = fList + "\t" + name + args + "\n"
 	}
+	// bound to the catalog's token vault rather than listed in funcs
+	fList = fList + "\ttokenize(string)\n\tdetokenize(string)\n"
 	return fList
 }
 func minFunc(args []any) any {
@@ -135,6 +146,86 @@ func maxFunc(args []any) any {
 	return second
 }
 
+// Masks all but the last four digits of an SSN, e.g. ***-**-1234.
+func maskSSNFunc(args []any) any {
+	digits := ""
+	for _, r := range args[0].(string) {
+		if r >= '0' && r <= '9' {
+			digits += string(r)
+		}
+	}
+	if len(digits) < 4 {
+		return "***-**-****"
+	}
+	return "***-**-" + digits[len(digits)-4:]
+}
+
+var pseudonymKey []byte
+
+// Sets the key of the pseudonym function. Without a key, pseudonyms of
+// low-entropy values such as SSNs could be reversed by hashing every
+// candidate value, so pseudonym fails until a key is set.
+func SetPseudonymKey(key []byte) {
+	pseudonymKey = key
+}
+
+// Sets the key of the pseudonym function to the key store's pseudonym key,
+// creating it the first time, so pseudonyms stay stable across sessions.
+func LoadPseudonymKey(ks *KeyStore) error {
+	key, err := ks.GetOrCreateKey("pseudonym", sha256.Size)
+	if err != nil {
+		return err
+	}
+	SetPseudonymKey(key)
+	return nil
+}
+
+// A stable pseudonym for a value: a prefix of its keyed hash.
+func pseudonymFunc(args []any) any {
+	mac := hmac.New(sha256.New, pseudonymKey)
+	mac.Write([]byte(args[0].(string)))
+	return "p" + hex.EncodeToString(mac.Sum(nil))[:15]
+}
+
+// Truncates a YYYY-MM-DD or M/D/YYYY date to the first day of its year.
+func truncYearFunc(args []any) any {
+	for _, layout := range []string{"2006-01-02", "1/2/2006"} {
+		tt, err := time.Parse(layout, strings.TrimSpace(args[0].(string)))
+		if err == nil {
+			return tt.Format("2006") + "-01-01"
+		}
+	}
+	return ""
+}
+
+// The bucket of the given width an age falls in, e.g. 30-39.
+func ageBucketFunc(args []any) any {
+	age := args[0].(int64)
+	width := args[1].(int64)
+	if width <= 0 {
+		width = 10
+	}
+	low := age - age%width
+	if age < 0 {
+		low = age - (width+age%width)%width
+	}
+	return fmt.Sprintf("%d-%d", low, low+width-1)
+}
+
+// Keeps the first n characters of a string and stars out the rest, e.g.
+// 021** for a zip code.
+func keepPrefixFunc(args []any) any {
+	s := args[0].(string)
+	n := int(args[1].(int64))
+	if n < 0 {
+		n = 0
+	}
+	if n >= len(s) {
+		return s
+	}
+	return s[:n] + strings.Repeat("*", len(s)-n)
+}
+
 func dateTimeToEpoch(args []any) any {
 	inString := args[0].(string)
 	tt, err := time.Parse(time.UnixDate, inString)
@@ -218,6 +309,9 @@ func (f *FuncExpr) EvalExpr(t *Tuple) (DBValue, error) {
 	if len(f.args) != len(fType.argTypes) {
 		return nil, GoDBError{ParseError, fmt.Sprintf("function %s expected %d args", f.op, len(fType.argTypes))}
 	}
+	if f.op == "pseudonym" && len(pseudonymKey) == 0 {
+		return nil, GoDBError{IllegalOperationError, "pseudonym needs a key; set one with LoadPseudonymKey"}
+	}
 	argvals := make([]any, len(fType.argTypes))
 	for i, argType := range fType.argTypes {
 		arg := *f.args[i]
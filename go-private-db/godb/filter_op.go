@@ -56,6 +56,7 @@ func (f *Filter[T]) Descriptor() *TupleDesc {
 // the predicate.
 // HINT: you can use the evalPred function defined in types.go to compare two values
 func (f *Filter[T]) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
+	bindVaultExprs(tid, f.left, f.right)
 	iter, err := f.child.Iterator(tid)
 	if err != nil {
 		return nil, err
@@ -25,6 +25,7 @@ type HeapFile struct {
 	desc    *TupleDesc
 	file    string
 	Mutex   sync.Mutex
+	cipher  *pageCipher // nil unless pages are encrypted at rest
 }
 
 // Create a HeapFile.
@@ -76,6 +77,46 @@ func (f *HeapFile) NumPagesWithoutLock() int {
 	return int(bytes) / PageSize
 }
 
+// Splits line number lineNo of a CSV file, checking that it has as many
+// fields as desc.
+func splitCSVLine(desc *TupleDesc, line string, sep string, lineNo int, skipLastField bool) ([]string, error) {
+	fields := strings.Split(line, sep)
+	if skipLastField {
+		fields = fields[0 : len(fields)-1]
+	}
+	numFields := len(fields)
+	if desc == nil || desc.Fields == nil {
+		return nil, GoDBError{MalformedDataError, "Descriptor was nil"}
+	}
+	if numFields != len(desc.Fields) {
+		return nil, GoDBError{MalformedDataError, fmt.Sprintf("LoadFromCSV:  line %d (%s) does not have expected number of fields (expected %d, got %d)", lineNo, line, len(desc.Fields), numFields)}
+	}
+	return fields, nil
+}
+
+// Converts the fields of a CSV line into a tuple with descriptor desc.
+func csvFieldsToTuple(desc *TupleDesc, fields []string, lineNo int) (*Tuple, error) {
+	var newFields []DBValue
+	for fno, field := range fields {
+		switch desc.Fields[fno].Ftype {
+		case IntType:
+			field = strings.TrimSpace(field)
+			floatVal, err := strconv.ParseFloat(field, 64)
+			if err != nil {
+				return nil, GoDBError{TypeMismatchError, fmt.Sprintf("LoadFromCSV: couldn't convert value %s to int, tuple %d", field, lineNo)}
+			}
+			intValue := int(floatVal)
+			newFields = append(newFields, IntField{int64(intValue)})
+		case StringType:
+			if len(field) > StringLength {
+				field = field[0:StringLength]
+			}
+			newFields = append(newFields, StringField{field})
+		}
+	}
+	return &Tuple{*desc, newFields, nil}, nil
+}
+
 // Load the contents of a heap file from a specified CSV file.  Parameters are as follows:
 // - hasHeader:  whether or not the CSV file has a header
 // - sep: the character to use to separate fields
@@ -84,49 +125,43 @@ func (f *HeapFile) NumPagesWithoutLock() int {
 // We provide the implementation of this method, but it won't work until
 // [HeapFile.insertTuple] is implemented
 func (f *HeapFile) LoadFromCSV(file *os.File, hasHeader bool, sep string, skipLastField bool) error {
+	return f.loadFromCSV(file, hasHeader, sep, skipLastField, nil)
+}
+
+// Calls onRow with the raw fields and the tuple of every data line of a
+// CSV file whose rows have descriptor desc.
+func scanCSV(file *os.File, desc *TupleDesc, hasHeader bool, sep string, skipLastField bool, onRow func(fields []string, t *Tuple)) error {
 	scanner := bufio.NewScanner(file)
 	cnt := 0
 	for scanner.Scan() {
-		line := scanner.Text()
-		fields := strings.Split(line, sep)
-		if skipLastField {
-			fields = fields[0 : len(fields)-1]
-		}
-		numFields := len(fields)
 		cnt++
-		desc := f.Descriptor()
-		if desc == nil || desc.Fields == nil {
-			return GoDBError{MalformedDataError, "Descriptor was nil"}
-		}
-		if numFields != len(desc.Fields) {
-			return GoDBError{MalformedDataError, fmt.Sprintf("LoadFromCSV:  line %d (%s) does not have expected number of fields (expected %d, got %d)", cnt, line, len(f.Descriptor().Fields), numFields)}
+		fields, err := splitCSVLine(desc, scanner.Text(), sep, cnt, skipLastField)
+		if err != nil {
+			return err
 		}
 		if cnt == 1 && hasHeader {
 			continue
 		}
-		var newFields []DBValue
-		for fno, field := range fields {
-			switch f.Descriptor().Fields[fno].Ftype {
-			case IntType:
-				field = strings.TrimSpace(field)
-				floatVal, err := strconv.ParseFloat(field, 64)
-				if err != nil {
-					return GoDBError{TypeMismatchError, fmt.Sprintf("LoadFromCSV: couldn't convert value %s to int, tuple %d", field, cnt)}
-				}
-				intValue := int(floatVal)
-				newFields = append(newFields, IntField{int64(intValue)})
-			case StringType:
-				if len(field) > StringLength {
-					field = field[0:StringLength]
-				}
-				newFields = append(newFields, StringField{field})
-			}
+		newT, err := csvFieldsToTuple(desc, fields, cnt)
+		if err != nil {
+			return err
+		}
+		onRow(fields, newT)
+	}
+	return nil
+}
+
+// LoadFromCSV, calling onFields (if not nil) with the raw fields of every
+// data line.
+func (f *HeapFile) loadFromCSV(file *os.File, hasHeader bool, sep string, skipLastField bool, onFields func(fields []string)) error {
+	return scanCSV(file, f.Descriptor(), hasHeader, sep, skipLastField, func(fields []string, newT *Tuple) {
+		if onFields != nil {
+			onFields(fields)
 		}
-		newT := Tuple{*f.Descriptor(), newFields, nil}
 		tid := NewTID()
 		bp := f.bufPool
 		bp.BeginTransaction(tid)
-		f.insertTuple(&newT, tid)
+		f.insertTuple(newT, tid)
 
 		// hack to force dirty pages to disk
 		// because CommitTransaction may not be implemented
@@ -146,8 +181,7 @@ func (f *HeapFile) LoadFromCSV(file *os.File, hasHeader bool, sep string, skipLa
 		//commit frequently, to avoid all pages in BP being full
 		//todo fix
 		bp.CommitTransaction(tid)
-	}
-	return nil
+	})
 }
 
 // Read the specified page number from the HeapFile on disk.  This method is
@@ -174,6 +208,13 @@ func (f *HeapFile) readPage(pageNo int) (*Page, error) {
 	if err != nil {
 		return nil, err
 	}
+	if f.cipher != nil {
+		b, err = f.cipher.open(pageNo, b)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
 	var p Page = newHeapPage(f.desc, pageNo, f)
 	hp, _ := p.(*heapPage)
 	hp.initFromBuffer(bytes.NewBuffer(b))
@@ -307,6 +348,13 @@ func (f *HeapFile) flushPage(p *Page) error {
 	file.Seek(int64(pageNo*PageSize), 0)
 	b := make([]byte, PageSize)
 	copy(b, buf.Bytes())
+	if f.cipher != nil {
+		b, err = f.cipher.seal(pageNo, b[:PageSize-f.cipher.overhead()])
+		if err != nil {
+			file.Close()
+			return err
+		}
+	}
 	_, err = file.Write(b)
 	if err != nil {
 		return err
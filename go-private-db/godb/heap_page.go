@@ -71,7 +71,11 @@ func newHeapPage(desc *TupleDesc, pageNo int, f *HeapFile) *heapPage {
 			bytesPerTuple += (int)(unsafe.Sizeof(int64(0)))
 		}
 	}
-	numSlots := (int32)((PageSize - 8) / bytesPerTuple)
+	pageSize := PageSize
+	if f != nil && f.cipher != nil {
+		pageSize -= f.cipher.overhead()
+	}
+	numSlots := (int32)((pageSize - 8) / bytesPerTuple)
 	return &heapPage{
 		PageNo:          pageNo,
 		NumberSlots:     numSlots,
@@ -93,8 +97,10 @@ func (h *heapPage) insertTuple(t *Tuple) (recordID, error) {
 	h.setDirty(true)
 	for i := 0; i < int(h.NumberSlots); i++ {
 		if h.UsedSlots[i] == 0 {
-			h.Tuples[i] = *t
 			t.Rid = TupleRecordID{PageNo: h.PageNo, SlotNum: i}
+			h.Tuples[i] = *t
+			// tuples from INSERT ... VALUES are named after their values
+			h.Tuples[i].Desc = h.Desc
 			h.UsedSlots[i] = 1
 			h.NumberUsedSlots++
 			return t.Rid, nil
@@ -0,0 +1,481 @@
+package godb
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"sync"
+	"sync/atomic"
+
+	pt "github.com/getamis/alice/crypto/ecpointgrouplaw"
+	"github.com/getamis/alice/crypto/elliptic"
+	"github.com/getamis/alice/crypto/homo/paillier"
+	"github.com/getamis/alice/crypto/utils"
+)
+
+// The public half of an additively homomorphic encryption scheme, i.e.,
+// everything the (untrusted) server needs to aggregate ciphertexts.
+// homo.Pubkey from the alice library satisfies this interface.
+type HomomorphicPubKey interface {
+	// Encrypts the big-endian unsigned integer m
+	Encrypt(m []byte) ([]byte, error)
+
+	// Returns an encryption of the sum of the plaintexts of c1 and c2
+	Add(c1 []byte, c2 []byte) ([]byte, error)
+
+	// Returns an encryption of the plaintext of c multiplied by scalar
+	MulConst(c []byte, scalar *big.Int) ([]byte, error)
+
+	// Serializes the public key
+	ToPubKeyBytes() []byte
+}
+
+// An additively homomorphic encryption scheme together with its private key.
+type HomomorphicScheme interface {
+	HomomorphicPubKey
+
+	// Decrypts c into a big-endian unsigned integer
+	Decrypt(c []byte) ([]byte, error)
+
+	// Returns the public key, safe to hand to the server
+	GetPubKey() HomomorphicPubKey
+
+	// Serializes the private key. The result can be passed to
+	// LoadHomomorphicScheme together with Kind().
+	ToPrivKeyBytes() []byte
+
+	// Name of the scheme in the homomorphicSchemes registry
+	Kind() string
+}
+
+type HomomorphicSchemeType struct {
+	keygen   func(keySize int) (HomomorphicScheme, error)
+	loadPriv func(bs []byte) (HomomorphicScheme, error)
+	loadPub  func(bs []byte) (HomomorphicPubKey, error)
+}
+
+const (
+	PaillierSchemeKind  string = "paillier"
+	ECElGamalSchemeKind string = "ec-elgamal"
+)
+
+var homomorphicSchemes = map[string]HomomorphicSchemeType{
+	PaillierSchemeKind:  {newPaillierScheme, loadPaillierScheme, loadPaillierPubKey},
+	ECElGamalSchemeKind: {newECElGamalScheme, loadECElGamalScheme, loadECElGamalPubKey},
+}
+
+func getHomomorphicSchemeType(kind string) (HomomorphicSchemeType, error) {
+	t, exists := homomorphicSchemes[kind]
+	if !exists {
+		return HomomorphicSchemeType{}, GoDBError{IllegalOperationError, fmt.Sprintf("unknown homomorphic scheme %s", kind)}
+	}
+	return t, nil
+}
+
+// Generate a new key for the homomorphic scheme named kind. The meaning of
+// keySize depends on the scheme (modulus bits for Paillier; ignored for
+// EC-ElGamal, which always uses secp256k1).
+func NewHomomorphicScheme(kind string, keySize int) (HomomorphicScheme, error) {
+	t, err := getHomomorphicSchemeType(kind)
+	if err != nil {
+		return nil, err
+	}
+	return t.keygen(keySize)
+}
+
+func LoadHomomorphicScheme(kind string, privBytes []byte) (HomomorphicScheme, error) {
+	t, err := getHomomorphicSchemeType(kind)
+	if err != nil {
+		return nil, err
+	}
+	return t.loadPriv(privBytes)
+}
+
+func LoadHomomorphicPubKey(kind string, pubBytes []byte) (HomomorphicPubKey, error) {
+	t, err := getHomomorphicSchemeType(kind)
+	if err != nil {
+		return nil, err
+	}
+	return t.loadPub(pubBytes)
+}
+
+func ListOfHomomorphicSchemes() []string {
+	var kinds []string
+	for kind := range homomorphicSchemes {
+		kinds = append(kinds, kind)
+	}
+	return kinds
+}
+
+// Build int64 encrypt and decrypt functions for an EncryptionScheme from a
+// homomorphic scheme. Ciphertexts are carried as strings.
+func newHomEncryptionFuncFromScheme(scheme HomomorphicScheme) (func(v any) (any, error), func(v any) (any, error), HomomorphicPubKey) {
+	encrypt := func(v any) (any, error) {
+		if intValue, ok := v.(int64); ok {
+			buf := new(bytes.Buffer)
+			err := binary.Write(buf, binary.BigEndian, intValue)
+			if err != nil {
+				return nil, err
+			}
+			result, err := scheme.Encrypt(buf.Bytes())
+			if err != nil {
+				return nil, err
+			}
+			return string(result), nil
+		} else {
+			return nil, GoDBError{TypeMismatchError, "homomorphic encryption only supports ints"}
+		}
+	}
+
+	decrypt := func(v any) (any, error) {
+		d, err := scheme.Decrypt([]byte(v.(string)))
+		if err != nil {
+			return nil, err
+		}
+		if len(d) > 8 {
+			return nil, GoDBError{MalformedDataError, "decrypted value does not fit in an int64"}
+		}
+		dByte := make([]byte, 8)
+		copy(dByte[8-len(d):], d)
+		return int64(binary.BigEndian.Uint64(dByte)), nil
+	}
+
+	return encrypt, decrypt, scheme.GetPubKey()
+}
+
+// ================== Paillier ======================
+
+// Paillier from the alice library. The primes are kept alongside the
+// library's key so that the private key can be serialized. If a randomizer
+// pool is running, encryption and homomorphic operations go through pooled,
+// which may be swapped while other goroutines encrypt.
+type paillierScheme struct {
+	*paillier.Paillier
+	p *big.Int
+	q *big.Int
+
+	pooled atomic.Pointer[pooledPaillierPubKey]
+}
+
+func newPaillierScheme(keySize int) (HomomorphicScheme, error) {
+	for i := 0; i < 100; i++ {
+		p, err := rand.Prime(rand.Reader, keySize/2)
+		if err != nil {
+			return nil, err
+		}
+		q, err := rand.Prime(rand.Reader, keySize/2)
+		if err != nil {
+			return nil, err
+		}
+		if p.Cmp(q) == 0 {
+			continue
+		}
+		// gcd(pq, (p-1)(q-1)) = 1
+		n := new(big.Int).Mul(p, q)
+		phi := new(big.Int).Mul(new(big.Int).Sub(p, big1), new(big.Int).Sub(q, big1))
+		if !utils.IsRelativePrime(n, phi) {
+			continue
+		}
+		return newPaillierSchemeFromPrimes(p, q)
+	}
+	return nil, GoDBError{IllegalOperationError, "could not generate paillier primes"}
+}
+
+func newPaillierSchemeFromPrimes(p *big.Int, q *big.Int) (HomomorphicScheme, error) {
+	pall, err := paillier.NewPaillierWithGivenPrimes(p, q)
+	if err != nil {
+		return nil, err
+	}
+	return &paillierScheme{Paillier: pall, p: p, q: q}, nil
+}
+
+func (s *paillierScheme) GetPubKey() HomomorphicPubKey {
+	if pooled := s.pooled.Load(); pooled != nil {
+		return pooled
+	}
+	return s.Paillier.GetPubKey()
+}
+
+func (s *paillierScheme) Encrypt(m []byte) ([]byte, error) {
+	return s.GetPubKey().Encrypt(m)
+}
+
+func (s *paillierScheme) Add(c1 []byte, c2 []byte) ([]byte, error) {
+	return s.GetPubKey().Add(c1, c2)
+}
+
+func (s *paillierScheme) MulConst(c []byte, scalar *big.Int) ([]byte, error) {
+	return s.GetPubKey().MulConst(c, scalar)
+}
+
+// Starts (or restarts) background precomputation of randomizers. Public
+// keys returned by GetPubKey afterwards share the pool.
+func (s *paillierScheme) StartRandomizerPool(config RandomizerPoolConfig) error {
+	s.StopRandomizerPool()
+	if config.Size <= 0 {
+		return nil
+	}
+	n := new(big.Int).Mul(s.p, s.q)
+	pool, err := NewPaillierRandomizerPool(n, config)
+	if err != nil {
+		return err
+	}
+	old := s.pooled.Swap(&pooledPaillierPubKey{inner: s.Paillier.GetPubKey(), n: n, nSquare: pool.nSquare, pool: pool})
+	if old != nil {
+		old.pool.Stop()
+	}
+	return nil
+}
+
+func (s *paillierScheme) StopRandomizerPool() {
+	if old := s.pooled.Swap(nil); old != nil {
+		old.pool.Stop()
+	}
+}
+
+func (s *paillierScheme) RandomizerPoolStats() RandomizerPoolStats {
+	pooled := s.pooled.Load()
+	if pooled == nil {
+		return RandomizerPoolStats{}
+	}
+	return pooled.pool.Stats()
+}
+
+func (s *paillierScheme) Kind() string {
+	return PaillierSchemeKind
+}
+
+// length-prefixed p followed by q
+func (s *paillierScheme) ToPrivKeyBytes() []byte {
+	buf := new(bytes.Buffer)
+	for _, v := range []*big.Int{s.p, s.q} {
+		b := v.Bytes()
+		binary.Write(buf, binary.BigEndian, uint32(len(b)))
+		buf.Write(b)
+	}
+	return buf.Bytes()
+}
+
+func loadPaillierScheme(bs []byte) (HomomorphicScheme, error) {
+	buf := bytes.NewBuffer(bs)
+	var primes []*big.Int
+	for i := 0; i < 2; i++ {
+		var l uint32
+		err := binary.Read(buf, binary.BigEndian, &l)
+		if err != nil || int(l) > buf.Len() {
+			return nil, GoDBError{MalformedDataError, "malformed paillier private key"}
+		}
+		primes = append(primes, new(big.Int).SetBytes(buf.Next(int(l))))
+	}
+	return newPaillierSchemeFromPrimes(primes[0], primes[1])
+}
+
+func loadPaillierPubKey(bs []byte) (HomomorphicPubKey, error) {
+	return (&paillier.Paillier{}).NewPubKeyFromBytes(bs)
+}
+
+// ================== Exponential EC-ElGamal ======================
+
+// Exponential ElGamal on secp256k1: Enc(m) = (rG, mG + rH) where H = xG.
+// Ciphertexts are far smaller than Paillier's and addition is cheap, but
+// decryption must solve a discrete log, so decrypted values (including
+// sums) must lie in [0, ecElGamalMaxPlaintext).
+const (
+	ecElGamalCoordLen     = 32
+	ecElGamalPointLen     = 2 * ecElGamalCoordLen
+	ecElGamalBabySteps    = 1 << 16
+	ecElGamalMaxPlaintext = ecElGamalBabySteps * ecElGamalBabySteps
+)
+
+type ecElGamalPubKey struct {
+	curve elliptic.Curve
+	h     *pt.ECPoint
+}
+
+type ecElGamalScheme struct {
+	*ecElGamalPubKey
+	x *big.Int
+
+	// baby-step table from point encoding to exponent, built on first decrypt
+	tableOnce sync.Once
+	table     map[string]uint32
+}
+
+func newECElGamalScheme(keySize int) (HomomorphicScheme, error) {
+	curve := elliptic.Secp256k1()
+	x, err := utils.RandomPositiveInt(curve.Params().N)
+	if err != nil {
+		return nil, err
+	}
+	return newECElGamalSchemeFromKey(x), nil
+}
+
+func newECElGamalSchemeFromKey(x *big.Int) *ecElGamalScheme {
+	curve := elliptic.Secp256k1()
+	h := pt.NewBase(curve).ScalarMult(x)
+	return &ecElGamalScheme{ecElGamalPubKey: &ecElGamalPubKey{curve, h}, x: x}
+}
+
+func loadECElGamalScheme(bs []byte) (HomomorphicScheme, error) {
+	x := new(big.Int).SetBytes(bs)
+	if x.Sign() <= 0 || x.Cmp(elliptic.Secp256k1().Params().N) >= 0 {
+		return nil, GoDBError{MalformedDataError, "malformed ec-elgamal private key"}
+	}
+	return newECElGamalSchemeFromKey(x), nil
+}
+
+func loadECElGamalPubKey(bs []byte) (HomomorphicPubKey, error) {
+	curve := elliptic.Secp256k1()
+	h, err := decodeECPoint(curve, bs)
+	if err != nil {
+		return nil, err
+	}
+	return &ecElGamalPubKey{curve, h}, nil
+}
+
+// fixed length X || Y encoding; the identity is all zeros
+func encodeECPoint(p *pt.ECPoint) []byte {
+	b := make([]byte, ecElGamalPointLen)
+	if p.IsIdentity() {
+		return b
+	}
+	p.GetX().FillBytes(b[:ecElGamalCoordLen])
+	p.GetY().FillBytes(b[ecElGamalCoordLen:])
+	return b
+}
+
+func decodeECPoint(curve elliptic.Curve, b []byte) (*pt.ECPoint, error) {
+	if len(b) != ecElGamalPointLen {
+		return nil, GoDBError{MalformedDataError, "malformed elliptic curve point"}
+	}
+	if bytes.Equal(b, make([]byte, ecElGamalPointLen)) {
+		return pt.NewIdentity(curve), nil
+	}
+	x := new(big.Int).SetBytes(b[:ecElGamalCoordLen])
+	y := new(big.Int).SetBytes(b[ecElGamalCoordLen:])
+	p, err := pt.NewECPoint(curve, x, y)
+	if err != nil {
+		return nil, GoDBError{MalformedDataError, "elliptic curve point is not on the curve"}
+	}
+	return p, nil
+}
+
+func (k *ecElGamalPubKey) decodeCiphertext(c []byte) (*pt.ECPoint, *pt.ECPoint, error) {
+	if len(c) != 2*ecElGamalPointLen {
+		return nil, nil, GoDBError{MalformedDataError, "malformed ec-elgamal ciphertext"}
+	}
+	c1, err := decodeECPoint(k.curve, c[:ecElGamalPointLen])
+	if err != nil {
+		return nil, nil, err
+	}
+	c2, err := decodeECPoint(k.curve, c[ecElGamalPointLen:])
+	if err != nil {
+		return nil, nil, err
+	}
+	return c1, c2, nil
+}
+
+func encodeECElGamalCiphertext(c1 *pt.ECPoint, c2 *pt.ECPoint) []byte {
+	return append(encodeECPoint(c1), encodeECPoint(c2)...)
+}
+
+func (k *ecElGamalPubKey) Encrypt(mBytes []byte) ([]byte, error) {
+	r, err := utils.RandomPositiveInt(k.curve.Params().N)
+	if err != nil {
+		return nil, err
+	}
+	m := new(big.Int).SetBytes(mBytes)
+	g := pt.NewBase(k.curve)
+	c1 := g.ScalarMult(r)
+	c2, err := g.ScalarMult(m).Add(k.h.ScalarMult(r))
+	if err != nil {
+		return nil, err
+	}
+	return encodeECElGamalCiphertext(c1, c2), nil
+}
+
+func (k *ecElGamalPubKey) Add(c1Bytes []byte, c2Bytes []byte) ([]byte, error) {
+	a1, a2, err := k.decodeCiphertext(c1Bytes)
+	if err != nil {
+		return nil, err
+	}
+	b1, b2, err := k.decodeCiphertext(c2Bytes)
+	if err != nil {
+		return nil, err
+	}
+	s1, err := a1.Add(b1)
+	if err != nil {
+		return nil, err
+	}
+	s2, err := a2.Add(b2)
+	if err != nil {
+		return nil, err
+	}
+	return encodeECElGamalCiphertext(s1, s2), nil
+}
+
+func (k *ecElGamalPubKey) MulConst(c []byte, scalar *big.Int) ([]byte, error) {
+	c1, c2, err := k.decodeCiphertext(c)
+	if err != nil {
+		return nil, err
+	}
+	return encodeECElGamalCiphertext(c1.ScalarMult(scalar), c2.ScalarMult(scalar)), nil
+}
+
+func (k *ecElGamalPubKey) ToPubKeyBytes() []byte {
+	return encodeECPoint(k.h)
+}
+
+func (s *ecElGamalScheme) GetPubKey() HomomorphicPubKey {
+	return s.ecElGamalPubKey
+}
+
+func (s *ecElGamalScheme) Kind() string {
+	return ECElGamalSchemeKind
+}
+
+func (s *ecElGamalScheme) ToPrivKeyBytes() []byte {
+	b := make([]byte, ecElGamalCoordLen)
+	return s.x.FillBytes(b)
+}
+
+// Decrypt recovers mG = C2 - xC1 and then m with baby-step giant-step.
+func (s *ecElGamalScheme) Decrypt(c []byte) ([]byte, error) {
+	c1, c2, err := s.decodeCiphertext(c)
+	if err != nil {
+		return nil, err
+	}
+	mG, err := c2.Add(c1.ScalarMult(s.x).Neg())
+	if err != nil {
+		return nil, err
+	}
+
+	s.tableOnce.Do(s.buildBabyStepTable)
+	giant := pt.NewBase(s.curve).ScalarMult(big.NewInt(ecElGamalBabySteps)).Neg()
+	cur := mG
+	for i := 0; i < ecElGamalBabySteps; i++ {
+		j, found := s.table[string(encodeECPoint(cur))]
+		if found {
+			m := new(big.Int).Mul(big.NewInt(int64(i)), big.NewInt(ecElGamalBabySteps))
+			m.Add(m, big.NewInt(int64(j)))
+			return m.Bytes(), nil
+		}
+		cur, err = cur.Add(giant)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, GoDBError{IllegalOperationError, fmt.Sprintf("ec-elgamal plaintext is outside [0, %d)", uint64(ecElGamalMaxPlaintext))}
+}
+
+func (s *ecElGamalScheme) buildBabyStepTable() {
+	s.table = make(map[string]uint32, ecElGamalBabySteps)
+	g := pt.NewBase(s.curve)
+	cur := pt.NewIdentity(s.curve)
+	for j := 0; j < ecElGamalBabySteps; j++ {
+		s.table[string(encodeECPoint(cur))] = uint32(j)
+		cur, _ = cur.Add(g)
+	}
+}
@@ -0,0 +1,153 @@
+package godb
+
+import (
+	"math/big"
+	"os"
+	"testing"
+	"time"
+)
+
+// smallest key the alice paillier implementation accepts
+const testHomKeySize = 2048
+
+func TestHomomorphicSchemeRoundTrip(t *testing.T) {
+	for _, kind := range ListOfHomomorphicSchemes() {
+		scheme, err := NewHomomorphicScheme(kind, testHomKeySize)
+		if err != nil {
+			t.Fatalf("%s: %s", kind, err.Error())
+		}
+		encrypt, decrypt, pk := newHomEncryptionFuncFromScheme(scheme)
+
+		c1, _ := encrypt(int64(125))
+		c2, _ := encrypt(int64(40000))
+		sum, err := pk.Add([]byte(c1.(string)), []byte(c2.(string)))
+		if err != nil {
+			t.Fatalf("%s: %s", kind, err.Error())
+		}
+		prod, err := pk.MulConst(sum, big.NewInt(3))
+		if err != nil {
+			t.Fatalf("%s: %s", kind, err.Error())
+		}
+		got, err := decrypt(string(prod))
+		if err != nil {
+			t.Fatalf("%s: %s", kind, err.Error())
+		}
+		if got.(int64) != 3*(125+40000) {
+			t.Errorf("%s: expected %d, got %d", kind, 3*(125+40000), got.(int64))
+		}
+	}
+}
+
+func TestHomomorphicSchemeSerialize(t *testing.T) {
+	for _, kind := range ListOfHomomorphicSchemes() {
+		scheme, err := NewHomomorphicScheme(kind, testHomKeySize)
+		if err != nil {
+			t.Fatalf("%s: %s", kind, err.Error())
+		}
+		pk, err := LoadHomomorphicPubKey(kind, scheme.GetPubKey().ToPubKeyBytes())
+		if err != nil {
+			t.Fatalf("%s: %s", kind, err.Error())
+		}
+		loaded, err := LoadHomomorphicScheme(kind, scheme.ToPrivKeyBytes())
+		if err != nil {
+			t.Fatalf("%s: %s", kind, err.Error())
+		}
+
+		// encrypt under the loaded public key, decrypt with the loaded private key
+		c, err := pk.Encrypt([]byte{0x01, 0x00})
+		if err != nil {
+			t.Fatalf("%s: %s", kind, err.Error())
+		}
+		d, err := loaded.Decrypt(c)
+		if err != nil {
+			t.Fatalf("%s: %s", kind, err.Error())
+		}
+		if new(big.Int).SetBytes(d).Int64() != 256 {
+			t.Errorf("%s: expected 256, got %v", kind, d)
+		}
+	}
+
+	_, err := NewHomomorphicScheme("rot13", 0)
+	if err == nil {
+		t.Errorf("expected error for unknown scheme")
+	}
+}
+
+func TestECElGamalEncryptedSumAgg(t *testing.T) {
+	scheme, err := NewHomomorphicScheme(ECElGamalSchemeKind, 0)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	err, e := translateQueryWithHomScheme("select sum(age) from t", scheme)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	_, t1, t2, hf, _, tid := makeTestVars()
+	hf.insertTuple(&t1, tid)
+	hf.insertTuple(&t2, tid)
+	os.Remove("elgamal_encrypted_test.dat")
+	defer os.Remove("elgamal_encrypted_test.dat")
+	encryptedHf, err := e.encryptOrDecrypt(hf, "elgamal_encrypted_test.dat", true, tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	sa := EncryptedSumAggState[string]{}
+	expr := FieldExpr{FieldType{Fname: "age", TableQualifier: "t"}}
+	sa.Init("sum", &expr, stringAggGetter, *e.PublicKeys["age"])
+	agg := NewEncryptedAggregator([]EncryptedAggState{&sa}, encryptedHf)
+	iter, err := agg.Iterator(tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	tup, err := iter()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	decrypted, err := e.encryptOrDecryptTuple(tup, false)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	expected := t1.Fields[1].(IntField).Value + t2.Fields[1].(IntField).Value
+	if decrypted.Fields[0].(IntField).Value != expected {
+		t.Errorf("expected sum %d, got %d", expected, decrypted.Fields[0].(IntField).Value)
+	}
+}
+
+// Reports ciphertext size and per-operation latency for each scheme, e.g.
+// go test -run XXX -bench HomomorphicSchemes
+func BenchmarkHomomorphicSchemes(b *testing.B) {
+	for _, kind := range ListOfHomomorphicSchemes() {
+		b.Run(kind, func(b *testing.B) {
+			scheme, err := NewHomomorphicScheme(kind, testHomKeySize)
+			if err != nil {
+				b.Fatalf(err.Error())
+			}
+			encrypt, decrypt, pk := newHomEncryptionFuncFromScheme(scheme)
+			c, _ := encrypt(int64(1000))
+			cBytes := []byte(c.(string))
+
+			var encTime, addTime, decTime time.Duration
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				start := time.Now()
+				c, _ = encrypt(int64(i))
+				encTime += time.Since(start)
+
+				start = time.Now()
+				cBytes, _ = pk.Add(cBytes, []byte(c.(string)))
+				addTime += time.Since(start)
+
+				start = time.Now()
+				decrypt(c)
+				decTime += time.Since(start)
+			}
+			b.ReportMetric(float64(len(cBytes)), "ciphertext-bytes")
+			b.ReportMetric(float64(encTime.Nanoseconds())/float64(b.N), "encrypt-ns/op")
+			b.ReportMetric(float64(addTime.Nanoseconds())/float64(b.N), "add-ns/op")
+			b.ReportMetric(float64(decTime.Nanoseconds())/float64(b.N), "decrypt-ns/op")
+		})
+	}
+}
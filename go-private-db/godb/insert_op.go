@@ -1,8 +1,11 @@
 package godb
 
+import "fmt"
+
 type InsertOp struct {
-	file  DBFile
-	child Operator
+	file       DBFile
+	child      Operator
+	encryption *EncryptionScheme
 }
 
 // Construtor.  The insert operator insert the records in the child
@@ -11,6 +14,27 @@ func NewInsertOp(insertFile DBFile, child Operator) *InsertOp {
 	return &InsertOp{file: insertFile, child: child}
 }
 
+// Like NewInsertOp, but the child produces plaintext tuples that are
+// encrypted under e before they are inserted into the encrypted file
+// insertFile. A nil e inserts tuples unchanged.
+func NewEncryptingInsertOp(insertFile DBFile, child Operator, e *EncryptionScheme) *InsertOp {
+	return &InsertOp{file: insertFile, child: child, encryption: e}
+}
+
+// Gives t the plaintext descriptor of the encrypted file and encrypts it.
+func (iop *InsertOp) encrypt(t *Tuple, plainDesc *TupleDesc) (*Tuple, error) {
+	if len(t.Fields) != len(plainDesc.Fields) {
+		return nil, GoDBError{TypeMismatchError, fmt.Sprintf("expected %d values to insert, got %d", len(plainDesc.Fields), len(t.Fields))}
+	}
+	for i, f := range plainDesc.Fields {
+		_, isInt := t.Fields[i].(IntField)
+		if isInt != (f.Ftype == IntType) {
+			return nil, GoDBError{TypeMismatchError, fmt.Sprintf("value %d has the wrong type for column %s", i+1, f.Fname)}
+		}
+	}
+	return iop.encryption.encryptOrDecryptTuple(&Tuple{Desc: *plainDesc, Fields: t.Fields}, true)
+}
+
 // The insert TupleDesc is a one column descriptor with an integer field named "count"
 func (i *InsertOp) Descriptor() *TupleDesc {
 	ft := FieldType{"count", "", IntType}
@@ -26,19 +50,36 @@ func (i *InsertOp) Descriptor() *TupleDesc {
 // were inserted.  Tuples should be inserted using the [DBFile.insertTuple]
 // method.
 func (iop *InsertOp) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
-	iter, _ := iop.child.Iterator(tid)
+	iter, err := iop.child.Iterator(tid)
+	if err != nil {
+		return nil, err
+	}
 	count := 0
+	var plainDesc *TupleDesc
+	if iop.encryption != nil {
+		plainDesc = iop.encryption.encryptedDesc(iop.file.Descriptor(), false)
+	}
 
 	return func() (*Tuple, error) {
 		for {
-			t, _ := iter()
+			t, err := iter()
+			if err != nil {
+				return nil, err
+			}
 			if t == nil {
 				td := iop.Descriptor()
 				f := IntField{int64(count)}
 				fs := []DBValue{f}
 				return &Tuple{*td, fs, nil}, nil
 			}
-			err := iop.file.insertTuple(t, tid)
+			if iop.encryption != nil {
+				var err error
+				t, err = iop.encrypt(t, plainDesc)
+				if err != nil {
+					return nil, err
+				}
+			}
+			err = iop.file.insertTuple(t, tid)
 			if err != nil {
 				return nil, err
 			}
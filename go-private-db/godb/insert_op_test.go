@@ -59,3 +59,50 @@ func TestInsert(t *testing.T) {
 		t.Errorf("insert failed, expected 2 tuples, got %d", cnt)
 	}
 }
+
+func TestEncryptedInsert(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(dir+"/catalog.txt", []byte("t (name string, age int)\n"), 0600)
+	bp := NewBufferPool(3)
+	c, err := NewCatalogFromFile("catalog.txt", bp, dir)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	e := getDummyEncryptionScheme()
+	c.SetTableEncryption("t", &e)
+
+	tid := NewTID()
+	bp.BeginTransaction(tid)
+	_, op, err := Parse(c, "insert into t values ('sam', 25), ('george jones', 999)")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	iter, _ := op.Iterator(tid)
+	tup, err := iter()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if tup.Fields[0].(IntField).Value != 2 {
+		t.Errorf("expected 2 inserted tuples, got %v", tup.Fields[0])
+	}
+
+	hf, _ := c.GetTable("t")
+	iter, _ = hf.Iterator(tid)
+	var stored []*Tuple
+	for tup, _ := iter(); tup != nil; tup, _ = iter() {
+		stored = append(stored, tup)
+	}
+	if len(stored) != 2 {
+		t.Fatalf("expected 2 stored tuples, got %d", len(stored))
+	}
+	if stored[0].Fields[0].(StringField).Value != "samabc" || stored[0].Fields[1].(IntField).Value != 26 {
+		t.Errorf("expected stored tuple to be encrypted, got %v", stored[0].Fields)
+	}
+
+	_, op, _ = Parse(c, "insert into t values (25, 'sam')")
+	iter, _ = op.Iterator(tid)
+	_, err = iter()
+	if err == nil {
+		t.Errorf("expected error inserting values of the wrong type")
+	}
+}
@@ -71,6 +71,7 @@ func (hj *EqualityJoin[T]) Descriptor() *TupleDesc {
 // out.  To pass this test, you will need to use something other than a nested
 // loops join.
 func (joinOp *EqualityJoin[T]) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
+	bindVaultExprs(tid, joinOp.leftField, joinOp.rightField)
 	iter1, _ := (*joinOp.left).Iterator(tid)
 	iter2, _ := (*joinOp.right).Iterator(tid)
 	t1, _ := iter1()
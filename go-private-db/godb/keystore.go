@@ -0,0 +1,140 @@
+package godb
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// A KeyStore holds the client's named secret keys (MAC keys, data keys,
+// ...). Keys are created on first use. If the store has a path, it is saved
+// there (mode 0600) every time a key is created or deleted.
+type KeyStore struct {
+	path  string
+	mutex sync.Mutex
+	keys  map[string][]byte
+}
+
+// Creates a key store that lives only in memory.
+func NewKeyStore() *KeyStore {
+	return &KeyStore{keys: make(map[string][]byte)}
+}
+
+// Opens the key store saved at path, or an empty one if path does not exist.
+func OpenKeyStore(path string) (*KeyStore, error) {
+	ks := &KeyStore{path: path, keys: make(map[string][]byte)}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return ks, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &ks.keys)
+	if err != nil {
+		return nil, GoDBError{MalformedDataError, fmt.Sprintf("malformed key store %s: %s", path, err.Error())}
+	}
+	return ks, nil
+}
+
+// Returns the key called name, creating a random key of size bytes if
+// there is none. Retired keys (see RetireKey) are empty.
+func (ks *KeyStore) GetOrCreateKey(name string, size int) ([]byte, error) {
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+	key, exists := ks.keys[name]
+	if exists {
+		return key, nil
+	}
+	key = make([]byte, size)
+	_, err := rand.Read(key)
+	if err != nil {
+		return nil, err
+	}
+	ks.keys[name] = key
+	err = ks.save()
+	if err != nil {
+		delete(ks.keys, name)
+		return nil, err
+	}
+	return key, nil
+}
+
+// Saves key under name, replacing any key of that name.
+func (ks *KeyStore) SetKey(name string, key []byte) error {
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+	old, exists := ks.keys[name]
+	ks.keys[name] = key
+	err := ks.save()
+	if err != nil {
+		if exists {
+			ks.keys[name] = old
+		} else {
+			delete(ks.keys, name)
+		}
+	}
+	return err
+}
+
+func (ks *KeyStore) GetKey(name string) ([]byte, bool) {
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+	key, exists := ks.keys[name]
+	return key, exists
+}
+
+// Deletes the key called name. Anything encrypted under it is unrecoverable
+// afterwards.
+func (ks *KeyStore) DeleteKey(name string) error {
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+	key, exists := ks.keys[name]
+	if !exists {
+		return nil
+	}
+	delete(ks.keys, name)
+	err := ks.save()
+	if err != nil {
+		ks.keys[name] = key
+	}
+	return err
+}
+
+// Destroys the key called name like DeleteKey, but leaves an empty key in
+// its place so that GetOrCreateKey does not create it again.
+func (ks *KeyStore) RetireKey(name string) error {
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+	key, exists := ks.keys[name]
+	ks.keys[name] = []byte{}
+	err := ks.save()
+	if err != nil {
+		if exists {
+			ks.keys[name] = key
+		} else {
+			delete(ks.keys, name)
+		}
+	}
+	return err
+}
+
+// writes to a temporary file and renames it, so a crash never leaves a
+// truncated key store behind
+func (ks *KeyStore) save() error {
+	if ks.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(ks.keys)
+	if err != nil {
+		return err
+	}
+	tmp := ks.path + ".tmp"
+	err = os.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, ks.path)
+}
@@ -0,0 +1,261 @@
+package godb
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A report of what an honest-but-curious server learns from the encrypted
+// tables of a catalog: per column, what the encryption kind reveals, with
+// the frequency histogram of deterministic and order-revealing columns and
+// the distribution of ciphertext lengths as the server sees them; and, from
+// an optional query log, the result size and the columns each query
+// touched.
+
+type ColumnLeakage struct {
+	Column            string         `json:"column"`
+	Kind              EncryptionKind `json:"kind"`
+	Padding           string         `json:"padding,omitempty"`
+	Leaks             []string       `json:"leaks"`
+	DistinctValues    int            `json:"distinct_values,omitempty"`
+	Frequencies       []int          `json:"frequencies,omitempty"` // occurrences of each distinct ciphertext, largest first
+	CiphertextLengths map[int]int    `json:"ciphertext_lengths,omitempty"`
+}
+
+type TableLeakage struct {
+	Table             string          `json:"table"`
+	Rows              int             `json:"rows"`
+	RowsAuthenticated bool            `json:"rows_authenticated"`
+	PagesEncrypted    bool            `json:"pages_encrypted"`
+	Columns           []ColumnLeakage `json:"columns"`
+}
+
+type QueryLeakage struct {
+	Query      string   `json:"query"`
+	ResultSize int      `json:"result_size"`
+	Accesses   []string `json:"accesses,omitempty"` // e.g. "t.ssn: equality"
+	Error      string   `json:"error,omitempty"`
+}
+
+type LeakageReport struct {
+	Tables  []TableLeakage `json:"tables"`
+	Queries []QueryLeakage `json:"queries,omitempty"`
+}
+
+type QueryLogEntry struct {
+	Query      string
+	ResultSize int
+}
+
+// Parses a query log with one "<result rows>\t<query>" entry per line.
+func ParseQueryLog(r io.Reader) ([]QueryLogEntry, error) {
+	var entries []QueryLogEntry
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		parts := strings.SplitN(line, "\t", 2)
+		if len(parts) != 2 {
+			return nil, GoDBError{ParseError, fmt.Sprintf("expected result size and query on line %d of query log", lineNo)}
+		}
+		size, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return nil, GoDBError{ParseError, fmt.Sprintf("invalid result size on line %d of query log", lineNo)}
+		}
+		entries = append(entries, QueryLogEntry{strings.TrimSuffix(strings.TrimSpace(parts[1]), ";"), size})
+	}
+	return entries, scanner.Err()
+}
+
+func kindLeaks(kind EncryptionKind, padded bool) []string {
+	length := "length of each value"
+	if padded {
+		length = "padded length of each value"
+	}
+	switch kind {
+	case PlaintextKind:
+		return []string{"every value"}
+	case DetKind:
+		return []string{"which rows have equal values (frequency histogram)", length}
+	case OreKind:
+		return []string{"which rows have equal values (frequency histogram)", "order of all values", length}
+	case HomKind:
+		return []string{"nothing about individual values"}
+	}
+	return []string{length}
+}
+
+var accessNames = map[EncryptionKind]string{
+	RndKind: "returned",
+	DetKind: "equality",
+	OreKind: "order",
+	HomKind: "aggregated",
+}
+
+// Builds a leakage report for the tables of c marked encrypted with
+// SetTableEncryption. log may be nil.
+func BuildLeakageReport(c *Catalog, log []QueryLogEntry, tid TransactionID) (*LeakageReport, error) {
+	report := &LeakageReport{Tables: []TableLeakage{}}
+	for _, t := range c.tables {
+		if t.encryption == nil {
+			continue
+		}
+		tl, err := tableLeakage(c, t, tid)
+		if err != nil {
+			return nil, err
+		}
+		report.Tables = append(report.Tables, *tl)
+	}
+
+	for _, entry := range log {
+		ql := QueryLeakage{Query: entry.Query, ResultSize: entry.ResultSize}
+		needs, err := queryRequirements(c, entry.Query)
+		if err != nil {
+			ql.Error = err.Error()
+		}
+		for col, kinds := range needs {
+			for kind := range kinds {
+				ql.Accesses = append(ql.Accesses, fmt.Sprintf("%s.%s: %s", col.table, col.column, accessNames[kind]))
+			}
+		}
+		sort.Strings(ql.Accesses)
+		report.Queries = append(report.Queries, ql)
+	}
+	return report, nil
+}
+
+// Whether file was opened with a page cipher. This is what the report
+// claims, rather than whether a page key happens to exist somewhere.
+func pagesEncrypted(file DBFile) bool {
+	hf, isHeapFile := file.(*HeapFile)
+	return isHeapFile && hf.cipher != nil
+}
+
+func tableLeakage(c *Catalog, t *Table, tid TransactionID) (*TableLeakage, error) {
+	e := t.encryption
+	tl := &TableLeakage{Table: t.name}
+	tl.RowsAuthenticated = e.MAC != nil && e.MAC.hasColumns(&t.desc)
+	file, err := c.GetTable(t.name)
+	if err != nil {
+		return nil, err
+	}
+	tl.PagesEncrypted = pagesEncrypted(file)
+
+	var columns []int
+	counts := make(map[int]map[string]int)
+	for i, f := range t.desc.Fields {
+		if f.Fname == RowIDField || f.Fname == RowMACField {
+			continue
+		}
+		columns = append(columns, i)
+		counts[i] = make(map[string]int)
+		kind := e.kind(f.Fname)
+		padding := e.Padding[f.Fname]
+		cl := ColumnLeakage{Column: f.Fname, Kind: kind, Padding: padding.String()}
+		cl.Leaks = kindLeaks(kind, padding.Kind != NoPadding)
+		tl.Columns = append(tl.Columns, cl)
+	}
+
+	iter, err := file.Iterator(tid)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		tup, err := iter()
+		if err != nil {
+			return nil, err
+		}
+		if tup == nil {
+			break
+		}
+		tl.Rows++
+		for j, i := range columns {
+			value := tup.Fields[i]
+			counts[i][fmt.Sprint(value)]++
+			if s, ok := value.(StringField); ok {
+				if tl.Columns[j].CiphertextLengths == nil {
+					tl.Columns[j].CiphertextLengths = make(map[int]int)
+				}
+				tl.Columns[j].CiphertextLengths[len(s.Value)]++
+			}
+		}
+	}
+
+	for j, i := range columns {
+		cl := &tl.Columns[j]
+		if cl.Kind == HomKind {
+			cl.CiphertextLengths = nil
+		}
+		if cl.Kind != DetKind && cl.Kind != OreKind && cl.Kind != PlaintextKind {
+			continue
+		}
+		cl.DistinctValues = len(counts[i])
+		for _, n := range counts[i] {
+			cl.Frequencies = append(cl.Frequencies, n)
+		}
+		sort.Sort(sort.Reverse(sort.IntSlice(cl.Frequencies)))
+	}
+	return tl, nil
+}
+
+func (r *LeakageReport) JSON() ([]byte, error) {
+	return json.MarshalIndent(r, "", "  ")
+}
+
+func (r *LeakageReport) String() string {
+	var sb strings.Builder
+	for _, t := range r.Tables {
+		fmt.Fprintf(&sb, "Table %s (%d rows)\n", t.Table, t.Rows)
+		if !t.RowsAuthenticated {
+			sb.WriteString("  rows are not authenticated; the server can modify or replay them undetected\n")
+		}
+		if !t.PagesEncrypted {
+			sb.WriteString("  pages are not encrypted at rest\n")
+		}
+		for _, col := range t.Columns {
+			fmt.Fprintf(&sb, "  %s (%s", col.Column, strings.ToUpper(string(col.Kind)))
+			if col.Padding != "" {
+				fmt.Fprintf(&sb, ", padded %s", col.Padding)
+			}
+			fmt.Fprintf(&sb, "): reveals %s\n", strings.Join(col.Leaks, "; "))
+			if col.Frequencies != nil {
+				fmt.Fprintf(&sb, "      %d distinct values, frequencies %v\n", col.DistinctValues, col.Frequencies)
+			}
+			if len(col.CiphertextLengths) > 1 {
+				var lengths []int
+				for l := range col.CiphertextLengths {
+					lengths = append(lengths, l)
+				}
+				sort.Ints(lengths)
+				sb.WriteString("      ciphertext lengths:")
+				for _, l := range lengths {
+					fmt.Fprintf(&sb, " %d bytes x%d", l, col.CiphertextLengths[l])
+				}
+				sb.WriteString("\n")
+			}
+		}
+	}
+	if len(r.Queries) > 0 {
+		sb.WriteString("Queries\n")
+		for _, q := range r.Queries {
+			fmt.Fprintf(&sb, "  %s\n      %d result rows", q.Query, q.ResultSize)
+			if len(q.Accesses) > 0 {
+				fmt.Fprintf(&sb, "; accesses %s", strings.Join(q.Accesses, ", "))
+			}
+			if q.Error != "" {
+				fmt.Fprintf(&sb, "; %s", q.Error)
+			}
+			sb.WriteString("\n")
+		}
+	}
+	return sb.String()
+}
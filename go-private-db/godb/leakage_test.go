@@ -0,0 +1,91 @@
+package godb
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLeakageReport(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(dir+"/catalog.txt", []byte("t (name string, age int)\nplain (x int)\n"), 0600)
+	bp := NewBufferPool(3)
+	c, err := NewCatalogFromFile("catalog.txt", bp, dir)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	e := getDummyEncryptionScheme()
+	e.Kinds = map[string]EncryptionKind{"name": DetKind, "age": RndKind}
+	e.Padding = map[string]PaddingPolicy{"name": {Kind: FixedPadding, Size: 16}}
+	c.SetTableEncryption("t", &e)
+
+	tid := NewTID()
+	bp.BeginTransaction(tid)
+	_, op, _ := Parse(c, "insert into t values ('sam', 25), ('sam', 30), ('george', 999)")
+	iter, _ := op.Iterator(tid)
+	_, err = iter()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	log, err := ParseQueryLog(strings.NewReader("2\tselect age from t where name = 'sam';\n1\tselect name from t where name like 's%'\n"))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	report, err := BuildLeakageReport(c, log, tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(report.Tables) != 1 || report.Tables[0].Table != "t" {
+		t.Fatalf("expected a report for the encrypted table only, got %v", report.Tables)
+	}
+	table := report.Tables[0]
+	if table.Rows != 3 || table.PagesEncrypted || table.RowsAuthenticated {
+		t.Errorf("unexpected table summary %+v", table)
+	}
+	name := table.Columns[0]
+	if name.Kind != DetKind || name.DistinctValues != 2 || name.Frequencies[0] != 2 || name.Frequencies[1] != 1 {
+		t.Errorf("unexpected leakage for deterministic column: %+v", name)
+	}
+	if name.Padding != "16" {
+		t.Errorf("expected padding to be reported, got %q", name.Padding)
+	}
+	if table.Columns[1].Frequencies != nil {
+		t.Errorf("expected no histogram for a randomized column")
+	}
+
+	if len(report.Queries) != 2 || report.Queries[0].ResultSize != 2 {
+		t.Fatalf("unexpected query leakage %v", report.Queries)
+	}
+	accesses := strings.Join(report.Queries[0].Accesses, ",")
+	if accesses != "t.age: returned,t.name: equality" {
+		t.Errorf("unexpected access pattern %s", accesses)
+	}
+	if report.Queries[1].Error == "" {
+		t.Errorf("expected the LIKE query to be flagged")
+	}
+
+	js, err := report.JSON()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	var decoded LeakageReport
+	err = json.Unmarshal(js, &decoded)
+	if err != nil || decoded.Tables[0].Columns[0].DistinctValues != 2 {
+		t.Errorf("expected report to round trip through JSON (%v)", err)
+	}
+	if !strings.Contains(report.String(), "name (DET, padded 16): reveals which rows have equal values") {
+		t.Errorf("unexpected text report:\n%s", report.String())
+	}
+
+	// pages count as encrypted only for files opened with a page cipher
+	hf, err := NewEncryptedHeapFile(dir+"/sealed.dat", &TupleDesc{Fields: []FieldType{{Fname: "x", Ftype: IntType}}}, bp, NewKeyStore())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if !pagesEncrypted(hf) {
+		t.Errorf("expected a file opened with NewEncryptedHeapFile to be reported encrypted")
+	}
+}
@@ -0,0 +1,275 @@
+package godb
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Dynamic data masking. A masked projection declares, for a role and a
+// table, an expression over a column (e.g. "maskssn(ssn)") that replaces
+// the column's values in the output of queries run by that role. Masks
+// apply wherever a column reaches the result: in the select list, inside
+// functions of it, in aggregates and in SELECT *. Predicates and joins still
+// see the real values, so a masked role can look rows up by an identifier
+// it cannot read back. Masks are saved in column_masks.json next to the
+// catalog.
+
+const columnMasksFile = "column_masks.json"
+
+type columnMaskKey struct {
+	role, table, column string
+}
+
+type columnMask struct {
+	source string // as declared, for saving
+	expr   Expr
+}
+
+// a mask as saved in columnMasksFile
+type savedColumnMask struct {
+	Role   string `json:"role"`
+	Table  string `json:"table"`
+	Column string `json:"column"`
+	Mask   string `json:"mask"`
+}
+
+// Declares that role sees column of table through mask, an expression
+// whose only column reference is column itself, e.g. "agebucket(age, 10)".
+// Only the superuser may declare masks.
+func (c *Catalog) SetColumnMask(role string, table string, column string, mask string) error {
+	err := c.checkSuperuser("declare masks")
+	if err != nil {
+		return err
+	}
+	e, err := c.parseColumnMask(table, column, mask)
+	if err != nil {
+		return err
+	}
+	key := columnMaskKey{role, table, column}
+	old, existed := c.masks[key]
+	c.masks[key] = columnMask{mask, e}
+	err = c.saveColumnMasks()
+	if err != nil {
+		if existed {
+			c.masks[key] = old
+		} else {
+			delete(c.masks, key)
+		}
+		return err
+	}
+	return nil
+}
+
+func (c *Catalog) parseColumnMask(table string, column string, mask string) (Expr, error) {
+	t := c.tableMap[table]
+	if t == nil {
+		return nil, GoDBError{NoSuchTableError, fmt.Sprintf("no table '%s' found", table)}
+	}
+	fieldNo, err := findFieldInTd(FieldType{column, "", UnknownType}, &t.desc)
+	if err != nil {
+		return nil, err
+	}
+	desc := TupleDesc{Fields: []FieldType{t.desc.Fields[fieldNo]}}
+	e, err := parseColumnExpr(c, mask, &desc)
+	if err != nil {
+		return nil, err
+	}
+	err = checkColumnExpr(e, column)
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Removes the mask of column of table for role, if any.
+func (c *Catalog) DropColumnMask(role string, table string, column string) error {
+	err := c.checkSuperuser("drop masks")
+	if err != nil {
+		return err
+	}
+	key := columnMaskKey{role, table, column}
+	old, existed := c.masks[key]
+	if !existed {
+		return nil
+	}
+	delete(c.masks, key)
+	err = c.saveColumnMasks()
+	if err != nil {
+		c.masks[key] = old
+		return err
+	}
+	return nil
+}
+
+func (c *Catalog) saveColumnMasks() error {
+	saved := make([]savedColumnMask, 0, len(c.masks))
+	for key, mask := range c.masks {
+		saved = append(saved, savedColumnMask{key.role, key.table, key.column, mask.source})
+	}
+	sort.Slice(saved, func(i, j int) bool {
+		a, b := saved[i], saved[j]
+		if a.Role != b.Role {
+			return a.Role < b.Role
+		}
+		if a.Table != b.Table {
+			return a.Table < b.Table
+		}
+		return a.Column < b.Column
+	})
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(c.rootPath+"/"+columnMasksFile, data, 0600)
+}
+
+// Loads the masks saved next to the catalog, if any.
+func (c *Catalog) loadColumnMasks() error {
+	path := c.rootPath + "/" + columnMasksFile
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var saved []savedColumnMask
+	err = json.Unmarshal(data, &saved)
+	if err != nil {
+		return GoDBError{MalformedDataError, fmt.Sprintf("malformed column masks %s: %s", path, err.Error())}
+	}
+	for _, m := range saved {
+		e, err := c.parseColumnMask(m.Table, m.Column, m.Mask)
+		if err != nil {
+			return GoDBError{MalformedDataError, fmt.Sprintf("cannot restore the mask of %s.%s for %s: %s", m.Table, m.Column, m.Role, err.Error())}
+		}
+		c.masks[columnMaskKey{m.Role, m.Table, m.Column}] = columnMask{m.Mask, e}
+	}
+	return nil
+}
+
+// Sets the role queries run as; masks declared for the role apply to them.
+// A user may only choose a role it holds, and "" makes it act as all of
+// them again (see sessionRoles).
+func (c *Catalog) SetRole(role string) error {
+	if c.user != "" && role != "" {
+		a, err := c.access()
+		if err != nil {
+			return err
+		}
+		a.mutex.Lock()
+		holds := a.members[c.user][role]
+		a.mutex.Unlock()
+		if !holds {
+			return GoDBError{PermissionError, fmt.Sprintf("permission denied: user %s does not hold role %s", c.user, role)}
+		}
+	}
+	c.role = role
+	return nil
+}
+
+func (c *Catalog) Role() string {
+	return c.role
+}
+
+// Checks that e reads no column but column and calls known functions with
+// arguments of the right types.
+func checkColumnExpr(e Expr, column string) error {
+	switch e := e.(type) {
+	case *FieldExpr:
+		if e.selectField.Fname != column {
+			return GoDBError{IllegalOperationError, fmt.Sprintf("expression over %s cannot read column %s", column, e.selectField.Fname)}
+		}
+	case *FuncExpr:
+		fType, exists := funcs[e.op]
+		if !exists {
+			return GoDBError{ParseError, fmt.Sprintf("unknown function %s", e.op)}
+		}
+		if len(e.args) != len(fType.argTypes) {
+			return GoDBError{ParseError, fmt.Sprintf("function %s expected %d args", e.op, len(fType.argTypes))}
+		}
+		for i, arg := range e.args {
+			if (*arg).GetExprType().Ftype != fType.argTypes[i] {
+				return GoDBError{TypeMismatchError, fmt.Sprintf("wrong type of argument %d to %s", i+1, e.op)}
+			}
+			err := checkColumnExpr(*arg, column)
+			if err != nil {
+				return err
+			}
+		}
+	case *vaultExpr:
+		return GoDBError{IllegalOperationError, "tokenize and detokenize cannot be used here"}
+	}
+	return nil
+}
+
+// Replaces the column read by a mask with field.
+func applyMask(mask Expr, field *FieldExpr) Expr {
+	switch mask := mask.(type) {
+	case *FieldExpr:
+		return field
+	case *FuncExpr:
+		args := make([]*Expr, len(mask.args))
+		for i, arg := range mask.args {
+			masked := applyMask(*arg, field)
+			args[i] = &masked
+		}
+		return &FuncExpr{mask.op, args}
+	}
+	return mask
+}
+
+// whether the session's roles have masks on any of tables
+func (c *Catalog) masksAny(tables []*LogicalTableNode) bool {
+	if len(c.masks) == 0 {
+		return false
+	}
+	for _, role := range c.sessionRoles() {
+		for key := range c.masks {
+			for _, t := range tables {
+				if key.role == role && key.table == t.tableName {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// Masks the columns of tables that e reads, for the session's roles. When
+// several of them mask a column, the mask of the first role by name
+// applies.
+func (c *Catalog) maskExpr(tables []*LogicalTableNode, e Expr) Expr {
+	switch e := e.(type) {
+	case *FieldExpr:
+		for _, t := range tables {
+			name := t.tableName
+			if t.alias != "" {
+				name = t.alias
+			}
+			if !strings.EqualFold(name, e.selectField.TableQualifier) {
+				continue
+			}
+			for _, role := range c.sessionRoles() {
+				if mask, exists := c.masks[columnMaskKey{role, t.tableName, e.selectField.Fname}]; exists {
+					return applyMask(mask.expr, e)
+				}
+			}
+		}
+	case *FuncExpr:
+		args := make([]*Expr, len(e.args))
+		changed := false
+		for i, arg := range e.args {
+			masked := c.maskExpr(tables, *arg)
+			changed = changed || masked != *arg
+			args[i] = &masked
+		}
+		if changed {
+			return &FuncExpr{e.op, args}
+		}
+	}
+	return e
+}
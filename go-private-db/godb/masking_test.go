@@ -0,0 +1,232 @@
+package godb
+
+import (
+	"os"
+	"testing"
+)
+
+func TestMaskingFuncs(t *testing.T) {
+	if v := maskSSNFunc([]any{"123-45-6789"}); v != "***-**-6789" {
+		t.Errorf("unexpected ssn mask %v", v)
+	}
+	if v := maskSSNFunc([]any{"12"}); v != "***-**-****" {
+		t.Errorf("unexpected mask of short value %v", v)
+	}
+	if v := truncYearFunc([]any{"3/4/1980"}); v != "1980-01-01" {
+		t.Errorf("unexpected truncated date %v", v)
+	}
+	if v := truncYearFunc([]any{"1975-11-02"}); v != "1975-01-01" {
+		t.Errorf("unexpected truncated date %v", v)
+	}
+	if v := ageBucketFunc([]any{int64(37), int64(10)}); v != "30-39" {
+		t.Errorf("unexpected age bucket %v", v)
+	}
+	if v := ageBucketFunc([]any{int64(37), int64(5)}); v != "35-39" {
+		t.Errorf("unexpected age bucket %v", v)
+	}
+
+	defer SetPseudonymKey(nil)
+	SetPseudonymKey([]byte("k1"))
+	p1 := pseudonymFunc([]any{"sam"})
+	if p1 != pseudonymFunc([]any{"sam"}) || p1 == pseudonymFunc([]any{"george"}) {
+		t.Errorf("expected stable, distinct pseudonyms")
+	}
+	SetPseudonymKey([]byte("k2"))
+	if p1 == pseudonymFunc([]any{"sam"}) {
+		t.Errorf("expected pseudonyms to depend on the key")
+	}
+}
+
+func TestPseudonymKey(t *testing.T) {
+	defer SetPseudonymKey(nil)
+	arg := Expr(&ConstExpr{StringField{"sam"}, StringType})
+	e := &FuncExpr{"pseudonym", []*Expr{&arg}}
+	SetPseudonymKey(nil)
+	if _, err := e.EvalExpr(nil); err == nil {
+		t.Errorf("expected pseudonym to fail without a key")
+	}
+
+	path := t.TempDir() + "/keys.json"
+	ks, _ := OpenKeyStore(path)
+	if err := LoadPseudonymKey(ks); err != nil {
+		t.Fatalf(err.Error())
+	}
+	p1, err := e.EvalExpr(nil)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	SetPseudonymKey(nil)
+	ks, _ = OpenKeyStore(path)
+	if err := LoadPseudonymKey(ks); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if p2, _ := e.EvalExpr(nil); p2 != p1 {
+		t.Errorf("expected the key store to keep pseudonyms stable, got %v and %v", p1, p2)
+	}
+}
+
+func maskingTestCatalog(t *testing.T) (*Catalog, TransactionID) {
+	dir := t.TempDir()
+	os.WriteFile(dir+"/catalog.txt", []byte("patients (name string, ssn string, dob string, age int)\n"), 0600)
+	bp := NewBufferPool(3)
+	c, err := NewCatalogFromFile("catalog.txt", bp, dir)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	tid := NewTID()
+	bp.BeginTransaction(tid)
+	_, op, err := Parse(c, "insert into patients values ('sam', '123-45-6789', '1980-03-04', 37), ('george', '555-12-3456', '1975-11-02', 42)")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	iter, _ := op.Iterator(tid)
+	_, err = iter()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	return c, tid
+}
+
+func queryRows(t *testing.T, c *Catalog, tid TransactionID, sql string) []*Tuple {
+	_, op, err := Parse(c, sql)
+	if err != nil {
+		t.Fatalf("%s: %s", sql, err.Error())
+	}
+	iter, err := op.Iterator(tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	var rows []*Tuple
+	for {
+		tup, err := iter()
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if tup == nil {
+			return rows
+		}
+		rows = append(rows, tup)
+	}
+}
+
+func TestMaskedProjection(t *testing.T) {
+	c, tid := maskingTestCatalog(t)
+	for col, mask := range map[string]string{"ssn": "maskssn(ssn)", "dob": "truncyear(dob)", "age": "agebucket(age, 10)"} {
+		err := c.SetColumnMask("support", "patients", col, mask)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	if c.SetColumnMask("support", "patients", "ssn", "maskssn(name)") == nil {
+		t.Errorf("expected a mask reading another column to be rejected")
+	}
+	if c.SetColumnMask("support", "patients", "ssn", "nosuchfunc(ssn)") == nil {
+		t.Errorf("expected a mask with an unknown function to be rejected")
+	}
+	if c.SetColumnMask("support", "patients", "age", "maskssn(age)") == nil {
+		t.Errorf("expected a mask with the wrong argument type to be rejected")
+	}
+
+	c.SetRole("support")
+	rows := queryRows(t, c, tid, "select name, ssn, dob, age from patients where ssn = '123-45-6789'")
+	if len(rows) != 1 {
+		t.Fatalf("expected lookup by the real ssn to find one row, got %d", len(rows))
+	}
+	expected := []DBValue{StringField{"sam"}, StringField{"***-**-6789"}, StringField{"1980-01-01"}, StringField{"30-39"}}
+	for i, v := range expected {
+		if rows[0].Fields[i] != v {
+			t.Errorf("expected %v, got %v", v, rows[0].Fields[i])
+		}
+	}
+
+	rows = queryRows(t, c, tid, "select * from patients p")
+	if len(rows) != 2 || rows[1].Fields[1] != (StringField{"***-**-3456"}) || rows[1].Fields[0] != (StringField{"george"}) {
+		t.Errorf("expected SELECT * to be masked, got %v", rows)
+	}
+	rows = queryRows(t, c, tid, "select getsubstr(ssn, 0, 3) from patients")
+	if rows[0].Fields[0] != (StringField{"***"}) {
+		t.Errorf("expected functions of masked columns to see masked values, got %v", rows[0].Fields[0])
+	}
+	rows = queryRows(t, c, tid, "select max(ssn) from patients")
+	if rows[0].Fields[0] != (StringField{"***-**-6789"}) {
+		t.Errorf("expected aggregates of masked columns to see masked values, got %v", rows[0].Fields[0])
+	}
+	_, op, err := Parse(c, "select sum(age) from patients")
+	if err == nil {
+		_, err = op.Iterator(tid)
+	}
+	if err == nil {
+		t.Errorf("expected sum of a masked int column to fail")
+	}
+
+	c.SetRole("")
+	rows = queryRows(t, c, tid, "select ssn, age from patients where name = 'sam'")
+	if rows[0].Fields[0] != (StringField{"123-45-6789"}) || rows[0].Fields[1] != (IntField{37}) {
+		t.Errorf("expected an unmasked role to see real values, got %v", rows[0])
+	}
+}
+
+func TestMasksFollowUserRoles(t *testing.T) {
+	c, tid := maskingTestCatalog(t)
+	if err := c.SetColumnMask("support", "patients", "ssn", "maskssn(ssn)"); err != nil {
+		t.Fatalf(err.Error())
+	}
+	for _, sql := range []string{
+		"create user sue",
+		"create role support",
+		"create role billing",
+		"grant support to sue",
+		"grant billing to sue",
+		"grant select on patients to support",
+	} {
+		mustParse(t, c, sql)
+	}
+	c.SetRole("billing")
+	if err := c.SetUser("sue"); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if c.Role() != "" {
+		t.Errorf("expected the superuser's role not to carry over to sue, got %q", c.Role())
+	}
+	rows := queryRows(t, c, tid, "select ssn from patients where name = 'sam'")
+	if rows[0].Fields[0] != (StringField{"***-**-6789"}) {
+		t.Errorf("expected sue's role to mask ssn without choosing it, got %v", rows[0].Fields[0])
+	}
+	if err := c.SetRole("nosuchrole"); err == nil {
+		t.Errorf("expected sue not to take a role she does not hold")
+	}
+	rows = queryRows(t, c, tid, "select ssn from patients where name = 'sam'")
+	if rows[0].Fields[0] != (StringField{"***-**-6789"}) {
+		t.Errorf("expected ssn to stay masked, got %v", rows[0].Fields[0])
+	}
+}
+
+func TestMasksSurviveReopen(t *testing.T) {
+	c, tid := maskingTestCatalog(t)
+	if err := c.SetColumnMask("support", "patients", "ssn", "maskssn(ssn)"); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := c.SetColumnMask("support", "patients", "age", "agebucket(age, 10)"); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := c.DropColumnMask("support", "patients", "age"); err != nil {
+		t.Fatalf(err.Error())
+	}
+	c.bp.CommitTransaction(tid)
+
+	bp := NewBufferPool(3)
+	c, err := NewCatalogFromFile("catalog.txt", bp, c.rootPath)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	tid = NewTID()
+	bp.BeginTransaction(tid)
+	c.SetRole("support")
+	rows := queryRows(t, c, tid, "select ssn, age from patients where name = 'sam'")
+	if len(rows) != 1 || rows[0].Fields[0] != (StringField{"***-**-6789"}) {
+		t.Errorf("expected ssn to stay masked after reopening the catalog, got %v", rows)
+	}
+	if len(rows) == 1 && rows[0].Fields[1] != (IntField{37}) {
+		t.Errorf("expected the dropped age mask to stay dropped, got %v", rows[0].Fields[1])
+	}
+}
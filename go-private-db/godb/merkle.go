@@ -0,0 +1,388 @@
+package godb
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// Merkle trees over heap file pages, used to check that an aggregate over
+// an encrypted table covered every row the client inserted. Each leaf
+// commits to a summary of one page: its number of rows and the homomorphic
+// sums of chosen columns. The client holds the root (MerkleRoot) and never
+// takes it from the server: it starts from the root of an empty file and,
+// for every tuple it inserts, checks the server's proof of the page the
+// tuple went into, computes the page's new summary and updates the root.
+// The server stores the summaries the client computed (MerkleFile); it
+// cannot compute them itself, as homomorphic additions are randomized. To
+// check an aggregate, the server sends a proof of every page's summary
+// (MerkleFile.Proofs); the client checks them against its root with
+// MerkleRoot.Verify and compares the total with the server's answer,
+// without receiving any tuples.
+//
+// Leaves hash the page number and the page's summary, so summaries cannot
+// be reordered or moved between positions. Leaf and inner hashes use
+// different prefixes, and an odd node at the end of a level is promoted
+// unchanged. Deletes are not tracked.
+
+const (
+	merkleLeafPrefix  = 0
+	merkleInnerPrefix = 1
+)
+
+// What the leaf of a page commits to.
+type PageSummary struct {
+	Rows int64
+	Sums []string // homomorphic sum of each summed column, "" for none
+}
+
+// The summary of a page together with the sibling hashes on the path from
+// the page's leaf to the root.
+type PageProof struct {
+	PageNo  int
+	Summary PageSummary
+	Path    [][]byte
+}
+
+// The columns whose ciphertexts page summaries add up, and the key they
+// are added under.
+type merkleSums struct {
+	columns []string
+	key     HomomorphicPubKey
+}
+
+// The summary of a page with summary s after inserting t.
+func (m *merkleSums) add(s PageSummary, t *Tuple) (PageSummary, error) {
+	sums := make([]string, len(m.columns))
+	for i, column := range m.columns {
+		fieldNo, err := findFieldInTd(FieldType{column, "", UnknownType}, &t.Desc)
+		if err != nil {
+			return s, err
+		}
+		v, ok := t.Fields[fieldNo].(StringField)
+		if !ok {
+			return s, GoDBError{TypeMismatchError, fmt.Sprintf("summed column %s must hold homomorphic ciphertexts", column)}
+		}
+		if i >= len(s.Sums) || s.Sums[i] == "" {
+			sums[i] = v.Value
+			continue
+		}
+		sum, err := m.key.Add([]byte(s.Sums[i]), []byte(v.Value))
+		if err != nil {
+			return s, err
+		}
+		sums[i] = string(sum)
+	}
+	return PageSummary{Rows: s.Rows + 1, Sums: sums}, nil
+}
+
+type merkleTree struct {
+	levels [][][]byte // levels[0] are the leaves, the last level is the root
+}
+
+func merkleLeafHash(pageNo int, s PageSummary) []byte {
+	h := sha256.New()
+	h.Write([]byte{merkleLeafPrefix})
+	binary.Write(h, binary.BigEndian, int64(pageNo))
+	binary.Write(h, binary.BigEndian, s.Rows)
+	binary.Write(h, binary.BigEndian, int64(len(s.Sums)))
+	for _, sum := range s.Sums {
+		binary.Write(h, binary.BigEndian, int64(len(sum)))
+		h.Write([]byte(sum))
+	}
+	return h.Sum(nil)
+}
+
+func merkleInnerHash(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{merkleInnerPrefix})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+func newMerkleTree(leaves [][]byte) *merkleTree {
+	tree := &merkleTree{levels: [][][]byte{leaves}}
+	level := leaves
+	for len(level) > 1 {
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 < len(level) {
+				next = append(next, merkleInnerHash(level[i], level[i+1]))
+			} else {
+				next = append(next, level[i])
+			}
+		}
+		tree.levels = append(tree.levels, next)
+		level = next
+	}
+	return tree
+}
+
+func (t *merkleTree) root() []byte {
+	top := t.levels[len(t.levels)-1]
+	if len(top) == 0 {
+		return merkleInnerHash(nil, nil)
+	}
+	return top[0]
+}
+
+// sibling hashes from leaf i up to the root; promoted nodes have no sibling
+// and contribute nothing to the path
+func (t *merkleTree) path(i int) [][]byte {
+	var path [][]byte
+	for _, level := range t.levels[:len(t.levels)-1] {
+		if i%2 == 1 {
+			path = append(path, level[i-1])
+		} else if i+1 < len(level) {
+			path = append(path, level[i+1])
+		}
+		i /= 2
+	}
+	return path
+}
+
+// recomputes the root of a tree with numLeaves leaves from leaf i and its path
+func merkleRootFromPath(leaf []byte, i int, numLeaves int, path [][]byte) ([]byte, bool) {
+	hash := leaf
+	size := numLeaves
+	for size > 1 {
+		if i%2 == 1 || i+1 < size {
+			if len(path) == 0 {
+				return nil, false
+			}
+			if i%2 == 1 {
+				hash = merkleInnerHash(path[0], hash)
+			} else {
+				hash = merkleInnerHash(hash, path[0])
+			}
+			path = path[1:]
+		}
+		i /= 2
+		size = (size + 1) / 2
+	}
+	return hash, len(path) == 0
+}
+
+// Recomputes the root of a tree with n leaves from the path a leaf appended
+// at position n would have. The last leaf has no right siblings, so the
+// path holds the roots of the tree's full left subtrees, lowest first.
+func merkleRootBeforeAppend(path [][]byte) []byte {
+	if len(path) == 0 {
+		return merkleInnerHash(nil, nil)
+	}
+	hash := path[0]
+	for _, sibling := range path[1:] {
+		hash = merkleInnerHash(sibling, hash)
+	}
+	return hash
+}
+
+// The client's trusted record of a heap file: the root of the Merkle tree
+// over its page summaries.
+type MerkleRoot struct {
+	Hash     []byte
+	NumPages int
+	sums     merkleSums
+}
+
+// The root of an empty file whose page summaries add up the homomorphic
+// ciphertexts of columns under key.
+func NewMerkleRoot(columns []string, key HomomorphicPubKey) *MerkleRoot {
+	return &MerkleRoot{Hash: merkleInnerHash(nil, nil), sums: merkleSums{columns, key}}
+}
+
+// Updates r for t, which the server inserted into the page of proof. proof
+// must be the page's proof from before the insert, as returned by
+// MerkleFile.InsertTuple; a new page has PageNo NumPages and an empty
+// summary. Returns the page's new summary, for MerkleFile.SetSummary.
+func (r *MerkleRoot) Insert(proof PageProof, t *Tuple) (PageSummary, error) {
+	n := r.NumPages
+	if proof.PageNo < 0 || proof.PageNo > n {
+		return PageSummary{}, GoDBError{IntegrityError, fmt.Sprintf("insert proof for unknown page %d", proof.PageNo)}
+	}
+	if proof.PageNo == n {
+		if proof.Summary.Rows != 0 || len(proof.Summary.Sums) != 0 || !bytes.Equal(merkleRootBeforeAppend(proof.Path), r.Hash) {
+			return PageSummary{}, GoDBError{IntegrityError, fmt.Sprintf("proof for new page %d does not match the Merkle root", n)}
+		}
+		n++
+	} else {
+		hash, ok := merkleRootFromPath(merkleLeafHash(proof.PageNo, proof.Summary), proof.PageNo, n, proof.Path)
+		if !ok || !bytes.Equal(hash, r.Hash) {
+			return PageSummary{}, GoDBError{IntegrityError, fmt.Sprintf("page %d does not match the Merkle root", proof.PageNo)}
+		}
+	}
+	summary, err := r.sums.add(proof.Summary, t)
+	if err != nil {
+		return PageSummary{}, err
+	}
+	hash, ok := merkleRootFromPath(merkleLeafHash(proof.PageNo, summary), proof.PageNo, n, proof.Path)
+	if !ok {
+		return PageSummary{}, GoDBError{IntegrityError, fmt.Sprintf("malformed proof for page %d", proof.PageNo)}
+	}
+	r.Hash = hash
+	r.NumPages = n
+	return summary, nil
+}
+
+// Checks that proofs cover every page of the file exactly once and that
+// each page's summary matches r. Returns the total number of rows and the
+// sums of the summed columns over all pages, which the client compares
+// (after decryption) with an aggregate the server returned.
+func (r *MerkleRoot) Verify(proofs []PageProof) (PageSummary, error) {
+	total := PageSummary{Sums: make([]string, len(r.sums.columns))}
+	if len(proofs) != r.NumPages {
+		return total, GoDBError{IntegrityError, fmt.Sprintf("server returned %d pages, expected %d", len(proofs), r.NumPages)}
+	}
+	seen := make([]bool, r.NumPages)
+	for _, proof := range proofs {
+		if proof.PageNo < 0 || proof.PageNo >= r.NumPages {
+			return total, GoDBError{IntegrityError, fmt.Sprintf("server returned unknown page %d", proof.PageNo)}
+		}
+		if seen[proof.PageNo] {
+			return total, GoDBError{IntegrityError, fmt.Sprintf("server returned page %d more than once", proof.PageNo)}
+		}
+		seen[proof.PageNo] = true
+		hash, ok := merkleRootFromPath(merkleLeafHash(proof.PageNo, proof.Summary), proof.PageNo, r.NumPages, proof.Path)
+		if !ok || !bytes.Equal(hash, r.Hash) {
+			return total, GoDBError{IntegrityError, fmt.Sprintf("page %d does not match the Merkle root", proof.PageNo)}
+		}
+		if len(proof.Summary.Sums) != len(total.Sums) {
+			return total, GoDBError{IntegrityError, fmt.Sprintf("page %d has %d sums, expected %d", proof.PageNo, len(proof.Summary.Sums), len(total.Sums))}
+		}
+		total.Rows += proof.Summary.Rows
+		for i, sum := range proof.Summary.Sums {
+			if sum == "" {
+				continue
+			}
+			if total.Sums[i] == "" {
+				total.Sums[i] = sum
+				continue
+			}
+			added, err := r.sums.key.Add([]byte(total.Sums[i]), []byte(sum))
+			if err != nil {
+				return total, err
+			}
+			total.Sums[i] = string(added)
+		}
+	}
+	return total, nil
+}
+
+// The server's side of a verified heap file: it keeps the summary of every
+// page, as computed by the client, and hands out proofs. Summaries are saved
+// next to the heap file, in <file>.merkle.
+type MerkleFile struct {
+	hf        *HeapFile
+	path      string
+	mutex     sync.Mutex
+	summaries []PageSummary
+}
+
+// Opens the page summaries of hf. A heap file without saved summaries must
+// be empty, since its existing pages could not be proven.
+func NewMerkleFile(hf *HeapFile) (*MerkleFile, error) {
+	m := &MerkleFile{hf: hf, path: hf.file + ".merkle"}
+	data, err := os.ReadFile(m.path)
+	if os.IsNotExist(err) {
+		if hf.NumPages() > 0 {
+			return nil, GoDBError{IllegalOperationError, fmt.Sprintf("%s has pages but no Merkle summaries", hf.file)}
+		}
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var saved []savedPageSummary
+	err = json.Unmarshal(data, &saved)
+	if err != nil {
+		return nil, GoDBError{MalformedDataError, fmt.Sprintf("malformed Merkle summaries %s: %s", m.path, err.Error())}
+	}
+	for _, s := range saved {
+		summary := PageSummary{Rows: s.Rows, Sums: make([]string, len(s.Sums))}
+		for i, sum := range s.Sums {
+			summary.Sums[i] = string(sum)
+		}
+		m.summaries = append(m.summaries, summary)
+	}
+	return m, nil
+}
+
+// a PageSummary as saved; ciphertexts are binary, so they are saved as
+// []byte (base64 in JSON)
+type savedPageSummary struct {
+	Rows int64
+	Sums [][]byte
+}
+
+func (m *MerkleFile) tree(summaries []PageSummary) *merkleTree {
+	leaves := make([][]byte, len(summaries))
+	for i, s := range summaries {
+		leaves[i] = merkleLeafHash(i, s)
+	}
+	return newMerkleTree(leaves)
+}
+
+// Inserts t into the file and returns the proof of the page it went into,
+// which the client passes to MerkleRoot.Insert and then answers with the
+// page's new summary (SetSummary).
+func (m *MerkleFile) InsertTuple(t *Tuple, tid TransactionID) (PageProof, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	err := m.hf.insertTuple(t, tid)
+	if err != nil {
+		return PageProof{}, err
+	}
+	rid, ok := t.Rid.(TupleRecordID)
+	if !ok || rid.PageNo < 0 || rid.PageNo > len(m.summaries) {
+		return PageProof{}, GoDBError{IllegalOperationError, "inserted tuple is not on a summarized page"}
+	}
+	summaries := m.summaries
+	if rid.PageNo == len(summaries) {
+		// the path of an appended leaf does not depend on its value
+		summaries = append(summaries[:len(summaries):len(summaries)], PageSummary{})
+	}
+	return PageProof{PageNo: rid.PageNo, Summary: summaries[rid.PageNo], Path: m.tree(summaries).path(rid.PageNo)}, nil
+}
+
+// Records the summary the client computed for page pageNo after an insert.
+func (m *MerkleFile) SetSummary(pageNo int, s PageSummary) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if pageNo < 0 || pageNo > len(m.summaries) {
+		return GoDBError{IllegalOperationError, fmt.Sprintf("no summary for page %d", pageNo)}
+	}
+	if pageNo == len(m.summaries) {
+		m.summaries = append(m.summaries, s)
+	} else {
+		m.summaries[pageNo] = s
+	}
+	saved := make([]savedPageSummary, len(m.summaries))
+	for i, summary := range m.summaries {
+		saved[i].Rows = summary.Rows
+		for _, sum := range summary.Sums {
+			saved[i].Sums = append(saved[i].Sums, []byte(sum))
+		}
+	}
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(m.path, data, 0644)
+}
+
+// Proofs of the summaries of all pages.
+func (m *MerkleFile) Proofs() []PageProof {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	tree := m.tree(m.summaries)
+	proofs := make([]PageProof, len(m.summaries))
+	for i, s := range m.summaries {
+		proofs[i] = PageProof{PageNo: i, Summary: s, Path: tree.path(i)}
+	}
+	return proofs
+}
@@ -0,0 +1,221 @@
+package godb
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestMerkleProofs(t *testing.T) {
+	for n := 1; n <= 9; n++ {
+		leaves := make([][]byte, n)
+		for i := range leaves {
+			leaves[i] = merkleLeafHash(i, PageSummary{Rows: int64(i)})
+		}
+		tree := newMerkleTree(leaves)
+		for i := 0; i < n; i++ {
+			root, ok := merkleRootFromPath(leaves[i], i, n, tree.path(i))
+			if !ok || string(root) != string(tree.root()) {
+				t.Errorf("proof for leaf %d of %d does not reach the root", i, n)
+			}
+			if n > 1 {
+				root, _ = merkleRootFromPath(leaves[i], (i+1)%n, n, tree.path(i))
+				if string(root) == string(tree.root()) {
+					t.Errorf("proof for leaf %d of %d verified at the wrong position", i, n)
+				}
+			}
+		}
+		// the path of a leaf appended to the first n-1 leaves proves their root
+		before := newMerkleTree(leaves[:n-1])
+		if string(merkleRootBeforeAppend(tree.path(n-1))) != string(before.root()) {
+			t.Errorf("append path of leaf %d does not reach the root of the %d leaves before it", n-1, n-1)
+		}
+	}
+}
+
+func TestMerkleVerifiedAggregate(t *testing.T) {
+	scheme, err := NewHomomorphicScheme(PaillierSchemeKind, testHomKeySize)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	encrypt, decrypt, pk := newHomEncryptionFuncFromScheme(scheme)
+
+	td := TupleDesc{Fields: []FieldType{
+		{Fname: "name", Ftype: StringType},
+		{Fname: "age", Ftype: StringType},
+	}}
+	os.Remove("merkle_test.dat")
+	os.Remove("merkle_test.dat.merkle")
+	defer os.Remove("merkle_test.dat")
+	defer os.Remove("merkle_test.dat.merkle")
+	bp := NewBufferPool(10)
+	hf, err := NewHeapFile("merkle_test.dat", &td, bp)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	tid := NewTID()
+	bp.BeginTransaction(tid)
+	server, err := NewMerkleFile(hf)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	root := NewMerkleRoot([]string{"age"}, pk)
+
+	newTuple := func(name string, age int64) *Tuple {
+		c, _ := encrypt(age)
+		return &Tuple{Desc: td, Fields: []DBValue{StringField{name}, StringField{c.(string)}}}
+	}
+	insert := func(tup *Tuple) error {
+		proof, err := server.InsertTuple(tup, tid)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		summary, err := root.Insert(proof, tup)
+		if err != nil {
+			return err
+		}
+		return server.SetSummary(proof.PageNo, summary)
+	}
+	n := 150
+	var sum int64
+	for i := 0; i < n; i++ {
+		if err := insert(newTuple(fmt.Sprintf("p%d", i), int64(i))); err != nil {
+			t.Fatalf("insert %d: %s", i, err.Error())
+		}
+		sum += int64(i)
+	}
+	if root.NumPages < 3 {
+		t.Fatalf("expected the table to span at least 3 pages, got %d", root.NumPages)
+	}
+
+	// the server's answer
+	serverSum := func() int64 {
+		expr := FieldExpr{FieldType{Fname: "age", Ftype: StringType}}
+		sa := EncryptedSumAggState[string]{}
+		sa.Init("sum", &expr, stringAggGetter, pk)
+		iter, err := NewEncryptedAggregator([]EncryptedAggState{&sa}, hf).Iterator(tid)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		tup, err := iter()
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		v, _ := decrypt(tup.Fields[0].(StringField).Value)
+		return v.(int64)
+	}
+	proofs := server.Proofs()
+
+	// the client's check, without the tuples
+	total, err := root.Verify(proofs)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	verifiedSum, _ := decrypt(total.Sums[0])
+	if serverSum() != sum || verifiedSum.(int64) != sum || total.Rows != int64(n) {
+		t.Errorf("expected a sum of %d over %d rows, got %v from the server and %v over %d rows from the proofs", sum, n, serverSum(), verifiedSum, total.Rows)
+	}
+
+	// summaries persist with the heap file
+	reopened, err := NewMerkleFile(hf)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, err = root.Verify(reopened.Proofs()); err != nil {
+		t.Errorf("expected saved summaries to verify, got %v", err)
+	}
+
+	// dropped page
+	_, err = root.Verify(proofs[1:])
+	if !isIntegrityError(err) {
+		t.Errorf("expected integrity error for a dropped page, got %v", err)
+	}
+
+	// page returned twice instead of another page
+	repeated := append([]PageProof{proofs[0]}, proofs[:len(proofs)-1]...)
+	_, err = root.Verify(repeated)
+	if !isIntegrityError(err) {
+		t.Errorf("expected integrity error for a repeated page, got %v", err)
+	}
+
+	// page with a row dropped
+	short := append([]PageProof{}, proofs...)
+	short[1].Summary.Rows--
+	_, err = root.Verify(short)
+	if !isIntegrityError(err) {
+		t.Errorf("expected integrity error for a page missing a row, got %v", err)
+	}
+
+	// pages swapped
+	swapped := append([]PageProof{}, proofs...)
+	swapped[0].Summary, swapped[1].Summary = proofs[1].Summary, proofs[0].Summary
+	_, err = root.Verify(swapped)
+	if !isIntegrityError(err) {
+		t.Errorf("expected integrity error for swapped pages, got %v", err)
+	}
+
+	// a summary the client did not compute
+	server.SetSummary(0, PageSummary{Rows: 1, Sums: []string{proofs[0].Summary.Sums[0]}})
+	if _, err = root.Verify(server.Proofs()); !isIntegrityError(err) {
+		t.Errorf("expected integrity error for a forged summary, got %v", err)
+	}
+	if err = insert(newTuple("new", 1)); !isIntegrityError(err) {
+		t.Errorf("expected integrity error for an insert into a page with a forged summary, got %v", err)
+	}
+	server.SetSummary(0, proofs[0].Summary)
+
+	// a row the client did not insert is in the server's answer but not
+	// in the verified total
+	server.InsertTuple(newTuple("forged", 1000), tid)
+	total, err = root.Verify(server.Proofs())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	verifiedSum, _ = decrypt(total.Sums[0])
+	if serverSum() == verifiedSum.(int64) {
+		t.Errorf("expected the forged row to show as a difference from the verified sum")
+	}
+}
+
+func TestMerkleRootGrowsFromEmpty(t *testing.T) {
+	scheme, err := NewHomomorphicScheme(PaillierSchemeKind, testHomKeySize)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	encrypt, decrypt, pk := newHomEncryptionFuncFromScheme(scheme)
+	td := TupleDesc{Fields: []FieldType{{Fname: "age", Ftype: StringType}}}
+	root := NewMerkleRoot([]string{"age"}, pk)
+	if total, err := root.Verify(nil); err != nil || total.Rows != 0 {
+		t.Errorf("expected an empty file to verify, got %v %v", total, err)
+	}
+
+	// one row per new page, so appends go to trees of every shape
+	m := &MerkleFile{}
+	var sum int64
+	for i := 0; i < 9; i++ {
+		c, _ := encrypt(int64(i))
+		tup := &Tuple{Desc: td, Fields: []DBValue{StringField{c.(string)}}}
+		proof := PageProof{PageNo: i, Path: m.tree(append(m.summaries, PageSummary{})).path(i)}
+		summary, err := root.Insert(proof, tup)
+		if err != nil {
+			t.Fatalf("page %d: %s", i, err.Error())
+		}
+		m.summaries = append(m.summaries, summary)
+		sum += int64(i)
+	}
+	total, err := root.Verify(m.Proofs())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	verifiedSum, _ := decrypt(total.Sums[0])
+	if total.Rows != 9 || verifiedSum.(int64) != sum {
+		t.Errorf("expected %d over 9 rows, got %v over %d", sum, verifiedSum, total.Rows)
+	}
+
+	// a new page cannot be claimed to have rows already
+	c, _ := encrypt(int64(1))
+	proof := PageProof{PageNo: 9, Summary: PageSummary{Rows: 1}, Path: m.tree(append(m.summaries, PageSummary{})).path(9)}
+	if _, err := root.Insert(proof, &Tuple{Desc: td, Fields: []DBValue{StringField{c.(string)}}}); !isIntegrityError(err) {
+		t.Errorf("expected integrity error for a new page with rows, got %v", err)
+	}
+}
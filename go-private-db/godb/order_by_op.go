@@ -63,6 +63,7 @@ func (s *tupleSorter) Less(i, j int) bool {
 // the sort algorithm will invoke to preduce a sorted list. See the first
 // example, example of SortMultiKeys, and documentation at: https://pkg.go.dev/sort
 func (o *OrderBy) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
+	bindVaultExprs(tid, o.orderBy...)
 	iter, err := o.child.Iterator(tid)
 	if err != nil {
 		return nil, err
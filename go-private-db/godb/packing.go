@@ -0,0 +1,170 @@
+package godb
+
+import (
+	"fmt"
+	"math/big"
+)
+
+// Name of the column holding the number of filled slots in each row of a
+// file written by packColumn.
+const PackedSlotsField = "slots"
+
+// Layout for packing several small non-negative integers into one
+// homomorphic plaintext. Slot i occupies bits [i*(ValueBits+GuardBits),
+// (i+1)*(ValueBits+GuardBits)). The guard bits absorb carries when packed
+// ciphertexts are added, so up to 2^GuardBits packed values can be summed
+// slot-wise before a slot overflows into its neighbour.
+type SlotPacking struct {
+	ValueBits int
+	GuardBits int
+	NumSlots  int
+}
+
+// Fits as many slots as possible into a plaintext of plaintextBits bits
+// (for Paillier, one less than the modulus size).
+func NewSlotPacking(plaintextBits int, valueBits int, guardBits int) (SlotPacking, error) {
+	if valueBits <= 0 || guardBits < 0 || valueBits > 63 {
+		return SlotPacking{}, GoDBError{IllegalOperationError, "slot value bits must be between 1 and 63 and guard bits non-negative"}
+	}
+	numSlots := plaintextBits / (valueBits + guardBits)
+	if numSlots < 1 {
+		return SlotPacking{}, GoDBError{IllegalOperationError, fmt.Sprintf("a %d bit slot does not fit in a %d bit plaintext", valueBits+guardBits, plaintextBits)}
+	}
+	return SlotPacking{ValueBits: valueBits, GuardBits: guardBits, NumSlots: numSlots}, nil
+}
+
+func (p SlotPacking) slotBits() uint {
+	return uint(p.ValueBits + p.GuardBits)
+}
+
+// How many packed plaintexts may be summed before a slot can overflow, or 0
+// if the guard bits allow more than any sum will see.
+func (p SlotPacking) maxAdditions() int64 {
+	if p.GuardBits >= 62 {
+		return 0
+	}
+	return int64(1) << p.GuardBits
+}
+
+// Packs up to NumSlots values into a big-endian plaintext.
+func (p SlotPacking) Pack(values []int64) ([]byte, error) {
+	if len(values) > p.NumSlots {
+		return nil, GoDBError{IllegalOperationError, fmt.Sprintf("cannot pack %d values into %d slots", len(values), p.NumSlots)}
+	}
+	packed := new(big.Int)
+	for i := len(values) - 1; i >= 0; i-- {
+		v := values[i]
+		if v < 0 || v >= int64(1)<<p.ValueBits {
+			return nil, GoDBError{MalformedDataError, fmt.Sprintf("value %d does not fit in a %d bit slot", v, p.ValueBits)}
+		}
+		packed.Lsh(packed, p.slotBits())
+		packed.Add(packed, big.NewInt(v))
+	}
+	return packed.Bytes(), nil
+}
+
+// Splits a (possibly summed) plaintext back into its NumSlots slots.
+func (p SlotPacking) Unpack(plaintext []byte) ([]int64, error) {
+	packed := new(big.Int).SetBytes(plaintext)
+	if packed.BitLen() > p.NumSlots*int(p.slotBits()) {
+		return nil, GoDBError{MalformedDataError, "packed plaintext has more bits than its slots"}
+	}
+	mask := new(big.Int).Sub(new(big.Int).Lsh(big1, p.slotBits()), big1)
+	values := make([]int64, p.NumSlots)
+	for i := 0; i < p.NumSlots; i++ {
+		slot := new(big.Int).And(packed, mask)
+		if !slot.IsInt64() {
+			return nil, GoDBError{MalformedDataError, "packed slot does not fit in an int64"}
+		}
+		values[i] = slot.Int64()
+		packed.Rsh(packed, p.slotBits())
+	}
+	return values, nil
+}
+
+// Encrypts the int column fname of hf into a new heap file toFile, packing
+// up to packing.NumSlots adjacent rows into each ciphertext. The output has
+// two columns: fname (the packed ciphertext, as a string) and
+// PackedSlotsField (the number of rows packed into it). Sums over the
+// output need packing.NumSlots times fewer additions; sums over more than
+// 2^GuardBits rows of it must be split (see LimitPackedAdditions).
+func packColumn(hf *HeapFile, fname string, packing SlotPacking, publicKey HomomorphicPubKey, toFile string, tid TransactionID) (*HeapFile, error) {
+	idx, err := findFieldInTd(FieldType{Fname: fname, Ftype: UnknownType}, hf.Descriptor())
+	if err != nil {
+		return nil, err
+	}
+	if hf.Descriptor().Fields[idx].Ftype != IntType {
+		return nil, GoDBError{TypeMismatchError, fmt.Sprintf("cannot pack non-integer column %s", fname)}
+	}
+
+	desc := &TupleDesc{Fields: []FieldType{
+		{Fname: fname, Ftype: StringType},
+		{Fname: PackedSlotsField, Ftype: IntType},
+	}}
+	out, err := NewHeapFile(toFile, desc, NewBufferPool(3))
+	if err != nil {
+		return nil, err
+	}
+
+	var values []int64
+	flush := func() error {
+		if len(values) == 0 {
+			return nil
+		}
+		plaintext, err := packing.Pack(values)
+		if err != nil {
+			return err
+		}
+		c, err := publicKey.Encrypt(plaintext)
+		if err != nil {
+			return err
+		}
+		t := Tuple{Desc: *desc, Fields: []DBValue{StringField{string(c)}, IntField{int64(len(values))}}}
+		err = out.insertTuple(&t, tid)
+		values = values[:0]
+		return err
+	}
+
+	iter, err := hf.Iterator(tid)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t, err := iter()
+		if err != nil {
+			return nil, err
+		}
+		if t == nil {
+			break
+		}
+		values = append(values, t.Fields[idx].(IntField).Value)
+		if len(values) == packing.NumSlots {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Decrypts a packed (possibly summed) ciphertext and adds up its slots.
+func newPackedHomDecryptionFunc(scheme HomomorphicScheme, packing SlotPacking) func(v any) (any, error) {
+	return func(v any) (any, error) {
+		plaintext, err := scheme.Decrypt([]byte(v.(string)))
+		if err != nil {
+			return nil, err
+		}
+		slots, err := packing.Unpack(plaintext)
+		if err != nil {
+			return nil, err
+		}
+		var total int64
+		for _, s := range slots {
+			total += s
+		}
+		return total, nil
+	}
+}
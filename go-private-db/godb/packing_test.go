@@ -0,0 +1,177 @@
+package godb
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestSlotPackingRoundTrip(t *testing.T) {
+	packing, err := NewSlotPacking(testHomKeySize-1, 16, 8)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if packing.NumSlots != (testHomKeySize-1)/24 {
+		t.Errorf("expected %d slots, got %d", (testHomKeySize-1)/24, packing.NumSlots)
+	}
+
+	p, err := packing.Pack([]int64{7, 0, 65535, 42})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	slots, err := packing.Unpack(p)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	for i, expected := range []int64{7, 0, 65535, 42} {
+		if slots[i] != expected {
+			t.Errorf("slot %d: expected %d, got %d", i, expected, slots[i])
+		}
+	}
+
+	_, err = packing.Pack([]int64{65536})
+	if err == nil {
+		t.Errorf("expected error packing a value wider than its slot")
+	}
+	_, err = packing.Pack([]int64{-1})
+	if err == nil {
+		t.Errorf("expected error packing a negative value")
+	}
+	_, err = packing.Pack(make([]int64, packing.NumSlots+1))
+	if err == nil {
+		t.Errorf("expected error packing more values than slots")
+	}
+}
+
+func TestPackedEncryptedAgg(t *testing.T) {
+	scheme, err := NewHomomorphicScheme(PaillierSchemeKind, testHomKeySize)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	packing, err := NewSlotPacking(testHomKeySize-1, 16, 8)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	td, _, _, hf, _, tid := makeTestVars()
+	n := 200
+	var sum int64
+	for i := 0; i < n; i++ {
+		tup := Tuple{Desc: td, Fields: []DBValue{StringField{fmt.Sprintf("p%d", i)}, IntField{int64(i * 3)}}}
+		hf.insertTuple(&tup, tid)
+		sum += int64(i * 3)
+	}
+
+	os.Remove("packed_test.dat")
+	defer os.Remove("packed_test.dat")
+	packedHf, err := packColumn(hf, "age", packing, scheme.GetPubKey(), "packed_test.dat", tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	expectedRows := (n + packing.NumSlots - 1) / packing.NumSlots
+	iter, _ := packedHf.Iterator(tid)
+	rows := 0
+	for {
+		tp, _ := iter()
+		if tp == nil {
+			break
+		}
+		rows++
+	}
+	if rows != expectedRows {
+		t.Errorf("expected %d packed rows for %d values, got %d", expectedRows, n, rows)
+	}
+
+	decrypt := newPackedHomDecryptionFunc(scheme, packing)
+	expr := FieldExpr{FieldType{Fname: "age", Ftype: StringType}}
+	slotsExpr := FieldExpr{FieldType{Fname: PackedSlotsField, Ftype: IntType}}
+
+	sa := EncryptedSumAggState[string]{}
+	sa.Init("sum", &expr, stringAggGetter, scheme.GetPubKey())
+	aa := EncryptedAvgAggState[string]{}
+	aa.Init("avg", &expr, stringAggGetter, scheme.GetPubKey())
+	aa.CountSlotsFrom(&slotsExpr)
+	sa.LimitPackedAdditions(packing)
+	aa.LimitPackedAdditions(packing)
+
+	agg := NewEncryptedAggregator([]EncryptedAggState{&sa, &aa}, packedHf)
+	aggIter, err := agg.Iterator(tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	tup, err := aggIter()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	gotSum, err := decrypt(tup.Fields[0].(StringField).Value)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if gotSum.(int64) != sum {
+		t.Errorf("expected packed sum %d, got %d", sum, gotSum.(int64))
+	}
+	avgSum, err := decrypt(tup.Fields[1].(StringField).Value)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	count := tup.Fields[2].(IntField).Value
+	if count != int64(n) || avgSum.(int64)/count != sum/int64(n) {
+		t.Errorf("expected avg %d over %d values, got %d over %d", sum/int64(n), n, avgSum.(int64)/count, count)
+	}
+}
+
+func TestPackedSumGuardBits(t *testing.T) {
+	scheme, err := NewHomomorphicScheme(PaillierSchemeKind, testHomKeySize)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	// 2 guard bits: at most 4 packed rows of 4 bit values may be summed
+	packing, err := NewSlotPacking(testHomKeySize-1, 4, 2)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	decrypt := newPackedHomDecryptionFunc(scheme, packing)
+	expr := FieldExpr{FieldType{Fname: "age", Ftype: StringType}}
+
+	os.Remove("packed_guard_test.dat")
+	defer os.Remove("packed_guard_test.dat")
+	for _, rows := range []int{4, 5} {
+		td, _, _, hf, _, tid := makeTestVars()
+		n := rows * packing.NumSlots
+		for i := 0; i < n; i++ {
+			tup := Tuple{Desc: td, Fields: []DBValue{StringField{fmt.Sprintf("p%d", i)}, IntField{15}}}
+			hf.insertTuple(&tup, tid)
+		}
+		os.Remove("packed_guard_test.dat")
+		packedHf, err := packColumn(hf, "age", packing, scheme.GetPubKey(), "packed_guard_test.dat", tid)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		sa := EncryptedSumAggState[string]{}
+		sa.Init("sum", &expr, stringAggGetter, scheme.GetPubKey())
+		sa.LimitPackedAdditions(packing)
+		aggIter, err := NewEncryptedAggregator([]EncryptedAggState{&sa}, packedHf).Iterator(tid)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		tup, err := aggIter()
+		if rows > 4 {
+			if err == nil {
+				t.Errorf("expected a sum of %d packed rows to overflow 2 guard bits", rows)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		sum, err := decrypt(tup.Fields[0].(StringField).Value)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if sum.(int64) != int64(15*n) {
+			t.Errorf("expected the sum at the limit to be exact, %d, got %d", 15*n, sum.(int64))
+		}
+	}
+}
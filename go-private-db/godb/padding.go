@@ -0,0 +1,120 @@
+package godb
+
+import (
+	"fmt"
+	"strconv"
+)
+
+type PaddingKind int
+
+const (
+	NoPadding PaddingKind = iota
+	// pad every value to exactly Size bytes
+	FixedPadding
+	// pad to the next power of two, and to at least Size bytes
+	PowerOfTwoPadding
+)
+
+// Deterministic (AES-SIV) ciphertexts are 16 bytes longer than their
+// plaintext and must still fit in a string field, so padded values can be
+// at most maxPaddedLength bytes long.
+const detOverhead = 16
+const maxPaddedLength = StringLength - detOverhead
+
+// How a string column is padded before encryption, so ciphertext lengths
+// reveal at most the padded length. Values are padded with a 0x80 byte
+// followed by zeros, which is removed again after decryption.
+type PaddingPolicy struct {
+	Kind PaddingKind
+	Size int
+}
+
+// Parses a padding policy as written in the catalog: a byte count for fixed
+// padding, "pow2" for power-of-two buckets, or "pow2:n" for power-of-two
+// buckets of at least n bytes. Sizes above maxPaddedLength are rejected:
+// their ciphertexts would not fit in a string field.
+func ParsePaddingPolicy(s string) (PaddingPolicy, error) {
+	if s == "pow2" {
+		return PaddingPolicy{Kind: PowerOfTwoPadding}, nil
+	}
+	if len(s) > 5 && s[:5] == "pow2:" {
+		min, err := strconv.Atoi(s[5:])
+		if err != nil || min < 1 {
+			return PaddingPolicy{}, GoDBError{ParseError, fmt.Sprintf("invalid minimum bucket size in padding policy %s", s)}
+		}
+		if min > maxPaddedLength {
+			return PaddingPolicy{}, GoDBError{ParseError, fmt.Sprintf("padding policy %s is wider than the %d bytes whose ciphertext fits in a string field", s, maxPaddedLength)}
+		}
+		return PaddingPolicy{Kind: PowerOfTwoPadding, Size: min}, nil
+	}
+	size, err := strconv.Atoi(s)
+	if err != nil || size < 1 {
+		return PaddingPolicy{}, GoDBError{ParseError, fmt.Sprintf("invalid padding policy %s", s)}
+	}
+	if size > maxPaddedLength {
+		return PaddingPolicy{}, GoDBError{ParseError, fmt.Sprintf("padding policy %s is wider than the %d bytes whose ciphertext fits in a string field", s, maxPaddedLength)}
+	}
+	return PaddingPolicy{Kind: FixedPadding, Size: size}, nil
+}
+
+func (p PaddingPolicy) String() string {
+	switch p.Kind {
+	case FixedPadding:
+		return strconv.Itoa(p.Size)
+	case PowerOfTwoPadding:
+		if p.Size > 0 {
+			return fmt.Sprintf("pow2:%d", p.Size)
+		}
+		return "pow2"
+	}
+	return ""
+}
+
+// length of the padded value for a value of n bytes
+func (p PaddingPolicy) paddedLength(n int) (int, error) {
+	size := n
+	switch p.Kind {
+	case FixedPadding:
+		if n+1 > p.Size {
+			return 0, GoDBError{IllegalOperationError, fmt.Sprintf("value of %d bytes does not fit padding to %d bytes", n, p.Size)}
+		}
+		size = p.Size
+	case PowerOfTwoPadding:
+		size = 1
+		for size < n+1 || size < p.Size {
+			size *= 2
+		}
+	}
+	if size > maxPaddedLength {
+		return 0, GoDBError{IllegalOperationError, fmt.Sprintf("value of %d bytes padded to %d bytes is too long for its ciphertext to fit in a string field (at most %d bytes)", n, size, maxPaddedLength)}
+	}
+	return size, nil
+}
+
+func (p PaddingPolicy) pad(v string) (string, error) {
+	if p.Kind == NoPadding {
+		return v, nil
+	}
+	size, err := p.paddedLength(len(v))
+	if err != nil {
+		return "", err
+	}
+	padded := make([]byte, size)
+	copy(padded, v)
+	padded[len(v)] = 0x80
+	return string(padded), nil
+}
+
+func (p PaddingPolicy) unpad(v string) (string, error) {
+	if p.Kind == NoPadding {
+		return v, nil
+	}
+	i := len(v) - 1
+	for i >= 0 && v[i] == 0 {
+		i--
+	}
+	if i < 0 || v[i] != 0x80 {
+		return "", GoDBError{MalformedDataError, "value has no valid padding"}
+	}
+	return v[:i], nil
+}
@@ -0,0 +1,167 @@
+package godb
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestPaddingPolicy(t *testing.T) {
+	fixed, _ := ParsePaddingPolicy("16")
+	pow2, _ := ParsePaddingPolicy("pow2:8")
+	for _, v := range []string{"", "a", "S61519A", "fifteen bytes.."} {
+		for _, p := range []PaddingPolicy{fixed, pow2} {
+			padded, err := p.pad(v)
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+			unpadded, err := p.unpad(padded)
+			if err != nil || unpadded != v {
+				t.Errorf("padding %s with %s did not round trip: got %q (%v)", v, p, unpadded, err)
+			}
+		}
+		padded, _ := fixed.pad(v)
+		if len(padded) != 16 {
+			t.Errorf("expected fixed padding to 16 bytes, got %d", len(padded))
+		}
+	}
+
+	_, err := fixed.pad("sixteen bytes...")
+	if err == nil {
+		t.Errorf("expected error padding a value that does not fit")
+	}
+	for n, expected := range map[int]int{0: 8, 7: 8, 8: 16} {
+		padded, _ := pow2.pad(strings.Repeat("x", n))
+		if len(padded) != expected {
+			t.Errorf("expected %d bytes padded to %d, got %d", n, expected, len(padded))
+		}
+	}
+	_, err = ParsePaddingPolicy("pow3")
+	if err == nil {
+		t.Errorf("expected error parsing an unknown padding policy")
+	}
+	for _, s := range []string{"17", "32", "pow2:32"} {
+		if _, err = ParsePaddingPolicy(s); err == nil {
+			t.Errorf("expected error parsing %s, whose ciphertexts do not fit in a string field", s)
+		}
+	}
+	if _, err = pow2.pad(strings.Repeat("x", maxPaddedLength)); err == nil {
+		t.Errorf("expected error padding a value whose ciphertext does not fit in a string field")
+	}
+}
+
+func TestPaddedDetEncryption(t *testing.T) {
+	td, _, _, _, _, _ := makeTestVars()
+	key := []byte("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	e := getDummyEncryptionScheme()
+	e.EncryptMethods["name"] = newDetEncryptionFunc(key)
+	e.DecryptMethods["name"] = newDetDecryptionFunc(key)
+	e.Padding = map[string]PaddingPolicy{"name": {Kind: PowerOfTwoPadding, Size: 16}}
+
+	short := Tuple{Desc: td, Fields: []DBValue{StringField{"al"}, IntField{1}}}
+	long := Tuple{Desc: td, Fields: []DBValue{StringField{"bartholomew"}, IntField{2}}}
+	c1, err := e.encryptOrDecryptTuple(&short, true)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	c2, _ := e.encryptOrDecryptTuple(&long, true)
+	if len(c1.Fields[0].(StringField).Value) != len(c2.Fields[0].(StringField).Value) {
+		t.Errorf("expected padded ciphertexts of equal length")
+	}
+
+	p, err := e.encryptOrDecryptTuple(c1, false)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if !p.equals(&short) {
+		t.Errorf("expected padding to be removed on decryption, got %v", p.Fields)
+	}
+
+	constant, err := e.encryptVal("al", "name")
+	if err != nil || constant != c1.Fields[0].(StringField).Value {
+		t.Errorf("expected encrypted constant to match the padded column value")
+	}
+}
+
+func TestPaddedDetEncryptionSurvivesFlush(t *testing.T) {
+	td, _, _, _, _, _ := makeTestVars()
+	key := []byte("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	e := getDummyEncryptionScheme()
+	e.EncryptMethods["name"] = newDetEncryptionFunc(key)
+	e.DecryptMethods["name"] = newDetDecryptionFunc(key)
+	e.Padding = map[string]PaddingPolicy{"name": {Kind: PowerOfTwoPadding, Size: maxPaddedLength}}
+
+	path := t.TempDir() + "/padded.dat"
+	bp := NewBufferPool(3)
+	hf, err := NewHeapFile(path, &td, bp)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	plain := Tuple{Desc: td, Fields: []DBValue{StringField{"fifteen bytes.."}, IntField{1}}}
+	encrypted, err := e.encryptOrDecryptTuple(&plain, true)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	tid := NewTID()
+	bp.BeginTransaction(tid)
+	if err = hf.insertTuple(encrypted, tid); err != nil {
+		t.Fatalf(err.Error())
+	}
+	bp.CommitTransaction(tid)
+
+	bp2 := NewBufferPool(3)
+	reopened, err := NewHeapFile(path, &td, bp2)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	tid = NewTID()
+	bp2.BeginTransaction(tid)
+	iter, _ := reopened.Iterator(tid)
+	stored, err := iter()
+	if err != nil || stored == nil {
+		t.Fatalf("expected to read the row back, got %v (%v)", stored, err)
+	}
+	decrypted, err := e.encryptOrDecryptTuple(stored, false)
+	if err != nil || !decrypted.equals(&plain) {
+		t.Errorf("expected the value read back from disk to decrypt, got %v (%v)", decrypted, err)
+	}
+	constant, err := e.encryptVal("fifteen bytes..", "name")
+	if err != nil || constant != stored.Fields[0].(StringField).Value {
+		t.Errorf("expected an encrypted constant to match the stored value")
+	}
+}
+
+func TestCatalogColumnPadding(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(dir+"/catalog.txt", []byte("t (name string pad pow2:16, code string pad 12, age int)\nu (name string pad 8, age int)\nv (name string pad pow2:16, age int pad 4)\n"), 0600)
+	c, err := NewCatalogFromFile("catalog.txt", NewBufferPool(3), dir)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if !strings.HasPrefix(c.CatalogString(), "t (name string pad pow2:16, code string pad 12, age int)\n") {
+		t.Errorf("unexpected catalog string %q", c.CatalogString())
+	}
+	e := EncryptionScheme{Padding: make(map[string]PaddingPolicy)}
+	err = c.applyColumnPadding(&e, []string{"t"})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if e.Padding["name"] != (PaddingPolicy{PowerOfTwoPadding, 16}) || e.Padding["code"] != (PaddingPolicy{FixedPadding, 12}) {
+		t.Errorf("unexpected padding policies %v", e.Padding)
+	}
+	if _, exists := e.Padding["age"]; exists {
+		t.Errorf("expected no padding for age")
+	}
+	if err = c.applyColumnPadding(&EncryptionScheme{Padding: make(map[string]PaddingPolicy)}, []string{"t", "u"}); err == nil {
+		t.Errorf("expected error for a column padded differently in two tables")
+	}
+	if err = c.applyColumnPadding(&EncryptionScheme{Padding: make(map[string]PaddingPolicy)}, []string{"t", "v"}); err == nil {
+		t.Errorf("expected error for a column padded in only one of two tables")
+	}
+
+	os.WriteFile(dir+"/bad.txt", []byte("t (name string pad)\n"), 0600)
+	_, err = NewCatalogFromFile("bad.txt", NewBufferPool(3), dir)
+	if err == nil {
+		t.Errorf("expected error for a column option without a value")
+	}
+}
@@ -0,0 +1,111 @@
+package godb
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Encryption at rest for heap files. Every page is sealed with AES-256-GCM
+// under a data key for the file, using a fresh random nonce on each write
+// and the page number as additional data, so a page cannot be read without
+// the key, and a modified page or a page copied to another offset fails to
+// decrypt. An encrypted page on disk is
+//
+//	nonce | ciphertext of the page | GCM tag
+//
+// and still takes PageSize bytes, so pages of an encrypted file hold a few
+// fewer tuples. This is independent of the column encryption done by
+// EncryptionScheme.
+type pageCipher struct {
+	aead cipher.AEAD
+}
+
+const pageKeySize = 32
+
+func newPageCipher(key []byte) (*pageCipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &pageCipher{aead}, nil
+}
+
+// bytes an encrypted page needs beyond its plaintext
+func (c *pageCipher) overhead() int {
+	return c.aead.NonceSize() + c.aead.Overhead()
+}
+
+func pageAAD(pageNo int) []byte {
+	aad := make([]byte, 8)
+	binary.BigEndian.PutUint64(aad, uint64(pageNo))
+	return aad
+}
+
+// Encrypts a page of PageSize-overhead() bytes into PageSize bytes.
+func (c *pageCipher) seal(pageNo int, page []byte) ([]byte, error) {
+	out := make([]byte, c.aead.NonceSize(), PageSize)
+	_, err := rand.Read(out)
+	if err != nil {
+		return nil, err
+	}
+	return c.aead.Seal(out, out, page, pageAAD(pageNo)), nil
+}
+
+func (c *pageCipher) open(pageNo int, page []byte) ([]byte, error) {
+	n := c.aead.NonceSize()
+	plain, err := c.aead.Open(nil, page[:n], page[n:], pageAAD(pageNo))
+	if err != nil {
+		return nil, GoDBError{IntegrityError, fmt.Sprintf("page %d failed to decrypt: wrong key or corrupted page", pageNo)}
+	}
+	return plain, nil
+}
+
+// The key store name of the data key of the heap file at path: "page/"
+// followed by the file's cleaned absolute path, so files of the same name in
+// different directories get different keys.
+func pageKeyName(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	return "page/" + abs, nil
+}
+
+// Creates a HeapFile like NewHeapFile whose pages are encrypted on disk.
+// The file's data key is the key store's pageKeyName key, created on first
+// use. Opening an existing file whose key is missing is an error: a new key
+// could not read its pages.
+func NewEncryptedHeapFile(fromFile string, td *TupleDesc, bp *BufferPool, ks *KeyStore) (*HeapFile, error) {
+	name, err := pageKeyName(fromFile)
+	if err != nil {
+		return nil, err
+	}
+	if _, exists := ks.GetKey(name); !exists {
+		if info, err := os.Stat(fromFile); err == nil && info.Size() > 0 {
+			return nil, GoDBError{MalformedDataError, fmt.Sprintf("key %s of encrypted file %s is missing from the key store", name, fromFile)}
+		}
+	}
+	key, err := ks.GetOrCreateKey(name, pageKeySize)
+	if err != nil {
+		return nil, err
+	}
+	c, err := newPageCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	hf, err := NewHeapFile(fromFile, td, bp)
+	if err != nil {
+		return nil, err
+	}
+	hf.cipher = c
+	return hf, nil
+}
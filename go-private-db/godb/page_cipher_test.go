@@ -0,0 +1,136 @@
+package godb
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestEncryptedHeapFile(t *testing.T) {
+	td, _, _, _, _, _ := makeTestVars()
+	os.Remove("page_cipher_test.dat")
+	defer os.Remove("page_cipher_test.dat")
+	ks := NewKeyStore()
+	bp := NewBufferPool(10)
+	hf, err := NewEncryptedHeapFile("page_cipher_test.dat", &td, bp, ks)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	tid := NewTID()
+	bp.BeginTransaction(tid)
+	n := 200
+	for i := 0; i < n; i++ {
+		tup := Tuple{Desc: td, Fields: []DBValue{StringField{fmt.Sprintf("patient%d", i)}, IntField{int64(i)}}}
+		err := hf.insertTuple(&tup, tid)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	bp.CommitTransaction(tid)
+	if hf.NumPages() < 2 {
+		t.Fatalf("expected at least 2 pages, got %d", hf.NumPages())
+	}
+
+	raw, _ := os.ReadFile("page_cipher_test.dat")
+	if bytes.Contains(raw, []byte("patient")) {
+		t.Errorf("expected no plaintext on disk")
+	}
+
+	countTuples := func(hf *HeapFile, bp *BufferPool) (int, error) {
+		tid := NewTID()
+		bp.BeginTransaction(tid)
+		defer bp.CommitTransaction(tid)
+		iter, err := hf.Iterator(tid)
+		if err != nil {
+			return 0, err
+		}
+		count := 0
+		for {
+			tup, err := iter()
+			if err != nil {
+				return count, err
+			}
+			if tup == nil {
+				return count, nil
+			}
+			if tup.Fields[0].(StringField).Value != fmt.Sprintf("patient%d", tup.Fields[1].(IntField).Value) {
+				return count, fmt.Errorf("tuple read back incorrectly: %v", tup.Fields)
+			}
+			count++
+		}
+	}
+
+	// reopened with the same key
+	bp2 := NewBufferPool(10)
+	reopened, _ := NewEncryptedHeapFile("page_cipher_test.dat", &td, bp2, ks)
+	count, err := countTuples(reopened, bp2)
+	if err != nil || count != n {
+		t.Errorf("expected to read back %d tuples, got %d (%v)", n, count, err)
+	}
+
+	// reopened without its key
+	bp3 := NewBufferPool(10)
+	_, err = NewEncryptedHeapFile("page_cipher_test.dat", &td, bp3, NewKeyStore())
+	if err == nil {
+		t.Errorf("expected opening an encrypted file without its key to fail")
+	}
+
+	// reopened with another key
+	otherKeys := NewKeyStore()
+	name, _ := pageKeyName("page_cipher_test.dat")
+	otherKeys.GetOrCreateKey(name, pageKeySize)
+	wrongKey, _ := NewEncryptedHeapFile("page_cipher_test.dat", &td, bp3, otherKeys)
+	_, err = countTuples(wrongKey, bp3)
+	if !isIntegrityError(err) {
+		t.Errorf("expected integrity error reading with the wrong key, got %v", err)
+	}
+
+	// pages swapped on disk
+	swapped := append([]byte{}, raw[PageSize:2*PageSize]...)
+	swapped = append(swapped, raw[:PageSize]...)
+	swapped = append(swapped, raw[2*PageSize:]...)
+	os.WriteFile("page_cipher_test.dat", swapped, 0644)
+	bp4 := NewBufferPool(10)
+	moved, _ := NewEncryptedHeapFile("page_cipher_test.dat", &td, bp4, ks)
+	_, err = countTuples(moved, bp4)
+	if !isIntegrityError(err) {
+		t.Errorf("expected integrity error for pages swapped on disk, got %v", err)
+	}
+}
+
+func TestEncryptedHeapFileKeyNames(t *testing.T) {
+	td, t1, _, _, _, _ := makeTestVars()
+	dir := t.TempDir()
+	os.Mkdir(dir+"/a", 0700)
+	os.Mkdir(dir+"/b", 0700)
+	ks := NewKeyStore()
+	bp := NewBufferPool(10)
+	a, err := NewEncryptedHeapFile(dir+"/a/t.dat", &td, bp, ks)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	b, err := NewEncryptedHeapFile(dir+"/b/../b/t.dat", &td, bp, ks)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	keyA, _ := ks.GetKey("page/" + dir + "/a/t.dat")
+	keyB, _ := ks.GetKey("page/" + dir + "/b/t.dat")
+	if keyA == nil || keyB == nil || bytes.Equal(keyA, keyB) || a.cipher == b.cipher {
+		t.Errorf("expected files of the same name in different directories to get their own keys")
+	}
+
+	// moving a file changes its key name, so its key is missing
+	tid := NewTID()
+	bp.BeginTransaction(tid)
+	if err = a.insertTuple(&t1, tid); err != nil {
+		t.Fatalf(err.Error())
+	}
+	bp.CommitTransaction(tid)
+	os.Rename(dir+"/a/t.dat", dir+"/moved.dat")
+	_, err = NewEncryptedHeapFile(dir+"/moved.dat", &td, NewBufferPool(10), ks)
+	if err == nil || !strings.Contains(err.Error(), "page/"+dir+"/moved.dat") {
+		t.Errorf("expected an error naming the missing key, got %v", err)
+	}
+}
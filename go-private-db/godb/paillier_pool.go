@@ -0,0 +1,263 @@
+package godb
+
+import (
+	"math/big"
+	"sync"
+	"sync/atomic"
+
+	"github.com/getamis/alice/crypto/utils"
+)
+
+// Almost all of the cost of a Paillier encryption is computing the
+// randomizer r^n mod n^2, which does not depend on the message. A
+// PaillierRandomizerPool computes randomizers in the background so that
+// Encrypt, Add and MulConst only have to do a multiplication.
+type RandomizerPoolConfig struct {
+	// number of precomputed randomizers to keep; <= 0 disables the pool
+	Size int
+
+	// randomizers to compute before StartRandomizerPool returns (at most Size)
+	WarmUp int
+
+	// background goroutines refilling the pool; <= 0 means 1
+	Workers int
+}
+
+type RandomizerPoolStats struct {
+	// randomizers taken from the pool
+	Hits uint64
+
+	// randomizers computed inline because the pool was empty
+	Misses uint64
+}
+
+func (s RandomizerPoolStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// Implemented by homomorphic schemes that can precompute encryption
+// randomness.
+type RandomizerPooledScheme interface {
+	StartRandomizerPool(config RandomizerPoolConfig) error
+	StopRandomizerPool()
+	RandomizerPoolStats() RandomizerPoolStats
+}
+
+type PaillierRandomizerPool struct {
+	n           *big.Int
+	nSquare     *big.Int
+	randomizers chan *big.Int
+	done        chan struct{}
+	stopOnce    sync.Once
+	hits        atomic.Uint64
+	misses      atomic.Uint64
+}
+
+func NewPaillierRandomizerPool(n *big.Int, config RandomizerPoolConfig) (*PaillierRandomizerPool, error) {
+	if config.Size <= 0 {
+		return nil, GoDBError{IllegalOperationError, "randomizer pool size must be positive"}
+	}
+	workers := config.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+	warmUp := config.WarmUp
+	if warmUp > config.Size {
+		warmUp = config.Size
+	}
+
+	p := &PaillierRandomizerPool{
+		n:           n,
+		nSquare:     new(big.Int).Mul(n, n),
+		randomizers: make(chan *big.Int, config.Size),
+		done:        make(chan struct{}),
+	}
+
+	// warm up with all workers before returning
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		count := warmUp / workers
+		if w < warmUp%workers {
+			count++
+		}
+		wg.Add(1)
+		go func(count int) {
+			defer wg.Done()
+			for i := 0; i < count; i++ {
+				rn, err := p.compute()
+				if err != nil {
+					errs <- err
+					return
+				}
+				p.randomizers <- rn
+			}
+		}(count)
+	}
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		return nil, err
+	}
+
+	for w := 0; w < workers; w++ {
+		go p.fill()
+	}
+	return p, nil
+}
+
+func (p *PaillierRandomizerPool) compute() (*big.Int, error) {
+	r, err := utils.RandomCoprimeInt(p.n)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).Exp(r, p.n, p.nSquare), nil
+}
+
+func (p *PaillierRandomizerPool) fill() {
+	for {
+		rn, err := p.compute()
+		if err != nil {
+			return
+		}
+		select {
+		case p.randomizers <- rn:
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// Returns a fresh r^n mod n^2, from the pool if one is ready
+func (p *PaillierRandomizerPool) Get() (*big.Int, error) {
+	select {
+	case rn := <-p.randomizers:
+		p.hits.Add(1)
+		return rn, nil
+	default:
+		p.misses.Add(1)
+		return p.compute()
+	}
+}
+
+func (p *PaillierRandomizerPool) Stats() RandomizerPoolStats {
+	return RandomizerPoolStats{Hits: p.hits.Load(), Misses: p.misses.Load()}
+}
+
+// Stops the background workers. Get keeps working, computing inline.
+func (p *PaillierRandomizerPool) Stop() {
+	p.stopOnce.Do(func() { close(p.done) })
+}
+
+// A Paillier public key (g = n + 1, as in alice) whose randomizers come from
+// a PaillierRandomizerPool. Ciphertexts are interchangeable with those of
+// the alice key it wraps.
+type pooledPaillierPubKey struct {
+	inner   HomomorphicPubKey
+	n       *big.Int
+	nSquare *big.Int
+	pool    *PaillierRandomizerPool
+}
+
+func (k *pooledPaillierPubKey) checkCiphertext(c *big.Int) error {
+	if utils.InRange(c, big1, k.nSquare) != nil || !utils.IsRelativePrime(c, k.n) {
+		return GoDBError{MalformedDataError, "malformed paillier ciphertext"}
+	}
+	return nil
+}
+
+func (k *pooledPaillierPubKey) randomize(c *big.Int) ([]byte, error) {
+	rn, err := k.pool.Get()
+	if err != nil {
+		return nil, err
+	}
+	c.Mul(c, rn)
+	c.Mod(c, k.nSquare)
+	return c.Bytes(), nil
+}
+
+// c = (1 + m*n) * r^n mod n^2
+func (k *pooledPaillierPubKey) Encrypt(mBytes []byte) ([]byte, error) {
+	m := new(big.Int).SetBytes(mBytes)
+	if m.Cmp(k.n) >= 0 {
+		return nil, GoDBError{MalformedDataError, "paillier message out of range"}
+	}
+	c := new(big.Int).Mul(m, k.n)
+	c.Add(c, big1)
+	return k.randomize(c)
+}
+
+func (k *pooledPaillierPubKey) Add(c1Bytes []byte, c2Bytes []byte) ([]byte, error) {
+	c1 := new(big.Int).SetBytes(c1Bytes)
+	c2 := new(big.Int).SetBytes(c2Bytes)
+	if err := k.checkCiphertext(c1); err != nil {
+		return nil, err
+	}
+	if err := k.checkCiphertext(c2); err != nil {
+		return nil, err
+	}
+	return k.randomize(c1.Mul(c1, c2))
+}
+
+func (k *pooledPaillierPubKey) MulConst(cBytes []byte, scalar *big.Int) ([]byte, error) {
+	c := new(big.Int).SetBytes(cBytes)
+	if err := k.checkCiphertext(c); err != nil {
+		return nil, err
+	}
+	c.Exp(c, new(big.Int).Mod(scalar, k.n), k.nSquare)
+	return k.randomize(c)
+}
+
+func (k *pooledPaillierPubKey) ToPubKeyBytes() []byte {
+	return k.inner.ToPubKeyBytes()
+}
+
+// Starts (or restarts) randomizer pools for the keys of the ring that
+// support them.
+func (r *HomomorphicKeyRing) startRandomizerPools(config RandomizerPoolConfig) error {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	for _, scheme := range r.keys {
+		if pooled, ok := scheme.(RandomizerPooledScheme); ok {
+			err := pooled.StartRandomizerPool(config)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (r *HomomorphicKeyRing) stopRandomizerPools() {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	for _, scheme := range r.keys {
+		if pooled, ok := scheme.(RandomizerPooledScheme); ok {
+			pooled.StopRandomizerPool()
+		}
+	}
+}
+
+// Precomputes randomizers for the homomorphic keys of e (e.g. a scheme
+// from TranslateQuery) according to config, so that encrypting and
+// aggregating under e is faster. Call Close once e is no longer used.
+func (e *EncryptionScheme) StartRandomizerPool(config RandomizerPoolConfig) error {
+	if e.HomKeys == nil {
+		return nil
+	}
+	err := e.HomKeys.startRandomizerPools(config)
+	if err != nil {
+		e.HomKeys.stopRandomizerPools()
+	}
+	return err
+}
+
+// Stops the background work started for e, such as randomizer pools.
+func (e *EncryptionScheme) Close() {
+	if e.HomKeys != nil {
+		e.HomKeys.stopRandomizerPools()
+	}
+}
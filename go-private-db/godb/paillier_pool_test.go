@@ -0,0 +1,162 @@
+package godb
+
+import (
+	"math/big"
+	"sync"
+	"testing"
+)
+
+func TestPaillierRandomizerPool(t *testing.T) {
+	scheme, err := NewHomomorphicScheme(PaillierSchemeKind, testHomKeySize)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	pooled := scheme.(RandomizerPooledScheme)
+	err = pooled.StartRandomizerPool(RandomizerPoolConfig{Size: 8, WarmUp: 8, Workers: 2})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer pooled.StopRandomizerPool()
+
+	// the pool is warm, so these come from it
+	encrypt, decrypt, pk := newHomEncryptionFuncFromScheme(scheme)
+	var cs [][]byte
+	for i := int64(1); i <= 4; i++ {
+		c, err := encrypt(i * 100)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		cs = append(cs, []byte(c.(string)))
+	}
+	stats := pooled.RandomizerPoolStats()
+	if stats.Hits != 4 || stats.Misses != 0 || stats.HitRate() != 1 {
+		t.Errorf("expected 4 hits from a warm pool, got %+v", stats)
+	}
+
+	sum := cs[0]
+	for _, c := range cs[1:] {
+		sum, err = pk.Add(sum, c)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	sum, err = pk.MulConst(sum, big.NewInt(2))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	got, err := decrypt(string(sum))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if got.(int64) != 2000 {
+		t.Errorf("expected 2000, got %d", got.(int64))
+	}
+
+	// pooled ciphertexts are ordinary paillier ciphertexts
+	pall := scheme.(*paillierScheme).Paillier
+	plain, err := pall.GetPubKey().Add(cs[0], cs[1])
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	d, err := pall.Decrypt(plain)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if new(big.Int).SetBytes(d).Int64() != 300 {
+		t.Errorf("expected 300, got %v", d)
+	}
+
+	// aggregation states initialize through the pooled public key
+	before := pooled.RandomizerPoolStats()
+	sa := EncryptedSumAggState[string]{}
+	expr := FieldExpr{FieldType{Fname: "age", TableQualifier: "t"}}
+	sa.Init("sum", &expr, stringAggGetter, pk)
+	after := pooled.RandomizerPoolStats()
+	if after.Hits+after.Misses != before.Hits+before.Misses+1 {
+		t.Errorf("expected EncryptedSumAggState.Init to draw one randomizer, stats went from %+v to %+v", before, after)
+	}
+
+	pooled.StopRandomizerPool()
+	if pooled.RandomizerPoolStats() != (RandomizerPoolStats{}) {
+		t.Errorf("expected empty stats after stopping the pool")
+	}
+}
+
+func TestRandomizerPoolRestartWhileEncrypting(t *testing.T) {
+	encrypt, decrypt, _, stop := newHomEncryptionFunc(testHomKeySize, RandomizerPoolConfig{Size: 4, WarmUp: 4})
+	defer stop()
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 3; i++ {
+				c, err := encrypt(int64(w))
+				if err != nil {
+					errs <- err
+					return
+				}
+				d, err := decrypt(c)
+				if err != nil || d.(int64) != int64(w) {
+					errs <- GoDBError{IllegalOperationError, "wrong decryption"}
+					return
+				}
+			}
+		}(w)
+	}
+	// restarting and stopping swaps the pooled key under the encryptions
+	scheme, err := NewHomomorphicScheme(PaillierSchemeKind, testHomKeySize)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	pooled := scheme.(RandomizerPooledScheme)
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			scheme.Encrypt(big.NewInt(1).Bytes())
+		}()
+		pooled.StartRandomizerPool(RandomizerPoolConfig{Size: 2})
+		pooled.StopRandomizerPool()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf(err.Error())
+	}
+
+	// without the pool, randomizers are computed inline
+	stop()
+	c, err := encrypt(int64(7))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if d, _ := decrypt(c); d.(int64) != 7 {
+		t.Errorf("expected 7 after stopping the pool, got %v", d)
+	}
+}
+
+func TestEncryptionSchemeRandomizerPool(t *testing.T) {
+	scheme, err := NewHomomorphicScheme(PaillierSchemeKind, testHomKeySize)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	e := EncryptionScheme{HomKeys: NewHomomorphicKeyRing(scheme)}
+	err = e.StartRandomizerPool(RandomizerPoolConfig{Size: 4, WarmUp: 4})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	pooled := scheme.(RandomizerPooledScheme)
+	if _, err := e.HomKeys.Encrypt(big.NewInt(7).Bytes()); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if pooled.RandomizerPoolStats().Hits == 0 {
+		t.Errorf("expected the scheme's encryptions to use the pool, got %+v", pooled.RandomizerPoolStats())
+	}
+	e.Close()
+	if pooled.RandomizerPoolStats() != (RandomizerPoolStats{}) {
+		t.Errorf("expected Close to stop the pool")
+	}
+	(&EncryptionScheme{}).Close()
+}
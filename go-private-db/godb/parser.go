@@ -658,6 +658,10 @@ func (s *LogicalSelectNode) generateExpr(c *Catalog, inputDesc *TupleDesc, table
 			}
 			exprs[i] = &newExpr
 		}
+		if isVaultFunc(*s.funcOp) {
+			ve, err := c.newVaultExpr(*s.funcOp, exprs)
+			return ve, fieldName, err
+		}
 
 		fe := FuncExpr{*s.funcOp, exprs}
 		return &fe, fieldName, nil
@@ -666,6 +670,28 @@ func (s *LogicalSelectNode) generateExpr(c *Catalog, inputDesc *TupleDesc, table
 
 }
 
+// Parses expr, a scalar expression over the fields of desc such as
+// "agebucket(age, 10)".
+func parseColumnExpr(c *Catalog, expr string, desc *TupleDesc) (Expr, error) {
+	stmt, err := sqlparser.Parse(fmt.Sprintf("select %s from t", expr))
+	if err != nil {
+		return nil, GoDBError{ParseError, fmt.Sprintf("invalid expression %s: %s", expr, err.Error())}
+	}
+	sel, ok := stmt.(*sqlparser.Select)
+	if !ok || len(sel.SelectExprs) != 1 {
+		return nil, GoDBError{ParseError, fmt.Sprintf("%s is not a single expression", expr)}
+	}
+	node, err := parseSelect(c, sel.SelectExprs[0])
+	if err != nil {
+		return nil, err
+	}
+	if node.exprType == ExprAggr || node.exprType == ExprStar {
+		return nil, GoDBError{ParseError, fmt.Sprintf("%s is not a scalar expression", expr)}
+	}
+	e, _, err := node.generateExpr(c, desc, map[string]*PlanNode{})
+	return e, err
+}
+
 const JoinBufferSize int = 10000000
 
 func exprToStr(e Expr) string {
@@ -684,6 +710,11 @@ func exprToStr(e Expr) string {
 			argStr += fmt.Sprintf("%s,", exprToStr(*arg))
 		}
 		return fmt.Sprintf("%s(%s)", ex.op, argStr)
+	case *vaultExpr:
+		if ex.detokenize {
+			return fmt.Sprintf("detokenize(%s)", exprToStr(ex.arg))
+		}
+		return fmt.Sprintf("tokenize(%s)", exprToStr(ex.arg))
 	default:
 		return fmt.Sprintf("%+v, ", e)
 	}
@@ -804,6 +835,27 @@ func PrintPhysicalPlan(o Operator, indent string) {
 }
 
 func makePhysicalPlan(c *Catalog, plan *LogicalPlan) (Operator, error) {
+	if c.user != "" {
+		columns, err := plan.readColumns(c)
+		if err != nil {
+			return nil, err
+		}
+		err = c.checkSelectPrivileges(columns)
+		if err != nil {
+			return nil, err
+		}
+	}
+	privacy, err := c.privacyPolicy()
+	if err != nil {
+		return nil, err
+	}
+	if privacy != nil {
+		err := checkPrivatePlan(plan)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	//build mapping from table names / aliases to operators
 	tableMap := make(map[string]*PlanNode)
 
@@ -828,8 +880,15 @@ func makePhysicalPlan(c *Catalog, plan *LogicalPlan) (Operator, error) {
 		tableMap[name] = &PlanNode{*t.file, td}
 	}
 
+	// row policies filter the table scans before the query's own predicates
+	filters, err := c.policyFilters(plan.tables, true, SelectPrivilege)
+	if err != nil {
+		return nil, err
+	}
+	filters = append(filters, plan.filters...)
+
 	//now apply each filter to appropriate table
-	for _, f := range plan.filters {
+	for _, f := range filters {
 		tabName, fieldName, err := f.fieldExpr.getTableField(c, plan.subqueries, plan.tables)
 		if err != nil {
 			return nil, err
@@ -969,6 +1028,7 @@ func makePhysicalPlan(c *Catalog, plan *LogicalPlan) (Operator, error) {
 	if hasAgg {
 		var gbys []Expr
 		var aggs []AggState
+		var sensitivities []float64
 
 		var aggCnt int
 		for _, s := range plan.aggs {
@@ -1000,6 +1060,22 @@ func makePhysicalPlan(c *Catalog, plan *LogicalPlan) (Operator, error) {
 					return nil, err
 				}
 
+				if masked := c.maskExpr(plan.tables, aggExpr); masked != aggExpr {
+					if (*s.funcOp == "sum" || *s.funcOp == "avg") && masked.GetExprType().Ftype != IntType {
+						return nil, GoDBError{IllegalOperationError, fmt.Sprintf("cannot compute %s of masked column %s", *s.funcOp, fieldName)}
+					}
+					aggExpr = masked
+				}
+				sensitivity := 1.0
+				if privacy != nil && (*s.funcOp == "sum" || *s.funcOp == "avg") {
+					bounds := c.columnClamp(plan.tables[0].tableName, fieldName)
+					if bounds == nil {
+						return nil, GoDBError{IllegalOperationError, fmt.Sprintf("column %s needs clamping bounds for differentially private %s", fieldName, *s.funcOp)}
+					}
+					aggExpr = clampExpr(aggExpr, bounds)
+					sensitivity = bounds.sensitivity()
+				}
+
 				switch aggExpr.GetExprType().Ftype {
 				case IntType:
 					getter = intAggGetter
@@ -1038,6 +1114,7 @@ func makePhysicalPlan(c *Catalog, plan *LogicalPlan) (Operator, error) {
 				}
 				as.Init(name, aggExpr, getter)
 				aggs = append(aggs, as)
+				sensitivities = append(sensitivities, sensitivity)
 				s.cachedField = &as.GetTupleDesc().Fields[0] //track aggregates by reference rather than name
 			}
 		}
@@ -1050,11 +1127,17 @@ func makePhysicalPlan(c *Catalog, plan *LogicalPlan) (Operator, error) {
 			gbys = append(gbys, expr)
 		}
 
+		var agg *Aggregator
 		if len(gbys) == 0 {
-			topOp = NewAggregator(aggs, topOp)
+			agg = NewAggregator(aggs, topOp)
 		} else {
-			topOp = NewGroupedAggregator(aggs, gbys, topOp)
+			agg = NewGroupedAggregator(aggs, gbys, topOp)
 		}
+		if privacy != nil {
+			agg.noise = &aggregateNoise{*privacy, privacy.Epsilon / float64(len(aggs)), sensitivities}
+		}
+		agg.suppression = c.suppressionFor(plan.tables)
+		topOp = agg
 	}
 	exprList := make([]Expr, len(plan.selects))
 	for i, s := range plan.selects {
@@ -1072,6 +1155,20 @@ func makePhysicalPlan(c *Catalog, plan *LogicalPlan) (Operator, error) {
 			fieldNames = append(fieldNames, field)
 		}
 	}
+	if c.masksAny(plan.tables) {
+		if selectAll {
+			// project every column so masks apply to SELECT *
+			exprList = nil
+			for _, f := range topOp.Descriptor().Fields {
+				exprList = append(exprList, &FieldExpr{f})
+				fieldNames = append(fieldNames, f.Fname)
+			}
+			selectAll = false
+		}
+		for i, e := range exprList {
+			exprList[i] = c.maskExpr(plan.tables, e)
+		}
+	}
 	if !selectAll {
 		projOp, err := NewProjectOp(exprList, fieldNames, plan.distinct, topOp)
 		if err != nil {
@@ -1108,6 +1205,12 @@ func makePhysicalPlan(c *Catalog, plan *LogicalPlan) (Operator, error) {
 		}
 		topOp = NewLimitOp(expr, topOp)
 	}
+	if privacy != nil {
+		err := c.privacy.ledger.spend(c.user, privacy.Epsilon)
+		if err != nil {
+			return nil, err
+		}
+	}
 	return topOp, nil
 }
 
@@ -1120,6 +1223,11 @@ func parseInsert(c *Catalog, insStmt *sqlparser.Insert) (Operator, error) {
 	if err != nil {
 		return nil, err
 	}
+	err = c.checkTablePrivilege(InsertPrivilege, sqlparser.String(tab))
+	if err != nil {
+		return nil, err
+	}
+	encryption := c.tableEncryption(sqlparser.String(tab))
 
 	switch stmt := insStmt.Rows.(type) {
 	case sqlparser.Values:
@@ -1139,8 +1247,11 @@ func parseInsert(c *Catalog, insStmt *sqlparser.Insert) (Operator, error) {
 			}
 			exprAr = append(exprAr, tupAr)
 		}
-		iterOp := NewValueOp(exprAr)
-		insertOp := NewInsertOp(file, iterOp)
+		checked, err := c.insertPolicyCheck(sqlparser.String(tab), file.Descriptor(), NewValueOp(exprAr))
+		if err != nil {
+			return nil, err
+		}
+		insertOp := NewEncryptingInsertOp(file, checked, encryption)
 		return insertOp, nil
 
 	case *sqlparser.Select:
@@ -1152,8 +1263,12 @@ func parseInsert(c *Catalog, insStmt *sqlparser.Insert) (Operator, error) {
 		if err != nil {
 			return nil, err
 		}
+		op, err = c.insertPolicyCheck(sqlparser.String(tab), file.Descriptor(), op)
+		if err != nil {
+			return nil, err
+		}
 
-		insertOp := NewInsertOp(file, op)
+		insertOp := NewEncryptingInsertOp(file, op, encryption)
 		return insertOp, nil
 	}
 	return nil, nil
@@ -1174,6 +1289,10 @@ func parseDelete(c *Catalog, delStmt *sqlparser.Delete) (Operator, error) {
 		return nil, GoDBError{ParseError, "godb does not supporting deleting from multiple tables"}
 	}
 
+	err = c.checkTablePrivilege(DeletePrivilege, tables[0].tableName)
+	if err != nil {
+		return nil, err
+	}
 	tableMap := make(map[string]*PlanNode)
 	tableMap[tables[0].tableName] = &PlanNode{*tables[0].file, (*tables[0].file).Descriptor()}
 
@@ -1187,6 +1306,22 @@ func parseDelete(c *Catalog, delStmt *sqlparser.Delete) (Operator, error) {
 			return nil, GoDBError{ParseError, "godb does not supporting deleting from multiple tables"}
 		}
 	}
+	if c.user != "" {
+		columns, err := (&LogicalPlan{filters: filters, tables: tables}).readColumns(c)
+		if err != nil {
+			return nil, err
+		}
+		err = c.checkSelectPrivileges(columns)
+		if err != nil {
+			return nil, err
+		}
+	}
+	policyFilters, err := c.policyFilters(tables, false, SelectPrivilege, DeletePrivilege)
+	if err != nil {
+		return nil, err
+	}
+	filters = append(policyFilters, filters...)
+	encryption := c.tableEncryption(tables[0].tableName)
 	var newOp Operator
 	newOp = *tables[0].file
 	for _, f := range filters {
@@ -1206,6 +1341,15 @@ func parseDelete(c *Catalog, delStmt *sqlparser.Delete) (Operator, error) {
 		if err != nil {
 			return nil, err
 		}
+		if encryption != nil {
+			rightExpr, err = encryptPredicateConstant(encryption, fieldName, f.predOp, rightExpr)
+			if err != nil {
+				return nil, err
+			}
+			if rightExpr.GetExprType().Ftype != leftExpr.GetExprType().Ftype {
+				return nil, GoDBError{TypeMismatchError, fmt.Sprintf("encrypted constant does not match the stored type of column %s", fieldName)}
+			}
+		}
 
 		//op := node.op
 		//dbField, _ := fieldNameToField(f.table, f.field, &PlanNode{op, &desc})
@@ -1231,16 +1375,21 @@ func parseDelete(c *Catalog, delStmt *sqlparser.Delete) (Operator, error) {
 type QueryType int
 
 const (
-	IteratorType         QueryType = iota
-	BeginXactionType     QueryType = iota
-	CommitXactionType    QueryType = iota
-	AbortXactionType     QueryType = iota
-	CreateTableQueryType QueryType = iota
-	DropTableQueryType   QueryType = iota
-	UnknownQueryType     QueryType = iota
+	IteratorType           QueryType = iota
+	BeginXactionType       QueryType = iota
+	CommitXactionType      QueryType = iota
+	AbortXactionType       QueryType = iota
+	CreateTableQueryType   QueryType = iota
+	DropTableQueryType     QueryType = iota
+	AccessControlQueryType QueryType = iota
+	UnknownQueryType       QueryType = iota
 )
 
 func processDDL(c *Catalog, ddl *sqlparser.DDL) (QueryType, error) {
+	err := c.checkSuperuser("create and drop tables")
+	if err != nil {
+		return UnknownQueryType, err
+	}
 	switch ddl.Action {
 	case "create":
 		fields := make([]FieldType, len(ddl.TableSpec.Columns))
@@ -1284,6 +1433,19 @@ func processDDL(c *Catalog, ddl *sqlparser.DDL) (QueryType, error) {
 }
 
 func Parse(c *Catalog, query string) (QueryType, Operator, error) {
+	if id, ok := parseForgetSubject(query); ok {
+		err := c.checkSuperuser("forget subjects")
+		if err != nil {
+			return UnknownQueryType, nil, err
+		}
+		return IteratorType, NewForgetSubjectOp(c, id), nil
+	}
+	if ok, err := processAccessControl(c, query); ok {
+		if err != nil {
+			return UnknownQueryType, nil, err
+		}
+		return AccessControlQueryType, nil, nil
+	}
 	stmt, err := sqlparser.Parse(query)
 	if err != nil {
 		return UnknownQueryType, nil, err
@@ -0,0 +1,200 @@
+package godb
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Classes of personally identifying or health information recognized in
+// column values.
+type PIIClass string
+
+const (
+	PIINone          PIIClass = ""
+	PIISSN           PIIClass = "ssn"
+	PIIPhone         PIIClass = "phone"
+	PIIName          PIIClass = "name"
+	PIIDateOfBirth   PIIClass = "dob"
+	PIIDate          PIIClass = "date"
+	PIIDiagnosisCode PIIClass = "icd10"
+)
+
+var piiClasses = map[string]PIIClass{
+	"ssn": PIISSN, "phone": PIIPhone, "name": PIIName, "dob": PIIDateOfBirth, "date": PIIDate, "icd10": PIIDiagnosisCode,
+}
+
+func parsePIIClass(s string) (PIIClass, error) {
+	class, exists := piiClasses[s]
+	if !exists {
+		return PIINone, GoDBError{ParseError, fmt.Sprintf("unknown PII class %s", s)}
+	}
+	return class, nil
+}
+
+// fraction of sampled values a pattern must match to classify a column
+const piiMatchThreshold = 0.8
+
+// fraction of sampled values that must be known names
+const piiNameThreshold = 0.3
+
+// Rows sampled per CSV load for classification.
+const DefaultPIISampleSize = 200
+
+var piiPatterns = []struct {
+	class   PIIClass
+	pattern *regexp.Regexp
+}{
+	{PIISSN, regexp.MustCompile(`^\d{3}-?\d{2}-?\d{4}$`)},
+	{PIIPhone, regexp.MustCompile(`^(\+?1[ .-]?)?\(?\d{3}\)?[ .-]?\d{3}[ .-]?\d{4}$`)},
+	{PIIDate, regexp.MustCompile(`^(\d{4}-\d{1,2}-\d{1,2}|\d{1,2}/\d{1,2}/\d{4})$`)},
+	{PIIDiagnosisCode, regexp.MustCompile(`^[A-TV-Z]\d[0-9AB](\.?[0-9A-TV-Z]{1,4})?$`)},
+}
+
+var alphabeticName = regexp.MustCompile(`^[A-Za-z][A-Za-z' -]*$`)
+
+var commonNames = map[string]bool{}
+
+func init() {
+	for _, n := range strings.Fields(`james mary robert patricia john jennifer michael linda david elizabeth
+		william barbara richard susan joseph jessica thomas sarah charles karen christopher lisa daniel nancy
+		matthew betty anthony sandra mark margaret donald ashley steven kimberly paul emily andrew donna joshua
+		michelle kenneth carol kevin amanda brian melissa george deborah sam samuel alice bob maria jose juan
+		smith johnson williams brown jones garcia miller davis rodriguez martinez hernandez lopez gonzalez
+		wilson anderson taylor moore jackson martin lee perez thompson white harris sanchez clark lewis
+		robinson walker young allen king wright scott nguyen hill green adams baker nelson carter mitchell`) {
+		commonNames[n] = true
+	}
+}
+
+// A uniform sample of the rows of a CSV file (reservoir sampling).
+type piiSample struct {
+	size int
+	seen int
+	rows [][]string
+}
+
+func (s *piiSample) add(fields []string) {
+	s.seen++
+	if len(s.rows) < s.size {
+		s.rows = append(s.rows, fields)
+	} else if i := rand.Intn(s.seen); i < s.size {
+		s.rows[i] = fields
+	}
+}
+
+// Classifies the columns of desc from sampled rows of raw CSV fields.
+// Columns that match no detector are left out of the result.
+func ClassifyColumns(desc *TupleDesc, rows [][]string) map[string]PIIClass {
+	classes := make(map[string]PIIClass)
+	for i, f := range desc.Fields {
+		var values []string
+		for _, row := range rows {
+			if i < len(row) {
+				if v := strings.TrimSpace(row[i]); v != "" {
+					values = append(values, v)
+				}
+			}
+		}
+		if class := classifyColumn(f.Fname, values); class != PIINone {
+			classes[f.Fname] = class
+		}
+	}
+	return classes
+}
+
+func fractionMatching(values []string, match func(string) bool) float64 {
+	n := 0
+	for _, v := range values {
+		if match(v) {
+			n++
+		}
+	}
+	return float64(n) / float64(len(values))
+}
+
+func classifyColumn(name string, values []string) PIIClass {
+	if len(values) == 0 {
+		return PIINone
+	}
+	name = strings.ToLower(name)
+	for _, p := range piiPatterns {
+		if fractionMatching(values, p.pattern.MatchString) < piiMatchThreshold {
+			continue
+		}
+		if p.class == PIIDate && (strings.Contains(name, "birth") || strings.Contains(name, "dob")) {
+			return PIIDateOfBirth
+		}
+		return p.class
+	}
+	knownNames := fractionMatching(values, func(v string) bool {
+		for _, part := range strings.Fields(strings.ToLower(v)) {
+			if commonNames[part] {
+				return true
+			}
+		}
+		return false
+	})
+	if knownNames >= piiNameThreshold {
+		return PIIName
+	}
+	if strings.Contains(name, "name") && fractionMatching(values, alphabeticName.MatchString) >= piiMatchThreshold {
+		return PIIName
+	}
+	return PIINone
+}
+
+// Classifies the columns of a CSV file with fields desc from a sample of up
+// to sampleSize rows, without loading it, and returns the PII class of each
+// column that matched a detector. Callers that load the file afterwards
+// should seek it back to the start first.
+func DetectPIIInCSV(file *os.File, desc *TupleDesc, hasHeader bool, sep string, skipLastField bool, sampleSize int) (map[string]PIIClass, error) {
+	sample := &piiSample{size: sampleSize}
+	err := scanCSV(file, desc, hasHeader, sep, skipLastField, func(fields []string, _ *Tuple) {
+		sample.add(fields)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ClassifyColumns(desc, sample.rows), nil
+}
+
+// Like LoadFromCSV, but also classifies the columns from a sample of up to
+// sampleSize rows and returns the PII class of each column that matched a
+// detector.
+func (f *HeapFile) LoadFromCSVWithPIIDetection(file *os.File, hasHeader bool, sep string, skipLastField bool, sampleSize int) (map[string]PIIClass, error) {
+	sample := &piiSample{size: sampleSize}
+	err := f.loadFromCSV(file, hasHeader, sep, skipLastField, sample.add)
+	if err != nil {
+		return nil, err
+	}
+	return ClassifyColumns(f.Descriptor(), sample.rows), nil
+}
+
+// Records the PII classes of table's columns in the catalog. Returns a
+// warning for every sensitive column that is stored in plaintext, because
+// its table is not encrypted or its encryption kind is plaintext.
+func (c *Catalog) RecordPII(table string, classes map[string]PIIClass) ([]string, error) {
+	t := c.tableMap[table]
+	if t == nil {
+		return nil, GoDBError{NoSuchTableError, fmt.Sprintf("no table '%s' found", table)}
+	}
+	var warnings []string
+	for _, f := range t.desc.Fields {
+		class, exists := classes[f.Fname]
+		if !exists {
+			continue
+		}
+		opts := t.options[f.Fname]
+		opts.PII = class
+		t.options[f.Fname] = opts
+		if t.encryption == nil {
+			warnings = append(warnings, fmt.Sprintf("column %s.%s looks like %s but table %s is stored in plaintext", table, f.Fname, class, table))
+		} else if t.encryption.kind(f.Fname) == PlaintextKind {
+			warnings = append(warnings, fmt.Sprintf("column %s.%s looks like %s but is stored in plaintext", table, f.Fname, class))
+		}
+	}
+	return warnings, nil
+}
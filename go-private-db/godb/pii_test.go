@@ -0,0 +1,122 @@
+package godb
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestClassifyColumns(t *testing.T) {
+	desc := &TupleDesc{Fields: []FieldType{
+		{Fname: "ssn", Ftype: StringType}, {Fname: "phone", Ftype: StringType},
+		{Fname: "first", Ftype: StringType}, {Fname: "birth_date", Ftype: StringType},
+		{Fname: "visit", Ftype: StringType}, {Fname: "diagnosis_code", Ftype: StringType},
+		{Fname: "nickname", Ftype: StringType}, {Fname: "age", Ftype: IntType},
+	}}
+	rows := [][]string{
+		{"123-45-6789", "(617) 555-1234", "Mary", "1980-02-29", "3/4/2021", "S61519A", "Zed", "42"},
+		{"987654321", "617.555.9876", "Xyzzy", "1975-11-02", "12/30/2022", "E11.9", "Quux", "37"},
+		{"555-12-3456", "+1 617 555 0000", "George", "2001-07-14", "1/1/2020", "J45", "Blorp", "7"},
+	}
+	classes := ClassifyColumns(desc, rows)
+	expected := map[string]PIIClass{
+		"ssn": PIISSN, "phone": PIIPhone, "first": PIIName, "birth_date": PIIDateOfBirth,
+		"visit": PIIDate, "diagnosis_code": PIIDiagnosisCode, "nickname": PIIName,
+	}
+	if len(classes) != len(expected) {
+		t.Errorf("expected %v, got %v", expected, classes)
+	}
+	for col, class := range expected {
+		if classes[col] != class {
+			t.Errorf("expected %s for %s, got %q", class, col, classes[col])
+		}
+	}
+}
+
+func TestLoadFromCSVWithPIIDetection(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(dir+"/catalog.txt", []byte("patients (name string, ssn string, age int)\n"), 0600)
+	bp := NewBufferPool(3)
+	c, err := NewCatalogFromFile("catalog.txt", bp, dir)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	csv := dir + "/patients.csv"
+	os.WriteFile(csv, []byte("name,ssn,age\nsam,123-45-6789,25\njames,555-12-3456,30\nlinda,987-65-4321,61\n"), 0600)
+	f, err := os.Open(csv)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer f.Close()
+	file, _ := c.GetTable("patients")
+	classes, err := file.(*HeapFile).LoadFromCSVWithPIIDetection(f, true, ",", false, 2)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if classes["name"] != PIIName || classes["ssn"] != PIISSN || len(classes) != 2 {
+		t.Fatalf("unexpected classes %v", classes)
+	}
+	if n := file.(*HeapFile).NumPages(); n != 1 {
+		t.Errorf("expected the rows to be loaded, got %d pages", n)
+	}
+
+	warnings, err := c.RecordPII("patients", classes)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(warnings) != 2 || !strings.Contains(warnings[1], "patients.ssn looks like ssn") {
+		t.Errorf("expected warnings for the plaintext table, got %v", warnings)
+	}
+	if !strings.Contains(c.CatalogString(), "ssn string pii ssn") {
+		t.Errorf("expected classification in catalog, got %s", c.CatalogString())
+	}
+	err = c.SaveToFile("catalog.txt", dir)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	c2, err := NewCatalogFromFile("catalog.txt", bp, dir)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if c2.tableMap["patients"].options["name"].PII != PIIName {
+		t.Errorf("expected classification to survive a catalog reload")
+	}
+
+	e := getDummyEncryptionScheme()
+	c.SetTableEncryption("patients", &e)
+	warnings, _ = c.RecordPII("patients", classes)
+	if len(warnings) != 0 {
+		t.Errorf("expected no warnings for an encrypted table, got %v", warnings)
+	}
+
+	e.Kinds = map[string]EncryptionKind{"ssn": PlaintextKind}
+	warnings, _ = c.RecordPII("patients", classes)
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "patients.ssn looks like ssn") {
+		t.Errorf("expected a warning for a plaintext column of an encrypted table, got %v", warnings)
+	}
+}
+
+func TestDetectPIIInCSV(t *testing.T) {
+	td := TupleDesc{Fields: []FieldType{{Fname: "name", Ftype: StringType}, {Fname: "ssn", Ftype: StringType}, {Fname: "age", Ftype: IntType}}}
+	csv := t.TempDir() + "/patients.csv"
+	os.WriteFile(csv, []byte("name,ssn,age\nsam,123-45-6789,25\njames,555-12-3456,30\nlinda,987-65-4321,61\n"), 0600)
+	f, err := os.Open(csv)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer f.Close()
+	classes, err := DetectPIIInCSV(f, &td, true, ",", false, DefaultPIISampleSize)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if classes["name"] != PIIName || classes["ssn"] != PIISSN || len(classes) != 2 {
+		t.Errorf("unexpected classes %v", classes)
+	}
+
+	os.WriteFile(csv, []byte("name,ssn,age\nsam,123-45-6789,young\n"), 0600)
+	f2, _ := os.Open(csv)
+	defer f2.Close()
+	if _, err := DetectPIIInCSV(f2, &td, true, ",", false, DefaultPIISampleSize); err == nil {
+		t.Errorf("expected a malformed row to be rejected before loading")
+	}
+}
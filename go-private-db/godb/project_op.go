@@ -43,6 +43,7 @@ func (p *Project) Descriptor() *TupleDesc {
 // distinct tuples seen so far.  Note that support for the distinct keyword is
 // optional as specified in the lab 2 assignment.
 func (p *Project) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
+	bindVaultExprs(tid, p.selectFields...)
 	iter, _ := p.child.Iterator(tid)
 	seen := make(map[any]bool)
 
@@ -1,42 +1,121 @@
 package godb
 
 import (
-	"github.com/getamis/alice/crypto/homo"
-	"github.com/getamis/alice/crypto/homo/paillier"
+	"fmt"
+
 	"github.com/xwb1989/sqlparser"
 )
 
 func translateQuery(sql string) (error, EncryptionScheme) {
+	scheme, err := NewHomomorphicScheme(PaillierSchemeKind, 2048)
+	if err != nil {
+		return err, EncryptionScheme{}
+	}
+	return translateQueryWithHomScheme(sql, scheme)
+}
+
+// Like translateQuery, but aggregated columns are encrypted under the given
+// homomorphic scheme, e.g. one from NewHomomorphicScheme, possibly with a
+// randomizer pool started.
+func translateQueryWithHomScheme(sql string, scheme HomomorphicScheme) (error, EncryptionScheme) {
+	keys := NewHomomorphicKeyRing(scheme)
+	homEncryptFunc, homDecryptFunc, publicKey := newHomEncryptionFuncFromScheme(keys)
+	err, e := translateQueryWithHomKey(sql, homEncryptFunc, homDecryptFunc, publicKey)
+	e.HomKeys = keys
+	return err, e
+}
+
+// Like translateQuery, but aggregated columns are encrypted under a freshly
+// dealt threshold-of-numShares Paillier key. One share file per custodian is
+// written to shareDir and their paths are returned. The scheme's decrypt
+// functions run every custodian locally from those share files and combine
+// their partial decryptions.
+func translateQueryWithThreshold(sql string, keySize int, threshold int, numShares int, shareDir string) (error, EncryptionScheme, []string) {
+	pk, paths, err := DealThresholdPaillierToDir(keySize, threshold, numShares, shareDir)
+	if err != nil {
+		return err, EncryptionScheme{}, nil
+	}
+	homEncryptFunc := newThresholdHomEncryptionFunc(pk)
+	homDecryptFunc := newThresholdHomDecryptionFunc(pk, paths)
+	err, e := translateQueryWithHomKey(sql, homEncryptFunc, homDecryptFunc, pk)
+	return err, e, paths
+}
+
+// Names of the keys TranslateQuery keeps in its key store.
+const (
+	translateDetKeyName = "translate/det"
+	translateHomKeyName = "translate/hom"
+)
+
+// The deterministic key of schemes built without a key store (tests only).
+var fixedDetKey = []byte("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+
+// Builds an encryption scheme for the query sql against catalog c. The
+// deterministic key and the Paillier key ring for aggregated columns are
+// taken from ks, or created there (a fresh 2048 bit Paillier key) the first
+// time, so that data encrypted by one call can be decrypted by the next.
+func TranslateQuery(c *Catalog, sql string, ks *KeyStore) (EncryptionScheme, error) {
+	detKey, err := ks.GetOrCreateKey(translateDetKeyName, 64)
+	if err != nil {
+		return EncryptionScheme{}, err
+	}
+	var keys *HomomorphicKeyRing
+	if b, exists := ks.GetKey(translateHomKeyName); exists {
+		keys, err = LoadHomomorphicKeyRing(b)
+		if err != nil {
+			return EncryptionScheme{}, err
+		}
+	} else {
+		scheme, err := NewHomomorphicScheme(PaillierSchemeKind, 2048)
+		if err != nil {
+			return EncryptionScheme{}, err
+		}
+		keys = NewHomomorphicKeyRing(scheme)
+		err = ks.SetKey(translateHomKeyName, keys.ToPrivKeyBytes())
+		if err != nil {
+			return EncryptionScheme{}, err
+		}
+	}
+	homEncryptFunc, homDecryptFunc, publicKey := newHomEncryptionFuncFromScheme(keys)
+	err, e := translateQueryWithCatalog(c, sql, detKey, homEncryptFunc, homDecryptFunc, publicKey)
+	e.HomKeys = keys
+	return e, err
+}
+
+func translateQueryWithHomKey(sql string, homEncryptFunc func(v any) (any, error), homDecryptFunc func(v any) (any, error), publicKey HomomorphicPubKey) (error, EncryptionScheme) {
+	bp := NewBufferPool(10)
+	c, err := NewCatalogFromFile("patients_catalog.txt", bp, "./")
+	if err != nil {
+		return err, EncryptionScheme{}
+	}
+	return translateQueryWithCatalog(c, sql, fixedDetKey, homEncryptFunc, homDecryptFunc, publicKey)
+}
+
+func translateQueryWithCatalog(c *Catalog, sql string, detKey []byte, homEncryptFunc func(v any) (any, error), homDecryptFunc func(v any) (any, error), publicKey HomomorphicPubKey) (error, EncryptionScheme) {
 	encryptMethods := make(map[string]func(v any) (any, error))
 	decryptMethods := make(map[string]func(v any) (any, error))
-	paillierMap := make(map[string](*(paillier.Paillier)))
-	publicKeys := make(map[string](*homo.Pubkey))
+	publicKeys := make(map[string](*HomomorphicPubKey))
 	intFieldEncryptedAsStringField := make(map[string]bool)
 
 	defaultEncrypt := func(v any) (any, error) {
 		return v, nil
 	}
 
-	key := []byte("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
-	detEncryptFunc := newDetEncryptionFunc(key)
-	detDecryptFunc := newDetDecryptionFunc(key)
-
-	keySize := 2048
-	homEncryptFunc, homDecryptFunc, publicKey := newHomEncryptionFunc(keySize)
+	detEncryptFunc := newDetEncryptionFunc(detKey)
+	detDecryptFunc := newDetDecryptionFunc(detKey)
 
 	e := EncryptionScheme{
 		EncryptMethods:                 encryptMethods,
 		DefaultEncrypt:                 detEncryptFunc,
 		DecryptMethods:                 decryptMethods,
 		DefaultDecrypt:                 detDecryptFunc,
-		PaillierMap:                    paillierMap,
 		PublicKeys:                     publicKeys,
 		IntFieldEncryptedAsStringField: intFieldEncryptedAsStringField,
+		Padding:                        make(map[string]PaddingPolicy),
+		Kinds:                          make(map[string]EncryptionKind),
+		DefaultKind:                    DetKind,
 	}
 
-	bp := NewBufferPool(10)
-	c, err := NewCatalogFromFile("patients_catalog.txt", bp, "./")
-
 	stmt, err := sqlparser.Parse(sql)
 	if err != nil {
 		return err, e
@@ -44,7 +123,18 @@ func translateQuery(sql string) (error, EncryptionScheme) {
 
 	switch stmt := stmt.(type) {
 	case *sqlparser.Select:
-		plan, _ := parseStatement(c, stmt)
+		plan, err := parseStatement(c, stmt)
+		if err != nil {
+			return err, e
+		}
+		var tables []string
+		for _, t := range plan.tables {
+			tables = append(tables, t.tableName)
+		}
+		err = c.applyColumnPadding(&e, tables)
+		if err != nil {
+			return err, e
+		}
 		aggs := plan.aggs
 		for _, agg := range aggs {
 			switch aggType := *(agg.funcOp); aggType {
@@ -52,6 +142,7 @@ func translateQuery(sql string) (error, EncryptionScheme) {
 				e.EncryptMethods[agg.field] = homEncryptFunc
 				e.DecryptMethods[agg.field] = homDecryptFunc
 				e.PublicKeys[agg.field] = &publicKey
+				e.Kinds[agg.field] = HomKind
 				e.EncryptMethods["count"] = defaultEncrypt
 				e.DecryptMethods["sum"] = homDecryptFunc
 				e.DecryptMethods["count"] = defaultEncrypt
@@ -63,6 +154,7 @@ func translateQuery(sql string) (error, EncryptionScheme) {
 				e.EncryptMethods[agg.field] = homEncryptFunc
 				e.DecryptMethods[agg.field] = homDecryptFunc
 				e.PublicKeys[agg.field] = &publicKey
+				e.Kinds[agg.field] = HomKind
 				e.DecryptMethods["sum"] = homDecryptFunc
 				e.PublicKeys["sum"] = &publicKey
 				e.IntFieldEncryptedAsStringField["sum"] = true
@@ -72,6 +164,7 @@ func translateQuery(sql string) (error, EncryptionScheme) {
 				e.EncryptMethods[agg.field] = detEncryptFunc
 				e.DecryptMethods[agg.field] = detDecryptFunc
 				e.PublicKeys[agg.field] = &publicKey
+				e.Kinds[agg.field] = DetKind
 				e.EncryptMethods["count"] = defaultEncrypt
 				e.DecryptMethods["count"] = defaultEncrypt
 				e.PublicKeys["count"] = &publicKey
@@ -80,3 +173,60 @@ func translateQuery(sql string) (error, EncryptionScheme) {
 	}
 	return nil, e
 }
+
+// Rewrites the constant of a predicate "fname op constant" on a column
+// encrypted under e so the server can evaluate it on ciphertexts. Only
+// equality and inequality on deterministically encrypted columns can be
+// evaluated; anything else fails with an error naming the column and the
+// kind of encryption it would need.
+func encryptPredicateConstant(e *EncryptionScheme, fname string, op BoolOp, constant Expr) (Expr, error) {
+	kind := e.kind(fname)
+	switch kind {
+	case PlaintextKind:
+		return constant, nil
+	case DetKind:
+		if op != OpEq && op != OpNeq {
+			return nil, GoDBError{IllegalOperationError, fmt.Sprintf("column %s is encrypted deterministically, which only supports = and <> predicates; %s needs order-preserving encryption", fname, boolOpName(op))}
+		}
+	default:
+		return nil, GoDBError{IllegalOperationError, fmt.Sprintf("column %s uses %s encryption, which does not support %s predicates; it needs deterministic encryption", fname, kind, boolOpName(op))}
+	}
+
+	value, err := constant.EvalExpr(nil)
+	if err != nil {
+		return nil, GoDBError{IllegalOperationError, fmt.Sprintf("predicate on encrypted column %s must compare it with a constant", fname)}
+	}
+	var plain any
+	switch value := value.(type) {
+	case IntField:
+		plain = value.Value
+	case StringField:
+		padded, err := e.Padding[fname].pad(value.Value)
+		if err != nil {
+			return nil, err
+		}
+		plain = padded
+	default:
+		return nil, GoDBError{IllegalOperationError, fmt.Sprintf("predicate on encrypted column %s must compare it with a constant", fname)}
+	}
+	ciphertext, err := e.getMethod(fname, true)(plain)
+	if err != nil {
+		return nil, err
+	}
+	switch ciphertext := ciphertext.(type) {
+	case int64:
+		return &ConstExpr{IntField{ciphertext}, IntType}, nil
+	case string:
+		return &ConstExpr{StringField{ciphertext}, StringType}, nil
+	}
+	return nil, GoDBError{TypeMismatchError, fmt.Sprintf("unexpected ciphertext type for column %s", fname)}
+}
+
+func boolOpName(op BoolOp) string {
+	for name, o := range BoolOpMap {
+		if o == op && name != "!=" {
+			return name
+		}
+	}
+	return "unknown"
+}
@@ -62,3 +62,42 @@ func TestTranslation(t *testing.T) {
 		}
 	}
 }
+
+func TestTranslateQueryKeepsKeys(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(dir+"/catalog.txt", []byte("t (name string, age int)\n"), 0600)
+	c, err := NewCatalogFromFile("catalog.txt", NewBufferPool(3), dir)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	sql := "select sum(age), count(name) from t"
+	ks, err := OpenKeyStore(dir + "/keys.json")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	e, err := TranslateQuery(c, sql, ks)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	desc := TupleDesc{Fields: []FieldType{{Fname: "name", Ftype: StringType}, {Fname: "age", Ftype: IntType}}}
+	encrypted, err := e.encryptOrDecryptTuple(&Tuple{Desc: desc, Fields: []DBValue{StringField{"alice"}, IntField{42}}}, true)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	ks, err = OpenKeyStore(dir + "/keys.json")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	e, err = TranslateQuery(c, sql, ks)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	decrypted, err := e.encryptOrDecryptTuple(encrypted, false)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if decrypted.Fields[0].(StringField).Value != "alice" || decrypted.Fields[1].(IntField).Value != 42 {
+		t.Errorf("expected a scheme from the same key store to decrypt, got %v", decrypted.Fields)
+	}
+}
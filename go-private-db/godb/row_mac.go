@@ -0,0 +1,142 @@
+package godb
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// Names of the columns a RowMAC appends to encrypted tuples.
+const (
+	RowIDField  = "_rowid"
+	RowMACField = "_mac"
+)
+
+// Bytes of HMAC-SHA256 output kept per tag; base64 encoded, a tag fills
+// exactly the StringLength bytes a heap file stores per string.
+const rowMACTagSize = 24
+
+// Per-row authentication tags for encrypted heap files. When an
+// EncryptionScheme has a RowMAC, every encrypted tuple gets a random row id
+// and an HMAC-SHA256 tag over the table name, the row id and all encrypted
+// fields as the heap file stores them (strings cut to StringLength bytes,
+// without trailing zero bytes). Decryption verifies the tag, so a server that modifies a
+// ciphertext, swaps ciphertexts between rows or tables, or copies a row
+// from another table is caught; whole-file decryption also rejects repeated
+// row ids (replayed rows).
+type RowMAC struct {
+	table string
+	key   []byte
+}
+
+// Creates a RowMAC for table, keyed by the key store's MAC key for that
+// table.
+func NewRowMAC(ks *KeyStore, table string) (*RowMAC, error) {
+	key, err := ks.GetOrCreateKey("mac/"+table, sha256.Size)
+	if err != nil {
+		return nil, err
+	}
+	return &RowMAC{table: table, key: key}, nil
+}
+
+func (m *RowMAC) fields() []FieldType {
+	return []FieldType{
+		{Fname: RowIDField, Ftype: IntType},
+		{Fname: RowMACField, Ftype: StringType},
+	}
+}
+
+// whether desc ends with the row id and MAC columns
+func (m *RowMAC) hasColumns(desc *TupleDesc) bool {
+	n := len(desc.Fields)
+	return n >= 2 && desc.Fields[n-2].Fname == RowIDField && desc.Fields[n-1].Fname == RowMACField
+}
+
+func (m *RowMAC) tag(rowID int64, fields []DBValue) string {
+	h := hmac.New(sha256.New, m.key)
+	writeLenPrefixed := func(b []byte) {
+		binary.Write(h, binary.BigEndian, uint32(len(b)))
+		h.Write(b)
+	}
+	writeLenPrefixed([]byte(m.table))
+	binary.Write(h, binary.BigEndian, rowID)
+	for _, f := range fields {
+		switch f := f.(type) {
+		case IntField:
+			h.Write([]byte{byte(IntType)})
+			binary.Write(h, binary.BigEndian, f.Value)
+		case StringField:
+			h.Write([]byte{byte(StringType)})
+			writeLenPrefixed([]byte(storedString(f.Value)))
+		}
+	}
+	return base64.RawStdEncoding.EncodeToString(h.Sum(nil)[:rowMACTagSize])
+}
+
+// s as it reads back from a heap file
+func storedString(s string) string {
+	if len(s) > StringLength {
+		s = s[:StringLength]
+	}
+	return strings.TrimRight(s, "\x00")
+}
+
+// Appends a fresh row id and the tag to an encrypted tuple.
+func (m *RowMAC) sign(t *Tuple) (*Tuple, error) {
+	id, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		return nil, err
+	}
+	rowID := id.Int64()
+	desc := TupleDesc{Fields: append(t.Desc.copy().Fields, m.fields()...)}
+	fields := append(append([]DBValue{}, t.Fields...), IntField{rowID}, StringField{m.tag(rowID, t.Fields)})
+	return &Tuple{Desc: desc, Fields: fields, Rid: t.Rid}, nil
+}
+
+// Checks the tag of an encrypted tuple and returns it without the row id
+// and MAC columns.
+func (m *RowMAC) verify(t *Tuple) (*Tuple, error) {
+	if !m.hasColumns(&t.Desc) || len(t.Fields) != len(t.Desc.Fields) {
+		return nil, GoDBError{IntegrityError, fmt.Sprintf("row of table %s has no authentication tag", m.table)}
+	}
+	n := len(t.Fields)
+	rowID, ok1 := t.Fields[n-2].(IntField)
+	tag, ok2 := t.Fields[n-1].(StringField)
+	if !ok1 || !ok2 {
+		return nil, GoDBError{IntegrityError, fmt.Sprintf("row of table %s has a malformed authentication tag", m.table)}
+	}
+	if !hmac.Equal([]byte(tag.Value), []byte(m.tag(rowID.Value, t.Fields[:n-2]))) {
+		return nil, GoDBError{IntegrityError, fmt.Sprintf("authentication tag mismatch for row %d of table %s", rowID.Value, m.table)}
+	}
+	desc := TupleDesc{Fields: t.Desc.copy().Fields[:n-2]}
+	return &Tuple{Desc: desc, Fields: t.Fields[:n-2], Rid: t.Rid}, nil
+}
+
+// Wraps a tuple iterator over an encrypted file so that it fails on the
+// second occurrence of a row id.
+func (m *RowMAC) uniqueRowIDs(iter func() (*Tuple, error)) func() (*Tuple, error) {
+	seen := make(map[int64]bool)
+	return func() (*Tuple, error) {
+		t, err := iter()
+		if t == nil || err != nil {
+			return t, err
+		}
+		if !m.hasColumns(&t.Desc) {
+			return nil, GoDBError{IntegrityError, fmt.Sprintf("row of table %s has no authentication tag", m.table)}
+		}
+		rowID, ok := t.Fields[len(t.Fields)-2].(IntField)
+		if !ok {
+			return nil, GoDBError{IntegrityError, fmt.Sprintf("row of table %s has a malformed authentication tag", m.table)}
+		}
+		if seen[rowID.Value] {
+			return nil, GoDBError{IntegrityError, fmt.Sprintf("row %d of table %s appears more than once", rowID.Value, m.table)}
+		}
+		seen[rowID.Value] = true
+		return t, nil
+	}
+}
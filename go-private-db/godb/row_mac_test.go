@@ -0,0 +1,214 @@
+package godb
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func isIntegrityError(err error) bool {
+	gerr, ok := err.(GoDBError)
+	return ok && gerr.code == IntegrityError
+}
+
+func TestKeyStorePersists(t *testing.T) {
+	path := t.TempDir() + "/keys.json"
+	ks, err := OpenKeyStore(path)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	k1, err := ks.GetOrCreateKey("mac/t", 32)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expected key store mode 0600, got %v", info.Mode().Perm())
+	}
+
+	reopened, err := OpenKeyStore(path)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	k2, exists := reopened.GetKey("mac/t")
+	if !exists || !bytes.Equal(k1, k2) {
+		t.Errorf("expected key to survive reopening the key store")
+	}
+
+	err = reopened.DeleteKey("mac/t")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	reopened, _ = OpenKeyStore(path)
+	if _, exists := reopened.GetKey("mac/t"); exists {
+		t.Errorf("expected deleted key to stay deleted")
+	}
+}
+
+func TestRowMACRoundTrip(t *testing.T) {
+	_, t1, t2, hf, _, tid := makeTestVars()
+	hf.insertTuple(&t1, tid)
+	hf.insertTuple(&t2, tid)
+
+	mac, err := NewRowMAC(NewKeyStore(), "t")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	e := getDummyEncryptionScheme()
+	e.MAC = mac
+
+	os.Remove("mac_encrypted_test.dat")
+	os.Remove("mac_decrypted_test.dat")
+	defer os.Remove("mac_encrypted_test.dat")
+	defer os.Remove("mac_decrypted_test.dat")
+	encryptedHf, err := e.encryptOrDecrypt(hf, "mac_encrypted_test.dat", true, tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if !mac.hasColumns(encryptedHf.Descriptor()) {
+		t.Fatalf("expected encrypted file to have row id and MAC columns")
+	}
+	decryptedHf, err := e.encryptOrDecrypt(encryptedHf, "mac_decrypted_test.dat", false, tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(decryptedHf.Descriptor().Fields) != 2 {
+		t.Errorf("expected MAC columns to be stripped on decryption")
+	}
+
+	iter, _ := decryptedHf.Iterator(tid)
+	i := 0
+	for {
+		tp, _ := iter()
+		if tp == nil {
+			break
+		}
+		if !tp.equals(&t1) && !tp.equals(&t2) {
+			t.Errorf("tuple decrypted incorrectly: %v", tp.Fields)
+		}
+		i++
+	}
+	if i != 2 {
+		t.Errorf("expected 2 tuples, got %d", i)
+	}
+}
+
+func TestRowMACDetectsTampering(t *testing.T) {
+	td, t1, t2, _, _, _ := makeTestVars()
+	ks := NewKeyStore()
+	mac, _ := NewRowMAC(ks, "t")
+	e := getDummyEncryptionScheme()
+	e.MAC = mac
+
+	c1, err := e.encryptOrDecryptTuple(&t1, true)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	c2, _ := e.encryptOrDecryptTuple(&t2, true)
+
+	// modified ciphertext
+	modified := *c1
+	modified.Fields = append([]DBValue{}, c1.Fields...)
+	modified.Fields[1] = IntField{modified.Fields[1].(IntField).Value + 1}
+	_, err = e.encryptOrDecryptTuple(&modified, false)
+	if !isIntegrityError(err) {
+		t.Errorf("expected integrity error for modified field, got %v", err)
+	}
+
+	// ciphertext moved to another row
+	swapped := *c1
+	swapped.Fields = append([]DBValue{}, c1.Fields...)
+	swapped.Fields[0] = c2.Fields[0]
+	_, err = e.encryptOrDecryptTuple(&swapped, false)
+	if !isIntegrityError(err) {
+		t.Errorf("expected integrity error for swapped field, got %v", err)
+	}
+
+	// row copied to another table
+	other, _ := NewRowMAC(ks, "u")
+	e.MAC = other
+	_, err = e.encryptOrDecryptTuple(c1, false)
+	if !isIntegrityError(err) {
+		t.Errorf("expected integrity error for row from another table, got %v", err)
+	}
+	e.MAC = mac
+
+	// replayed row
+	os.Remove("mac_replay_test.dat")
+	os.Remove("mac_replay_decrypted_test.dat")
+	defer os.Remove("mac_replay_test.dat")
+	defer os.Remove("mac_replay_decrypted_test.dat")
+	bp := NewBufferPool(3)
+	replayHf, err := NewHeapFile("mac_replay_test.dat", e.encryptedDesc(&td, true), bp)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	tid := NewTID()
+	bp.BeginTransaction(tid)
+	replayHf.insertTuple(c1, tid)
+	replayHf.insertTuple(c2, tid)
+	replayHf.insertTuple(c1, tid)
+	_, err = e.encryptOrDecrypt(replayHf, "mac_replay_decrypted_test.dat", false, tid)
+	if !isIntegrityError(err) {
+		t.Errorf("expected integrity error for replayed row, got %v", err)
+	}
+}
+
+func TestRowMACSurvivesFlush(t *testing.T) {
+	dir := t.TempDir()
+	mac, err := NewRowMAC(NewKeyStore(), "t")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	identity := func(v any) (any, error) { return v, nil }
+	e := EncryptionScheme{DefaultEncrypt: identity, DefaultDecrypt: identity, MAC: mac}
+	td := TupleDesc{Fields: []FieldType{{Fname: "note", Ftype: StringType}, {Fname: "n", Ftype: IntType}}}
+
+	// enough rows that some raw tags would end in a zero byte, and a note
+	// longer than the heap file stores
+	const rows = 1000
+	bp := NewBufferPool(50)
+	hf, err := NewHeapFile(dir+"/mac.dat", e.encryptedDesc(&td, true), bp)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	tid := NewTID()
+	bp.BeginTransaction(tid)
+	for i := 0; i < rows; i++ {
+		tup := Tuple{Desc: td, Fields: []DBValue{StringField{"a note well over thirty-two bytes long"}, IntField{int64(i)}}}
+		signed, err := e.encryptOrDecryptTuple(&tup, true)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if err = hf.insertTuple(signed, tid); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	bp.CommitTransaction(tid)
+	bp.FlushAllPages()
+
+	bp = NewBufferPool(50)
+	hf, err = NewHeapFile(dir+"/mac.dat", e.encryptedDesc(&td, true), bp)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	tid = NewTID()
+	bp.BeginTransaction(tid)
+	iter, _ := hf.Iterator(tid)
+	n := 0
+	for tup, err := iter(); tup != nil || err != nil; tup, err = iter() {
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if _, err = e.encryptOrDecryptTuple(tup, false); err != nil {
+			t.Fatalf("row %v: %v", tup.Fields[1], err)
+		}
+		n++
+	}
+	if n != rows {
+		t.Errorf("expected %d rows, got %d", rows, n)
+	}
+}
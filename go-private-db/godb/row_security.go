@@ -0,0 +1,467 @@
+package godb
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/xwb1989/sqlparser"
+)
+
+// Row-level security. Beyond column grants, a row policy limits the rows of
+// a table a user may see and change to those satisfying a predicate:
+//
+//	ALTER USER alice SET clinic = 'north'
+//	CREATE POLICY own_clinic ON patients FOR SELECT TO clinician USING (clinic = user_attribute('clinic'))
+//	DROP POLICY own_clinic ON patients
+//
+// The predicate is a conjunction of comparisons of a column (or a function
+// of columns) of the table with an expression, like a WHERE clause. It may
+// call current_user(), current_role() and user_attribute(name), which are
+// replaced by the session's user, the role it acts as (the held role set by
+// Catalog.SetRole or its only role, otherwise "") and the user's attribute
+// name when a statement is planned; statements of a user
+// without the attribute fail. A policy applies FOR SELECT, INSERT, DELETE or
+// ALL (the default) to a user or role, or to every user if TO is omitted or
+// PUBLIC. SELECT policies become filters directly above the table's scan, so
+// other rows are invisible to queries, subqueries and INSERT ... SELECT.
+// DELETE removes only rows satisfying both the SELECT and DELETE policies.
+// Every row INSERT adds must satisfy the INSERT policies, or the statement
+// fails. All policies that apply must hold; a table without policies for a
+// user is limited only by the user's privileges. The superuser bypasses
+// policies. Policies are saved in row_policies.json next to the catalog,
+// user attributes in the system table _user_attributes.
+
+const rowPoliciesFile = "row_policies.json"
+
+type RowPolicy struct {
+	Name    string    `json:"name"`
+	Table   string    `json:"table"`
+	Command Privilege `json:"command"` // "" for all commands
+	Grantee string    `json:"grantee"` // user or role, "" for every user
+	Using   string    `json:"using"`   // the predicate
+}
+
+type rowPolicies struct {
+	path     string
+	Policies []RowPolicy `json:"policies"`
+}
+
+// Opens the policies saved at path, or none if path does not exist.
+func openRowPolicies(path string) (rowPolicies, error) {
+	p := rowPolicies{path: path}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return p, nil
+	}
+	if err != nil {
+		return p, err
+	}
+	err = json.Unmarshal(data, &p)
+	if err != nil {
+		return p, GoDBError{MalformedDataError, fmt.Sprintf("malformed row policies %s: %s", path, err.Error())}
+	}
+	return p, nil
+}
+
+func (p *rowPolicies) save() error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(p.path, data, 0600)
+}
+
+func (a *accessControl) addAttribute(user string, name string, value string) {
+	if a.attributes[user] == nil {
+		a.attributes[user] = make(map[string]string)
+	}
+	a.attributes[user][name] = value
+}
+
+// Sets (or, if !set, removes) attribute name of user.
+func (a *accessControl) setAttribute(user string, name string, value string, set bool) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.users[user] != "user" {
+		return GoDBError{IllegalOperationError, fmt.Sprintf("no user '%s'", user)}
+	}
+	err := a.deleteRows(a.attributesFile, user, name)
+	if err != nil {
+		return err
+	}
+	delete(a.attributes[user], name)
+	if !set {
+		return nil
+	}
+	err = a.insertRow(a.attributesFile, user, name, value)
+	if err != nil {
+		return err
+	}
+	a.addAttribute(user, name, value)
+	return nil
+}
+
+func (a *accessControl) createPolicy(p RowPolicy) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if _, exists := a.users[p.Grantee]; p.Grantee != "" && !exists {
+		return GoDBError{IllegalOperationError, fmt.Sprintf("no user or role '%s'", p.Grantee)}
+	}
+	for _, q := range a.policies.Policies {
+		if q.Name == p.Name && q.Table == p.Table {
+			return GoDBError{IllegalOperationError, fmt.Sprintf("policy %s on table %s already exists", p.Name, p.Table)}
+		}
+	}
+	a.policies.Policies = append(a.policies.Policies, p)
+	return a.policies.save()
+}
+
+func (a *accessControl) dropPolicy(name string, table string) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	for i, p := range a.policies.Policies {
+		if p.Name == name && p.Table == table {
+			a.policies.Policies = append(a.policies.Policies[:i], a.policies.Policies[i+1:]...)
+			return a.policies.save()
+		}
+	}
+	return GoDBError{IllegalOperationError, fmt.Sprintf("no policy %s on table %s", name, table)}
+}
+
+// The policies on table for any of commands that apply to user, and user's
+// attributes.
+func (a *accessControl) policiesFor(user string, table string, commands []Privilege) ([]RowPolicy, map[string]string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	var policies []RowPolicy
+	for _, p := range a.policies.Policies {
+		if p.Table != table || (p.Grantee != "" && p.Grantee != user && !a.members[user][p.Grantee]) {
+			continue
+		}
+		for _, cmd := range commands {
+			if p.Command == "" || p.Command == cmd {
+				policies = append(policies, p)
+				break
+			}
+		}
+	}
+	attributes := make(map[string]string)
+	for name, value := range a.attributes[user] {
+		attributes[name] = value
+	}
+	return policies, attributes
+}
+
+// The values session functions of policy predicates are replaced by.
+type policySession struct {
+	user, role string
+	attributes map[string]string // nil when only checking a predicate
+}
+
+// Replaces session functions in lsn by constants and qualifies its columns
+// with qualifier.
+func (s *policySession) bind(lsn *LogicalSelectNode, qualifier string) error {
+	switch lsn.exprType {
+	case ExprField:
+		lsn.table = qualifier
+	case ExprFunc:
+		switch *lsn.funcOp {
+		case "current_user", "current_role":
+			if len(lsn.args) != 0 {
+				return GoDBError{ParseError, fmt.Sprintf("%s takes no arguments", *lsn.funcOp)}
+			}
+			value := s.user
+			if *lsn.funcOp == "current_role" {
+				value = s.role
+			}
+			*lsn = NewConstSelectNode(value, lsn.alias)
+		case "user_attribute":
+			if len(lsn.args) != 1 || lsn.args[0].exprType != ExprConst {
+				return GoDBError{ParseError, "user_attribute takes the name of an attribute"}
+			}
+			name := strings.ToLower(lsn.args[0].value)
+			value, exists := s.attributes[name]
+			if !exists && s.attributes != nil {
+				return GoDBError{PermissionError, fmt.Sprintf("permission denied: user '%s' has no attribute %s", s.user, name)}
+			}
+			*lsn = NewConstSelectNode(value, lsn.alias)
+		default:
+			for _, arg := range lsn.args {
+				err := s.bind(arg, qualifier)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	case ExprAggr, ExprStar:
+		return GoDBError{ParseError, "policy predicates cannot use aggregates or *"}
+	}
+	return nil
+}
+
+// Parses the predicate of a policy on table into filters bound to session
+// and qualified with qualifier.
+func parsePolicyPredicate(c *Catalog, table string, using string, session *policySession, qualifier string) ([]*LogicalFilterNode, error) {
+	stmt, err := sqlparser.Parse(fmt.Sprintf("select * from %s where %s", table, using))
+	if err != nil {
+		return nil, GoDBError{ParseError, fmt.Sprintf("invalid policy predicate %s: %s", using, err.Error())}
+	}
+	sel, ok := stmt.(*sqlparser.Select)
+	if !ok || sel.Where == nil || len(sel.From) != 1 {
+		return nil, GoDBError{ParseError, fmt.Sprintf("invalid policy predicate %s", using)}
+	}
+	tables, _, _, err := parseFrom(c, sel.From[0])
+	if err != nil {
+		return nil, err
+	}
+	comparisons, err := conjuncts(sel.Where.Expr)
+	if err != nil {
+		return nil, err
+	}
+	var filters []*LogicalFilterNode
+	for _, cmp := range comparisons {
+		fs, joins, err := parseWhere(c, nil, tables, cmp)
+		if err != nil {
+			return nil, err
+		}
+		if joins != nil {
+			return nil, GoDBError{ParseError, "policy predicates cannot refer to other tables"}
+		}
+		for _, f := range fs {
+			_, field, err := f.fieldExpr.getTableField(c, nil, tables)
+			if err != nil {
+				return nil, err
+			}
+			if field == "" {
+				return nil, GoDBError{ParseError, fmt.Sprintf("the left side of %s is not a column of %s", sqlparser.String(cmp), table)}
+			}
+			err = session.bind(&f.fieldExpr, qualifier)
+			if err != nil {
+				return nil, err
+			}
+			err = session.bind(&f.constExpr, qualifier)
+			if err != nil {
+				return nil, err
+			}
+		}
+		filters = append(filters, fs...)
+	}
+	return filters, nil
+}
+
+// The comparisons of a conjunction. parseWhere drops errors below an AND,
+// which must not quietly weaken a policy.
+func conjuncts(expr sqlparser.Expr) ([]sqlparser.Expr, error) {
+	switch expr := expr.(type) {
+	case *sqlparser.AndExpr:
+		left, err := conjuncts(expr.Left)
+		if err != nil {
+			return nil, err
+		}
+		right, err := conjuncts(expr.Right)
+		if err != nil {
+			return nil, err
+		}
+		return append(left, right...), nil
+	case *sqlparser.ParenExpr:
+		return conjuncts(expr.Expr)
+	case *sqlparser.ComparisonExpr:
+		return []sqlparser.Expr{expr}, nil
+	}
+	return nil, GoDBError{ParseError, fmt.Sprintf("policy predicates must be conjunctions of comparisons, not %s", sqlparser.String(expr))}
+}
+
+// The filters the policies for any of commands put on tables for the
+// session user, qualified with the tables' aliases (or names if
+// qualify).
+func (c *Catalog) policyFilters(tables []*LogicalTableNode, qualify bool, commands ...Privilege) ([]*LogicalFilterNode, error) {
+	if c.user == "" {
+		return nil, nil
+	}
+	a, err := c.access()
+	if err != nil {
+		return nil, err
+	}
+	var filters []*LogicalFilterNode
+	for _, t := range tables {
+		policies, attributes := a.policiesFor(c.user, t.tableName, commands)
+		qualifier := ""
+		if qualify {
+			qualifier = t.tableName
+			if t.alias != "" {
+				qualifier = t.alias
+			}
+		}
+		for _, p := range policies {
+			fs, err := parsePolicyPredicate(c, t.tableName, p.Using, &policySession{c.user, c.currentRole(), attributes}, qualifier)
+			if err != nil {
+				return nil, err
+			}
+			filters = append(filters, fs...)
+		}
+	}
+	return filters, nil
+}
+
+type policyCheck struct {
+	policy      string
+	left, right Expr
+	op          BoolOp
+}
+
+// Operator failing the statement when a tuple of its child does not satisfy
+// the INSERT policies of the table it is inserted into.
+type policyCheckOp struct {
+	table  string
+	desc   *TupleDesc // of the table
+	checks []policyCheck
+	child  Operator
+}
+
+// Checks the rows child inserts into table against the INSERT policies of
+// the session user; returns child itself if none apply.
+func (c *Catalog) insertPolicyCheck(table string, desc *TupleDesc, child Operator) (Operator, error) {
+	if c.user == "" {
+		return child, nil
+	}
+	a, err := c.access()
+	if err != nil {
+		return nil, err
+	}
+	policies, attributes := a.policiesFor(c.user, table, []Privilege{InsertPrivilege})
+	if len(policies) == 0 {
+		return child, nil
+	}
+	var checks []policyCheck
+	for _, p := range policies {
+		filters, err := parsePolicyPredicate(c, table, p.Using, &policySession{c.user, c.currentRole(), attributes}, "")
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range filters {
+			left, _, err := f.fieldExpr.generateExpr(c, desc, map[string]*PlanNode{})
+			if err != nil {
+				return nil, err
+			}
+			right, _, err := f.constExpr.generateExpr(c, desc, map[string]*PlanNode{})
+			if err != nil {
+				return nil, err
+			}
+			if left.GetExprType().Ftype != right.GetExprType().Ftype {
+				return nil, GoDBError{IncompatibleTypesError, fmt.Sprintf("policy %s on %s compares values of different types", p.Name, table)}
+			}
+			checks = append(checks, policyCheck{p.Name, left, right, f.predOp})
+		}
+	}
+	return &policyCheckOp{table, desc, checks, child}, nil
+}
+
+func (p *policyCheckOp) Descriptor() *TupleDesc {
+	return p.child.Descriptor()
+}
+
+func (p *policyCheckOp) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
+	iter, err := p.child.Iterator(tid)
+	if err != nil {
+		return nil, err
+	}
+	return func() (*Tuple, error) {
+		t, err := iter()
+		if err != nil || t == nil {
+			return t, err
+		}
+		row := &Tuple{*p.desc, t.Fields, nil}
+		for _, check := range p.checks {
+			left, err := check.left.EvalExpr(row)
+			if err != nil {
+				return nil, err
+			}
+			right, err := check.right.EvalExpr(row)
+			if err != nil {
+				return nil, err
+			}
+			var ok bool
+			switch left := left.(type) {
+			case IntField:
+				ok = evalPred(left.Value, right.(IntField).Value, check.op)
+			case StringField:
+				ok = evalPred(left.Value, right.(StringField).Value, check.op)
+			}
+			if !ok {
+				return nil, GoDBError{PermissionError, fmt.Sprintf("permission denied: new row violates policy %s on table %s", check.policy, p.table)}
+			}
+		}
+		return t, nil
+	}, nil
+}
+
+var (
+	createPolicyRegexp  = regexp.MustCompile(`(?is)^\s*create\s+policy\s+(\w+)\s+on\s+(\w+)(?:\s+for\s+(all|select|insert|delete))?(?:\s+to\s+(\w+))?\s+using\s*\((.*)\)\s*;?\s*$`)
+	dropPolicyRegexp    = regexp.MustCompile(`(?is)^\s*drop\s+policy\s+(\w+)\s+on\s+(\w+)\s*;?\s*$`)
+	alterUserAttrRegexp = regexp.MustCompile(`(?is)^\s*alter\s+user\s+(\w+)\s+(?:set\s+(\w+)\s*=\s*(?:'([^']*)'|([^\s';]+))|reset\s+(\w+))\s*;?\s*$`)
+)
+
+// Runs query if it is a row security statement; returns false if it is not
+// one.
+func processRowSecurity(c *Catalog, query string) (bool, error) {
+	if m := createPolicyRegexp.FindStringSubmatch(query); m != nil {
+		if err := c.checkSuperuser("create policies"); err != nil {
+			return true, err
+		}
+		p := RowPolicy{Name: strings.ToLower(m[1]), Table: strings.ToLower(m[2]), Command: Privilege(strings.ToLower(m[3])), Grantee: strings.ToLower(m[4]), Using: m[5]}
+		if p.Command == "all" {
+			p.Command = ""
+		}
+		if p.Grantee == "public" {
+			p.Grantee = ""
+		}
+		t := c.tableMap[p.Table]
+		if t == nil {
+			return true, GoDBError{NoSuchTableError, fmt.Sprintf("no table '%s' found", p.Table)}
+		}
+		// check the predicate, without the values of session functions
+		filters, err := parsePolicyPredicate(c, p.Table, p.Using, &policySession{}, "")
+		if err != nil {
+			return true, err
+		}
+		for _, f := range filters {
+			_, _, err = f.fieldExpr.generateExpr(c, &t.desc, map[string]*PlanNode{})
+			if err != nil {
+				return true, err
+			}
+		}
+		a, err := c.access()
+		if err != nil {
+			return true, err
+		}
+		return true, a.createPolicy(p)
+	}
+	if m := dropPolicyRegexp.FindStringSubmatch(query); m != nil {
+		if err := c.checkSuperuser("drop policies"); err != nil {
+			return true, err
+		}
+		a, err := c.access()
+		if err != nil {
+			return true, err
+		}
+		return true, a.dropPolicy(strings.ToLower(m[1]), strings.ToLower(m[2]))
+	}
+	if m := alterUserAttrRegexp.FindStringSubmatch(query); m != nil {
+		if err := c.checkSuperuser("set user attributes"); err != nil {
+			return true, err
+		}
+		a, err := c.access()
+		if err != nil {
+			return true, err
+		}
+		user := strings.ToLower(m[1])
+		if m[5] != "" {
+			return true, a.setAttribute(user, strings.ToLower(m[5]), "", false)
+		}
+		return true, a.setAttribute(user, strings.ToLower(m[2]), m[3]+m[4], true)
+	}
+	return false, nil
+}
@@ -0,0 +1,202 @@
+package godb
+
+import (
+	"os"
+	"testing"
+)
+
+func rowSecurityTestCatalog(t *testing.T) (*Catalog, TransactionID, string) {
+	dir := t.TempDir()
+	os.WriteFile(dir+"/catalog.txt", []byte("patients (id string, clinic string, age int)\nvisits (id string, ward string)\n"), 0600)
+	bp := NewBufferPool(10)
+	c, err := NewCatalogFromFile("catalog.txt", bp, dir)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	tid := NewTID()
+	bp.BeginTransaction(tid)
+	for _, sql := range []string{
+		"insert into patients values ('p1', 'north', 30), ('p2', 'south', 40), ('p3', 'north', 50)",
+		"insert into visits values ('p1', 'a'), ('p2', 'b'), ('p3', 'c')",
+	} {
+		_, op, err := Parse(c, sql)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		iter, _ := op.Iterator(tid)
+		if _, err = iter(); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	for _, sql := range []string{
+		"create user alice",
+		"create user bob",
+		"create role clinician",
+		"grant clinician to alice",
+		"grant clinician to bob",
+		"grant all on patients to clinician",
+		"grant select on visits to clinician",
+		"alter user alice set clinic = 'north'",
+		"ALTER USER bob SET clinic = south",
+		"CREATE POLICY own_clinic ON patients TO clinician USING (clinic = user_attribute('clinic'))",
+	} {
+		mustParse(t, c, sql)
+	}
+	bp.CommitTransaction(tid)
+	tid = NewTID()
+	bp.BeginTransaction(tid)
+	return c, tid, dir
+}
+
+func patientIds(t *testing.T, c *Catalog, tid TransactionID, sql string) map[string]bool {
+	ids := make(map[string]bool)
+	for _, row := range queryRows(t, c, tid, sql) {
+		ids[row.Fields[0].(StringField).Value] = true
+	}
+	return ids
+}
+
+func runStatement(c *Catalog, tid TransactionID, sql string) error {
+	_, op, err := Parse(c, sql)
+	if err != nil {
+		return err
+	}
+	iter, err := op.Iterator(tid)
+	if err != nil {
+		return err
+	}
+	_, err = iter()
+	return err
+}
+
+func TestRowPolicySelect(t *testing.T) {
+	c, tid, _ := rowSecurityTestCatalog(t)
+	if ids := patientIds(t, c, tid, "select id from patients"); len(ids) != 3 {
+		t.Errorf("expected the superuser to see all patients, got %v", ids)
+	}
+
+	c.SetUser("alice")
+	if ids := patientIds(t, c, tid, "select id from patients"); len(ids) != 2 || !ids["p1"] || !ids["p3"] {
+		t.Errorf("expected alice to see the north clinic, got %v", ids)
+	}
+	if ids := patientIds(t, c, tid, "select p.id from patients p, visits v where p.id = v.id and v.ward <> 'c'"); len(ids) != 1 || !ids["p1"] {
+		t.Errorf("expected the policy to apply below the join, got %v", ids)
+	}
+	if ids := patientIds(t, c, tid, "select id from (select id from patients) sq"); len(ids) != 2 {
+		t.Errorf("expected the policy to apply in subqueries, got %v", ids)
+	}
+	if rows := queryRows(t, c, tid, "select count(*) from patients where age > 20"); rows[0].Fields[0].(IntField).Value != 2 {
+		t.Errorf("expected aggregates over the visible rows only, got %v", rows[0].Fields)
+	}
+
+	asSuperuser(c)
+	c.SetUser("bob")
+	if ids := patientIds(t, c, tid, "select id from patients"); len(ids) != 1 || !ids["p2"] {
+		t.Errorf("expected bob to see the south clinic, got %v", ids)
+	}
+
+	asSuperuser(c)
+	mustParse(t, c, "create user carol")
+	mustParse(t, c, "grant clinician to carol")
+	c.SetUser("carol")
+	expectPermissionError(t, c, "select id from patients")
+	if ids := patientIds(t, c, tid, "select id from visits"); len(ids) != 3 {
+		t.Errorf("expected tables without policies to be unrestricted, got %v", ids)
+	}
+}
+
+func TestRowPolicyInsertDelete(t *testing.T) {
+	c, tid, _ := rowSecurityTestCatalog(t)
+	c.SetUser("alice")
+	if err := runStatement(c, tid, "insert into patients values ('p4', 'north', 60)"); err != nil {
+		t.Fatalf(err.Error())
+	}
+	err := runStatement(c, tid, "insert into patients values ('p5', 'south', 60)")
+	if gerr, ok := err.(GoDBError); !ok || gerr.code != PermissionError {
+		t.Errorf("expected inserting into another clinic to be refused, got %v", err)
+	}
+
+	if err := runStatement(c, tid, "delete from patients where age > 35"); err != nil {
+		t.Fatalf(err.Error())
+	}
+	asSuperuser(c)
+	if ids := patientIds(t, c, tid, "select id from patients"); len(ids) != 2 || !ids["p1"] || !ids["p2"] {
+		t.Errorf("expected the delete to spare the south clinic, got %v", ids)
+	}
+
+	mustParse(t, c, "create policy adults on patients for delete using (age >= 35)")
+	c.SetUser("alice")
+	if err := runStatement(c, tid, "delete from patients where id = 'p1'"); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if ids := patientIds(t, c, tid, "select id from patients"); len(ids) != 1 || !ids["p1"] {
+		t.Errorf("expected the delete policy to protect p1, got %v", ids)
+	}
+}
+
+func TestRowPolicyStatements(t *testing.T) {
+	c, _, dir := rowSecurityTestCatalog(t)
+	for _, sql := range []string{
+		"create policy p on patients using (clinic = 'north' or age > 3)",
+		"create policy p on patients using (ward = 'a')",
+		"create policy p on nosuchtable using (id = 'p1')",
+		"create policy p on patients to nosuchuser using (id = 'p1')",
+		"create policy own_clinic on patients using (id = 'p1')",
+		"drop policy nosuchpolicy on patients",
+		"alter user clinician set clinic = 'north'",
+	} {
+		if _, _, err := Parse(c, sql); err == nil {
+			t.Errorf("%s: expected an error", sql)
+		}
+	}
+	c.SetUser("alice")
+	expectPermissionError(t, c, "create policy p on patients using (id = current_user())")
+	expectPermissionError(t, c, "drop policy own_clinic on patients")
+	expectPermissionError(t, c, "alter user alice set clinic = 'south'")
+
+	c.bp.FlushAllPages()
+	c2, err := NewCatalogFromFile("catalog.txt", NewBufferPool(10), dir)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	tid := NewTID()
+	c2.bp.BeginTransaction(tid)
+	c2.SetUser("bob")
+	if ids := patientIds(t, c2, tid, "select id from patients"); len(ids) != 1 || !ids["p2"] {
+		t.Errorf("expected the policy and attributes to persist, got %v", ids)
+	}
+	asSuperuser(c2)
+	mustParse(t, c2, "drop policy own_clinic on patients")
+	c2.SetUser("bob")
+	if ids := patientIds(t, c2, tid, "select id from patients"); len(ids) != 3 {
+		t.Errorf("expected bob to see all patients without the policy, got %v", ids)
+	}
+}
+
+func TestRowPolicyCurrentRole(t *testing.T) {
+	c, tid, _ := rowSecurityTestCatalog(t)
+	for _, sql := range []string{
+		"create role a",
+		"create role b",
+		"grant a to alice",
+		"create policy ward_role on visits using (ward = current_role())",
+	} {
+		mustParse(t, c, sql)
+	}
+	c.SetUser("alice")
+	if ids := patientIds(t, c, tid, "select id from visits"); len(ids) != 0 {
+		t.Errorf("expected current_role() to match nothing before alice chooses one of her roles, got %v", ids)
+	}
+	if err := c.SetRole("a"); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if ids := patientIds(t, c, tid, "select id from visits"); len(ids) != 1 || !ids["p1"] {
+		t.Errorf("expected alice to see ward a as role a, got %v", ids)
+	}
+	if c.SetRole("b") == nil {
+		t.Errorf("expected alice not to take role b")
+	}
+	if ids := patientIds(t, c, tid, "select id from visits"); len(ids) != 1 || !ids["p1"] {
+		t.Errorf("expected current_role() to stay a, got %v", ids)
+	}
+}
@@ -0,0 +1,343 @@
+package godb
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Crypto-shredding. Deleting a subject's rows leaves their ciphertexts in
+// old page images, backups and copies of the file. When an EncryptionScheme
+// has SubjectKeys, the randomized columns of each row are additionally
+// sealed with AES-256-GCM under a random key belonging to the row's subject
+// (the value of the subject column, e.g. a patient id). The keys live in a
+// KeyStore of their own, the key table, which must not be copied into
+// backups. FORGET SUBJECT retires the subject's key, after which every copy
+// of the subject's encrypted fields is unrecoverable: they decrypt to
+// ShreddedValue (0 for int columns), and new rows for the subject are
+// refused.
+//
+// A sealed value is longer than the StringLength bytes a heap file stores
+// per field, so sealed values are appended to a log of their own and the
+// field holds a random handle to its value. The log belongs with the
+// table's data (and its backups). Columns encrypted for server-side
+// operations (det, ore, hom) and int columns would stay readable under their
+// table keys, so schemes with SubjectKeys may only have randomized string
+// (or int-as-string) columns besides plaintext ones and the subject column.
+
+// What a shredded string field decrypts to.
+const ShreddedValue = "<forgotten>"
+
+const subjectKeySize = 32
+
+// random bytes per handle of a sealed value
+const sealedHandleSize = 16
+
+type SubjectKeys struct {
+	keys   *KeyStore
+	sealed *sealedValueLog
+	table  string
+	column string // identifies the subject of a row
+}
+
+// Encrypts randomized columns of table under per-subject keys from ks,
+// identifying subjects by the plaintext value of column. Sealed values are
+// kept in the log at sealedPath, which is created if it does not exist.
+func NewSubjectKeys(ks *KeyStore, sealedPath string, table string, column string) (*SubjectKeys, error) {
+	sealed, err := openSealedValueLog(sealedPath)
+	if err != nil {
+		return nil, err
+	}
+	return &SubjectKeys{ks, sealed, table, column}, nil
+}
+
+// Sealed values by handle, saved in an append-only file with one
+// "handle base64(nonce || ciphertext)" line per value.
+type sealedValueLog struct {
+	mutex  sync.Mutex
+	file   *os.File
+	values map[string][]byte
+}
+
+func openSealedValueLog(path string) (*sealedValueLog, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	l := &sealedValueLog{file: file, values: make(map[string][]byte)}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		handle, encoded, ok := strings.Cut(scanner.Text(), " ")
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if !ok || err != nil {
+			file.Close()
+			return nil, GoDBError{MalformedDataError, fmt.Sprintf("malformed sealed value log %s", path)}
+		}
+		l.values[handle] = value
+	}
+	if err = scanner.Err(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// A new random handle, short enough to be stored in a heap file.
+func (l *sealedValueLog) reserve() (string, error) {
+	b := make([]byte, sealedHandleSize)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (l *sealedValueLog) put(handle string, value []byte) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	_, err := l.file.WriteString(handle + " " + base64.StdEncoding.EncodeToString(value) + "\n")
+	if err != nil {
+		return err
+	}
+	err = l.file.Sync()
+	if err != nil {
+		return err
+	}
+	l.values[handle] = value
+	return nil
+}
+
+func (l *sealedValueLog) get(handle string) ([]byte, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	value, exists := l.values[handle]
+	return value, exists
+}
+
+func subjectKeyName(id string) string {
+	return "subject/" + id
+}
+
+// Destroys the key of subject id.
+func (s *SubjectKeys) Forget(id string) error {
+	return s.keys.RetireKey(subjectKeyName(id))
+}
+
+// Which fields of desc are sealed under subject keys, or nil if none are
+// (including when desc has no subject column). Fails if desc has encrypted
+// fields that subject keys cannot cover.
+func (s *SubjectKeys) keyedFields(e *EncryptionScheme, desc *TupleDesc) ([]bool, error) {
+	if s == nil {
+		return nil, nil
+	}
+	subject := s.subjectField(desc)
+	if subject < 0 {
+		return nil, nil
+	}
+	keyed := make([]bool, len(desc.Fields))
+	someKeyed := false
+	for i, f := range desc.Fields {
+		if i == subject || e.kind(f.Fname) == PlaintextKind {
+			continue
+		}
+		_, swappedTypes := e.IntFieldEncryptedAsStringField[f.Fname]
+		if e.kind(f.Fname) != RndKind || (f.Ftype != StringType && !swappedTypes) {
+			return nil, GoDBError{IllegalOperationError, fmt.Sprintf("column %s (%s) cannot be encrypted under subject keys and would survive FORGET SUBJECT; make it a randomized string (or int-as-string) column, or plaintext", f.Fname, e.kind(f.Fname))}
+		}
+		keyed[i] = true
+		someKeyed = true
+	}
+	if !someKeyed {
+		return nil, nil
+	}
+	return keyed, nil
+}
+
+func (s *SubjectKeys) subjectField(desc *TupleDesc) int {
+	for i, f := range desc.Fields {
+		if f.Fname == s.column {
+			return i
+		}
+	}
+	return -1
+}
+
+// binds a sealed value to its table, column, subject and handle
+func (s *SubjectKeys) aad(column string, id string, handle string) []byte {
+	return []byte(s.table + "\x00" + column + "\x00" + id + "\x00" + handle)
+}
+
+// Encrypts (or decrypts) the keyed fields of t into fields, whose other
+// fields, including the subject column, are already done.
+func (s *SubjectKeys) encryptOrDecryptFields(e *EncryptionScheme, t *Tuple, fields []DBValue, keyed []bool, encrypt bool) error {
+	subject := s.subjectField(&t.Desc)
+	id := subjectID(fields[subject])
+	if encrypt {
+		id = subjectID(t.Fields[subject])
+	}
+	var key []byte
+	if encrypt {
+		var err error
+		key, err = s.keys.GetOrCreateKey(subjectKeyName(id), subjectKeySize)
+		if err != nil {
+			return err
+		}
+		if len(key) == 0 {
+			return GoDBError{IllegalOperationError, fmt.Sprintf("subject %s has been forgotten", id)}
+		}
+	} else {
+		key, _ = s.keys.GetKey(subjectKeyName(id))
+	}
+	var aead cipher.AEAD
+	if len(key) > 0 {
+		var err error
+		aead, err = newGCM(key)
+		if err != nil {
+			return err
+		}
+	}
+
+	for i, f := range t.Desc.Fields {
+		if !keyed[i] {
+			continue
+		}
+		if encrypt {
+			v, err := e.encryptOrDecryptField(f, t.Fields[i], true)
+			if err != nil {
+				return err
+			}
+			nonce := make([]byte, aead.NonceSize())
+			_, err = rand.Read(nonce)
+			if err != nil {
+				return err
+			}
+			// the handle is drawn before sealing so that the seal binds it
+			handle, err := s.sealed.reserve()
+			if err != nil {
+				return err
+			}
+			err = s.sealed.put(handle, aead.Seal(nonce, nonce, []byte(v.(StringField).Value), s.aad(f.Fname, id, handle)))
+			if err != nil {
+				return err
+			}
+			fields[i] = StringField{handle}
+			continue
+		}
+		if aead == nil {
+			fields[i] = shreddedField(e, f.Fname)
+			continue
+		}
+		handle := t.Fields[i].(StringField).Value
+		sealed, exists := s.sealed.get(handle)
+		n := aead.NonceSize()
+		if !exists || len(sealed) < n {
+			return GoDBError{IntegrityError, fmt.Sprintf("%s of subject %s has no sealed value", f.Fname, id)}
+		}
+		plain, err := aead.Open(nil, sealed[:n], sealed[n:], s.aad(f.Fname, id, handle))
+		if err != nil {
+			return GoDBError{IntegrityError, fmt.Sprintf("%s of subject %s failed to decrypt: wrong key or corrupted value", f.Fname, id)}
+		}
+		fields[i], err = e.encryptOrDecryptField(f, StringField{string(plain)}, false)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func subjectID(v DBValue) string {
+	switch v := v.(type) {
+	case IntField:
+		return strconv.FormatInt(v.Value, 10)
+	case StringField:
+		return v.Value
+	}
+	return fmt.Sprint(v)
+}
+
+func shreddedField(e *EncryptionScheme, fname string) DBValue {
+	if _, swappedTypes := e.IntFieldEncryptedAsStringField[fname]; swappedTypes {
+		return IntField{0}
+	}
+	return StringField{ShreddedValue}
+}
+
+// Destroys the key of subject id in the key tables of all tables of the
+// catalog with subject keys. Returns the number of such tables.
+func (c *Catalog) ForgetSubject(id string) (int, error) {
+	n := 0
+	retired := make(map[*KeyStore]bool)
+	for _, t := range c.tables {
+		if t.encryption == nil || t.encryption.Subjects == nil {
+			continue
+		}
+		n++
+		s := t.encryption.Subjects
+		if retired[s.keys] {
+			continue
+		}
+		err := s.Forget(id)
+		if err != nil {
+			return n, err
+		}
+		retired[s.keys] = true
+	}
+	if n == 0 {
+		return 0, GoDBError{IllegalOperationError, "no table has subject keys"}
+	}
+	return n, nil
+}
+
+var forgetSubjectRegexp = regexp.MustCompile(`(?is)^\s*forget\s+subject\s+(?:'([^']*)'|([^\s';]+))\s*;?\s*$`)
+
+// The subject id of a FORGET SUBJECT statement, if query is one.
+func parseForgetSubject(query string) (string, bool) {
+	m := forgetSubjectRegexp.FindStringSubmatch(query)
+	if m == nil {
+		return "", false
+	}
+	if m[1] != "" {
+		return m[1], true
+	}
+	return m[2], true
+}
+
+// Operator for FORGET SUBJECT; like DeleteOp, it does its work when
+// iterated and returns a single "count" tuple, the number of tables with
+// subject keys.
+type ForgetSubjectOp struct {
+	c  *Catalog
+	id string
+}
+
+func NewForgetSubjectOp(c *Catalog, id string) *ForgetSubjectOp {
+	return &ForgetSubjectOp{c, id}
+}
+
+func (f *ForgetSubjectOp) Descriptor() *TupleDesc {
+	return &TupleDesc{Fields: []FieldType{{Fname: "count", Ftype: IntType}}}
+}
+
+func (f *ForgetSubjectOp) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
+	done := false
+	return func() (*Tuple, error) {
+		if done {
+			return nil, nil
+		}
+		done = true
+		n, err := f.c.ForgetSubject(f.id)
+		if err != nil {
+			return nil, err
+		}
+		return &Tuple{*f.Descriptor(), []DBValue{IntField{int64(n)}}, nil}, nil
+	}, nil
+}
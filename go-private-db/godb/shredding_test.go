@@ -0,0 +1,221 @@
+package godb
+
+import (
+	"os"
+	"testing"
+)
+
+func TestParseForgetSubject(t *testing.T) {
+	for query, id := range map[string]string{
+		"FORGET SUBJECT 'p 17'":  "p 17",
+		"forget subject p17;":    "p17",
+		"  Forget Subject 42 ; ": "42",
+	} {
+		got, ok := parseForgetSubject(query)
+		if !ok || got != id {
+			t.Errorf("%s: expected subject %q, got %q (%v)", query, id, got, ok)
+		}
+	}
+	if _, ok := parseForgetSubject("select * from forget"); ok {
+		t.Errorf("expected a select not to parse as FORGET SUBJECT")
+	}
+}
+
+func TestForgetSubject(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(dir+"/catalog.txt", []byte("patients (id string, diagnosis string, age int)\n"), 0600)
+	bp := NewBufferPool(3)
+	c, err := NewCatalogFromFile("catalog.txt", bp, dir)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	tid := NewTID()
+	bp.BeginTransaction(tid)
+	_, op, _ := Parse(c, "forget subject p1")
+	iter, _ := op.Iterator(tid)
+	if _, err = iter(); err == nil {
+		t.Errorf("expected an error without subject keys")
+	}
+
+	ks, err := OpenKeyStore(dir + "/subject_keys.json")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	subjects, err := NewSubjectKeys(ks, dir+"/patients.sealed", "patients", "id")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	identity := func(v any) (any, error) { return v, nil }
+	e := EncryptionScheme{
+		DefaultEncrypt: identity,
+		DefaultDecrypt: identity,
+		Kinds:          map[string]EncryptionKind{"id": DetKind, "age": PlaintextKind},
+		Subjects:       subjects,
+	}
+	if err = c.SetTableEncryption("patients", &e); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	_, op, err = Parse(c, "insert into patients values ('p1', 'flu', 30), ('p2', 'asthma', 40)")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	iter, _ = op.Iterator(tid)
+	if _, err = iter(); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	decrypted := func() map[string]*Tuple {
+		hf, _ := c.GetTable("patients")
+		iter, _ := hf.Iterator(tid)
+		rows := make(map[string]*Tuple)
+		for tup, _ := iter(); tup != nil; tup, _ = iter() {
+			if tup.Fields[1].(StringField).Value == "flu" || tup.Fields[1].(StringField).Value == "asthma" {
+				t.Errorf("expected diagnosis to be encrypted under the subject key, got %v", tup.Fields)
+			}
+			plain, err := e.encryptOrDecryptTuple(tup, false)
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+			rows[plain.Fields[0].(StringField).Value] = plain
+		}
+		return rows
+	}
+	rows := decrypted()
+	if rows["p1"].Fields[1].(StringField).Value != "flu" || rows["p2"].Fields[1].(StringField).Value != "asthma" {
+		t.Errorf("expected diagnoses to decrypt, got %v %v", rows["p1"].Fields, rows["p2"].Fields)
+	}
+
+	_, op, err = Parse(c, "FORGET SUBJECT 'p1'")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	iter, _ = op.Iterator(tid)
+	tup, err := iter()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if tup.Fields[0].(IntField).Value != 1 {
+		t.Errorf("expected one table with subject keys, got %v", tup.Fields[0])
+	}
+	rows = decrypted()
+	if rows["p1"].Fields[1].(StringField).Value != ShreddedValue || rows["p1"].Fields[2].(IntField).Value != 30 {
+		t.Errorf("expected p1's diagnosis to be shredded, got %v", rows["p1"].Fields)
+	}
+	if rows["p2"].Fields[1].(StringField).Value != "asthma" {
+		t.Errorf("expected p2 to be unaffected, got %v", rows["p2"].Fields)
+	}
+
+	// the retired key is saved, and the subject cannot come back
+	reopened, _ := OpenKeyStore(dir + "/subject_keys.json")
+	if key, exists := reopened.GetKey("subject/p1"); !exists || len(key) != 0 {
+		t.Errorf("expected p1's key to be retired in the key table")
+	}
+	_, op, _ = Parse(c, "insert into patients values ('p1', 'flu', 30)")
+	iter, _ = op.Iterator(tid)
+	if _, err = iter(); err == nil {
+		t.Errorf("expected inserting a forgotten subject to fail")
+	}
+}
+
+func TestForgetSubjectAfterReopen(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(dir+"/catalog.txt", []byte("patients (id string, diagnosis string, age int)\n"), 0600)
+	identity := func(v any) (any, error) { return v, nil }
+	open := func() (*Catalog, *EncryptionScheme) {
+		c, err := NewCatalogFromFile("catalog.txt", NewBufferPool(3), dir)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		ks, err := OpenKeyStore(dir + "/subject_keys.json")
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		subjects, err := NewSubjectKeys(ks, dir+"/patients.sealed", "patients", "id")
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		e := &EncryptionScheme{
+			DefaultEncrypt: identity,
+			DefaultDecrypt: identity,
+			Kinds:          map[string]EncryptionKind{"id": DetKind, "age": PlaintextKind},
+			Subjects:       subjects,
+		}
+		if err = c.SetTableEncryption("patients", e); err != nil {
+			t.Fatalf(err.Error())
+		}
+		return c, e
+	}
+
+	c, _ := open()
+	tid := NewTID()
+	c.bp.BeginTransaction(tid)
+	if err := runStatement(c, tid, "insert into patients values ('p1', 'chronic obstructive pulmonary disease', 60), ('p2', 'flu', 30)"); err != nil {
+		t.Fatalf(err.Error())
+	}
+	c.bp.CommitTransaction(tid)
+	c.bp.FlushAllPages()
+
+	c, e := open()
+	tid = NewTID()
+	c.bp.BeginTransaction(tid)
+	decrypted := func() map[string]string {
+		hf, _ := c.GetTable("patients")
+		iter, _ := hf.Iterator(tid)
+		diagnoses := make(map[string]string)
+		for tup, err := iter(); tup != nil || err != nil; tup, err = iter() {
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+			plain, err := e.encryptOrDecryptTuple(tup, false)
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+			diagnoses[plain.Fields[0].(StringField).Value] = plain.Fields[1].(StringField).Value
+		}
+		return diagnoses
+	}
+	diagnoses := decrypted()
+	if diagnoses["p1"] != "chronic obstructive pulmonary disease" || diagnoses["p2"] != "flu" {
+		t.Errorf("expected sealed values to read back after reopening, got %v", diagnoses)
+	}
+	if err := runStatement(c, tid, "forget subject p1"); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if diagnoses = decrypted(); diagnoses["p1"] != ShreddedValue || diagnoses["p2"] != "flu" {
+		t.Errorf("expected only p1 to be shredded, got %v", diagnoses)
+	}
+}
+
+func TestSubjectKeysRejectUncoveredColumns(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(dir+"/catalog.txt", []byte("patients (id string, diagnosis string, age int)\n"), 0600)
+	c, err := NewCatalogFromFile("catalog.txt", NewBufferPool(3), dir)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	ks := NewKeyStore()
+	subjects, err := NewSubjectKeys(ks, dir+"/patients.sealed", "patients", "id")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	for name, kinds := range map[string]map[string]EncryptionKind{
+		"randomized int": {"id": DetKind},
+		"det string":     {"id": DetKind, "age": PlaintextKind, "diagnosis": DetKind},
+		"ore int":        {"id": DetKind, "age": OreKind},
+		"hom int":        {"id": DetKind, "age": HomKind},
+	} {
+		e := &EncryptionScheme{Kinds: kinds, Subjects: subjects}
+		if err := c.SetTableEncryption("patients", e); err == nil {
+			t.Errorf("%s: expected a column that survives FORGET SUBJECT to be rejected", name)
+		}
+	}
+	e := &EncryptionScheme{
+		Kinds:                          map[string]EncryptionKind{"id": DetKind},
+		IntFieldEncryptedAsStringField: map[string]bool{"age": true},
+		Subjects:                       subjects,
+	}
+	if err := c.SetTableEncryption("patients", e); err != nil {
+		t.Errorf("expected a randomized int stored as a string to be covered, got %v", err)
+	}
+}
@@ -0,0 +1,392 @@
+package godb
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Small-cell suppression. Release rules for health data forbid showing
+// aggregates over fewer than a threshold number of individuals. When a
+// SuppressionPolicy applies to an Aggregator or EncryptedAggregator, groups
+// (cells) with fewer input rows than the threshold are either dropped from
+// the result or merged into a single "other" group. Dropping one cell is not
+// enough when totals are known: for every group-by column, the cells that
+// agree on all other group-by columns form a slice whose total can be had
+// from a coarser query, so more cells of the slice are suppressed (dropped
+// or merged) until no hidden cell, and no hidden total under the threshold,
+// can be derived by subtraction (complementary suppression).
+
+type SuppressionMode int
+
+const (
+	SuppressCells SuppressionMode = iota // drop small groups from the result
+	MergeCells                           // fold small groups into one "other" group
+)
+
+type SuppressionPolicy struct {
+	Threshold int // groups over fewer rows are not shown on their own
+	Mode      SuppressionMode
+}
+
+// The value of string group-by fields in the merged group of a MergeCells
+// policy; int group-by fields are 0.
+const OtherGroupLabel = "other"
+
+func ParseSuppressionMode(s string) (SuppressionMode, error) {
+	switch strings.ToLower(s) {
+	case "suppress":
+		return SuppressCells, nil
+	case "merge":
+		return MergeCells, nil
+	}
+	return SuppressCells, GoDBError{ParseError, fmt.Sprintf("unknown suppression mode %s, expected suppress or merge", s)}
+}
+
+// Parses a policy as given in the catalog: "<threshold>" to suppress cells,
+// or "<threshold>:merge".
+func ParseSuppressionPolicy(s string) (*SuppressionPolicy, error) {
+	threshold, mode, found := strings.Cut(s, ":")
+	policy := &SuppressionPolicy{}
+	var err error
+	policy.Threshold, err = strconv.Atoi(threshold)
+	if err != nil || policy.Threshold <= 0 {
+		return nil, GoDBError{ParseError, fmt.Sprintf("invalid suppression threshold %s", threshold)}
+	}
+	if found {
+		policy.Mode, err = ParseSuppressionMode(mode)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return policy, nil
+}
+
+func (p *SuppressionPolicy) String() string {
+	if p.Mode == MergeCells {
+		return strconv.Itoa(p.Threshold) + ":merge"
+	}
+	return strconv.Itoa(p.Threshold)
+}
+
+// Sets the suppression policy of all aggregate queries in this session; nil
+// removes it. Table policies still apply. Only the superuser may change
+// suppression policies.
+func (c *Catalog) SetSuppression(policy *SuppressionPolicy) error {
+	err := c.checkSuperuser("change suppression policies")
+	if err != nil {
+		return err
+	}
+	c.suppression = policy
+	return nil
+}
+
+// Sets the suppression policy of aggregate queries over table; nil removes
+// it. The policy is saved with the catalog (see SaveToFile). Only the
+// superuser may change suppression policies.
+func (c *Catalog) SetTableSuppression(table string, policy *SuppressionPolicy) error {
+	err := c.checkSuperuser("change suppression policies")
+	if err != nil {
+		return err
+	}
+	t := c.tableMap[table]
+	if t == nil {
+		return GoDBError{NoSuchTableError, fmt.Sprintf("no table '%s' found", table)}
+	}
+	t.suppression = policy
+	return nil
+}
+
+// The strictest of the session policy and those of tables, or nil if none
+// applies.
+func (c *Catalog) suppressionFor(tables []*LogicalTableNode) *SuppressionPolicy {
+	policy := c.suppression
+	for _, lt := range tables {
+		t := c.tableMap[lt.tableName]
+		if t != nil && t.suppression != nil && (policy == nil || t.suppression.Threshold > policy.Threshold) {
+			policy = t.suppression
+		}
+	}
+	return policy
+}
+
+// Suppress the result of a with policy; nil removes suppression.
+func (a *Aggregator) SetSuppression(policy *SuppressionPolicy) {
+	a.suppression = policy
+}
+
+// Suppress the result of a with policy; nil removes suppression.
+func (a *EncryptedAggregator) SetSuppression(policy *SuppressionPolicy) {
+	a.suppression = policy
+}
+
+// Decides which groups of an aggregate result may be shown. keys are the
+// group-by tuples of the groups (a single nil key for a result without
+// group-by) and counts the number of input rows of each. Returns whether
+// each group is shown on its own and, under MergeCells, the groups to fold
+// into the "other" group.
+func (p *SuppressionPolicy) plan(keys []*Tuple, counts []int) ([]bool, []int) {
+	hidden := make([]bool, len(counts))
+	for i, count := range counts {
+		hidden[i] = count < p.Threshold
+	}
+	var merged []int
+	for {
+		p.complement(keys, counts, hidden)
+		if p.Mode != MergeCells {
+			break
+		}
+		// the merged group must itself reach the threshold; hiding
+		// another group may expose a slice, so complement again
+		total := hiddenRows(counts, hidden)
+		if total == 0 || total >= p.Threshold {
+			break
+		}
+		j := smallestShown(allGroups(len(counts)), counts, hidden)
+		if j < 0 {
+			break
+		}
+		hidden[j] = true
+	}
+	if p.Mode == MergeCells && hiddenRows(counts, hidden) >= p.Threshold {
+		for i, h := range hidden {
+			if h {
+				merged = append(merged, i)
+			}
+		}
+	}
+	shown := make([]bool, len(counts))
+	for i, h := range hidden {
+		shown[i] = !h
+	}
+	return shown, merged
+}
+
+// Hides more groups until, in every slice, no hidden group can be derived
+// from the slice total.
+func (p *SuppressionPolicy) complement(keys []*Tuple, counts []int, hidden []bool) {
+	dims := 1
+	if len(keys) > 0 && keys[0] != nil {
+		dims = len(keys[0].Fields)
+	}
+	for changed := true; changed; {
+		changed = false
+		for d := 0; d < dims; d++ {
+			slices := make(map[string][]int)
+			var names []string
+			for i, key := range keys {
+				name := sliceName(key, d)
+				if slices[name] == nil {
+					names = append(names, name)
+				}
+				slices[name] = append(slices[name], i)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				groups := slices[name]
+				if !p.exposed(groups, counts, hidden) {
+					continue
+				}
+				j := smallestShown(groups, counts, hidden)
+				if j >= 0 {
+					hidden[j] = true
+					changed = true
+				}
+			}
+		}
+	}
+}
+
+// whether the hidden groups of a slice can be recovered from its total and
+// its shown groups: a single hidden group, or hidden groups whose sum is
+// itself a small cell
+func (p *SuppressionPolicy) exposed(groups []int, counts []int, hidden []bool) bool {
+	nHidden, hiddenTotal, nShown := 0, 0, 0
+	for _, i := range groups {
+		if hidden[i] {
+			nHidden++
+			hiddenTotal += counts[i]
+		} else {
+			nShown++
+		}
+	}
+	return nHidden > 0 && nShown > 0 && (nHidden == 1 || hiddenTotal < p.Threshold)
+}
+
+func hiddenRows(counts []int, hidden []bool) int {
+	total := 0
+	for i, h := range hidden {
+		if h {
+			total += counts[i]
+		}
+	}
+	return total
+}
+
+func allGroups(n int) []int {
+	groups := make([]int, n)
+	for i := range groups {
+		groups[i] = i
+	}
+	return groups
+}
+
+// the shown group of groups with the fewest rows, or -1 if all are hidden
+func smallestShown(groups []int, counts []int, hidden []bool) int {
+	j := -1
+	for _, i := range groups {
+		if !hidden[i] && (j < 0 || counts[i] < counts[j]) {
+			j = i
+		}
+	}
+	return j
+}
+
+// identifies the slice along dimension d that key belongs to: its fields
+// other than the d-th
+func sliceName(key *Tuple, d int) string {
+	if key == nil {
+		return ""
+	}
+	var parts []string
+	for i, f := range key.Fields {
+		if i != d {
+			parts = append(parts, fmt.Sprint(f))
+		}
+	}
+	return strings.Join(parts, "\x00")
+}
+
+// The group-by tuple of the merged group.
+func otherGroupKey(key *Tuple) *Tuple {
+	if key == nil {
+		return nil
+	}
+	fields := make([]DBValue, len(key.Fields))
+	for i, f := range key.Fields {
+		switch f.(type) {
+		case StringField:
+			fields[i] = StringField{OtherGroupLabel}
+		default:
+			fields[i] = IntField{0}
+		}
+	}
+	return &Tuple{key.Desc, fields, nil}
+}
+
+func finalizeGroup[S interface{ Finalize() *Tuple }](key *Tuple, states []S) *Tuple {
+	t := key
+	for _, as := range states {
+		if t == nil {
+			t = as.Finalize()
+		} else {
+			t = joinTuples(t, as.Finalize())
+		}
+	}
+	return t
+}
+
+// Finalizes the groups of a that policy lets through, in the order of keys.
+func (a *Aggregator) suppressedTuples(keys []*Tuple, aggState map[any]*[]AggState, counts map[any]int) ([]*Tuple, error) {
+	groupKeys := make([]any, len(keys))
+	groupCounts := make([]int, len(keys))
+	for i, key := range keys {
+		groupKeys[i] = any(DefaultGroup)
+		if key != nil {
+			groupKeys[i] = key.tupleKey()
+		}
+		groupCounts[i] = counts[groupKeys[i]]
+	}
+	shown, merged := a.suppression.plan(keys, groupCounts)
+	var result []*Tuple
+	for i, key := range keys {
+		if shown[i] {
+			states := *aggState[groupKeys[i]]
+			t, err := a.addNoise(states, finalizeGroup(key, states))
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, t)
+		}
+	}
+	if len(merged) > 0 {
+		states := make([]AggState, len(a.newAggState))
+		for i, as := range a.newAggState {
+			states[i] = as.Copy()
+			for _, j := range merged {
+				states[i].Merge((*aggState[groupKeys[j]])[i])
+			}
+		}
+		t, err := a.addNoise(states, finalizeGroup(otherGroupKey(keys[merged[0]]), states))
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, t)
+	}
+	return result, nil
+}
+
+func (a *Aggregator) addNoise(states []AggState, t *Tuple) (*Tuple, error) {
+	if a.noise != nil {
+		return a.noise.apply(states, t)
+	}
+	return t, nil
+}
+
+// Finalizes the groups of a that policy lets through, in the order of keys.
+func (a *EncryptedAggregator) suppressedTuples(keys []*Tuple, aggState map[any]*[]EncryptedAggState, counts map[any]int) []*Tuple {
+	groupKeys := make([]any, len(keys))
+	groupCounts := make([]int, len(keys))
+	for i, key := range keys {
+		groupKeys[i] = any(DefaultGroup)
+		if key != nil {
+			groupKeys[i] = key.tupleKey()
+		}
+		groupCounts[i] = counts[groupKeys[i]]
+	}
+	shown, merged := a.suppression.plan(keys, groupCounts)
+	var result []*Tuple
+	for i, key := range keys {
+		if shown[i] {
+			result = append(result, finalizeGroup(key, *aggState[groupKeys[i]]))
+		}
+	}
+	if len(merged) > 0 {
+		states := make([]EncryptedAggState, len(a.newAggState))
+		for i, as := range a.newAggState {
+			states[i] = as.Copy()
+			for _, j := range merged {
+				states[i].Merge((*aggState[groupKeys[j]])[i])
+			}
+		}
+		result = append(result, finalizeGroup(otherGroupKey(keys[merged[0]]), states))
+	}
+	return result
+}
+
+// iterates over tuples
+func tupleSliceIterator(tuples []*Tuple) func() (*Tuple, error) {
+	i := 0
+	return func() (*Tuple, error) {
+		if i >= len(tuples) {
+			return nil, nil
+		}
+		i++
+		return tuples[i-1], nil
+	}
+}
+
+// an operator over an in-memory list of tuples
+type tupleListOp struct {
+	desc   *TupleDesc
+	tuples []*Tuple
+}
+
+func (o *tupleListOp) Descriptor() *TupleDesc {
+	return o.desc
+}
+
+func (o *tupleListOp) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
+	return tupleSliceIterator(o.tuples), nil
+}
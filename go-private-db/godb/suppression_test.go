@@ -0,0 +1,210 @@
+package godb
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+func suppressionTestCatalog(t *testing.T) (*Catalog, TransactionID) {
+	dir := t.TempDir()
+	os.WriteFile(dir+"/catalog.txt", []byte("t (ward string, sex string, age int)\n"), 0600)
+	bp := NewBufferPool(3)
+	c, err := NewCatalogFromFile("catalog.txt", bp, dir)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	// ward a has 10 rows, b 7, c 2 and d 4
+	var values []string
+	for ward, n := range map[string]int{"a": 10, "b": 7, "c": 2, "d": 4} {
+		for i := 0; i < n; i++ {
+			values = append(values, fmt.Sprintf("('%s', '%s', %d)", ward, []string{"f", "m"}[i%2], 20+i))
+		}
+	}
+	tid := NewTID()
+	bp.BeginTransaction(tid)
+	_, op, err := Parse(c, "insert into t values "+strings.Join(values, ", "))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	iter, _ := op.Iterator(tid)
+	_, err = iter()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	return c, tid
+}
+
+func wardCounts(rows []*Tuple) map[string]int64 {
+	counts := make(map[string]int64)
+	for _, r := range rows {
+		counts[r.Fields[0].(StringField).Value] = r.Fields[1].(IntField).Value
+	}
+	return counts
+}
+
+func TestSuppressionPlan(t *testing.T) {
+	p := SuppressionPolicy{Threshold: 5}
+	keys := []*Tuple{{Fields: []DBValue{StringField{"a"}}}, {Fields: []DBValue{StringField{"b"}}}, {Fields: []DBValue{StringField{"c"}}}}
+	shown, _ := p.plan(keys, []int{10, 2, 8})
+	if !shown[0] || shown[1] || shown[2] {
+		t.Errorf("expected the small group and its complement to be hidden, got %v", shown)
+	}
+	shown, _ = p.plan(keys, []int{10, 6, 8})
+	if !shown[0] || !shown[1] || !shown[2] {
+		t.Errorf("expected all groups shown, got %v", shown)
+	}
+
+	// two dimensions: the hidden cell must be covered in its row and column
+	var keys2 []*Tuple
+	for _, ward := range []string{"a", "b", "c"} {
+		for _, sex := range []string{"f", "m"} {
+			keys2 = append(keys2, &Tuple{Fields: []DBValue{StringField{ward}, StringField{sex}}})
+		}
+	}
+	counts := []int{20, 30, 2, 40, 25, 35}
+	checkSlices := func(shown []bool) {
+		for _, d := range []int{0, 1} {
+			slices := make(map[string][]int)
+			for i, key := range keys2 {
+				slices[sliceName(key, d)] = append(slices[sliceName(key, d)], i)
+			}
+			for name, groups := range slices {
+				hidden := 0
+				for _, i := range groups {
+					if !shown[i] {
+						hidden++
+					}
+				}
+				if hidden == 1 {
+					t.Errorf("slice %q along %d has a single hidden cell (%v)", name, d, shown)
+				}
+			}
+		}
+		if shown[2] {
+			t.Errorf("expected the small cell to be hidden")
+		}
+	}
+	shown, _ = p.plan(keys2, counts)
+	checkSlices(shown)
+
+	p.Mode = MergeCells
+	shown, merged := p.plan(keys, []int{10, 3, 2})
+	if !shown[0] || shown[1] || shown[2] || len(merged) != 2 {
+		t.Errorf("expected both small groups merged, got %v %v", shown, merged)
+	}
+	// 2 + 1 is below the threshold, so the next smallest group joins
+	shown, merged = p.plan(append(keys, &Tuple{Fields: []DBValue{StringField{"d"}}}), []int{10, 2, 1, 7})
+	if !shown[0] || shown[3] || len(merged) != 3 {
+		t.Errorf("expected the merged group to reach the threshold, got %v %v", shown, merged)
+	}
+	// merging does not protect a cell whose row and column totals are known
+	shown, merged = p.plan(keys2, counts)
+	checkSlices(shown)
+	total := 0
+	for _, i := range merged {
+		total += counts[i]
+	}
+	if len(merged) < 4 || total < p.Threshold {
+		t.Errorf("expected complementary cells to be merged too, got %v %v", shown, merged)
+	}
+}
+
+func TestSuppressedQueries(t *testing.T) {
+	c, tid := suppressionTestCatalog(t)
+	if len(queryRows(t, c, tid, "select ward, count(*) from t group by ward")) != 4 {
+		t.Fatalf("expected all wards without a policy")
+	}
+
+	err := c.SetTableSuppression("t", &SuppressionPolicy{Threshold: 5})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	counts := wardCounts(queryRows(t, c, tid, "select ward, count(*) from t group by ward"))
+	if len(counts) != 2 || counts["a"] != 10 || counts["b"] != 7 {
+		t.Errorf("expected wards c and d suppressed, got %v", counts)
+	}
+	rows := queryRows(t, c, tid, "select ward, sum(age) from t where ward <> 'b' and ward <> 'd' group by ward")
+	if len(rows) != 0 {
+		t.Errorf("expected ward a suppressed to protect ward c, got %d rows", len(rows))
+	}
+	rows = queryRows(t, c, tid, "select count(*) from t where ward = 'd'")
+	if len(rows) != 0 {
+		t.Errorf("expected a small total to be suppressed")
+	}
+
+	// the session policy is stricter
+	c.SetSuppression(&SuppressionPolicy{Threshold: 8, Mode: MergeCells})
+	counts = wardCounts(queryRows(t, c, tid, "select ward, count(*) from t group by ward"))
+	if len(counts) != 2 || counts["a"] != 10 || counts[OtherGroupLabel] != 13 {
+		t.Errorf("expected wards b, c and d merged, got %v", counts)
+	}
+	if c.SetTableSuppression("nosuchtable", nil) == nil {
+		t.Errorf("expected an error for an unknown table")
+	}
+}
+
+func TestSuppressionPolicySaved(t *testing.T) {
+	c, tid := suppressionTestCatalog(t)
+	if err := c.SetTableSuppression("t", &SuppressionPolicy{Threshold: 8, Mode: MergeCells}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	c.bp.CommitTransaction(tid)
+	c.bp.FlushAllPages()
+	if err := c.SaveToFile("catalog.txt", c.rootPath); err != nil {
+		t.Fatalf(err.Error())
+	}
+	c, err := NewCatalogFromFile("catalog.txt", NewBufferPool(3), c.rootPath)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	tid = NewTID()
+	c.bp.BeginTransaction(tid)
+	counts := wardCounts(queryRows(t, c, tid, "select ward, count(*) from t group by ward"))
+	if len(counts) != 2 || counts["a"] != 10 || counts[OtherGroupLabel] != 13 {
+		t.Errorf("expected the table policy to survive reopening the catalog, got %v", counts)
+	}
+
+	mustParse(t, c, "create user alice")
+	mustParse(t, c, "grant select on t to alice")
+	c.SetUser("alice")
+	if c.SetSuppression(nil) == nil || c.SetTableSuppression("t", nil) == nil {
+		t.Errorf("expected only the superuser to change suppression policies")
+	}
+	if counts = wardCounts(queryRows(t, c, tid, "select ward, count(*) from t group by ward")); len(counts) != 2 {
+		t.Errorf("expected the policy to stay, got %v", counts)
+	}
+}
+
+func TestSuppressedEncryptedAggregator(t *testing.T) {
+	desc := &TupleDesc{Fields: []FieldType{{Fname: "ward", Ftype: StringType}}}
+	var tuples []*Tuple
+	for ward, n := range map[string]int{"a": 6, "b": 5, "c": 1} {
+		for i := 0; i < n; i++ {
+			tuples = append(tuples, &Tuple{*desc, []DBValue{StringField{ward}}, nil})
+		}
+	}
+	for _, parallelism := range []int{1, 3} {
+		ca := EncryptedCountAggState{}
+		ca.Init("count", &FieldExpr{desc.Fields[0]}, nil, nil)
+		agg := NewGroupedEncryptedAggregator([]EncryptedAggState{&ca}, []Expr{&FieldExpr{desc.Fields[0]}}, &tupleListOp{desc, tuples})
+		agg.parallelism = parallelism
+		agg.SetSuppression(&SuppressionPolicy{Threshold: 3, Mode: MergeCells})
+		iter, err := agg.Iterator(NewTID())
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		var rows []*Tuple
+		for tup, err := iter(); tup != nil || err != nil; tup, err = iter() {
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+			rows = append(rows, tup)
+		}
+		counts := wardCounts(rows)
+		if len(counts) != 2 || counts["a"] != 6 || counts[OtherGroupLabel] != 6 {
+			t.Errorf("expected wards b and c merged, got %v", counts)
+		}
+	}
+}
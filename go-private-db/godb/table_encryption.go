@@ -0,0 +1,276 @@
+package godb
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Encrypted tables saved in the catalog. A table encrypted with
+// EncryptTable records the kind of each column ("enc det" after the column
+// type) and, after the column list, where its keys live:
+//
+//	patients (id string enc det, diagnosis string enc rnd, age string enc rnd:int) keys patients.keys subject id subject_keys subjects.keys
+//
+// The column keys are kept in the key store named by keys, one per column;
+// subject keys (see NewSubjectKeys) in the one named by subject_keys, with
+// sealed values in <table>.sealed next to the table. Relative paths are
+// relative to the catalog's root path. Opening the catalog rebuilds the
+// scheme from these keys, so inserts keep being encrypted and FORGET
+// SUBJECT keeps working across restarts.
+//
+// Only plaintext, det and rnd columns can be rebuilt. Randomized
+// ciphertexts do not fit in a heap field, so rnd columns need subject keys,
+// which keep their sealed values outside the heap.
+
+const detKeySize = 64 // AES-SIV
+const rndKeySize = 32 // AES-256-GCM
+
+// How a column of an encrypted table is encrypted: "enc <kind>" in the
+// catalog, or "enc <kind>:int" for an int column stored as a string.
+type ColumnEncryption struct {
+	Kind EncryptionKind // "" if the table is not encrypted with EncryptTable
+	Int  bool
+}
+
+func parseColumnEncryption(s string) (ColumnEncryption, error) {
+	var enc ColumnEncryption
+	kind, suffix, found := strings.Cut(s, ":")
+	if found && suffix != "int" {
+		return enc, GoDBError{ParseError, fmt.Sprintf("unknown encryption %s, expected <kind> or <kind>:int", s)}
+	}
+	enc.Int = found
+	switch EncryptionKind(kind) {
+	case PlaintextKind, RndKind, DetKind, OreKind, HomKind:
+		enc.Kind = EncryptionKind(kind)
+	default:
+		return enc, GoDBError{ParseError, fmt.Sprintf("unknown encryption kind %s", kind)}
+	}
+	return enc, nil
+}
+
+func (e ColumnEncryption) String() string {
+	if e.Int {
+		return string(e.Kind) + ":int"
+	}
+	return string(e.Kind)
+}
+
+// Where the keys of a table encrypted with EncryptTable live.
+type EncryptionRef struct {
+	Keys        string // key store of the column keys
+	Subject     string // subject column, "" without subject keys
+	SubjectKeys string // key store of the subject keys
+}
+
+func (r *EncryptionRef) String() string {
+	if r == nil {
+		return ""
+	}
+	str := " keys " + r.Keys
+	if r.Subject != "" {
+		str += " subject " + r.Subject + " subject_keys " + r.SubjectKeys
+	}
+	return str
+}
+
+// Encrypts the columns of table as given by columns (other columns stay in
+// plaintext) under keys from the key stores named in ref, which are created
+// with random keys as needed. The catalog records the kinds and ref, and
+// reopening it after SaveToFile rebuilds the same scheme. The table's
+// descriptor is that of the encrypted file, so columns with Int set must be
+// string columns. Only the superuser may encrypt tables.
+func (c *Catalog) EncryptTable(table string, columns map[string]ColumnEncryption, ref EncryptionRef) error {
+	err := c.checkSuperuser("encrypt tables")
+	if err != nil {
+		return err
+	}
+	t := c.tableMap[table]
+	if t == nil {
+		return GoDBError{NoSuchTableError, fmt.Sprintf("no table '%s' found", table)}
+	}
+	options := make(map[string]ColumnOptions)
+	for fname, opts := range t.options {
+		opts.Encryption = ColumnEncryption{}
+		options[fname] = opts
+	}
+	for fname, enc := range columns {
+		if _, err := findFieldInTd(FieldType{fname, "", UnknownType}, &t.desc); err != nil {
+			return err
+		}
+		opts := options[fname]
+		opts.Encryption = enc
+		options[fname] = opts
+	}
+	e, err := c.loadTableEncryption(table, &t.desc, options, &ref, true)
+	if err != nil {
+		return err
+	}
+	t.options = options
+	t.keys = &ref
+	t.encryption = e
+	return nil
+}
+
+// The key store at path (relative to the root path), opened once per
+// catalog so tables sharing a store share its keys.
+func (c *Catalog) openKeyStore(path string) (*KeyStore, error) {
+	if path == "" {
+		return nil, GoDBError{ParseError, "missing key store path"}
+	}
+	if !filepath.IsAbs(path) {
+		path = c.rootPath + "/" + path
+	}
+	path = filepath.Clean(path)
+	if ks, exists := c.keyStores[path]; exists {
+		return ks, nil
+	}
+	ks, err := OpenKeyStore(path)
+	if err != nil {
+		return nil, err
+	}
+	if c.keyStores == nil {
+		c.keyStores = make(map[string]*KeyStore)
+	}
+	c.keyStores[path] = ks
+	return ks, nil
+}
+
+func columnKeyName(table string, column string, kind EncryptionKind) string {
+	return table + "." + column + "/" + string(kind)
+}
+
+// Builds the scheme of table with the column kinds of options and the keys
+// named in ref. Missing column keys are created if create is set, and are
+// an error otherwise: new keys could not decrypt the table's data.
+func (c *Catalog) loadTableEncryption(table string, desc *TupleDesc, options map[string]ColumnOptions, ref *EncryptionRef, create bool) (*EncryptionScheme, error) {
+	ks, err := c.openKeyStore(ref.Keys)
+	if err != nil {
+		return nil, err
+	}
+	identity := func(v any) (any, error) { return v, nil }
+	e := &EncryptionScheme{
+		EncryptMethods:                 make(map[string](func(v any) (any, error))),
+		DefaultEncrypt:                 identity,
+		DecryptMethods:                 make(map[string](func(v any) (any, error))),
+		DefaultDecrypt:                 identity,
+		IntFieldEncryptedAsStringField: make(map[string]bool),
+		Padding:                        make(map[string]PaddingPolicy),
+		Kinds:                          make(map[string]EncryptionKind),
+		DefaultKind:                    PlaintextKind,
+	}
+	for _, f := range desc.Fields {
+		opts := options[f.Fname]
+		enc := opts.Encryption
+		if opts.Padding.Kind != NoPadding {
+			e.Padding[f.Fname] = opts.Padding
+		}
+		if enc.Kind == "" || enc.Kind == PlaintextKind {
+			if enc.Int {
+				return nil, GoDBError{ParseError, fmt.Sprintf("plaintext column %s cannot be stored as a string", f.Fname)}
+			}
+			continue
+		}
+		if f.Ftype != StringType {
+			return nil, GoDBError{TypeMismatchError, fmt.Sprintf("encrypted column %s must be a string column (use enc %s:int for ints)", f.Fname, enc.Kind)}
+		}
+		var encrypt, decrypt func(v any) (any, error)
+		switch enc.Kind {
+		case DetKind:
+			key, err := columnKey(ks, columnKeyName(table, f.Fname, enc.Kind), detKeySize, create)
+			if err != nil {
+				return nil, err
+			}
+			encrypt, decrypt = checkingDetWidth(table, f.Fname, newDetEncryptionFunc(key)), newDetDecryptionFunc(key)
+		case RndKind:
+			if ref.Subject == "" || ref.Subject == f.Fname {
+				return nil, GoDBError{IllegalOperationError, fmt.Sprintf("randomized column %s needs subject keys: its ciphertexts do not fit in a heap field", f.Fname)}
+			}
+			key, err := columnKey(ks, columnKeyName(table, f.Fname, enc.Kind), rndKeySize, create)
+			if err != nil {
+				return nil, err
+			}
+			encrypt, err = newRndEncryptionFunc(key)
+			if err != nil {
+				return nil, err
+			}
+			decrypt, err = newRndDecryptionFunc(key)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			return nil, GoDBError{IllegalOperationError, fmt.Sprintf("column %s: %s encryption cannot be saved in the catalog", f.Fname, enc.Kind)}
+		}
+		if enc.Int {
+			e.IntFieldEncryptedAsStringField[f.Fname] = true
+			decrypt = decryptingToInt(decrypt)
+		}
+		e.EncryptMethods[f.Fname] = encrypt
+		e.DecryptMethods[f.Fname] = decrypt
+		e.Kinds[f.Fname] = enc.Kind
+	}
+
+	if ref.Subject != "" {
+		if _, err := findFieldInTd(FieldType{ref.Subject, "", UnknownType}, desc); err != nil {
+			return nil, err
+		}
+		subjectKeys, err := c.openKeyStore(ref.SubjectKeys)
+		if err != nil {
+			return nil, err
+		}
+		e.Subjects, err = NewSubjectKeys(subjectKeys, c.rootPath+"/"+table+".sealed", table, ref.Subject)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := e.Subjects.keyedFields(e, desc); err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+func columnKey(ks *KeyStore, name string, size int, create bool) ([]byte, error) {
+	if create {
+		return ks.GetOrCreateKey(name, size)
+	}
+	key, exists := ks.GetKey(name)
+	if !exists || len(key) != size {
+		return nil, GoDBError{MalformedDataError, fmt.Sprintf("key %s is missing from the key store", name)}
+	}
+	return key, nil
+}
+
+// Wraps the deterministic encryption of column of table to reject values,
+// padded if the column is, longer than maxPaddedLength bytes: their
+// ciphertexts would be truncated in the heap.
+func checkingDetWidth(table string, column string, encrypt func(v any) (any, error)) func(v any) (any, error) {
+	return func(v any) (any, error) {
+		n := 0
+		switch v := v.(type) {
+		case string:
+			n = len(v)
+		case int64:
+			n = len(strconv.FormatInt(v, 10))
+		}
+		if n > maxPaddedLength {
+			return nil, GoDBError{IllegalOperationError, fmt.Sprintf("value of %s.%s is %d bytes long, but deterministic ciphertexts of values over %d bytes do not fit in a string field", table, column, n, maxPaddedLength)}
+		}
+		return encrypt(v)
+	}
+}
+
+// Wraps decrypt, which returns decimal strings, to return int64s.
+func decryptingToInt(decrypt func(v any) (any, error)) func(v any) (any, error) {
+	return func(v any) (any, error) {
+		plain, err := decrypt(v)
+		if err != nil {
+			return nil, err
+		}
+		i, err := strconv.ParseInt(plain.(string), 10, 64)
+		if err != nil {
+			return nil, GoDBError{MalformedDataError, fmt.Sprintf("encrypted int decrypts to %q", plain)}
+		}
+		return i, nil
+	}
+}
@@ -0,0 +1,142 @@
+package godb
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestEncryptTableSurvivesReopen(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(dir+"/catalog.txt", []byte("patients (id string, diagnosis string, age string)\n"), 0600)
+	c, err := NewCatalogFromFile("catalog.txt", NewBufferPool(3), dir)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	columns := map[string]ColumnEncryption{
+		"id":        {Kind: DetKind},
+		"diagnosis": {Kind: RndKind},
+		"age":       {Kind: RndKind, Int: true},
+	}
+	ref := EncryptionRef{Keys: "patients.keys", Subject: "id", SubjectKeys: "subjects.keys"}
+	if err = c.EncryptTable("patients", columns, ref); err != nil {
+		t.Fatalf(err.Error())
+	}
+	tid := NewTID()
+	c.bp.BeginTransaction(tid)
+	if err = runStatement(c, tid, "insert into patients values ('p1', 'flu', 30), ('p2', 'asthma', 40)"); err != nil {
+		t.Fatalf(err.Error())
+	}
+	c.bp.CommitTransaction(tid)
+	c.bp.FlushAllPages()
+	if err = c.SaveToFile("catalog.txt", dir); err != nil {
+		t.Fatalf(err.Error())
+	}
+	saved, _ := os.ReadFile(dir + "/catalog.txt")
+	if !strings.Contains(string(saved), "id string enc det") || !strings.Contains(string(saved), "age string enc rnd:int") || !strings.Contains(string(saved), ") keys patients.keys subject id subject_keys subjects.keys") {
+		t.Errorf("expected the catalog to record the encryption, got %s", saved)
+	}
+
+	c, err = NewCatalogFromFile("catalog.txt", NewBufferPool(3), dir)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	e := c.tableEncryption("patients")
+	if e == nil {
+		t.Fatalf("expected the table to be encrypted after reopening the catalog")
+	}
+	tid = NewTID()
+	c.bp.BeginTransaction(tid)
+	if err = runStatement(c, tid, "insert into patients values ('p3', 'cold', 50)"); err != nil {
+		t.Fatalf(err.Error())
+	}
+	decrypted := func() map[string]*Tuple {
+		hf, _ := c.GetTable("patients")
+		iter, _ := hf.Iterator(tid)
+		rows := make(map[string]*Tuple)
+		for tup, err := iter(); tup != nil || err != nil; tup, err = iter() {
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+			for _, f := range tup.Fields {
+				if v := f.(StringField).Value; v == "p3" || v == "cold" || v == "50" {
+					t.Errorf("expected rows inserted after reopening to be encrypted, got %v", tup.Fields)
+				}
+			}
+			plain, err := e.encryptOrDecryptTuple(tup, false)
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+			rows[plain.Fields[0].(StringField).Value] = plain
+		}
+		return rows
+	}
+	rows := decrypted()
+	if len(rows) != 3 || rows["p1"].Fields[1].(StringField).Value != "flu" || rows["p3"].Fields[2].(IntField).Value != 50 {
+		t.Errorf("expected all rows to decrypt, got %v", rows)
+	}
+
+	if err = runStatement(c, tid, "forget subject p1"); err != nil {
+		t.Fatalf(err.Error())
+	}
+	rows = decrypted()
+	if rows["p1"].Fields[1].(StringField).Value != ShreddedValue || rows["p1"].Fields[2].(IntField).Value != 0 {
+		t.Errorf("expected p1 to be shredded, got %v", rows["p1"].Fields)
+	}
+	if rows["p2"].Fields[1].(StringField).Value != "asthma" || rows["p3"].Fields[2].(IntField).Value != 50 {
+		t.Errorf("expected p2 and p3 to be unaffected, got %v %v", rows["p2"].Fields, rows["p3"].Fields)
+	}
+
+	os.Remove(dir + "/patients.keys")
+	if _, err = NewCatalogFromFile("catalog.txt", NewBufferPool(3), dir); err == nil {
+		t.Errorf("expected reopening without the table's keys to fail")
+	}
+}
+
+func TestEncryptTableRejects(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(dir+"/catalog.txt", []byte("patients (id string, diagnosis string, age int)\n"), 0600)
+	c, err := NewCatalogFromFile("catalog.txt", NewBufferPool(3), dir)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	ref := EncryptionRef{Keys: "patients.keys"}
+	for name, columns := range map[string]map[string]ColumnEncryption{
+		"rnd without subject keys": {"diagnosis": {Kind: RndKind}},
+		"det int":                  {"age": {Kind: DetKind}},
+		"hom":                      {"age": {Kind: HomKind, Int: true}},
+		"no such column":           {"name": {Kind: DetKind}},
+	} {
+		if err := c.EncryptTable("patients", columns, ref); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	if c.tableEncryption("patients") != nil {
+		t.Errorf("expected failed attempts to leave the table in plaintext")
+	}
+
+	if err := c.EncryptTable("patients", map[string]ColumnEncryption{"id": {Kind: DetKind}}, ref); err != nil {
+		t.Fatalf(err.Error())
+	}
+	tid := NewTID()
+	c.bp.BeginTransaction(tid)
+	err = runStatement(c, tid, "insert into patients values ('patient-id-of-17x', 'flu', 30)")
+	if err == nil || !strings.Contains(err.Error(), "patients.id") {
+		t.Errorf("expected a det value too wide for a string field to be rejected, got %v", err)
+	}
+	if err = runStatement(c, tid, "insert into patients values ('patient-id-of-16', 'flu', 30)"); err != nil {
+		t.Errorf("expected a det value of %d bytes to fit: %s", maxPaddedLength, err.Error())
+	}
+	c.bp.CommitTransaction(tid)
+
+	mustParse(t, c, "create user alice")
+	c.SetUser("alice")
+	if err := c.EncryptTable("patients", map[string]ColumnEncryption{"id": {Kind: DetKind}}, ref); err == nil {
+		t.Errorf("expected only the superuser to encrypt tables")
+	}
+
+	os.WriteFile(dir+"/bad.txt", []byte("patients (id string enc det, diagnosis string)\n"), 0600)
+	if _, err := NewCatalogFromFile("bad.txt", NewBufferPool(3), dir); err == nil {
+		t.Errorf("expected an encrypted column without a key store to be rejected")
+	}
+}
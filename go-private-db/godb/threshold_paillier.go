@@ -0,0 +1,418 @@
+package godb
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+
+	"github.com/getamis/alice/crypto/utils"
+)
+
+// Threshold Paillier decryption (Shoup / Damgard-Jurik with s = 1).
+//
+// A dealer generates n = pq from safe primes and splits the decryption
+// exponent d (d = 0 mod m, d = 1 mod n, where m = p'q') into Shamir shares,
+// one per data custodian. Ciphertexts are ordinary Paillier ciphertexts with
+// g = n + 1, so they can be added with the existing encrypted aggregation
+// states. Decrypting an aggregate requires threshold custodians to each run
+// PartialDecrypt with their share, after which anyone can run CombineShares.
+// The full private key is never held by a single process after dealing.
+
+var (
+	big1 = big.NewInt(1)
+	big2 = big.NewInt(2)
+	big4 = big.NewInt(4)
+)
+
+// Public parameters of a threshold Paillier key. ThresholdPaillierPubKey
+// implements HomomorphicPubKey, so it can be passed to EncryptedAggState.Init.
+type ThresholdPaillierPubKey struct {
+	N         *big.Int
+	NSquare   *big.Int
+	Threshold int
+	NumShares int
+}
+
+// The secret share held by a single custodian.
+type PaillierKeyShare struct {
+	Index     int
+	Share     *big.Int
+	N         *big.Int
+	Threshold int
+	NumShares int
+}
+
+// The contribution of one custodian to decrypting a single ciphertext.
+type PartialDecryption struct {
+	Index int
+	Value *big.Int
+}
+
+// Deal a new t-of-n threshold Paillier key. keySize is the bit length of the
+// modulus; threshold custodians out of numShares are needed to decrypt.
+func NewThresholdPaillier(keySize int, threshold int, numShares int) (*ThresholdPaillierPubKey, []*PaillierKeyShare, error) {
+	if threshold < 1 || threshold > numShares {
+		return nil, nil, GoDBError{IllegalOperationError, fmt.Sprintf("invalid threshold %d for %d shares", threshold, numShares)}
+	}
+
+	var p, q *utils.SafePrime
+	var err error
+	for {
+		p, err = utils.GenerateRandomSafePrime(rand.Reader, keySize/2)
+		if err != nil {
+			return nil, nil, err
+		}
+		q, err = utils.GenerateRandomSafePrime(rand.Reader, keySize/2)
+		if err != nil {
+			return nil, nil, err
+		}
+		if p.P.Cmp(q.P) != 0 {
+			break
+		}
+	}
+
+	n := new(big.Int).Mul(p.P, q.P)
+	m := new(big.Int).Mul(p.Q, q.Q)
+	nm := new(big.Int).Mul(n, m)
+
+	// d = 0 mod m and d = 1 mod n
+	mInv := new(big.Int).ModInverse(m, n)
+	if mInv == nil {
+		return nil, nil, GoDBError{IllegalOperationError, "generated modulus is not coprime with m"}
+	}
+	d := new(big.Int).Mul(m, mInv)
+	d.Mod(d, nm)
+
+	// random polynomial f of degree threshold-1 with f(0) = d
+	coeffs := make([]*big.Int, threshold)
+	coeffs[0] = d
+	for i := 1; i < threshold; i++ {
+		coeffs[i], err = rand.Int(rand.Reader, nm)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	pk := &ThresholdPaillierPubKey{
+		N:         n,
+		NSquare:   new(big.Int).Mul(n, n),
+		Threshold: threshold,
+		NumShares: numShares,
+	}
+
+	shares := make([]*PaillierKeyShare, numShares)
+	for i := 1; i <= numShares; i++ {
+		x := big.NewInt(int64(i))
+		y := new(big.Int)
+		for j := threshold - 1; j >= 0; j-- {
+			y.Mul(y, x)
+			y.Add(y, coeffs[j])
+			y.Mod(y, nm)
+		}
+		shares[i-1] = &PaillierKeyShare{
+			Index:     i,
+			Share:     y,
+			N:         new(big.Int).Set(n),
+			Threshold: threshold,
+			NumShares: numShares,
+		}
+	}
+	return pk, shares, nil
+}
+
+// delta = numShares!
+func (pk *ThresholdPaillierPubKey) delta() *big.Int {
+	return new(big.Int).MulRange(1, int64(pk.NumShares))
+}
+
+func (pk *ThresholdPaillierPubKey) checkCiphertext(c *big.Int) error {
+	if c.Sign() <= 0 || c.Cmp(pk.NSquare) >= 0 {
+		return GoDBError{MalformedDataError, "ciphertext out of range"}
+	}
+	if new(big.Int).GCD(nil, nil, c, pk.N).Cmp(big1) != 0 {
+		return GoDBError{MalformedDataError, "ciphertext is not invertible"}
+	}
+	return nil
+}
+
+func (pk *ThresholdPaillierPubKey) randomizer() (*big.Int, error) {
+	r, err := utils.RandomCoprimeInt(pk.N)
+	if err != nil {
+		return nil, err
+	}
+	return r.Exp(r, pk.N, pk.NSquare), nil
+}
+
+func (pk *ThresholdPaillierPubKey) GetMessageRange(fieldOrder *big.Int) *big.Int {
+	return new(big.Int).Set(pk.N)
+}
+
+// Encrypt computes (1 + n)^m * r^n mod n^2 = (1 + m*n) * r^n mod n^2
+func (pk *ThresholdPaillierPubKey) Encrypt(mBytes []byte) ([]byte, error) {
+	m := new(big.Int).SetBytes(mBytes)
+	if m.Cmp(pk.N) >= 0 {
+		return nil, GoDBError{IllegalOperationError, "plaintext does not fit in the threshold key's message space"}
+	}
+	rn, err := pk.randomizer()
+	if err != nil {
+		return nil, err
+	}
+	c := new(big.Int).Mul(m, pk.N)
+	c.Add(c, big1)
+	c.Mul(c, rn)
+	c.Mod(c, pk.NSquare)
+	return c.Bytes(), nil
+}
+
+func (pk *ThresholdPaillierPubKey) Add(c1Bytes []byte, c2Bytes []byte) ([]byte, error) {
+	c1 := new(big.Int).SetBytes(c1Bytes)
+	c2 := new(big.Int).SetBytes(c2Bytes)
+	if err := pk.checkCiphertext(c1); err != nil {
+		return nil, err
+	}
+	if err := pk.checkCiphertext(c2); err != nil {
+		return nil, err
+	}
+	rn, err := pk.randomizer()
+	if err != nil {
+		return nil, err
+	}
+	result := new(big.Int).Mul(c1, c2)
+	result.Mul(result, rn)
+	result.Mod(result, pk.NSquare)
+	return result.Bytes(), nil
+}
+
+func (pk *ThresholdPaillierPubKey) MulConst(cBytes []byte, scalar *big.Int) ([]byte, error) {
+	c := new(big.Int).SetBytes(cBytes)
+	if err := pk.checkCiphertext(c); err != nil {
+		return nil, err
+	}
+	rn, err := pk.randomizer()
+	if err != nil {
+		return nil, err
+	}
+	result := new(big.Int).Exp(c, new(big.Int).Mod(scalar, pk.N), pk.NSquare)
+	result.Mul(result, rn)
+	result.Mod(result, pk.NSquare)
+	return result.Bytes(), nil
+}
+
+// As with regular Paillier, encryptions cannot be verified
+func (pk *ThresholdPaillierPubKey) VerifyEnc([]byte) error {
+	return nil
+}
+
+func (pk *ThresholdPaillierPubKey) ToPubKeyBytes() []byte {
+	bs, _ := json.Marshal(pk)
+	return bs
+}
+
+// Compute this custodian's partial decryption c^(2 * delta * share) mod n^2.
+func (s *PaillierKeyShare) PartialDecrypt(cBytes []byte) (*PartialDecryption, error) {
+	pk := s.pubKey()
+	c := new(big.Int).SetBytes(cBytes)
+	if err := pk.checkCiphertext(c); err != nil {
+		return nil, err
+	}
+	exp := new(big.Int).Mul(big2, pk.delta())
+	exp.Mul(exp, s.Share)
+	return &PartialDecryption{Index: s.Index, Value: new(big.Int).Exp(c, exp, pk.NSquare)}, nil
+}
+
+func (s *PaillierKeyShare) pubKey() *ThresholdPaillierPubKey {
+	return &ThresholdPaillierPubKey{
+		N:         s.N,
+		NSquare:   new(big.Int).Mul(s.N, s.N),
+		Threshold: s.Threshold,
+		NumShares: s.NumShares,
+	}
+}
+
+// Combine at least pk.Threshold partial decryptions of the same ciphertext
+// into the plaintext. Extra partial decryptions beyond the threshold are
+// ignored; duplicate indices are rejected.
+func CombineShares(pk *ThresholdPaillierPubKey, partials []*PartialDecryption) ([]byte, error) {
+	seen := make(map[int]bool)
+	var used []*PartialDecryption
+	for _, pd := range partials {
+		if pd == nil {
+			continue
+		}
+		if pd.Index < 1 || pd.Index > pk.NumShares {
+			return nil, GoDBError{MalformedDataError, fmt.Sprintf("partial decryption has invalid index %d", pd.Index)}
+		}
+		if seen[pd.Index] {
+			return nil, GoDBError{MalformedDataError, fmt.Sprintf("duplicate partial decryption from custodian %d", pd.Index)}
+		}
+		seen[pd.Index] = true
+		if len(used) < pk.Threshold {
+			used = append(used, pd)
+		}
+	}
+	if len(used) < pk.Threshold {
+		return nil, GoDBError{IllegalOperationError, fmt.Sprintf("need %d partial decryptions, got %d", pk.Threshold, len(used))}
+	}
+
+	delta := pk.delta()
+	combined := big.NewInt(1)
+	for _, pd := range used {
+		// integer lagrange coefficient delta * prod_{j != i} j / (j - i)
+		num := new(big.Int).Set(delta)
+		den := big.NewInt(1)
+		for _, other := range used {
+			if other.Index == pd.Index {
+				continue
+			}
+			num.Mul(num, big.NewInt(int64(other.Index)))
+			den.Mul(den, big.NewInt(int64(other.Index-pd.Index)))
+		}
+		lambda := new(big.Int).Quo(num, den)
+		exp := new(big.Int).Mul(big2, lambda)
+
+		base := pd.Value
+		if exp.Sign() < 0 {
+			base = new(big.Int).ModInverse(pd.Value, pk.NSquare)
+			if base == nil {
+				return nil, GoDBError{MalformedDataError, fmt.Sprintf("partial decryption from custodian %d is not invertible", pd.Index)}
+			}
+			exp.Neg(exp)
+		}
+		combined.Mul(combined, new(big.Int).Exp(base, exp, pk.NSquare))
+		combined.Mod(combined, pk.NSquare)
+	}
+
+	// combined = 1 + 4 * delta^2 * m * n mod n^2
+	l := new(big.Int).Sub(combined, big1)
+	l.Div(l, pk.N)
+	scale := new(big.Int).Mul(delta, delta)
+	scale.Mul(scale, big4)
+	scale.ModInverse(scale, pk.N)
+	l.Mul(l, scale)
+	l.Mod(l, pk.N)
+	return l.Bytes(), nil
+}
+
+// Write a custodian's key share to its own file. The file is created with
+// owner-only permissions, since anyone holding threshold shares can decrypt.
+func WriteKeyShareFile(s *PaillierKeyShare, path string) error {
+	bs, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, bs, 0600)
+}
+
+func ReadKeyShareFile(path string) (*PaillierKeyShare, error) {
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &PaillierKeyShare{}
+	err = json.Unmarshal(bs, s)
+	if err != nil {
+		return nil, GoDBError{MalformedDataError, fmt.Sprintf("malformed key share file %s: %s", path, err.Error())}
+	}
+	if s.Share == nil || s.N == nil || s.Index < 1 || s.Index > s.NumShares {
+		return nil, GoDBError{MalformedDataError, fmt.Sprintf("incomplete key share file %s", path)}
+	}
+	return s, nil
+}
+
+func WriteThresholdPubKeyFile(pk *ThresholdPaillierPubKey, path string) error {
+	return os.WriteFile(path, pk.ToPubKeyBytes(), 0644)
+}
+
+func ReadThresholdPubKeyFile(path string) (*ThresholdPaillierPubKey, error) {
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pk := &ThresholdPaillierPubKey{}
+	err = json.Unmarshal(bs, pk)
+	if err != nil || pk.N == nil {
+		return nil, GoDBError{MalformedDataError, fmt.Sprintf("malformed threshold public key file %s", path)}
+	}
+	pk.NSquare = new(big.Int).Mul(pk.N, pk.N)
+	return pk, nil
+}
+
+// File that custodian i's share is written to within a share directory
+func keyShareFileName(dir string, index int) string {
+	return filepath.Join(dir, fmt.Sprintf("custodian_%d.share", index))
+}
+
+// Deal a threshold key and write the public key and one share file per
+// custodian into dir. Returns the paths of the share files.
+func DealThresholdPaillierToDir(keySize int, threshold int, numShares int, dir string) (*ThresholdPaillierPubKey, []string, error) {
+	pk, shares, err := NewThresholdPaillier(keySize, threshold, numShares)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = WriteThresholdPubKeyFile(pk, filepath.Join(dir, "threshold.pub"))
+	if err != nil {
+		return nil, nil, err
+	}
+	paths := make([]string, len(shares))
+	for i, s := range shares {
+		paths[i] = keyShareFileName(dir, s.Index)
+		err = WriteKeyShareFile(s, paths[i])
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return pk, paths, nil
+}
+
+// Encrypt function for int64 columns under a threshold key, producing the
+// same string encoded ciphertexts as newHomEncryptionFunc.
+func newThresholdHomEncryptionFunc(pk *ThresholdPaillierPubKey) func(v any) (any, error) {
+	return func(v any) (any, error) {
+		intValue, ok := v.(int64)
+		if !ok {
+			panic("cannot encrypt unsupported type!")
+		}
+		byts := make([]byte, 8)
+		binary.BigEndian.PutUint64(byts, uint64(intValue))
+		result, err := pk.Encrypt(byts)
+		if err != nil {
+			return nil, err
+		}
+		return string(result), nil
+	}
+}
+
+// Decrypt function that simulates the custodians as local parties: each share
+// file is loaded and used for a partial decryption, and the partials are then
+// combined. Fails unless at least threshold share files are given.
+func newThresholdHomDecryptionFunc(pk *ThresholdPaillierPubKey, sharePaths []string) func(v any) (any, error) {
+	return func(v any) (any, error) {
+		c := []byte(v.(string))
+		var partials []*PartialDecryption
+		for _, path := range sharePaths {
+			s, err := ReadKeyShareFile(path)
+			if err != nil {
+				return nil, err
+			}
+			pd, err := s.PartialDecrypt(c)
+			if err != nil {
+				return nil, err
+			}
+			partials = append(partials, pd)
+		}
+		d, err := CombineShares(pk, partials)
+		if err != nil {
+			return nil, err
+		}
+		if len(d) > 8 {
+			return nil, GoDBError{MalformedDataError, "decrypted value does not fit in an int64"}
+		}
+		dByte := make([]byte, 8)
+		copy(dByte[8-len(d):], d)
+		return int64(binary.BigEndian.Uint64(dByte)), nil
+	}
+}
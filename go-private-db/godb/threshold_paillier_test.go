@@ -0,0 +1,120 @@
+package godb
+
+import (
+	"encoding/binary"
+	"os"
+	"testing"
+)
+
+// small keys keep safe prime generation fast in tests
+const testThresholdKeySize = 256
+
+func TestThresholdPaillierCombine(t *testing.T) {
+	pk, shares, err := NewThresholdPaillier(testThresholdKeySize, 2, 3)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	encrypt := newThresholdHomEncryptionFunc(pk)
+	e1, _ := encrypt(int64(125))
+	e2, _ := encrypt(int64(1234567890))
+	sum, err := pk.Add([]byte(e1.(string)), []byte(e2.(string)))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	// every pair of custodians should be able to decrypt
+	pairs := [][]int{{0, 1}, {0, 2}, {1, 2}}
+	for _, pair := range pairs {
+		var partials []*PartialDecryption
+		for _, i := range pair {
+			pd, err := shares[i].PartialDecrypt(sum)
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+			partials = append(partials, pd)
+		}
+		d, err := CombineShares(pk, partials)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		dByte := make([]byte, 8)
+		copy(dByte[8-len(d):], d)
+		got := int64(binary.BigEndian.Uint64(dByte))
+		if got != 125+1234567890 {
+			t.Errorf("custodians %v decrypted %d, expected %d", pair, got, 125+1234567890)
+		}
+	}
+}
+
+func TestThresholdPaillierBelowQuorum(t *testing.T) {
+	pk, shares, err := NewThresholdPaillier(testThresholdKeySize, 3, 4)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	c, _ := pk.Encrypt([]byte{42})
+	p1, _ := shares[0].PartialDecrypt(c)
+	p2, _ := shares[3].PartialDecrypt(c)
+	_, err = CombineShares(pk, []*PartialDecryption{p1, p2})
+	if err == nil {
+		t.Errorf("expected error combining fewer than threshold partial decryptions")
+	}
+	_, err = CombineShares(pk, []*PartialDecryption{p1, p1, p2})
+	if err == nil {
+		t.Errorf("expected error combining duplicate partial decryptions")
+	}
+}
+
+func TestThresholdEncryptedSumAgg(t *testing.T) {
+	dir := t.TempDir()
+	err, e, paths := translateQueryWithThreshold("select sum(age) from t", testThresholdKeySize, 2, 3, dir)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(paths) != 3 {
+		t.Fatalf("expected 3 share files, got %d", len(paths))
+	}
+
+	_, t1, t2, hf, _, tid := makeTestVars()
+	hf.insertTuple(&t1, tid)
+	hf.insertTuple(&t2, tid)
+	os.Remove("threshold_encrypted_test.dat")
+	defer os.Remove("threshold_encrypted_test.dat")
+	encryptedHf, err := e.encryptOrDecrypt(hf, "threshold_encrypted_test.dat", true, tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	sa := EncryptedSumAggState[string]{}
+	expr := FieldExpr{FieldType{Fname: "age", TableQualifier: "t"}}
+	sa.Init("sum", &expr, stringAggGetter, *e.PublicKeys["age"])
+	agg := NewEncryptedAggregator([]EncryptedAggState{&sa}, encryptedHf)
+	iter, err := agg.Iterator(tid)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	tup, err := iter()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	decrypted, err := e.encryptOrDecryptTuple(tup, false)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	expected := t1.Fields[1].(IntField).Value + t2.Fields[1].(IntField).Value
+	if decrypted.Fields[0].(IntField).Value != expected {
+		t.Errorf("expected sum %d, got %d", expected, decrypted.Fields[0].(IntField).Value)
+	}
+
+	// a single custodian cannot decrypt
+	pk, err := ReadThresholdPubKeyFile(dir + "/threshold.pub")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	decrypt := newThresholdHomDecryptionFunc(pk, paths[:1])
+	_, err = decrypt(tup.Fields[0].(StringField).Value)
+	if err == nil {
+		t.Errorf("expected decryption with one share file to fail")
+	}
+}
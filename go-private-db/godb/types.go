@@ -24,6 +24,8 @@ const (
 	IllegalOperationError   GoDBErrorCode = iota
 	DeadlockError           GoDBErrorCode = iota
 	IllegalTransactionError GoDBErrorCode = iota
+	IntegrityError          GoDBErrorCode = iota
+	PermissionError         GoDBErrorCode = iota
 )
 
 type GoDBError struct {
@@ -27,6 +27,9 @@ func (v *ValueOp) Descriptor() *TupleDesc {
 }
 
 func (v *ValueOp) Iterator(tid TransactionID) (func() (*Tuple, error), error) {
+	for _, tup := range v.exprs {
+		bindVaultExprs(tid, tup...)
+	}
 	curTup := 0
 	return func() (*Tuple, error) {
 		if curTup >= len(v.exprs) {
@@ -0,0 +1,251 @@
+package godb
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+)
+
+// A TokenVault replaces identifiers with random tokens. Each distinct value
+// gets one token, so tokenized extracts can still be joined on them. The
+// (token, value) pairs live in a heap file of their own whose pages are
+// encrypted with a key from the KeyStore, outside the catalog. SQL queries
+// call tokenize(s) and detokenize(s) only when the catalog's role was
+// authorized on the vault. New tokens are stored in the transaction of the
+// query that creates them: until it commits only that transaction sees
+// them, and they are dropped if it aborts.
+
+const tokenPrefix = "tok_"
+
+// random bytes per token
+const tokenSize = 12
+
+type TokenVault struct {
+	mutex  sync.Mutex
+	file   *HeapFile
+	tokens map[string]string // value -> token
+	values map[string]string // token -> value
+	roles  map[string]bool
+
+	// tokens of transactions that have not committed yet
+	pendingTokens map[TransactionID]map[string]string
+	pendingValues map[TransactionID]map[string]string
+}
+
+var vaultDesc = TupleDesc{Fields: []FieldType{{Fname: "token", Ftype: StringType}, {Fname: "value", Ftype: StringType}}}
+
+// Opens the vault stored in path, creating it if it does not exist.
+func OpenTokenVault(path string, bp *BufferPool, ks *KeyStore) (*TokenVault, error) {
+	file, err := NewEncryptedHeapFile(path, &vaultDesc, bp, ks)
+	if err != nil {
+		return nil, err
+	}
+	v := &TokenVault{
+		file:          file,
+		tokens:        make(map[string]string),
+		values:        make(map[string]string),
+		roles:         make(map[string]bool),
+		pendingTokens: make(map[TransactionID]map[string]string),
+		pendingValues: make(map[TransactionID]map[string]string),
+	}
+	tid := NewTID()
+	bp.BeginTransaction(tid)
+	defer bp.CommitTransaction(tid)
+	iter, err := file.Iterator(tid)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t, err := iter()
+		if err != nil {
+			return nil, err
+		}
+		if t == nil {
+			return v, nil
+		}
+		token := t.Fields[0].(StringField).Value
+		value := t.Fields[1].(StringField).Value
+		// transactions that tokenized the same value concurrently each
+		// stored a token; all of them detokenize, the first is kept
+		if _, exists := v.tokens[value]; !exists {
+			v.tokens[value] = token
+		}
+		v.values[token] = value
+	}
+}
+
+// Allows the given roles to call tokenize and detokenize.
+func (v *TokenVault) Authorize(roles ...string) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	for _, r := range roles {
+		v.roles[r] = true
+	}
+}
+
+// whether any of roles may call tokenize and detokenize
+func (v *TokenVault) authorizedAny(roles []string) bool {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	for _, role := range roles {
+		if v.roles[role] {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the token of value, creating a new one and storing it in tid if
+// value has none.
+func (v *TokenVault) Tokenize(value string, tid TransactionID) (string, error) {
+	v.mutex.Lock()
+	if token, exists := v.tokens[value]; exists {
+		v.mutex.Unlock()
+		return token, nil
+	}
+	if token, exists := v.pendingTokens[tid][value]; exists {
+		v.mutex.Unlock()
+		return token, nil
+	}
+	v.mutex.Unlock()
+	if len(value) > StringLength {
+		return "", GoDBError{IllegalOperationError, fmt.Sprintf("cannot tokenize values longer than %d bytes", StringLength)}
+	}
+	b := make([]byte, tokenSize)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	token := tokenPrefix + hex.EncodeToString(b)
+
+	// not under the mutex: the insert may wait for a transaction that is
+	// itself tokenizing
+	err = v.file.insertTuple(&Tuple{vaultDesc, []DBValue{StringField{token}, StringField{value}}, nil}, tid)
+	if err != nil {
+		return "", err
+	}
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if v.pendingTokens[tid] == nil {
+		v.pendingTokens[tid] = make(map[string]string)
+		v.pendingValues[tid] = make(map[string]string)
+		v.file.bufPool.onTransactionEnd(tid, func(committed bool) {
+			v.endTransaction(tid, committed)
+		})
+	}
+	v.pendingTokens[tid][value] = token
+	v.pendingValues[tid][token] = value
+	return token, nil
+}
+
+// Returns the value token replaced, if token was committed or created in
+// tid.
+func (v *TokenVault) Detokenize(token string, tid TransactionID) (string, error) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	value, exists := v.values[token]
+	if !exists {
+		value, exists = v.pendingValues[tid][token]
+	}
+	if !exists {
+		return "", GoDBError{TupleNotFoundError, fmt.Sprintf("unknown token %s", token)}
+	}
+	return value, nil
+}
+
+// Makes the tokens tid created visible to all transactions if it committed,
+// and forgets them otherwise.
+func (v *TokenVault) endTransaction(tid TransactionID, committed bool) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if committed {
+		for value, token := range v.pendingTokens[tid] {
+			if _, exists := v.tokens[value]; !exists {
+				v.tokens[value] = token
+			}
+			v.values[token] = value
+		}
+	}
+	delete(v.pendingTokens, tid)
+	delete(v.pendingValues, tid)
+}
+
+// Makes v the vault tokenize and detokenize use in queries on c.
+func (c *Catalog) SetTokenVault(v *TokenVault) error {
+	err := c.checkSuperuser("open token vaults")
+	if err != nil {
+		return err
+	}
+	c.vault = v
+	return nil
+}
+
+func isVaultFunc(op string) bool {
+	return op == "tokenize" || op == "detokenize"
+}
+
+// A call to tokenize or detokenize, bound to a vault and, by the operator
+// that evaluates it, to a transaction.
+type vaultExpr struct {
+	vault      *TokenVault
+	detokenize bool
+	arg        Expr
+	bound      bool
+	tid        TransactionID
+}
+
+// Binds the calls to tokenize and detokenize in exprs to tid. Operators
+// call this from Iterator for the expressions they evaluate.
+func bindVaultExprs(tid TransactionID, exprs ...Expr) {
+	for _, e := range exprs {
+		switch e := e.(type) {
+		case *vaultExpr:
+			e.bound = true
+			e.tid = tid
+			bindVaultExprs(tid, e.arg)
+		case *FuncExpr:
+			for _, arg := range e.args {
+				bindVaultExprs(tid, *arg)
+			}
+		}
+	}
+}
+
+func (c *Catalog) newVaultExpr(op string, args []*Expr) (Expr, error) {
+	if c == nil || c.vault == nil {
+		return nil, GoDBError{IllegalOperationError, fmt.Sprintf("%s needs a token vault", op)}
+	}
+	if !c.vault.authorizedAny(c.sessionRoles()) {
+		return nil, GoDBError{IllegalOperationError, fmt.Sprintf("no role of the session may call %s", op)}
+	}
+	if len(args) != 1 || (*args[0]).GetExprType().Ftype != StringType {
+		return nil, GoDBError{ParseError, fmt.Sprintf("function %s expected one arg of type string", op)}
+	}
+	return &vaultExpr{vault: c.vault, detokenize: op == "detokenize", arg: *args[0]}, nil
+}
+
+func (e *vaultExpr) EvalExpr(t *Tuple) (DBValue, error) {
+	val, err := e.arg.EvalExpr(t)
+	if err != nil {
+		return nil, err
+	}
+	if !e.bound {
+		return nil, GoDBError{IllegalOperationError, "tokenize and detokenize are not supported in this part of a query"}
+	}
+	s := val.(StringField).Value
+	if e.detokenize {
+		s, err = e.vault.Detokenize(s, e.tid)
+	} else {
+		s, err = e.vault.Tokenize(s, e.tid)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return StringField{s}, nil
+}
+
+func (e *vaultExpr) GetExprType() FieldType {
+	ft := e.arg.GetExprType()
+	return FieldType{ft.Fname, ft.TableQualifier, StringType}
+}
@@ -0,0 +1,102 @@
+package godb
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestTokenVault(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(dir+"/catalog.txt", []byte("patients (name string, ssn string)\nclaims (ssn string, amount int)\n"), 0600)
+	bp := NewBufferPool(5)
+	c, err := NewCatalogFromFile("catalog.txt", bp, dir)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	tid := NewTID()
+	bp.BeginTransaction(tid)
+	for _, sql := range []string{
+		"insert into patients values ('sam', '123-45-6789'), ('george', '555-12-3456')",
+		"insert into claims values ('555-12-3456', 10), ('123-45-6789', 20)",
+	} {
+		_, op, _ := Parse(c, sql)
+		iter, _ := op.Iterator(tid)
+		_, err = iter()
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+
+	_, _, err = Parse(c, "select tokenize(ssn) from patients")
+	if err == nil {
+		t.Errorf("expected tokenize to need a vault")
+	}
+	ks := NewKeyStore()
+	vault, err := OpenTokenVault(dir+"/vault.dat", bp, ks)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	c.SetTokenVault(vault)
+	_, _, err = Parse(c, "select tokenize(ssn) from patients")
+	if err == nil {
+		t.Errorf("expected tokenize to be refused to an unauthorized role")
+	}
+
+	vault.Authorize("etl")
+	c.SetRole("etl")
+	patients := queryRows(t, c, tid, "select name, tokenize(ssn) from patients")
+	claims := queryRows(t, c, tid, "select tokenize(ssn), amount from claims")
+	if len(patients) != 2 || len(claims) != 2 {
+		t.Fatalf("expected two rows from each table")
+	}
+	samToken := patients[0].Fields[1].(StringField).Value
+	if !strings.HasPrefix(samToken, tokenPrefix) || samToken == patients[1].Fields[1].(StringField).Value {
+		t.Errorf("unexpected tokens %v", patients)
+	}
+	if claims[1].Fields[0].(StringField).Value != samToken {
+		t.Errorf("expected equal values to get equal tokens in different tables")
+	}
+	rows := queryRows(t, c, tid, "select detokenize(tokenize(ssn)) from claims")
+	if rows[0].Fields[0] != (StringField{"555-12-3456"}) {
+		t.Errorf("expected detokenize to reverse tokenize, got %v", rows[0].Fields[0])
+	}
+	_, err = vault.Detokenize("tok_unknown", tid)
+	if err == nil {
+		t.Errorf("expected an unknown token to be rejected")
+	}
+	if _, err = vault.Detokenize(samToken, NewTID()); err == nil {
+		t.Errorf("expected tokens to be hidden from other transactions until committed")
+	}
+	bp.CommitTransaction(tid)
+	if value, err := vault.Detokenize(samToken, NewTID()); err != nil || value != "123-45-6789" {
+		t.Errorf("expected committed tokens to be visible to other transactions, got %s (%v)", value, err)
+	}
+
+	// tokens created in an aborted transaction are dropped
+	aborted := NewTID()
+	bp.BeginTransaction(aborted)
+	rows = queryRows(t, c, aborted, "select tokenize(name) from patients")
+	abortedToken := rows[0].Fields[0].(StringField).Value
+	bp.AbortTransaction(aborted)
+	if _, err = vault.Detokenize(abortedToken, NewTID()); err == nil {
+		t.Errorf("expected tokens of an aborted transaction to be dropped")
+	}
+
+	// the vault is encrypted at rest and reloads the same tokens
+	data, _ := os.ReadFile(dir + "/vault.dat")
+	if strings.Contains(string(data), "123-45-6789") {
+		t.Errorf("expected the vault file to be encrypted")
+	}
+	reopened, err := OpenTokenVault(dir+"/vault.dat", NewBufferPool(2), ks)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	token, err := reopened.Tokenize("123-45-6789", NewTID())
+	if err != nil || token != samToken {
+		t.Errorf("expected a reopened vault to keep its tokens, got %s (%v)", token, err)
+	}
+	if _, err = reopened.Detokenize(abortedToken, NewTID()); err == nil {
+		t.Errorf("expected the vault file not to keep tokens of an aborted transaction")
+	}
+}
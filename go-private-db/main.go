@@ -5,6 +5,7 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"runtime"
 	"runtime/pprof"
 	"strconv"
 	"strings"
@@ -29,7 +30,15 @@ Available shell commands:
 	\d : List tables and fields in the current database
 	\f : List available functions for use in queries
 	\a : Toggle aligned vs csv output
-	\l table path/to/file [sep] [hasHeader]: Append csv file to end of table.  Default to sep = ',', hasHeader = 'true'`
+	\advise path/to/workload.sql : Recommend an encryption kind for each column given a file of ;-separated queries
+	\l table path/to/file [sep] [hasHeader] [detectPII]: Append csv file to end of table.  Default to sep = ',', hasHeader = 'true', detectPII = 'true'.  Before loading, columns that look like personal data are recorded in the catalog and tables stored in plaintext are warned about
+	\r [role] : Run queries as role, which a user must hold (no argument for all of the user's roles)
+	\u user : Run queries as user, with the privileges granted to it and its roles; the session cannot switch back to the superuser
+	\m table role column expression : Show column of table to role only through a masking expression, e.g. \m patients support ssn maskssn(ssn)
+	\v path/to/vault path/to/keystore [role ...] : Open a token vault; the listed roles may call tokenize and detokenize
+	\k path/to/keystore : Load the key of pseudonym() from a key store, creating it there the first time
+	\s threshold [suppress|merge] [table] : Hide aggregate groups over fewer rows than threshold, for the session or a table (0 removes the policy)
+	\e table path/to/file path/to/out.dat path/to/keystore query : Encrypt csv file (with header, sep = ',') with table's schema for query, appending to out.dat; the keys are kept in (or reused from) the key store`
 
 /*func printCatalog(fname string) {
 	f, err := os.Open(fname)
@@ -164,30 +173,175 @@ func main() {
 				fmt.Println("Available functions:")
 				fmt.Printf(godb.ListOfFunctions())
 			case 'a':
-				aligned = !aligned
-				if aligned {
-					fmt.Println("Output aligned")
+				if strings.HasPrefix(text, "\\advise") {
+					splits := strings.Fields(text)
+					if len(splits) != 2 {
+						fmt.Printf("\033[31;1mExpected workload file after \\advise\033[0m\n")
+						continue
+					}
+					f, err := os.Open(splits[1])
+					if err != nil {
+						fmt.Printf("\033[31;1m%s\033[0m\n", err.Error())
+						continue
+					}
+					queries, err := godb.ParseWorkload(f)
+					f.Close()
+					if err != nil {
+						fmt.Printf("\033[31;1m%s\033[0m\n", err.Error())
+						continue
+					}
+					fmt.Print(godb.AdviseEncryption(c, queries).String())
 				} else {
-					fmt.Println("Output unaligned")
+					aligned = !aligned
+					if aligned {
+						fmt.Println("Output aligned")
+					} else {
+						fmt.Println("Output unaligned")
+					}
 				}
 
+			case 'r':
+				splits := strings.Fields(text)
+				role := ""
+				if len(splits) > 1 {
+					role = splits[1]
+				}
+				err := c.SetRole(role)
+				if err != nil {
+					fmt.Printf("\033[31;1m%s\033[0m\n", err.Error())
+					continue
+				}
+				fmt.Printf("Role '%s'\n", c.Role())
+			case 'u':
+				splits := strings.Fields(text)
+				if len(splits) < 2 {
+					fmt.Printf("\033[31;1mExpected user after \\u\033[0m\n")
+					continue
+				}
+				err := c.SetUser(splits[1])
+				if err != nil {
+					fmt.Printf("\033[31;1m%s\033[0m\n", err.Error())
+					continue
+				}
+				fmt.Printf("User '%s'\n", c.User())
+			case 'm':
+				splits := strings.SplitN(text, " ", 5)
+				if len(splits) < 5 {
+					fmt.Printf("\033[31;1mExpected table, role, column and mask expression after \\m\033[0m\n")
+					continue
+				}
+				err := c.SetColumnMask(splits[2], splits[1], splits[3], splits[4])
+				if err != nil {
+					fmt.Printf("\033[31;1m%s\033[0m\n", err.Error())
+					continue
+				}
+				fmt.Printf("\033[32;1mMASK\033[0m\n\n")
+			case 'v':
+				splits := strings.Fields(text)
+				if len(splits) < 3 {
+					fmt.Printf("\033[31;1mExpected vault file and key store after \\v\033[0m\n")
+					continue
+				}
+				if c.User() != "" {
+					fmt.Printf("\033[31;1mpermission denied: only the superuser may open token vaults\033[0m\n")
+					continue
+				}
+				ks, err := godb.OpenKeyStore(splits[2])
+				if err != nil {
+					fmt.Printf("\033[31;1m%s\033[0m\n", err.Error())
+					continue
+				}
+				vault, err := godb.OpenTokenVault(splits[1], bp, ks)
+				if err != nil {
+					fmt.Printf("\033[31;1m%s\033[0m\n", err.Error())
+					continue
+				}
+				vault.Authorize(splits[3:]...)
+				err = c.SetTokenVault(vault)
+				if err != nil {
+					fmt.Printf("\033[31;1m%s\033[0m\n", err.Error())
+					continue
+				}
+				fmt.Printf("Opened token vault %s\n", splits[1])
+			case 'k':
+				splits := strings.Fields(text)
+				if len(splits) < 2 {
+					fmt.Printf("\033[31;1mExpected key store after \\k\033[0m\n")
+					continue
+				}
+				if c.User() != "" {
+					fmt.Printf("\033[31;1mpermission denied: only the superuser may set the pseudonym key\033[0m\n")
+					continue
+				}
+				ks, err := godb.OpenKeyStore(splits[1])
+				if err == nil {
+					err = godb.LoadPseudonymKey(ks)
+				}
+				if err != nil {
+					fmt.Printf("\033[31;1m%s\033[0m\n", err.Error())
+					continue
+				}
+				fmt.Printf("Loaded pseudonym key from %s\n", splits[1])
+			case 's':
+				splits := strings.Fields(text)
+				if len(splits) < 2 {
+					fmt.Printf("\033[31;1mExpected threshold after \\s\033[0m\n")
+					continue
+				}
+				threshold, err := strconv.Atoi(splits[1])
+				if err != nil {
+					fmt.Printf("\033[31;1mInvalid threshold %s\033[0m\n", splits[1])
+					continue
+				}
+				var policy *godb.SuppressionPolicy
+				if threshold > 0 {
+					policy = &godb.SuppressionPolicy{Threshold: threshold}
+					if len(splits) > 2 {
+						policy.Mode, err = godb.ParseSuppressionMode(splits[2])
+						if err != nil {
+							fmt.Printf("\033[31;1m%s\033[0m\n", err.Error())
+							continue
+						}
+					}
+				}
+				if len(splits) > 3 {
+					err = c.SetTableSuppression(splits[3], policy)
+					if err == nil {
+						err = c.SaveToFile(catName, catPath)
+					}
+				} else {
+					err = c.SetSuppression(policy)
+				}
+				if err != nil {
+					fmt.Printf("\033[31;1m%s\033[0m\n", err.Error())
+					continue
+				}
+				fmt.Printf("\033[32;1mSUPPRESS\033[0m\n\n")
 			case '?':
 				fallthrough
 			case 'h':
 				fmt.Println(helpText)
 
 			case 'l':
+				if c.User() != "" {
+					fmt.Printf("\033[31;1mpermission denied: only the superuser may load files\033[0m\n")
+					continue
+				}
 				splits := strings.Split(text, " ")
 				table := splits[1]
 				path := splits[2]
 				sep := ","
 				hasHeader := true
+				detectPII := true
 				if len(splits) > 3 {
 					sep = splits[3]
 				}
 				if len(splits) > 4 {
 					hasHeader = splits[4] != "false"
 				}
+				if len(splits) > 5 {
+					detectPII = splits[5] != "false"
+				}
 
 				//todo -- following code assumes data is in heap files
 				hf, err := c.GetTable(table)
@@ -201,12 +355,87 @@ func main() {
 					fmt.Printf("\033[31;1m%s\033[0m\n", err.Error())
 					continue
 				}
+				if detectPII {
+					// classify before loading, so the warning comes before any plaintext is written
+					classes, err := godb.DetectPIIInCSV(f, heapFile.Descriptor(), hasHeader, sep, false, godb.DefaultPIISampleSize)
+					if err == nil {
+						_, err = f.Seek(0, 0)
+					}
+					if err != nil {
+						fmt.Printf("\033[31;1m%s\033[0m\n", err.Error())
+						continue
+					}
+					if len(classes) > 0 {
+						before := c.CatalogString()
+						warnings, err := c.RecordPII(table, classes)
+						if err == nil && c.CatalogString() != before {
+							err = c.SaveToFile(catName, catPath)
+						}
+						if err != nil {
+							fmt.Printf("\033[31;1m%s\033[0m\n", err.Error())
+							continue
+						}
+						for _, w := range warnings {
+							fmt.Printf("\033[33;1mWarning: %s\033[0m\n", w)
+						}
+					}
+				}
 				err = heapFile.LoadFromCSV(f, hasHeader, sep, false)
 				if err != nil {
 					fmt.Printf("\033[31;1m%s\033[0m\n", err.Error())
 					continue
 				}
 				fmt.Printf("\033[32;1mLOAD\033[0m\n\n")
+
+			case 'e':
+				splits := strings.SplitN(text, " ", 6)
+				if len(splits) < 6 {
+					fmt.Printf("\033[31;1mExpected table, csv file, output file, key store and query after \\e\033[0m\n")
+					continue
+				}
+				table := splits[1]
+				path := splits[2]
+				outPath := splits[3]
+				sql := strings.TrimSuffix(strings.TrimSpace(splits[5]), ";")
+
+				hf, err := c.GetTable(table)
+				if err != nil {
+					fmt.Printf("\033[31;1m%s\033[0m\n", err.Error())
+					continue
+				}
+				ks, err := godb.OpenKeyStore(splits[4])
+				if err != nil {
+					fmt.Printf("\033[31;1m%s\033[0m\n", err.Error())
+					continue
+				}
+				e, err := godb.TranslateQuery(c, sql, ks)
+				if err != nil {
+					fmt.Printf("\033[31;1m%s\033[0m\n", err.Error())
+					continue
+				}
+				f, err := os.Open(path)
+				if err != nil {
+					fmt.Printf("\033[31;1m%s\033[0m\n", err.Error())
+					continue
+				}
+				e.Pipeline.Progress = func(done int) {
+					fmt.Printf("\rencrypted %d rows", done)
+				}
+				err = e.StartRandomizerPool(godb.RandomizerPoolConfig{Size: 1024, Workers: runtime.NumCPU()})
+				if err != nil {
+					f.Close()
+					fmt.Printf("\033[31;1m%s\033[0m\n", err.Error())
+					continue
+				}
+				_, _, err = godb.EncryptCSV(&e, hf.Descriptor(), f, true, ",", outPath, bp)
+				e.Close()
+				f.Close()
+				fmt.Println()
+				if err != nil {
+					fmt.Printf("\033[31;1m%s\033[0m\n", err.Error())
+					continue
+				}
+				fmt.Printf("\033[32;1mENCRYPT\033[0m\n\n")
 			}
 
 			query = ""
@@ -344,6 +573,8 @@ func main() {
 			if err != nil {
 				fmt.Printf("\033[31;1m%s\033[0m\n", err.Error())
 			}
+		case godb.AccessControlQueryType:
+			fmt.Printf("\033[32;1mOK\033[0m\n\n")
 		}
 
 	}